@@ -0,0 +1,22 @@
+package api
+
+// Controller handles commands sent to the desktop, like starting a recording.
+// Signalers pass commands on to the controller they're addressed to by name.
+type Controller interface {
+	// GetName returns the name that commands are addressed to
+	GetName() string
+	// HandleCommand handles a command with an optional JSON payload, and returns
+	// a result that can be encoded as JSON.
+	HandleCommand(command string, payload []byte) (any, error)
+}
+
+// ControllerEventHandler receives an event that a controller published on its own
+type ControllerEventHandler func(event string, payload any)
+
+// EventController is a Controller that also publishes events without being asked,
+// like a clip being saved from a gamepad. Signalers pass them on to clients.
+type EventController interface {
+	Controller
+	// OnEvent adds a handler for the controller's events
+	OnEvent(ControllerEventHandler)
+}
@@ -19,9 +19,20 @@ type Desktop interface {
 	WithVideoSource(VideoSource) Desktop
 	// WithAudioSource adds an audio source to the desktop
 	WithAudioSource(AudioSource) Desktop
+	// WithVideoCodecPreference sets the order, by mime type, in which video
+	// codecs are offered to sessions
+	WithVideoCodecPreference(...string) Desktop
 	// WithWebRTCAPI adds a webrtc api to the desktop
 	WithWebRTCAPI(*webrtc.API, *webrtc.Configuration) Desktop
+	// WithController adds a controller that signalers pass commands to
+	WithController(Controller) Desktop
+	// WithPreviewSource sets what makes previews of the screen
+	WithPreviewSource(PreviewSource) Desktop
+	// WithAudioSink sets where the audio that sessions send, like their microphones, is played
+	WithAudioSink(AudioSink) Desktop
 
+	// GetAudioSink returns where the audio that sessions send is played, or nil
+	GetAudioSink() AudioSink
 	// GetSignalers returns the signalers
 	GetSignalers() []Signaler
 	// GetGamepads returns the gamepads
@@ -36,6 +47,12 @@ type Desktop interface {
 	GetMouse() Mouse
 	// GetWebRTCAPI returns the webrtc api
 	GetWebRTCAPI() (*webrtc.API, *webrtc.Configuration)
+	// GetControllers returns the controllers
+	GetControllers() []Controller
+	// GetPreviewSource returns the preview source, which may be nil
+	GetPreviewSource() PreviewSource
+	// GetMixer returns the mixer that the desktop's media sources are added to
+	GetMixer() Mixer
 
 	// Run starts the desktop. This is a blocking call.
 	// to stop the desktop, cancel the context.
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"math"
+	"time"
 
 	"github.com/pod-arcade/pod-arcade/pkg/util"
 )
@@ -17,6 +18,12 @@ const (
 	InputTypeTouchscreen   InputType = 3
 	InputTypeGamepad       InputType = 4
 	InputTypeGamepadRumble InputType = 5
+	InputTypeFrameEcho     InputType = 6
+	InputTypeSelectOutput  InputType = 7
+	InputTypeVideoSettings InputType = 8
+	InputTypeMicrophone    InputType = 9
+	InputTypePauseTrack    InputType = 10
+	InputTypeMediaMode     InputType = 11
 )
 
 // GamepadInput describes the state of a gamepad's inputs.
@@ -337,3 +344,197 @@ func (i *KeyboardInput) FromBytes(input []byte) error {
 
 	return nil
 }
+
+// FrameEcho is sent by the client when it renders a video frame, echoing the
+// latency SEI the frame carried so the desktop can measure end to end latency.
+type FrameEcho struct {
+	// CaptureTime is the capture time from the SEI, in microseconds since the unix epoch
+	CaptureTime uint64
+	// FrameNumber is the frame counter from the SEI
+	FrameNumber uint32
+	// RenderDelay is the time between rendering the frame and sending the echo, in microseconds
+	RenderDelay uint32
+}
+
+func (i *FrameEcho) ToBytes() []byte {
+	output := make([]byte, 17)
+	output[0] = byte(InputTypeFrameEcho)
+	d := output[1:]
+	binary.LittleEndian.PutUint64(d[0:8], i.CaptureTime)
+	binary.LittleEndian.PutUint32(d[8:12], i.FrameNumber)
+	binary.LittleEndian.PutUint32(d[12:16], i.RenderDelay)
+
+	return output
+}
+
+func (i *FrameEcho) FromBytes(input []byte) error {
+	if len(input) < 1 || input[0] != byte(InputTypeFrameEcho) {
+		return errors.New("data is not a frame echo")
+	}
+
+	d := input[1:]
+	if len(d) != 16 {
+		return fmt.Errorf("invalid payload size %d should be 16 bytes", len(d))
+	}
+
+	i.CaptureTime = binary.LittleEndian.Uint64(d[0:8])
+	i.FrameNumber = binary.LittleEndian.Uint32(d[8:12])
+	i.RenderDelay = binary.LittleEndian.Uint32(d[12:16])
+
+	return nil
+}
+
+// SelectOutput is sent by the client to switch one of its video tracks to
+// another output, like a different monitor.
+type SelectOutput struct {
+	// Track is the index of the video track, in the order of the video media sections in the offer
+	Track byte
+	// OutputID is the ID of the output to show on the track
+	OutputID string
+}
+
+func (i *SelectOutput) ToBytes() []byte {
+	output := make([]byte, 2, 2+len(i.OutputID))
+	output[0] = byte(InputTypeSelectOutput)
+	output[1] = i.Track
+	return append(output, i.OutputID...)
+}
+
+func (i *SelectOutput) FromBytes(input []byte) error {
+	if len(input) < 1 || input[0] != byte(InputTypeSelectOutput) {
+		return errors.New("data is not an output selection")
+	}
+	if len(input) < 3 {
+		return fmt.Errorf("invalid payload size %d should be at least 2 bytes", len(input)-1)
+	}
+
+	i.Track = input[1]
+	i.OutputID = string(input[2:])
+	return nil
+}
+
+// SetVideoSettings is sent by the client to change the resolution, frame rate or
+// quality of the output shown on one of its video tracks. Every session watching
+// the output sees the change, since they share its encoder.
+type SetVideoSettings struct {
+	// Track is the index of the video track, in the order of the video media sections in the offer
+	Track    byte
+	Settings VideoSettings
+}
+
+func (i *SetVideoSettings) ToBytes() []byte {
+	output := make([]byte, 8)
+	output[0] = byte(InputTypeVideoSettings)
+	output[1] = i.Track
+	binary.LittleEndian.PutUint16(output[2:4], uint16(i.Settings.Width))
+	binary.LittleEndian.PutUint16(output[4:6], uint16(i.Settings.Height))
+	output[6] = byte(i.Settings.FrameRate)
+	output[7] = byte(i.Settings.Quality)
+	return output
+}
+
+func (i *SetVideoSettings) FromBytes(input []byte) error {
+	if len(input) < 1 || input[0] != byte(InputTypeVideoSettings) {
+		return errors.New("data is not a video settings change")
+	}
+	if len(input) != 8 {
+		return fmt.Errorf("invalid payload size %d should be 7 bytes", len(input)-1)
+	}
+
+	i.Track = input[1]
+	i.Settings = VideoSettings{
+		Width:     int(binary.LittleEndian.Uint16(input[2:4])),
+		Height:    int(binary.LittleEndian.Uint16(input[4:6])),
+		FrameRate: int(input[6]),
+		Quality:   int(input[7]),
+	}
+	return nil
+}
+
+// MicrophoneState is sent by the client to mute or unmute the microphone it's sending
+type MicrophoneState struct {
+	Muted bool
+}
+
+func (i *MicrophoneState) ToBytes() []byte {
+	return []byte{byte(InputTypeMicrophone), util.PackBits(i.Muted, false, false, false, false, false, false, false)}
+}
+
+func (i *MicrophoneState) FromBytes(input []byte) error {
+	if len(input) < 1 || input[0] != byte(InputTypeMicrophone) {
+		return errors.New("data is not a microphone state")
+	}
+	if len(input) != 2 {
+		return fmt.Errorf("invalid payload size %d should be 1 byte", len(input)-1)
+	}
+
+	i.Muted, _, _, _, _, _, _, _ = util.UnpackBits(input[1])
+	return nil
+}
+
+// PauseTrack is sent by the client to stop or restart one of the tracks it's
+// receiving, like when its tab is hidden. Other sessions aren't affected.
+type PauseTrack struct {
+	// MID is the media ID of the track's transceiver
+	MID    string
+	Paused bool
+}
+
+func (i *PauseTrack) ToBytes() []byte {
+	output := make([]byte, 2, 2+len(i.MID))
+	output[0] = byte(InputTypePauseTrack)
+	output[1] = util.PackBits(i.Paused, false, false, false, false, false, false, false)
+	return append(output, i.MID...)
+}
+
+func (i *PauseTrack) FromBytes(input []byte) error {
+	if len(input) < 1 || input[0] != byte(InputTypePauseTrack) {
+		return errors.New("data is not a track pause")
+	}
+	if len(input) < 3 {
+		return fmt.Errorf("invalid payload size %d should be at least 2 bytes", len(input)-1)
+	}
+
+	i.Paused, _, _, _, _, _, _, _ = util.UnpackBits(input[1])
+	i.MID = string(input[2:])
+	return nil
+}
+
+// MediaMode is how much of the desktop's media a session gets
+type MediaMode byte
+
+const (
+	// MediaModeFull sends every track that isn't paused, at its full frame rate
+	MediaModeFull MediaMode = 0
+	// MediaModeAudioOnly pauses every video track
+	MediaModeAudioOnly MediaMode = 1
+	// MediaModeThumbnail sends video tracks only a keyframe every ThumbnailInterval
+	MediaModeThumbnail MediaMode = 2
+)
+
+// ThumbnailInterval is how often video tracks change in MediaModeThumbnail
+const ThumbnailInterval = time.Second
+
+// SetMediaMode is sent by the client to change how much media it gets, without renegotiating
+type SetMediaMode struct {
+	Mode MediaMode
+}
+
+func (i *SetMediaMode) ToBytes() []byte {
+	return []byte{byte(InputTypeMediaMode), byte(i.Mode)}
+}
+
+func (i *SetMediaMode) FromBytes(input []byte) error {
+	if len(input) < 1 || input[0] != byte(InputTypeMediaMode) {
+		return errors.New("data is not a media mode")
+	}
+	if len(input) != 2 {
+		return fmt.Errorf("invalid payload size %d should be 1 byte", len(input)-1)
+	}
+	if MediaMode(input[1]) > MediaModeThumbnail {
+		return fmt.Errorf("unknown media mode %d", input[1])
+	}
+
+	i.Mode = MediaMode(input[1])
+	return nil
+}
@@ -43,3 +43,108 @@ func TestGamepadInput_ToBytesAndFromBytes(t *testing.T) {
 	//TODO test axis
 
 }
+
+func TestFrameEcho_ToBytesAndFromBytes(t *testing.T) {
+	echo := api.FrameEcho{CaptureTime: 0x0102030405060708, FrameNumber: 9, RenderDelay: 250}
+	expected := []byte{6, 8, 7, 6, 5, 4, 3, 2, 1, 9, 0, 0, 0, 250, 0, 0, 0}
+
+	if !bytes.Equal(echo.ToBytes(), expected) {
+		t.Errorf("Expected %v, got %v", expected, echo.ToBytes())
+	}
+
+	inp := api.FrameEcho{}
+	if err := inp.FromBytes(expected); err != nil {
+		t.Fatal(err)
+	}
+	if inp != echo {
+		t.Errorf("Expected %v, got %v", echo, inp)
+	}
+}
+
+func TestSelectOutput_ToBytesAndFromBytes(t *testing.T) {
+	sel := api.SelectOutput{Track: 1, OutputID: "DP-1"}
+	expected := []byte{7, 1, 'D', 'P', '-', '1'}
+
+	if !bytes.Equal(sel.ToBytes(), expected) {
+		t.Errorf("Expected %v, got %v", expected, sel.ToBytes())
+	}
+
+	inp := api.SelectOutput{}
+	if err := inp.FromBytes(expected); err != nil {
+		t.Fatal(err)
+	}
+	if inp != sel {
+		t.Errorf("Expected %v, got %v", sel, inp)
+	}
+}
+
+func TestSetVideoSettings_ToBytesAndFromBytes(t *testing.T) {
+	set := api.SetVideoSettings{Track: 1, Settings: api.VideoSettings{Width: 1280, Height: 720, FrameRate: 30, Quality: 28}}
+	expected := []byte{8, 1, 0x00, 0x05, 0xd0, 0x02, 30, 28}
+
+	if !bytes.Equal(set.ToBytes(), expected) {
+		t.Errorf("Expected %v, got %v", expected, set.ToBytes())
+	}
+
+	inp := api.SetVideoSettings{}
+	if err := inp.FromBytes(expected); err != nil {
+		t.Fatal(err)
+	}
+	if inp != set {
+		t.Errorf("Expected %v, got %v", set, inp)
+	}
+}
+
+func TestMicrophoneState_ToBytesAndFromBytes(t *testing.T) {
+	state := api.MicrophoneState{Muted: true}
+	expected := []byte{9, 1}
+
+	if !bytes.Equal(state.ToBytes(), expected) {
+		t.Errorf("Expected %v, got %v", expected, state.ToBytes())
+	}
+
+	inp := api.MicrophoneState{}
+	if err := inp.FromBytes(expected); err != nil {
+		t.Fatal(err)
+	}
+	if inp != state {
+		t.Errorf("Expected %v, got %v", state, inp)
+	}
+}
+
+func TestPauseTrack_ToBytesAndFromBytes(t *testing.T) {
+	pause := api.PauseTrack{MID: "1", Paused: true}
+	expected := []byte{10, 1, '1'}
+
+	if !bytes.Equal(pause.ToBytes(), expected) {
+		t.Errorf("Expected %v, got %v", expected, pause.ToBytes())
+	}
+
+	inp := api.PauseTrack{}
+	if err := inp.FromBytes(expected); err != nil {
+		t.Fatal(err)
+	}
+	if inp != pause {
+		t.Errorf("Expected %v, got %v", pause, inp)
+	}
+}
+
+func TestSetMediaMode_ToBytesAndFromBytes(t *testing.T) {
+	mode := api.SetMediaMode{Mode: api.MediaModeThumbnail}
+	expected := []byte{11, 2}
+
+	if !bytes.Equal(mode.ToBytes(), expected) {
+		t.Errorf("Expected %v, got %v", expected, mode.ToBytes())
+	}
+
+	inp := api.SetMediaMode{}
+	if err := inp.FromBytes(expected); err != nil {
+		t.Fatal(err)
+	}
+	if inp != mode {
+		t.Errorf("Expected %v, got %v", mode, inp)
+	}
+	if err := inp.FromBytes([]byte{11, 3}); err == nil {
+		t.Error("Expected an unknown mode to fail")
+	}
+}
@@ -2,6 +2,8 @@ package api
 
 import (
 	"context"
+	"fmt"
+	"io"
 
 	"github.com/pion/rtp"
 	"github.com/pion/webrtc/v4"
@@ -12,16 +14,32 @@ type AudioSource interface {
 	GetAudioCodecParameters() webrtc.RTPCodecParameters
 
 	// StreamAudio streams audio to the channel. This is a blocking call.
-	// to stop streaming, cancel the context.
+	// to stop streaming, cancel the context. Packets sent on the channel
+	// belong to the receiver, and may be recycled once they're written.
 	StreamAudio(ctx context.Context, pktChan chan<- *rtp.Packet) error
 
 	MediaSource
 }
+
+// MicrophoneSampleRate is the rate of the audio that sessions send to an AudioSink
+const MicrophoneSampleRate = 48000
+
+// AudioSink plays the audio that sessions send to the desktop, like a player's microphone
+type AudioSink interface {
+	// OpenAudio starts playing a session's audio. It's written to the stream as mono
+	// signed 16 bit little endian samples at MicrophoneSampleRate. Closing the stream
+	// stops playing it.
+	OpenAudio(session SessionID) (io.WriteCloser, error)
+
+	MediaSource
+}
+
 type VideoSource interface {
 	// GetVideoCodecParameters returns the video codec parameters
 	GetVideoCodecParameters() webrtc.RTPCodecParameters
 	// StreamVideo streams video to the channel. This is a blocking call.
-	// to stop streaming, cancel the context.
+	// to stop streaming, cancel the context. Packets sent on the channel
+	// belong to the receiver, and may be recycled once they're written.
 	StreamVideo(ctx context.Context, pktChan chan<- *rtp.Packet) error
 
 	MediaSource
@@ -31,3 +49,79 @@ type MediaSource interface {
 	// GetName returns the name of the media source
 	GetName() string
 }
+
+// KeyframeRequester is implemented by sources that can produce a keyframe on demand,
+// so that a session or consumer that just started watching can start decoding. Sources
+// may combine requests and take a while, if they have to restart for a keyframe.
+type KeyframeRequester interface {
+	RequestKeyframe()
+}
+
+// DefaultVideoOutputID is the output of video sources that don't say which output they capture
+const DefaultVideoOutputID = "default"
+
+// VideoOutput is a part of the desktop that video sources capture, like a monitor
+// or a region of the screen. Every codec that an output is encoded with shares
+// its track ID and stream ID.
+type VideoOutput struct {
+	// ID stays the same across restarts, so clients can remember which output they picked
+	ID   string `json:"id"`
+	Name string `json:"name,omitempty"`
+
+	// X, Y, Width and Height are where the output is on the desktop, when it's known
+	X      int `json:"x,omitempty"`
+	Y      int `json:"y,omitempty"`
+	Width  int `json:"width,omitempty"`
+	Height int `json:"height,omitempty"`
+
+	// TrackID, StreamID and Codecs are filled in by the mixer
+	TrackID  string   `json:"trackId,omitempty"`
+	StreamID string   `json:"streamId,omitempty"`
+	Codecs   []string `json:"codecs,omitempty"`
+}
+
+// OutputSource is implemented by video sources that capture one of several outputs
+type OutputSource interface {
+	GetVideoOutput() VideoOutput
+}
+
+// VideoSettings are what a client can ask an output to be encoded with. Zero fields
+// keep the source's own settings, and a zero width or height keeps the aspect ratio.
+type VideoSettings struct {
+	Width     int `json:"width,omitempty"`
+	Height    int `json:"height,omitempty"`
+	FrameRate int `json:"frameRate,omitempty"`
+	// Quality is the encoder's quality, from 1 (best) to 51. Lossless can't be asked
+	// for, since 0 keeps the source's own.
+	Quality int `json:"quality,omitempty"`
+}
+
+// Limits of VideoSettings
+const (
+	MaxVideoDimension = 7680
+	MaxFrameRate      = 240
+	MaxVideoQuality   = 51
+)
+
+func (s VideoSettings) Validate() error {
+	if s.Width < 0 || s.Width > MaxVideoDimension || s.Height < 0 || s.Height > MaxVideoDimension {
+		return fmt.Errorf("resolution %vx%v is out of range", s.Width, s.Height)
+	}
+	if s.Width%2 != 0 || s.Height%2 != 0 {
+		return fmt.Errorf("resolution %vx%v must be even", s.Width, s.Height)
+	}
+	if s.FrameRate < 0 || s.FrameRate > MaxFrameRate {
+		return fmt.Errorf("frame rate %v is out of range", s.FrameRate)
+	}
+	if s.Quality < 0 || s.Quality > MaxVideoQuality {
+		return fmt.Errorf("quality %v is out of range", s.Quality)
+	}
+	return nil
+}
+
+// VideoSettingsSource is implemented by video sources whose encoder settings can be
+// changed. New settings are used the next time the source starts.
+type VideoSettingsSource interface {
+	GetVideoSettings() VideoSettings
+	SetVideoSettings(VideoSettings) error
+}
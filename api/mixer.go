@@ -2,7 +2,9 @@ package api
 
 import (
 	"context"
+	"time"
 
+	"github.com/pion/rtp"
 	"github.com/pion/webrtc/v4"
 )
 
@@ -10,14 +12,88 @@ import (
 // You can add any number of audio and video sources to the mixer, and get out
 // video and audio tracks that can be added to a webrtc peer connection.
 type Mixer interface {
+	// AddVideoSource and AddAudioSource add sources, even while sessions are live
 	AddVideoSource(VideoSource) error
 	AddAudioSource(AudioSource) error
+	// RemoveVideoSource and RemoveAudioSource stop sources and remove them
+	RemoveVideoSource(VideoSource) error
+	RemoveAudioSource(AudioSource) error
+	// OnSourcesChanged adds a handler that's called after sources are added or removed
+	OnSourcesChanged(func())
+
+	// SetVideoCodecPreference sets the order, by mime type, in which video codecs
+	// are picked when a session supports more than one of them.
+	SetVideoCodecPreference(mimeTypes []string)
+	// SetVideoSettings changes how an output is encoded. Its running sources restart,
+	// and sessions see the change at the next keyframe. An empty output is the default output.
+	SetVideoSettings(output string, settings VideoSettings) error
+	// SetIdleTimeout sets how long sources keep running after their last consumer released them
+	SetIdleTimeout(time.Duration)
 
 	GetAudioSources() []AudioSource
 	GetVideoSources() []VideoSource
 
-	GetAudioTracks() []*webrtc.TrackLocalStaticRTP
-	GetVideoTracks() []*webrtc.TrackLocalStaticRTP
+	GetAudioTracks() []Track
+	GetVideoTracks() []Track
+
+	// GetVideoOutputs returns the outputs that video sources capture, in the order
+	// they were added. The first one is the default.
+	GetVideoOutputs() []VideoOutput
+
+	// NegotiateVideoTrack returns the video track of the output that best matches
+	// the codecs in the offer. An empty output is the default output.
+	NegotiateVideoTrack(offer *webrtc.SessionDescription, output string) (Track, error)
+	// GetVideoTrack returns the output's video track with the given mime type. An empty
+	// output is the default output, and an empty mime type picks the preferred codec.
+	GetVideoTrack(output string, mimeType string) (Track, error)
+	// StartVideoTrack is GetVideoTrack, but it also acquires the track
+	StartVideoTrack(output string, mimeType string) (Track, error)
+
+	// AcquireTrack starts the track's source if it isn't running yet. Sources keep
+	// running until every consumer that acquired them released them again.
+	AcquireTrack(Track)
+	// ReleaseTrack releases a track. Its source stops after the idle timeout, unless
+	// it's acquired again.
+	ReleaseTrack(Track)
 
 	Stream(ctx context.Context) error
 }
+
+// Track is a track from the mixer, which is shared by every session.
+type Track interface {
+	webrtc.TrackLocal
+
+	// Codec returns the codec of the packets on the track
+	Codec() webrtc.RTPCodecCapability
+
+	// ForSession returns the track to add to a session's peer connection
+	ForSession(SessionID) webrtc.TrackLocal
+
+	// Subscribe returns a copy of every packet written to the track, for consumers
+	// other than sessions. Up to size packets are buffered before packets are dropped.
+	Subscribe(size int) TrackSubscription
+
+	// RequestKeyframe asks the track's source for a keyframe, if it can make one
+	RequestKeyframe()
+
+	// SetKeyframeInterval sends a session only keyframes, at most one per interval,
+	// or every frame again if interval is 0. Other sessions aren't affected.
+	SetKeyframeInterval(session SessionID, interval time.Duration)
+}
+
+// Subscription sizes that buffer a few seconds of packets, so that a subscriber
+// writing to a slow disk or server doesn't drop frames
+const (
+	VideoSubscriptionSize = 2000
+	AudioSubscriptionSize = 500
+)
+
+// TrackSubscription receives the packets of a track
+type TrackSubscription interface {
+	// Packets returns the channel of packets. They belong to the receiver, and
+	// there's a gap in the sequence numbers wherever the subscriber fell behind.
+	Packets() <-chan *rtp.Packet
+	// Close stops the subscription, closes the channel, and gives back any packets
+	// still in it, so it's called once the receiver is done reading
+	Close()
+}
@@ -0,0 +1,17 @@
+package api
+
+import "context"
+
+// PreviewHandler receives a new preview image of the screen
+type PreviewHandler func(image []byte)
+
+// PreviewSource periodically makes small preview images of the screen, for desktop
+// pickers. Signalers publish them to clients.
+type PreviewSource interface {
+	// GetName returns the name of the preview source
+	GetName() string
+	// OnPreview adds a handler for new previews
+	OnPreview(PreviewHandler)
+	// Run makes previews until the context is done
+	Run(ctx context.Context) error
+}
@@ -4,6 +4,10 @@ import "github.com/pion/webrtc/v4"
 
 type SessionID string
 
+// RenegotiationHandler sends an offer from the desktop to the session's client.
+// The client's answer is passed to the peer connection's SetRemoteDescription.
+type RenegotiationHandler func(offer webrtc.SessionDescription) error
+
 type Session interface {
 	// GetName returns the name of the session
 	GetName() string
@@ -16,4 +20,13 @@ type Session interface {
 
 	// GetPeerConnection returns the peer connection
 	GetPeerConnection() *webrtc.PeerConnection
+
+	// OnConnectionStateChange adds a handler for changes to the state of the peer
+	// connection. Unlike the peer connection's own, every handler that's added is called.
+	OnConnectionStateChange(func(webrtc.PeerConnectionState))
+
+	// OnRenegotiate sets how the session sends offers to its client
+	OnRenegotiate(RenegotiationHandler)
+	// Renegotiate sends the client a new offer, after the desktop's tracks changed
+	Renegotiate() error
 }
@@ -3,16 +3,32 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/caarlos0/env"
 	"github.com/pion/webrtc/v4"
+	"github.com/pod-arcade/pod-arcade/api"
 	"github.com/pod-arcade/pod-arcade/internal/udev"
 	"github.com/pod-arcade/pod-arcade/pkg/desktop"
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/audio_mixer"
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/broadcast"
 	"github.com/pod-arcade/pod-arcade/pkg/desktop/cmd_capture"
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/encoder"
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/grim"
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/hls"
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/microphone"
 	"github.com/pod-arcade/pod-arcade/pkg/desktop/mqtt"
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/preview"
 	"github.com/pod-arcade/pod-arcade/pkg/desktop/pulseaudio"
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/recorder"
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/replay"
 	"github.com/pod-arcade/pod-arcade/pkg/desktop/uinput"
 	"github.com/pod-arcade/pod-arcade/pkg/desktop/wayland"
 	"github.com/pod-arcade/pod-arcade/pkg/desktop/wf_recorder"
@@ -27,9 +43,87 @@ var DesktopConfig struct {
 	VIDEO_QUALITY    int    `env:"VIDEO_QUALITY" envDefault:"30"`
 	DISABLE_HW_ACCEL bool   `env:"DISABLE_HW_ACCEL" envDefault:"true"`
 	VIDEO_PROFILE    string `env:"VIDEO_PROFILE" envDefault:"constrained_baseline"`
+	// Encoder profiles to encode the screen with, in order of preference. Each one runs its own
+	// encoder while a session is using it. The built-in profiles are h264 and vp9, which use
+	// VAAPI unless DISABLE_HW_ACCEL is set, and h264-vaapi and vp9-vaapi. VIDEO_QUALITY and
+	// VIDEO_PROFILE only apply to the built-in profiles.
+	VIDEO_CODECS []string `env:"VIDEO_CODECS" envDefault:"h264"`
+	// More encoder profiles, as a JSON array. They replace built-in profiles with the same name.
+	ENCODER_PROFILES string `env:"ENCODER_PROFILES" envDefault:""`
+	// Outputs to capture separately, separated by semicolons, like "HDMI-A-1;right=DP-1;left=0,0 960x1080".
+	// Clients pick between them. The whole desktop is captured as one output when it's empty.
+	VIDEO_OUTPUTS string `env:"VIDEO_OUTPUTS" envDefault:""`
+	// Records the audio with the first H.264 capture, muxed into one stream, so the audio
+	// and video stay in sync. Audio is captured separately with GStreamer otherwise.
+	MUX_AUDIO bool `env:"MUX_AUDIO" envDefault:"false"`
+	// Applications whose audio is streamed, by name, binary or process ID, separated by commas.
+	// They're moved onto a null sink of their own, so other sounds stay off the stream, and
+	// their volumes can be changed over MQTT. Use "*" to stream every application this way.
+	AUDIO_APPS []string `env:"AUDIO_APPS"`
+	// PulseAudio sources mixed into the one audio track, separated by commas, like the monitors
+	// of the game's sink and a voice chat's. The sources in AUDIO_DUCK make the others quieter
+	// while they're playing. The default source is streamed on its own when it's empty.
+	AUDIO_MIX  []string `env:"AUDIO_MIX"`
+	AUDIO_DUCK []string `env:"AUDIO_DUCK"`
+	// Where the microphones that sessions send are played. "pulse" gives each session a virtual
+	// PulseAudio microphone, and "wav" writes them to WAV files in MICROPHONE_DIR. Sessions'
+	// microphones are ignored when it's empty.
+	MICROPHONE     string `env:"MICROPHONE" envDefault:""`
+	MICROPHONE_DIR string `env:"MICROPHONE_DIR" envDefault:"microphones"`
+
+	// Encoders start when the first session connects, and stop once there have been no
+	// sessions for SOURCE_IDLE_TIMEOUT. Recording, broadcasting, the replay buffer and HLS keep them running.
+	SOURCE_IDLE_TIMEOUT time.Duration `env:"SOURCE_IDLE_TIMEOUT" envDefault:"30s"`
 
 	WEBRTC_PORT int      `env:"WEBRTC_PORT" envDefault:"0"`
 	WEBRTC_IPS  []string `env:"WEBRTC_IPS"`
+	// FlexFEC packets to send per video packet, from 0 to 1. 0 disables FEC.
+	VIDEO_FEC_OVERHEAD float64 `env:"VIDEO_FEC_OVERHEAD" envDefault:"0"`
+	// Packets are paced at this many bits per second, or faster when a frame wouldn't
+	// leave within PACER_FRAME_SPREAD of the frame interval. 0 disables pacing.
+	PACER_RATE         int     `env:"PACER_RATE" envDefault:"20000000"`
+	PACER_BURST        int     `env:"PACER_BURST" envDefault:"12000"`
+	PACER_FRAME_SPREAD float64 `env:"PACER_FRAME_SPREAD" envDefault:"0.5"`
+
+	// Recordings are written here when started over MQTT. Recording is disabled when it's empty.
+	RECORDING_DIR       string        `env:"RECORDING_DIR" envDefault:""`
+	RECORDING_MAX_SIZE  int64         `env:"RECORDING_MAX_SIZE" envDefault:"0"`
+	RECORDING_RETENTION time.Duration `env:"RECORDING_RETENTION" envDefault:"0"`
+
+	// The desktop is streamed to this RTMP URL, like rtmp://relay/live/table-1, when started over
+	// MQTT. Audio is transcoded to AAC at RTMP_AUDIO_BITRATE, and dropped connections are retried,
+	// waiting up to RTMP_MAX_BACKOFF in between. Broadcasting is disabled when it's empty.
+	// Other URLs can be streamed to over MQTT, but only on RTMP_URL's host or RTMP_ALLOWED_HOSTS.
+	RTMP_URL           string        `env:"RTMP_URL" envDefault:""`
+	RTMP_ALLOWED_HOSTS []string      `env:"RTMP_ALLOWED_HOSTS"`
+	RTMP_AUDIO_BITRATE int           `env:"RTMP_AUDIO_BITRATE" envDefault:"128000"`
+	RTMP_MAX_BACKOFF   time.Duration `env:"RTMP_MAX_BACKOFF" envDefault:"30s"`
+
+	// Clips of the last REPLAY_WINDOW are saved here over MQTT, or by pressing REPLAY_CHORD
+	// on a gamepad. The replay buffer is disabled when it's empty.
+	REPLAY_DIR    string        `env:"REPLAY_DIR" envDefault:""`
+	REPLAY_WINDOW time.Duration `env:"REPLAY_WINDOW" envDefault:"30s"`
+	REPLAY_CHORD  string        `env:"REPLAY_CHORD" envDefault:"select+home"`
+
+	// The desktop is packaged as Low-Latency HLS into HLS_DIR, for audiences too large for
+	// WebRTC. Segments are at least HLS_SEGMENT_DURATION long, with parts of at most
+	// HLS_PART_DURATION, and the playlist lists the last HLS_SEGMENTS of them. It's served
+	// without auth on HLS_HOST and HLS_PORT unless the port is 0, or HLS_DIR can be shared
+	// with the server. HLS_HOST is localhost by default, so only a proxy on the same
+	// machine can reach it. HLS is disabled when HLS_DIR is empty.
+	HLS_DIR              string        `env:"HLS_DIR" envDefault:""`
+	HLS_HOST             string        `env:"HLS_HOST" envDefault:"127.0.0.1"`
+	HLS_PORT             int           `env:"HLS_PORT" envDefault:"8081"`
+	HLS_SEGMENT_DURATION time.Duration `env:"HLS_SEGMENT_DURATION" envDefault:"2s"`
+	HLS_PART_DURATION    time.Duration `env:"HLS_PART_DURATION" envDefault:"250ms"`
+	HLS_SEGMENTS         int           `env:"HLS_SEGMENTS" envDefault:"6"`
+
+	// A JPEG preview of the screen is published every PREVIEW_INTERVAL, scaled by PREVIEW_SCALE.
+	// Its quality is lowered until it fits in PREVIEW_MAX_SIZE bytes. 0 disables previews.
+	PREVIEW_INTERVAL time.Duration `env:"PREVIEW_INTERVAL" envDefault:"30s"`
+	PREVIEW_SCALE    float64       `env:"PREVIEW_SCALE" envDefault:"0.25"`
+	PREVIEW_MAX_SIZE int           `env:"PREVIEW_MAX_SIZE" envDefault:"65536"`
+	PREVIEW_QUALITY  int           `env:"PREVIEW_QUALITY" envDefault:"70"`
 
 	ICEServers     []webrtc.ICEServer `json:"-"`
 	ICEServersJSON string             `env:"ICE_SERVERS" envDefault:"" json:"-"`
@@ -60,6 +154,85 @@ func getMQTTConfigurator() mqtt.MQTTConfigurator {
 	}
 }
 
+// getEncoderProfiles returns the built-in encoder profiles, along with the ones from ENCODER_PROFILES
+func getEncoderProfiles() encoder.Profiles {
+	profiles := encoder.DefaultProfiles(DesktopConfig.VIDEO_QUALITY, DesktopConfig.VIDEO_PROFILE)
+	if DesktopConfig.ENCODER_PROFILES != "" {
+		custom := []encoder.EncoderProfile{}
+		if err := json.Unmarshal([]byte(DesktopConfig.ENCODER_PROFILES), &custom); err != nil {
+			logger.Fatal().Err(err).Msg("Failed to decode ENCODER_PROFILES, should be a json array")
+		}
+		if err := profiles.Add(custom...); err != nil {
+			logger.Fatal().Err(err).Msg("Invalid ENCODER_PROFILES")
+		}
+	}
+	return profiles
+}
+
+// getVideoSources creates one screen capture per configured output and encoder profile,
+// returning them along with their mime types in order of preference. The audio source
+// is the one muxed with the video when MUX_AUDIO is set, and nil otherwise.
+func getVideoSources() ([]api.VideoSource, []string, api.AudioSource) {
+	outputs, err := wf_recorder.ParseOutputs(DesktopConfig.VIDEO_OUTPUTS)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Invalid VIDEO_OUTPUTS")
+	}
+	if len(outputs) == 0 {
+		// The whole desktop
+		outputs = []wf_recorder.Output{{}}
+	}
+
+	profiles := getEncoderProfiles()
+	sources := []api.VideoSource{}
+	mimeTypes := []string{}
+	var audio api.AudioSource
+	for _, name := range DesktopConfig.VIDEO_CODECS {
+		name = strings.ToLower(strings.TrimSpace(name))
+		// The plain codec names pick the hardware encoder when it's enabled
+		if !DesktopConfig.DISABLE_HW_ACCEL && (name == "h264" || name == "vp9") {
+			name += "-vaapi"
+		}
+		profile, err := profiles.Get(name)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("Invalid VIDEO_CODECS")
+		}
+		if !slices.Contains(mimeTypes, profile.Codec) {
+			mimeTypes = append(mimeTypes, profile.Codec)
+		}
+
+		for _, output := range outputs {
+			capture := wf_recorder.NewOutputCapture(output, profile)
+			if strings.EqualFold(profile.Codec, webrtc.MimeTypeVP9) {
+				sources = append(sources, cmd_capture.NewCommandCaptureIVF(capture))
+			} else if DesktopConfig.MUX_AUDIO && audio == nil {
+				muxed := cmd_capture.NewCommandCaptureMPEGTS(wf_recorder.NewMuxedCapture(capture))
+				sources = append(sources, muxed.Video())
+				audio = muxed.Audio()
+			} else {
+				sources = append(sources, cmd_capture.NewCommandCaptureH264(capture))
+			}
+		}
+	}
+	return sources, mimeTypes, audio
+}
+
+// getAudioMixer mixes the PulseAudio sources in AUDIO_MIX into one source
+func getAudioMixer() api.AudioSource {
+	inputs := []audio_mixer.Input{}
+	for _, source := range DesktopConfig.AUDIO_MIX {
+		inputs = append(inputs, audio_mixer.Input{
+			Source: pulseaudio.NewPulseAudioSourceCapture(source),
+			Gain:   1,
+			Ducks:  slices.Contains(DesktopConfig.AUDIO_DUCK, source),
+		})
+	}
+	mixer, err := audio_mixer.NewAudioMixer(audio_mixer.DefaultConfig, inputs...)
+	if err != nil {
+		logger.Fatal().Msgf("Invalid AUDIO_MIX. %v", err)
+	}
+	return mixer
+}
+
 func main() {
 	env.Parse(&DesktopConfig)
 	err := configureICE()
@@ -77,9 +250,21 @@ func main() {
 	logger.Debug().Msgf("\tMQTT_HOST: %v", DesktopConfig.MQTT_HOST)
 	logger.Debug().Msgf("\tVIDEO_QUALITY: %v", DesktopConfig.VIDEO_QUALITY)
 	logger.Debug().Msgf("\tVIDEO_PROFILE: %v", DesktopConfig.VIDEO_PROFILE)
+	logger.Debug().Msgf("\tVIDEO_CODECS: %v", DesktopConfig.VIDEO_CODECS)
+	logger.Debug().Msgf("\tVIDEO_OUTPUTS: %v", DesktopConfig.VIDEO_OUTPUTS)
+	logger.Debug().Msgf("\tMUX_AUDIO: %v", DesktopConfig.MUX_AUDIO)
+	logger.Debug().Msgf("\tAUDIO_APPS: %v", DesktopConfig.AUDIO_APPS)
+	logger.Debug().Msgf("\tAUDIO_MIX: %v", DesktopConfig.AUDIO_MIX)
+	logger.Debug().Msgf("\tMICROPHONE: %v", DesktopConfig.MICROPHONE)
+	logger.Debug().Msgf("\tSOURCE_IDLE_TIMEOUT: %v", DesktopConfig.SOURCE_IDLE_TIMEOUT)
 	logger.Debug().Msgf("\tHARDWARE_ACCELERATION: %v", !DesktopConfig.DISABLE_HW_ACCEL)
 	logger.Debug().Msgf("\tWEBRTC_PORT: %v (0 means auto discover them)", DesktopConfig.WEBRTC_PORT)
 	logger.Debug().Msgf("\tWEBRTC_IPS: %v", DesktopConfig.WEBRTC_IPS)
+	logger.Debug().Msgf("\tRECORDING_DIR: %v", DesktopConfig.RECORDING_DIR)
+	logger.Debug().Msgf("\tREPLAY_DIR: %v", DesktopConfig.REPLAY_DIR)
+	logger.Debug().Msgf("\tHLS_DIR: %v", DesktopConfig.HLS_DIR)
+	logger.Debug().Msgf("\tHLS_HOST: %v", DesktopConfig.HLS_HOST)
+	logger.Debug().Msgf("\tPREVIEW_INTERVAL: %v", DesktopConfig.PREVIEW_INTERVAL)
 
 	ctx, _ := signal.NotifyContext(context.Background(), os.Interrupt)
 
@@ -99,25 +284,134 @@ func main() {
 
 	wc := wayland.NewWaylandInputClient(ctx)
 
+	videoSources, videoCodecs, audioSource := getVideoSources()
+	var appAudio *pulseaudio.AppAudio
+	if audioSource != nil && (len(DesktopConfig.AUDIO_APPS) > 0 || len(DesktopConfig.AUDIO_MIX) > 0) {
+		logger.Warn().Msg("AUDIO_APPS and AUDIO_MIX are ignored when MUX_AUDIO is set")
+	} else if len(DesktopConfig.AUDIO_APPS) > 0 {
+		if len(DesktopConfig.AUDIO_MIX) > 0 {
+			logger.Warn().Msg("AUDIO_MIX is ignored when AUDIO_APPS is set")
+		}
+		apps := slices.DeleteFunc(DesktopConfig.AUDIO_APPS, func(app string) bool { return app == "*" })
+		appAudio = pulseaudio.NewAppAudio(pulseaudio.AppAudioConfig{Apps: apps})
+		audioSource = appAudio
+	} else if len(DesktopConfig.AUDIO_MIX) > 0 {
+		audioSource = getAudioMixer()
+	} else if audioSource == nil {
+		audioSource = cmd_capture.NewCommandCaptureOgg(pulseaudio.NewGSTPulseAudioCapture())
+	}
+
 	d := desktop.
 		NewDesktop().
-		WithVideoSource(
-			cmd_capture.NewCommandCaptureH264(
-				wf_recorder.NewScreenCapture(DesktopConfig.VIDEO_QUALITY, !DesktopConfig.DISABLE_HW_ACCEL, DesktopConfig.VIDEO_PROFILE),
-			)).
-		WithAudioSource(cmd_capture.NewCommandCaptureOgg(pulseaudio.NewGSTPulseAudioCapture())).
+		WithVideoCodecPreference(videoCodecs...).
+		WithAudioSource(audioSource).
 		WithSignaler(mqtt.NewMQTTSignaler(getMQTTConfigurator())).
-		WithGamepad(uinput.CreateVirtualGamepad(uDev, 0, 0x045E, 0x02D1)).
-		WithGamepad(uinput.CreateVirtualGamepad(uDev, 1, 0x045E, 0x02D1)).
-		WithGamepad(uinput.CreateVirtualGamepad(uDev, 2, 0x045E, 0x02D1)).
-		WithGamepad(uinput.CreateVirtualGamepad(uDev, 3, 0x045E, 0x02D1)).
 		WithMouse(wc).
 		WithKeyboard(wc)
 
+	for _, v := range videoSources {
+		d.WithVideoSource(v)
+	}
+	if appAudio != nil {
+		d.WithController(appAudio)
+	}
+	switch DesktopConfig.MICROPHONE {
+	case "":
+	case "pulse":
+		d.WithAudioSink(pulseaudio.NewMicrophoneSink())
+	case "wav":
+		d.WithAudioSink(microphone.NewWAVSink(DesktopConfig.MICROPHONE_DIR))
+	default:
+		logger.Fatal().Msgf("Invalid MICROPHONE %q, should be pulse or wav", DesktopConfig.MICROPHONE)
+	}
+	d.GetMixer().SetIdleTimeout(DesktopConfig.SOURCE_IDLE_TIMEOUT)
+
+	gamepads := []api.Gamepad{}
+	for i := 0; i < 4; i++ {
+		gamepads = append(gamepads, uinput.CreateVirtualGamepad(uDev, i, 0x045E, 0x02D1))
+	}
+
+	if DesktopConfig.REPLAY_DIR != "" {
+		r := replay.NewReplay(d.GetMixer(), replay.Config{
+			Dir:    DesktopConfig.REPLAY_DIR,
+			Window: DesktopConfig.REPLAY_WINDOW,
+		})
+		d.WithController(r)
+
+		chord, err := replay.ParseChord(DesktopConfig.REPLAY_CHORD)
+		if err != nil {
+			logger.Fatal().Msgf("Invalid REPLAY_CHORD. %v", err)
+		}
+		for i, g := range gamepads {
+			gamepads[i] = replay.WithChord(g, chord, func() { r.Save("gamepad") })
+		}
+		go func() {
+			if err := r.Run(ctx); err != nil {
+				logger.Error().Msgf("Replay buffer stopped. %v", err)
+			}
+		}()
+	}
+
+	for _, g := range gamepads {
+		d.WithGamepad(g)
+	}
+
+	if DesktopConfig.HLS_DIR != "" {
+		h := hls.NewPackager(d.GetMixer(), hls.Config{
+			Dir:             DesktopConfig.HLS_DIR,
+			SegmentDuration: DesktopConfig.HLS_SEGMENT_DURATION,
+			PartDuration:    DesktopConfig.HLS_PART_DURATION,
+			Segments:        DesktopConfig.HLS_SEGMENTS,
+		})
+		go func() {
+			if err := h.Run(ctx); err != nil {
+				logger.Error().Msgf("HLS packager stopped. %v", err)
+			}
+		}()
+		if DesktopConfig.HLS_PORT != 0 {
+			go func() {
+				addr := net.JoinHostPort(DesktopConfig.HLS_HOST, strconv.Itoa(DesktopConfig.HLS_PORT))
+				if err := http.ListenAndServe(addr, h); err != nil {
+					logger.Error().Msgf("Failed to serve HLS. %v", err)
+				}
+			}()
+		}
+	}
+
+	if DesktopConfig.PREVIEW_INTERVAL > 0 {
+		d.WithPreviewSource(preview.NewPreview(grim.NewScreenshot(DesktopConfig.PREVIEW_SCALE), preview.Config{
+			Interval: DesktopConfig.PREVIEW_INTERVAL,
+			MaxSize:  DesktopConfig.PREVIEW_MAX_SIZE,
+			Quality:  DesktopConfig.PREVIEW_QUALITY,
+		}))
+	}
+
+	if DesktopConfig.RECORDING_DIR != "" {
+		d.WithController(recorder.NewRecorder(d.GetMixer(), recorder.Config{
+			Dir:       DesktopConfig.RECORDING_DIR,
+			MaxSize:   DesktopConfig.RECORDING_MAX_SIZE,
+			Retention: DesktopConfig.RECORDING_RETENTION,
+		}))
+	}
+
+	if DesktopConfig.RTMP_URL != "" {
+		d.WithController(broadcast.NewBroadcaster(d.GetMixer(), broadcast.Config{
+			URL:          DesktopConfig.RTMP_URL,
+			AllowedHosts: DesktopConfig.RTMP_ALLOWED_HOSTS,
+			AudioBitrate: DesktopConfig.RTMP_AUDIO_BITRATE,
+			MaxBackoff:   DesktopConfig.RTMP_MAX_BACKOFF,
+		}))
+	}
+
 	// Register a webrtc API. Includes all of the codecs, interceptors, etc.
 	webrtcAPI, err := desktop.GetWebRTCAPI(d, &desktop.WebRTCAPIConfig{
 		SinglePort:  DesktopConfig.WEBRTC_PORT,
 		ExternalIPs: DesktopConfig.WEBRTC_IPS,
+		FECOverhead: DesktopConfig.VIDEO_FEC_OVERHEAD,
+
+		PacerRate:        DesktopConfig.PACER_RATE,
+		PacerBurst:       DesktopConfig.PACER_BURST,
+		PacerFrameSpread: DesktopConfig.PACER_FRAME_SPREAD,
 	})
 	if err != nil {
 		panic(err)
@@ -7,12 +7,15 @@ import (
 
 	"github.com/caarlos0/env"
 	"github.com/pion/webrtc/v4"
+	"github.com/pod-arcade/pod-arcade/api"
 	"github.com/pod-arcade/pod-arcade/pkg/desktop"
 	"github.com/pod-arcade/pod-arcade/pkg/desktop/cmd_capture"
 	"github.com/pod-arcade/pod-arcade/pkg/desktop/mqtt"
-	"github.com/pod-arcade/pod-arcade/pkg/desktop/sample_recorder"
+	"github.com/pod-arcade/pod-arcade/pkg/log"
 )
 
+var logger = log.NewLogger("noop-desktop", map[string]string{})
+
 var DesktopConfig struct {
 	MQTT_HOST   string `env:"MQTT_HOST" envDefault:"tcp://localhost:1883"`
 	DESKTOP_ID  string `env:"DESKTOP_ID"`
@@ -21,6 +24,12 @@ var DesktopConfig struct {
 	WEBRTC_PORT int      `env:"WEBRTC_PORT" envDefault:"0"`
 	WEBRTC_IPS  []string `env:"WEBRTC_IPS"`
 
+	// Files to play in a loop. The video can be H.264 Annex-B, played at VIDEO_FPS,
+	// or IVF, and defaults to a generated test pattern. The audio is Ogg/Opus.
+	VIDEO_FILE string `env:"VIDEO_FILE" envDefault:""`
+	VIDEO_FPS  int    `env:"VIDEO_FPS" envDefault:"30"`
+	AUDIO_FILE string `env:"AUDIO_FILE" envDefault:""`
+
 	CLOUD_AUTH_KEY string `env:"CLOUD_AUTH_KEY" envDefault:""`
 	CLOUD_URL      string `env:"CLOUD_URL" envDefault:"https://play.pod-arcade.com"`
 }
@@ -33,6 +42,15 @@ func getMQTTConfigurator() mqtt.MQTTConfigurator {
 	}
 }
 
+// getVideoSource plays VIDEO_FILE
+func getVideoSource() api.VideoSource {
+	source, err := cmd_capture.NewFileVideoSource(DesktopConfig.VIDEO_FILE, DesktopConfig.VIDEO_FPS)
+	if err != nil {
+		logger.Fatal().Msgf("Failed to open VIDEO_FILE. %v", err)
+	}
+	return source
+}
+
 func main() {
 	env.Parse(&DesktopConfig)
 	if DesktopConfig.DESKTOP_ID == "" {
@@ -44,6 +62,16 @@ func main() {
 	}
 	ctx, _ := signal.NotifyContext(context.Background(), os.Interrupt)
 
+	if DesktopConfig.VIDEO_FILE == "" {
+		path, err := writeTestPattern()
+		if err != nil {
+			logger.Fatal().Msgf("Failed to write the test pattern. %v", err)
+		}
+		defer os.Remove(path)
+		logger.Info().Msg("Playing a test pattern, since VIDEO_FILE isn't set")
+		DesktopConfig.VIDEO_FILE = path
+	}
+
 	// Open udev
 	// This is used by our game controllers to register themselves in applications
 	// udev := udev.NewUDev(ctx)
@@ -57,7 +85,15 @@ func main() {
 	d := desktop.
 		NewDesktop().
 		WithSignaler(mqtt.NewMQTTSignaler(getMQTTConfigurator())).
-		WithVideoSource(cmd_capture.NewCommandCaptureH264(&sample_recorder.SampleRecorder{}))
+		WithVideoSource(getVideoSource())
+
+	if DesktopConfig.AUDIO_FILE != "" {
+		source, err := cmd_capture.NewFileAudioSource(DesktopConfig.AUDIO_FILE)
+		if err != nil {
+			logger.Fatal().Msgf("Failed to open AUDIO_FILE. %v", err)
+		}
+		d.WithAudioSource(source)
+	}
 
 	// Register a webrtc API. Includes all of the codecs, interceptors, etc.
 	webrtcAPI, err := desktop.GetWebRTCAPI(d, &desktop.WebRTCAPIConfig{
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+)
+
+// The test pattern is colour bars with a box bouncing over them. It's encoded as
+// H.264 without an encoder: the first frame sends every macroblock uncompressed
+// (I_PCM), and later frames resend only the macroblocks that changed, skipping the rest.
+const (
+	patternWidth  = 640
+	patternHeight = 480
+	patternBox    = 80
+	// patternFrames is one period of the box's bounce, so the loop is seamless. The
+	// box moves 4 pixels across a frame over 560, and 2 down over 280.
+	patternFrames = 280
+
+	mbsWide = patternWidth / 16
+	mbsHigh = patternHeight / 16
+)
+
+// patternBars are the colours of the bars, as Y, Cb, Cr
+var patternBars = [][3]byte{
+	{235, 128, 128}, // white
+	{210, 16, 146},  // yellow
+	{170, 166, 16},  // cyan
+	{145, 54, 34},   // green
+	{106, 202, 222}, // magenta
+	{81, 90, 240},   // red
+	{41, 240, 110},  // blue
+	{16, 128, 128},  // black
+}
+
+// writeTestPattern writes the test pattern to a temporary file, as H.264 Annex-B
+func writeTestPattern() (string, error) {
+	file, err := os.CreateTemp("", "noop-desktop-*.h264")
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	w := bufio.NewWriter(file)
+	var prev *patternFrame
+	for i := 0; i < patternFrames; i++ {
+		frame := drawPatternFrame(i)
+		if prev == nil {
+			writeNAL(w, 0x67, patternSPS())
+			writeNAL(w, 0x68, patternPPS())
+			writeNAL(w, 0x65, frame.slice(nil, i))
+		} else {
+			writeNAL(w, 0x41, frame.slice(prev, i))
+		}
+		prev = frame
+	}
+	if err := w.Flush(); err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+// patternFrame is a 4:2:0 picture
+type patternFrame struct {
+	y      [patternHeight][patternWidth]byte
+	cb, cr [patternHeight / 2][patternWidth / 2]byte
+}
+
+func drawPatternFrame(i int) *patternFrame {
+	f := &patternFrame{}
+	boxX := bounce(i*4, patternWidth-patternBox)
+	boxY := bounce(i*2, patternFrames)
+	for y := 0; y < patternHeight; y++ {
+		for x := 0; x < patternWidth; x++ {
+			c := patternBars[x*len(patternBars)/patternWidth]
+			if x >= boxX && x < boxX+patternBox && y >= boxY && y < boxY+patternBox {
+				c = patternBars[len(patternBars)-1-x*len(patternBars)/patternWidth]
+			}
+			f.y[y][x] = c[0]
+			if x%2 == 0 && y%2 == 0 {
+				f.cb[y/2][x/2] = c[1]
+				f.cr[y/2][x/2] = c[2]
+			}
+		}
+	}
+	return f
+}
+
+// bounce moves back and forth between 0 and max
+func bounce(pos, max int) int {
+	pos %= 2 * max
+	if pos > max {
+		return 2*max - pos
+	}
+	return pos
+}
+
+// macroblock returns the samples of a macroblock, in the order I_PCM sends them
+func (f *patternFrame) macroblock(mbX, mbY int) []byte {
+	samples := make([]byte, 0, 384)
+	for y := 0; y < 16; y++ {
+		samples = append(samples, f.y[mbY*16+y][mbX*16:mbX*16+16]...)
+	}
+	for _, plane := range []*[patternHeight / 2][patternWidth / 2]byte{&f.cb, &f.cr} {
+		for y := 0; y < 8; y++ {
+			samples = append(samples, plane[mbY*8+y][mbX*8:mbX*8+8]...)
+		}
+	}
+	return samples
+}
+
+// slice encodes the frame as an IDR slice, or as a P slice on top of prev
+func (f *patternFrame) slice(prev *patternFrame, i int) []byte {
+	b := &bitWriter{}
+	b.ue(0) // first_mb_in_slice
+	if prev == nil {
+		b.ue(7) // slice_type I
+	} else {
+		b.ue(5) // slice_type P
+	}
+	b.ue(0)                // pic_parameter_set_id
+	b.bits(uint(i%256), 8) // frame_num
+	if prev == nil {
+		b.ue(0)      // idr_pic_id
+		b.bits(0, 2) // no_output_of_prior_pics_flag, long_term_reference_flag
+	} else {
+		b.bits(0, 3) // num_ref_idx_active_override_flag, ref_pic_list_modification_flag_l0, adaptive_ref_pic_marking_mode_flag
+	}
+	b.se(0) // slice_qp_delta
+	b.ue(1) // disable_deblocking_filter_idc
+
+	skipped := 0
+	for mbY := 0; mbY < mbsHigh; mbY++ {
+		for mbX := 0; mbX < mbsWide; mbX++ {
+			samples := f.macroblock(mbX, mbY)
+			if prev != nil {
+				if bytes.Equal(samples, prev.macroblock(mbX, mbY)) {
+					skipped++
+					continue
+				}
+				b.ue(uint(skipped)) // mb_skip_run
+				skipped = 0
+				b.ue(30) // mb_type I_PCM, in a P slice
+			} else {
+				b.ue(25) // mb_type I_PCM
+			}
+			b.align()
+			b.buf = append(b.buf, samples...)
+		}
+	}
+	if skipped > 0 {
+		b.ue(uint(skipped))
+	}
+	b.trailing()
+	return b.buf
+}
+
+// patternSPS is a constrained baseline, level 3.1 sequence parameter set
+func patternSPS() []byte {
+	b := &bitWriter{}
+	b.bits(66, 8)   // profile_idc
+	b.bits(0xe0, 8) // constraint_set0/1/2_flag
+	b.bits(31, 8)   // level_idc
+	b.ue(0)         // seq_parameter_set_id
+	b.ue(4)         // log2_max_frame_num_minus4
+	b.ue(2)         // pic_order_cnt_type
+	b.ue(1)         // max_num_ref_frames
+	b.bits(0, 1)    // gaps_in_frame_num_value_allowed_flag
+	b.ue(mbsWide - 1)
+	b.ue(mbsHigh - 1)
+	b.bits(1, 1) // frame_mbs_only_flag
+	b.bits(1, 1) // direct_8x8_inference_flag
+	b.bits(0, 1) // frame_cropping_flag
+	b.bits(0, 1) // vui_parameters_present_flag
+	b.trailing()
+	return b.buf
+}
+
+func patternPPS() []byte {
+	b := &bitWriter{}
+	b.ue(0)      // pic_parameter_set_id
+	b.ue(0)      // seq_parameter_set_id
+	b.bits(0, 2) // entropy_coding_mode_flag, bottom_field_pic_order_in_frame_present_flag
+	b.ue(0)      // num_slice_groups_minus1
+	b.ue(0)      // num_ref_idx_l0_default_active_minus1
+	b.ue(0)      // num_ref_idx_l1_default_active_minus1
+	b.bits(0, 3) // weighted_pred_flag, weighted_bipred_idc
+	b.se(0)      // pic_init_qp_minus26
+	b.se(0)      // pic_init_qs_minus26
+	b.se(0)      // chroma_qp_index_offset
+	b.bits(1, 1) // deblocking_filter_control_present_flag
+	b.bits(0, 2) // constrained_intra_pred_flag, redundant_pic_cnt_present_flag
+	b.trailing()
+	return b.buf
+}
+
+// writeNAL writes a start code, the header, and the payload with emulation prevention
+func writeNAL(w *bufio.Writer, header byte, payload []byte) {
+	w.Write([]byte{0, 0, 0, 1, header})
+	zeros := 0
+	for _, c := range payload {
+		if zeros >= 2 && c <= 3 {
+			w.WriteByte(3)
+			zeros = 0
+		}
+		w.WriteByte(c)
+		if c == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+}
+
+// bitWriter writes the bits of an RBSP, most significant first
+type bitWriter struct {
+	buf []byte
+	n   uint // bits used in the last byte, or 0 if it's full
+}
+
+func (b *bitWriter) bits(v uint, count uint) {
+	for i := count; i > 0; i-- {
+		if b.n == 0 {
+			b.buf = append(b.buf, 0)
+		}
+		b.buf[len(b.buf)-1] |= byte((v>>(i-1))&1) << (7 - b.n)
+		b.n = (b.n + 1) % 8
+	}
+}
+
+// ue writes an unsigned Exp-Golomb code
+func (b *bitWriter) ue(v uint) {
+	v++
+	length := uint(0)
+	for x := v; x > 1; x >>= 1 {
+		length++
+	}
+	b.bits(0, length)
+	b.bits(v, length+1)
+}
+
+// se writes a signed Exp-Golomb code
+func (b *bitWriter) se(v int) {
+	if v > 0 {
+		b.ue(uint(2*v - 1))
+	} else {
+		b.ue(uint(-2 * v))
+	}
+}
+
+func (b *bitWriter) align() {
+	b.n = 0
+}
+
+// trailing writes the stop bit, and aligns to a byte
+func (b *bitWriter) trailing() {
+	b.bits(1, 1)
+	b.align()
+}
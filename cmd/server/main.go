@@ -45,6 +45,9 @@ var ServerConfig struct {
 	TLSCert string `env:"TLS_CERT" envDefault:"" json:"-"`
 
 	StunPort int `env:"STUN_PORT" envDefault:"-1" json:"-"`
+
+	// Desktops' HLS is served from here at /hls/, when they write it to directories in it
+	HLSDir string `env:"HLS_DIR" envDefault:"" json:"-"`
 }
 
 func init() {
@@ -166,6 +169,14 @@ func main() {
 	mux.Handle("/metrics", metrics.Handle())
 	server.Log.Debug("Serving Metrics")
 
+	// HTTP requests aren't authenticated, so the HLS is only served when auth isn't required
+	if ServerConfig.HLSDir != "" && ServerConfig.RequireAuth {
+		server.Log.Warn("Not serving HLS, since auth is required")
+	} else if ServerConfig.HLSDir != "" {
+		mux.Handle("/hls/", http.StripPrefix("/hls", handlers.NewHLSHandler(ServerConfig.HLSDir)))
+		server.Log.Debug("Serving HLS")
+	}
+
 	mux.HandleFunc("/config.json", func(w http.ResponseWriter, r *http.Request) {
 		response, err := json.Marshal(ServerConfig)
 		if err != nil {
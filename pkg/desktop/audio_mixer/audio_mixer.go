@@ -0,0 +1,316 @@
+// Package audio_mixer mixes several PCM audio sources into a single source, since
+// browsers only reliably play one audio track. Each input is decoded, resampled to
+// the output rate, scaled by its gain, and summed into PCMU frames.
+package audio_mixer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"github.com/pod-arcade/pod-arcade/api"
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/media_clock"
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/packet_pool"
+	"github.com/pod-arcade/pod-arcade/pkg/log"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// SampleRate is the rate of the mixed audio, which is PCMU
+	SampleRate = 8000
+	// FrameDuration is how much audio goes in each packet of the mixed audio
+	FrameDuration = 20 * time.Millisecond
+
+	frameSamples     = SampleRate * int(FrameDuration/time.Millisecond) / 1000
+	inputChannelSize = 64
+	maxDrift         = 80 * time.Millisecond
+)
+
+// ErrUnknownInput is returned when changing the gain of an input that isn't in the mixer
+var ErrUnknownInput = errors.New("input isn't in the audio mixer")
+
+// Input is one of the sources being mixed
+type Input struct {
+	Source api.AudioSource
+	// Gain scales the input's samples. 1 leaves them as they are.
+	Gain float64
+	// Ducks makes the other inputs quieter while this one is playing, like a voice
+	// chat over the game's audio
+	Ducks bool
+}
+
+type Config struct {
+	// Name is the name of the mixed source
+	Name string
+	// MaxBuffer is how much audio is kept for each input, to smooth out packets that
+	// arrive in bursts. The oldest audio is dropped once an input gets further ahead.
+	MaxBuffer time.Duration
+	// DuckGain is the gain on the other inputs while a ducking input is playing
+	DuckGain float64
+	// DuckThreshold is the RMS level, from 0 to 1, above which a ducking input counts as playing
+	DuckThreshold float64
+	// DuckRelease is how long the other inputs stay ducked after a ducking input goes quiet
+	DuckRelease time.Duration
+}
+
+// DefaultConfig is a good place to start. NewAudioMixer takes any field that isn't set from it.
+var DefaultConfig = Config{
+	Name:          "Audio Mixer",
+	MaxBuffer:     200 * time.Millisecond,
+	DuckGain:      0.3,
+	DuckThreshold: 0.02,
+	DuckRelease:   500 * time.Millisecond,
+}
+
+var _ api.AudioSource = (*AudioMixer)(nil)
+
+// AudioMixer is an audio source that mixes its inputs together. Inputs are mixed as
+// their packets arrive, so each input's own timestamps are ignored.
+type AudioMixer struct {
+	config Config
+	inputs []*input
+
+	// duck is the gain on the inputs being ducked, and quiet is how long it's been
+	// since a ducking input played
+	duck  float64
+	quiet time.Duration
+	acc   []float64
+	mtx   sync.Mutex
+
+	l zerolog.Logger
+}
+
+// input is an Input, with its decoder and the audio waiting to be mixed
+type input struct {
+	Input
+	decode    decoder
+	resampler *resampler
+	// decoded and resampled are only used by the goroutine reading the input
+	decoded   []int16
+	resampled []int16
+	// buf is the audio waiting to be mixed. It's guarded by the mixer's mtx.
+	buf []int16
+}
+
+// NewAudioMixer returns a mixer of the inputs, which must all use PCM codecs
+func NewAudioMixer(config Config, inputs ...Input) (*AudioMixer, error) {
+	if config.Name == "" {
+		config.Name = DefaultConfig.Name
+	}
+	if config.MaxBuffer <= 0 {
+		config.MaxBuffer = DefaultConfig.MaxBuffer
+	}
+	if config.DuckGain <= 0 {
+		config.DuckGain = DefaultConfig.DuckGain
+	}
+	if config.DuckThreshold <= 0 {
+		config.DuckThreshold = DefaultConfig.DuckThreshold
+	}
+	if config.DuckRelease <= 0 {
+		config.DuckRelease = DefaultConfig.DuckRelease
+	}
+
+	m := &AudioMixer{
+		config: config,
+		duck:   1,
+		quiet:  config.DuckRelease,
+		acc:    make([]float64, frameSamples),
+		l:      log.NewLogger("audio-mixer", map[string]string{"Name": config.Name}),
+	}
+	for _, in := range inputs {
+		codec := in.Source.GetAudioCodecParameters()
+		decode, err := newDecoder(codec)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %w", in.Source.GetName(), err)
+		}
+		if codec.ClockRate == 0 {
+			return nil, fmt.Errorf("%v: no clock rate", in.Source.GetName())
+		}
+		m.inputs = append(m.inputs, &input{
+			Input:     in,
+			decode:    decode,
+			resampler: newResampler(codec.ClockRate, SampleRate),
+		})
+	}
+	return m, nil
+}
+
+func (m *AudioMixer) GetName() string {
+	return m.config.Name
+}
+
+func (m *AudioMixer) GetAudioCodecParameters() webrtc.RTPCodecParameters {
+	return webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMU, ClockRate: SampleRate}, PayloadType: 0}
+}
+
+// SetGain changes the gain of the input with the source called name
+func (m *AudioMixer) SetGain(name string, gain float64) error {
+	if gain < 0 || math.IsNaN(gain) || math.IsInf(gain, 0) {
+		return fmt.Errorf("invalid gain %v", gain)
+	}
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	for _, in := range m.inputs {
+		if in.Source.GetName() == name {
+			in.Gain = gain
+			return nil
+		}
+	}
+	return ErrUnknownInput
+}
+
+// StreamAudio streams all of the inputs, and sends a frame of the mix every
+// FrameDuration. It stops when any of the inputs fails.
+func (m *AudioMixer) StreamAudio(ctx context.Context, pktChan chan<- *rtp.Packet) error {
+	ctx, cancel := context.WithCancel(ctx)
+	wg := sync.WaitGroup{}
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	m.reset()
+	errc := make(chan error, len(m.inputs))
+	for _, in := range m.inputs {
+		wg.Add(1)
+		go func(in *input) {
+			defer wg.Done()
+			if err := m.streamInput(ctx, in); err != nil {
+				errc <- err
+			}
+		}(in)
+	}
+
+	ticker := time.NewTicker(FrameDuration)
+	defer ticker.Stop()
+	timeline := media_clock.NewTimeline(media_clock.Default, SampleRate, maxDrift)
+	sequencer := rtp.NewRandomSequencer()
+	frame := make([]int16, frameSamples)
+	var position int64
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-errc:
+			return err
+		case now := <-ticker.C:
+			m.mix(frame)
+
+			// The frame is the audio that arrived over the last tick
+			p := packet_pool.GetPacket()
+			p.Version = 2
+			p.SequenceNumber = sequencer.NextSequenceNumber()
+			p.Timestamp = timeline.Timestamp(position, now.Add(-FrameDuration))
+			p.Payload = encodeUlaw(frame, p.Payload[:0])
+			position += int64(len(frame))
+
+			select {
+			case pktChan <- p:
+			case <-ctx.Done():
+				packet_pool.PutPacket(p)
+				return nil
+			}
+		}
+	}
+}
+
+// reset forgets the audio left over from the last time the mixer was streaming
+func (m *AudioMixer) reset() {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	for _, in := range m.inputs {
+		in.buf = in.buf[:0]
+		in.resampler = newResampler(in.Source.GetAudioCodecParameters().ClockRate, SampleRate)
+	}
+	m.duck = 1
+	// Nothing has played yet, so nothing starts ducked
+	m.quiet = m.config.DuckRelease
+}
+
+// streamInput streams an input into its buffer until the context is done
+func (m *AudioMixer) streamInput(ctx context.Context, in *input) error {
+	pkts := make(chan *rtp.Packet, inputChannelSize)
+	read := make(chan struct{})
+	go func() {
+		defer close(read)
+		for p := range pkts {
+			m.write(in, p.Payload)
+			packet_pool.PutPacket(p)
+		}
+	}()
+
+	m.l.Info().Msgf("Mixing %v", in.Source.GetName())
+	err := in.Source.StreamAudio(ctx, pkts)
+	close(pkts)
+	<-read
+	if err != nil {
+		return fmt.Errorf("%v: %w", in.Source.GetName(), err)
+	}
+	return nil
+}
+
+// write adds a packet of an input's audio to its buffer
+func (m *AudioMixer) write(in *input, payload []byte) {
+	in.decoded = in.decode(payload, in.decoded[:0])
+	in.resampled = in.resampler.resample(in.decoded, in.resampled[:0])
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	in.buf = append(in.buf, in.resampled...)
+	maxSamples := int(m.config.MaxBuffer * SampleRate / time.Second)
+	if len(in.buf) > maxSamples {
+		m.l.Trace().Msgf("%v is %v samples ahead, dropping them", in.Source.GetName(), len(in.buf)-maxSamples)
+		in.buf = in.buf[:copy(in.buf, in.buf[len(in.buf)-maxSamples:])]
+	}
+}
+
+// mix takes a frame of audio from each input's buffer, and mixes them into out.
+// Inputs that don't have a full frame yet are padded with silence.
+func (m *AudioMixer) mix(out []int16) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	// Ducking comes from this frame of the ducking inputs, and fades over the frame
+	playing := false
+	for _, in := range m.inputs {
+		if in.Ducks && level(in.buf[:min(len(out), len(in.buf))]) > m.config.DuckThreshold {
+			playing = true
+		}
+	}
+	if playing {
+		m.quiet = 0
+	} else {
+		m.quiet += time.Duration(len(out)) * time.Second / SampleRate
+	}
+	duckFrom, duckTo := m.duck, 1.0
+	if playing || m.quiet < m.config.DuckRelease {
+		duckTo = m.config.DuckGain
+	}
+	m.duck = duckTo
+
+	acc := m.acc[:0]
+	for range out {
+		acc = append(acc, 0)
+	}
+	for _, in := range m.inputs {
+		n := min(len(out), len(in.buf))
+		for i, s := range in.buf[:n] {
+			gain := in.Gain
+			if !in.Ducks {
+				gain *= duckFrom + (duckTo-duckFrom)*float64(i+1)/float64(len(out))
+			}
+			acc[i] += float64(s) * gain
+		}
+		in.buf = in.buf[:copy(in.buf, in.buf[n:])]
+	}
+	for i, v := range acc {
+		out[i] = int16(max(min(v, math.MaxInt16), math.MinInt16))
+	}
+	m.acc = acc
+}
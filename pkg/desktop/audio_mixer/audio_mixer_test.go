@@ -0,0 +1,172 @@
+package audio_mixer
+
+import (
+	"context"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// toneSource sends packets of a constant L16 sample
+type toneSource struct {
+	name   string
+	rate   uint32
+	sample int16
+}
+
+func (s *toneSource) GetName() string {
+	return s.name
+}
+
+func (s *toneSource) GetAudioCodecParameters() webrtc.RTPCodecParameters {
+	return webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: MimeTypeL16, ClockRate: s.rate}}
+}
+
+func (s *toneSource) StreamAudio(ctx context.Context, pktChan chan<- *rtp.Packet) error {
+	payload := make([]byte, 0, s.rate/50*2)
+	for i := 0; i < cap(payload)/2; i++ {
+		payload = binary.BigEndian.AppendUint16(payload, uint16(s.sample))
+	}
+	ticker := time.NewTicker(FrameDuration)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			pktChan <- &rtp.Packet{Payload: append([]byte{}, payload...)}
+		}
+	}
+}
+
+// l16 returns the samples as an L16 payload
+func l16(samples ...int16) []byte {
+	payload := []byte{}
+	for _, s := range samples {
+		payload = binary.BigEndian.AppendUint16(payload, uint16(s))
+	}
+	return payload
+}
+
+func TestResampler(t *testing.T) {
+	r := newResampler(16000, 8000)
+	out := r.resample([]int16{0, 10, 20, 30, 40}, nil)
+	out = r.resample([]int16{50, 60, 70}, out)
+	want := []int16{0, 20, 40, 60}
+	if len(out) != len(want) {
+		t.Fatalf("got %v, want %v", out, want)
+	}
+	for i := range want {
+		if out[i] != want[i] {
+			t.Fatalf("got %v, want %v", out, want)
+		}
+	}
+
+	// Upsampling interpolates across the pieces
+	r = newResampler(8000, 16000)
+	out = r.resample([]int16{0, 100}, nil)
+	out = r.resample([]int16{200}, out)
+	want = []int16{0, 50, 100, 150}
+	for i := range want {
+		if out[i] != want[i] {
+			t.Fatalf("got %v, want %v", out, want)
+		}
+	}
+}
+
+// frameOf returns a frame of the mixer's output rate, with every sample set to sample
+func frameOf(sample int16, frames int) []byte {
+	samples := make([]int16, frameSamples*frames)
+	for i := range samples {
+		samples[i] = sample
+	}
+	return l16(samples...)
+}
+
+func TestAudioMixer_Mix(t *testing.T) {
+	game := &toneSource{name: "game", rate: SampleRate}
+	voice := &toneSource{name: "voice", rate: SampleRate}
+	config := DefaultConfig
+	config.DuckGain = 0.5
+	// Released as soon as the voice has been quiet for a frame
+	config.DuckRelease = FrameDuration
+	m, err := NewAudioMixer(config, Input{Source: game, Gain: 2}, Input{Source: voice, Gain: 1, Ducks: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame := make([]int16, frameSamples)
+
+	// Just the game, at twice its volume, and not ducked before anything played
+	m.write(m.inputs[0], frameOf(1000, 3))
+	m.mix(frame)
+	if frame[0] != 2000 || frame[frameSamples-1] != 2000 {
+		t.Errorf("Expected the game at 2000, got %v", frame[0])
+	}
+
+	// The voice ducks the game, fading over the frame
+	m.write(m.inputs[1], frameOf(1000, 1))
+	m.mix(frame)
+	if frame[0] < 2900 {
+		t.Errorf("Expected the ducking to start near 3000, got %v", frame[0])
+	}
+	if frame[frameSamples-1] != 2000 {
+		t.Errorf("Expected the game to be ducked by the end of the frame, got %v", frame[frameSamples-1])
+	}
+
+	// The ducking is released once the voice stops
+	if err := m.SetGain("game", 1); err != nil {
+		t.Fatal(err)
+	}
+	m.mix(frame)
+	if frame[frameSamples-1] != 1000 {
+		t.Errorf("Expected only the game once the voice stopped, got %v", frame[frameSamples-1])
+	}
+
+	// Inputs without audio are silent
+	m.mix(frame)
+	if frame[0] != 0 {
+		t.Errorf("Expected silence, got %v", frame[0])
+	}
+
+	if err := m.SetGain("chat", 1); err != ErrUnknownInput {
+		t.Errorf("Expected ErrUnknownInput, got %v", err)
+	}
+}
+
+func TestAudioMixer_StreamAudio(t *testing.T) {
+	m, err := NewAudioMixer(Config{}, Input{Source: &toneSource{name: "game", rate: 48000, sample: 4000}, Gain: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pkts := make(chan *rtp.Packet, 16)
+	go m.StreamAudio(ctx, pkts)
+
+	var last *rtp.Packet
+	for i := 0; i < 5; i++ {
+		p := <-pkts
+		if len(p.Payload) != frameSamples {
+			t.Fatalf("Expected %v samples, got %v", frameSamples, len(p.Payload))
+		}
+		if last != nil && p.SequenceNumber != last.SequenceNumber+1 {
+			t.Errorf("Expected sequence number %v, got %v", last.SequenceNumber+1, p.SequenceNumber)
+		}
+		last = p
+	}
+
+	if _, err := NewAudioMixer(Config{}, Input{Source: &opusSource{}}); err == nil {
+		t.Error("Expected an error mixing Opus")
+	}
+}
+
+type opusSource struct {
+	toneSource
+}
+
+func (s *opusSource) GetAudioCodecParameters() webrtc.RTPCodecParameters {
+	return webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000}}
+}
@@ -0,0 +1,106 @@
+package audio_mixer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/zaf/g711"
+)
+
+// MimeTypeL16 is uncompressed 16 bit big endian PCM, from RFC 3551
+const MimeTypeL16 = "audio/L16"
+
+// decoder turns the payload of a packet into mono samples, appending them to samples
+type decoder func(payload []byte, samples []int16) []int16
+
+// newDecoder returns a decoder for the codec, or an error if it isn't PCM
+func newDecoder(codec webrtc.RTPCodecParameters) (decoder, error) {
+	channels := max(int(codec.Channels), 1)
+	switch {
+	case strings.EqualFold(codec.MimeType, webrtc.MimeTypePCMU):
+		return downmix(channels, 1, func(b []byte) int16 { return g711.DecodeUlawFrame(b[0]) }), nil
+	case strings.EqualFold(codec.MimeType, webrtc.MimeTypePCMA):
+		return downmix(channels, 1, func(b []byte) int16 { return g711.DecodeAlawFrame(b[0]) }), nil
+	case strings.EqualFold(codec.MimeType, MimeTypeL16):
+		return downmix(channels, 2, func(b []byte) int16 { return int16(binary.BigEndian.Uint16(b)) }), nil
+	}
+	return nil, fmt.Errorf("can't mix %v, only PCMU, PCMA and L16", codec.MimeType)
+}
+
+// downmix returns a decoder for interleaved samples of size bytes, which averages the channels
+func downmix(channels int, size int, decode func([]byte) int16) decoder {
+	frameSize := channels * size
+	return func(payload []byte, samples []int16) []int16 {
+		for ; len(payload) >= frameSize; payload = payload[frameSize:] {
+			sum := 0
+			for c := 0; c < channels; c++ {
+				sum += int(decode(payload[c*size:]))
+			}
+			samples = append(samples, int16(sum/channels))
+		}
+		return samples
+	}
+}
+
+// encodeUlaw appends the samples to payload as PCMU
+func encodeUlaw(samples []int16, payload []byte) []byte {
+	for _, s := range samples {
+		payload = append(payload, g711.EncodeUlawFrame(s))
+	}
+	return payload
+}
+
+// resampler converts a stream of samples to another rate, interpolating between
+// them. It keeps its place between calls, so a stream can be resampled in pieces.
+type resampler struct {
+	// step is how far through the input each output sample moves
+	step float64
+	// pos is where the next output sample is, relative to the start of the next input.
+	// It's below 0 while the next output sample is between last and the next input.
+	pos  float64
+	last int16
+}
+
+func newResampler(from uint32, to uint32) *resampler {
+	return &resampler{step: float64(from) / float64(to)}
+}
+
+// resample appends in, at the new rate, to out
+func (r *resampler) resample(in []int16, out []int16) []int16 {
+	if len(in) == 0 {
+		return out
+	}
+	if r.step == 1 {
+		return append(out, in...)
+	}
+
+	for ; r.pos < float64(len(in)-1); r.pos += r.step {
+		i := int(math.Floor(r.pos))
+		a := r.last
+		if i >= 0 {
+			a = in[i]
+		}
+		b := in[i+1]
+		frac := r.pos - float64(i)
+		out = append(out, int16(float64(a)+(float64(b)-float64(a))*frac))
+	}
+	r.pos -= float64(len(in))
+	r.last = in[len(in)-1]
+	return out
+}
+
+// level returns the RMS level of the samples, from 0 to 1
+func level(samples []int16) float64 {
+	if len(samples) == 0 {
+		return 0
+	}
+	sum := 0.0
+	for _, s := range samples {
+		v := float64(s) / math.MaxInt16
+		sum += v * v
+	}
+	return math.Sqrt(sum / float64(len(samples)))
+}
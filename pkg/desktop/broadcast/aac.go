@@ -0,0 +1,200 @@
+package broadcast
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media/oggwriter"
+	"github.com/pod-arcade/pod-arcade/pkg/util"
+	"github.com/rs/zerolog"
+)
+
+// aacSampleRate is the sample rate the audio is encoded at, whatever it was before
+const aacSampleRate = 48000
+
+// aacFrameSamples is how many samples there are in each AAC frame
+const aacFrameSamples = 1024
+
+// adtsSampleRates are the sample rates of ADTS's sampling frequency indexes
+var adtsSampleRates = [...]int{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+// aacFrame is an encoded frame, without its ADTS header
+type aacFrame struct {
+	// config is the AudioSpecificConfig of the stream the frame is from
+	config []byte
+	data   []byte
+}
+
+// parseADTSHeader returns the size of an ADTS frame and of its header, and the AudioSpecificConfig it describes
+func parseADTSHeader(h []byte) (frameSize int, headerSize int, config []byte, err error) {
+	if len(h) < 7 || h[0] != 0xff || h[1]&0xf0 != 0xf0 {
+		return 0, 0, nil, errors.New("not an adts header")
+	}
+	headerSize = 7
+	if h[1]&0x01 == 0 {
+		// There's a CRC after the header
+		headerSize = 9
+	}
+	objectType := h[2]>>6 + 1
+	frequencyIndex := h[2] >> 2 & 0x0f
+	channels := (h[2]&0x01)<<2 | h[3]>>6
+	if int(frequencyIndex) >= len(adtsSampleRates) {
+		return 0, 0, nil, fmt.Errorf("invalid adts sampling frequency index %v", frequencyIndex)
+	}
+	frameSize = int(h[3]&0x03)<<11 | int(h[4])<<3 | int(h[5])>>5
+	if frameSize < headerSize {
+		return 0, 0, nil, fmt.Errorf("adts frame of %v bytes is smaller than its header", frameSize)
+	}
+	config = []byte{objectType<<3 | frequencyIndex>>1, frequencyIndex<<7 | channels<<3}
+	return frameSize, headerSize, config, nil
+}
+
+// canEncodeAAC returns whether the encoder can read audio of a codec
+func canEncodeAAC(codec webrtc.RTPCodecCapability) bool {
+	switch strings.ToLower(codec.MimeType) {
+	case strings.ToLower(webrtc.MimeTypeOpus), strings.ToLower(webrtc.MimeTypePCMU), strings.ToLower(webrtc.MimeTypePCMA):
+		return true
+	}
+	return false
+}
+
+// aacEncoder transcodes a track's RTP packets to AAC with ffmpeg
+type aacEncoder struct {
+	in     *os.File
+	ogg    *oggwriter.OggWriter
+	frames chan aacFrame
+	done   chan struct{}
+	l      zerolog.Logger
+}
+
+// startAACEncoder starts encoding audio of the codec, at bitrate bits per second
+func startAACEncoder(ctx context.Context, codec webrtc.RTPCodecCapability, bitrate int, l zerolog.Logger) (*aacEncoder, error) {
+	channels := max(int(codec.Channels), 1)
+	var input []string
+	switch strings.ToLower(codec.MimeType) {
+	case strings.ToLower(webrtc.MimeTypeOpus):
+		input = []string{"-f", "ogg"}
+	case strings.ToLower(webrtc.MimeTypePCMU):
+		input = []string{"-f", "mulaw", "-ar", fmt.Sprint(codec.ClockRate), "-ac", fmt.Sprint(channels)}
+	case strings.ToLower(webrtc.MimeTypePCMA):
+		input = []string{"-f", "alaw", "-ar", fmt.Sprint(codec.ClockRate), "-ac", fmt.Sprint(channels)}
+	default:
+		return nil, fmt.Errorf("can't encode %v to aac", codec.MimeType)
+	}
+
+	inR, inW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	outR, outW, err := os.Pipe()
+	if err != nil {
+		inR.Close()
+		inW.Close()
+		return nil, err
+	}
+
+	args := []string{"-hide_banner", "-loglevel", "warning", "-fflags", "nobuffer", "-probesize", "32", "-analyzeduration", "0"}
+	args = append(args, input...)
+	args = append(args,
+		"-i", "pipe:0",
+		"-c:a", "aac", "-b:a", fmt.Sprint(bitrate), "-ar", fmt.Sprint(aacSampleRate),
+		"-flush_packets", "1",
+		"-f", "adts", "pipe:1",
+	)
+	runner := &util.ProgramRunner{
+		Program: "ffmpeg",
+		Args:    args,
+		Stdin:   inR,
+		Stdout:  outW,
+		// Linux-specific: set Pdeathsig to ensure child termination
+		SysProcAttr: syscall.SysProcAttr{
+			Pdeathsig: syscall.SIGKILL,
+		},
+	}
+
+	e := &aacEncoder{in: inW, frames: make(chan aacFrame, 50), done: make(chan struct{}), l: l}
+	if strings.EqualFold(codec.MimeType, webrtc.MimeTypeOpus) {
+		if e.ogg, err = oggwriter.NewWith(inW, 48000, uint16(channels)); err != nil {
+			inR.Close()
+			inW.Close()
+			outR.Close()
+			outW.Close()
+			return nil, err
+		}
+	}
+
+	go func() {
+		defer outW.Close()
+		defer inR.Close()
+		if err := runner.RunOnce("broadcast-aac", ctx); err != nil && ctx.Err() == nil {
+			l.Warn().Err(err).Msg("AAC encoder exited")
+		}
+	}()
+	go func() {
+		defer close(e.done)
+		defer close(e.frames)
+		defer outR.Close()
+		if err := e.readFrames(ctx, outR); err != nil && ctx.Err() == nil {
+			l.Warn().Err(err).Msg("Failed to read AAC")
+		}
+	}()
+	return e, nil
+}
+
+// readFrames splits the encoder's ADTS stream into frames
+func (e *aacEncoder) readFrames(ctx context.Context, out io.Reader) error {
+	r := bufio.NewReader(out)
+	header := make([]byte, 9)
+	for {
+		if _, err := io.ReadFull(r, header[:7]); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		frameSize, headerSize, config, err := parseADTSHeader(header)
+		if err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(r, header[7:headerSize]); err != nil {
+			return err
+		}
+		data := make([]byte, frameSize-headerSize)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return err
+		}
+		select {
+		case e.frames <- aacFrame{config: config, data: data}:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// WriteRTP passes the audio in a packet on to the encoder
+func (e *aacEncoder) WriteRTP(p *rtp.Packet) error {
+	if e.ogg != nil {
+		return e.ogg.WriteRTP(p)
+	}
+	_, err := e.in.Write(p.Payload)
+	return err
+}
+
+// Frames returns the encoded frames, and is closed once the encoder stops
+func (e *aacEncoder) Frames() <-chan aacFrame {
+	return e.frames
+}
+
+// Close stops the encoder. The context it was started with has to be done too.
+func (e *aacEncoder) Close() {
+	e.in.Close()
+	<-e.done
+}
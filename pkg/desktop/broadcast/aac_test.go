@@ -0,0 +1,31 @@
+package broadcast
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParseADTSHeader(t *testing.T) {
+	// AAC LC, 48kHz, stereo, 371 bytes, without a CRC
+	header := []byte{0xff, 0xf1, 0x4c, 0x80, 0x2e, 0x7f, 0xfc}
+	frameSize, headerSize, config, err := parseADTSHeader(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frameSize != 371 || headerSize != 7 {
+		t.Errorf("got a frame of %v bytes with a header of %v, want 371 and 7", frameSize, headerSize)
+	}
+	if want := []byte{0x11, 0x90}; !bytes.Equal(config, want) {
+		t.Errorf("got config %x, want %x", config, want)
+	}
+
+	// With a CRC
+	header[1] = 0xf0
+	if _, headerSize, _, _ = parseADTSHeader(header); headerSize != 9 {
+		t.Errorf("got a header of %v bytes with a CRC, want 9", headerSize)
+	}
+
+	if _, _, _, err := parseADTSHeader([]byte{0x00, 0x01, 0x4c, 0x80, 0x2e, 0x7f, 0xfc}); err == nil {
+		t.Error("expected an error without a sync word")
+	}
+}
@@ -0,0 +1,247 @@
+// Package broadcast streams what the desktop streams to an RTMP server, like a
+// tournament's nginx-rtmp relay, without capturing the screen again. The mixer's
+// H.264 is remuxed into FLV as it is, and its audio is transcoded to AAC.
+package broadcast
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/pod-arcade/pod-arcade/api"
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/rtmp"
+	"github.com/pod-arcade/pod-arcade/pkg/log"
+	"github.com/pod-arcade/pod-arcade/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+)
+
+// DefaultMaxBackoff is the longest wait between reconnects, unless configured otherwise
+const DefaultMaxBackoff = 30 * time.Second
+
+// DefaultAudioBitrate is the bitrate of the AAC audio, unless configured otherwise
+const DefaultAudioBitrate = 128000
+
+var (
+	ErrAlreadyStreaming = errors.New("already streaming")
+	ErrNotStreaming     = errors.New("not streaming")
+	ErrNoURL            = errors.New("no rtmp url to stream to")
+	ErrURLNotAllowed    = errors.New("rtmp url is not allowed")
+	ErrUnknownCommand   = errors.New("unknown command")
+)
+
+var broadcastActive = metrics.GlobalMetricCache.GetGauge("broadcast_active", prometheus.Labels{})
+var broadcastConnected = metrics.GlobalMetricCache.GetGauge("broadcast_connected", prometheus.Labels{})
+var broadcastReconnects = metrics.GlobalMetricCache.GetCounter("broadcast_reconnects", prometheus.Labels{})
+
+type Config struct {
+	// URL is where the desktop is streamed, unless start is given another
+	URL string
+	// AllowedHosts are the hosts, besides URL's, that start may be given URLs on. Anyone
+	// who can publish to the desktop's MQTT topics can start a stream, so they can't be
+	// allowed to send the screen anywhere they like.
+	AllowedHosts []string
+	// AudioBitrate is the bitrate of the AAC audio, in bits per second
+	AudioBitrate int
+	// MaxBackoff is the longest wait between reconnects. It starts at a second, and doubles every time.
+	MaxBackoff time.Duration
+}
+
+// Status describes the stream
+type Status struct {
+	Streaming bool `json:"streaming"`
+	Connected bool `json:"connected"`
+	// URL is where it's streamed to, without the stream key
+	URL        string    `json:"url,omitempty"`
+	Reconnects int       `json:"reconnects"`
+	LastError  string    `json:"lastError,omitempty"`
+	Since      time.Time `json:"since"`
+}
+
+// startCommand is the optional payload of the start command
+type startCommand struct {
+	// URL replaces the configured URL for this stream
+	URL string `json:"url"`
+}
+
+var _ api.Controller = (*Broadcaster)(nil)
+
+// Broadcaster streams the mixer's H.264 video, with its audio, to one RTMP URL at a time
+type Broadcaster struct {
+	mixer  api.Mixer
+	config Config
+
+	active *stream
+	mtx    sync.Mutex
+	l      zerolog.Logger
+}
+
+func NewBroadcaster(mixer api.Mixer, config Config) *Broadcaster {
+	if config.AudioBitrate <= 0 {
+		config.AudioBitrate = DefaultAudioBitrate
+	}
+	if config.MaxBackoff <= 0 {
+		config.MaxBackoff = DefaultMaxBackoff
+	}
+	return &Broadcaster{
+		mixer:  mixer,
+		config: config,
+		l:      log.NewLogger("Broadcast", nil),
+	}
+}
+
+func (b *Broadcaster) GetName() string {
+	return "broadcast"
+}
+
+// HandleCommand handles the start, stop and status commands
+func (b *Broadcaster) HandleCommand(command string, payload []byte) (any, error) {
+	switch command {
+	case "start":
+		cmd := startCommand{}
+		if len(payload) > 0 {
+			if err := json.Unmarshal(payload, &cmd); err != nil {
+				return nil, err
+			}
+		}
+		return b.Start(cmd.URL)
+	case "stop":
+		return b.Stop()
+	case "status":
+		return b.Status(), nil
+	default:
+		return nil, fmt.Errorf("%w %q", ErrUnknownCommand, command)
+	}
+}
+
+// Start starts streaming to url, or to the configured URL if it's empty. It keeps
+// reconnecting until it's stopped.
+func (b *Broadcaster) Start(url string) (Status, error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	if b.active != nil {
+		return Status{}, ErrAlreadyStreaming
+	}
+	if url == "" {
+		url = b.config.URL
+	}
+	if url == "" {
+		return Status{}, ErrNoURL
+	}
+	address, tcURL, _, _, err := rtmp.ParseURL(url)
+	if err != nil {
+		return Status{}, err
+	}
+	if !b.allowed(address) {
+		return Status{}, fmt.Errorf("%w: %v", ErrURLNotAllowed, tcURL)
+	}
+
+	// The sources keep running for as long as we're streaming, even without sessions
+	video, err := b.mixer.StartVideoTrack("", webrtc.MimeTypeH264)
+	if err != nil {
+		return Status{}, err
+	}
+	var audio api.Track
+	for _, t := range b.mixer.GetAudioTracks() {
+		if canEncodeAAC(t.Codec()) {
+			audio = t
+			b.mixer.AcquireTrack(audio)
+			break
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &stream{
+		url:          url,
+		video:        video,
+		audio:        audio,
+		videoPkts:    video.Subscribe(api.VideoSubscriptionSize),
+		audioBitrate: b.config.AudioBitrate,
+		maxBackoff:   b.config.MaxBackoff,
+		status:       Status{Streaming: true, URL: tcURL, Since: time.Now()},
+		cancel:       cancel,
+		done:         make(chan struct{}),
+		l:            b.l.With().Str("url", tcURL).Logger(),
+	}
+	if audio != nil {
+		s.audioPkts = audio.Subscribe(api.AudioSubscriptionSize)
+	}
+	b.active = s
+	broadcastActive.Set(1)
+
+	go func() {
+		s.run(ctx)
+		b.finished(s)
+	}()
+
+	b.l.Info().Msgf("Started streaming to %v", tcURL)
+	return s.getStatus(), nil
+}
+
+// allowed returns whether an address is on the configured URL's host, or one of the allowed hosts
+func (b *Broadcaster) allowed(address string) bool {
+	host, _, _ := net.SplitHostPort(address)
+	hosts := b.config.AllowedHosts
+	if b.config.URL != "" {
+		if configured, _, _, _, err := rtmp.ParseURL(b.config.URL); err == nil {
+			configuredHost, _, _ := net.SplitHostPort(configured)
+			hosts = append(slices.Clip(hosts), configuredHost)
+		}
+	}
+	return slices.ContainsFunc(hosts, func(h string) bool { return strings.EqualFold(h, host) })
+}
+
+// Stop stops streaming
+func (b *Broadcaster) Stop() (Status, error) {
+	b.mtx.Lock()
+	s := b.active
+	b.active = nil
+	b.mtx.Unlock()
+
+	if s == nil {
+		return Status{}, ErrNotStreaming
+	}
+	s.stop()
+	status := s.getStatus()
+	b.l.Info().Msgf("Stopped streaming to %v", status.URL)
+
+	status.Streaming = false
+	status.Connected = false
+	return status, nil
+}
+
+// Status returns the status of the current stream
+func (b *Broadcaster) Status() Status {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if b.active == nil {
+		return Status{}
+	}
+	return b.active.getStatus()
+}
+
+// finished is called when a stream stops, whether it was asked to or not
+func (b *Broadcaster) finished(s *stream) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	if b.active == s {
+		b.active = nil
+	}
+	if b.active == nil {
+		broadcastActive.Set(0)
+		broadcastConnected.Set(0)
+	}
+	b.mixer.ReleaseTrack(s.video)
+	if s.audio != nil {
+		b.mixer.ReleaseTrack(s.audio)
+	}
+}
@@ -0,0 +1,21 @@
+package broadcast
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestBroadcaster_OnlyStreamsToAllowedHosts(t *testing.T) {
+	b := NewBroadcaster(nil, Config{URL: "rtmp://relay:1935/live/table-1", AllowedHosts: []string{"backup.example"}})
+
+	for _, url := range []string{"rtmp://attacker.example/live/key", "rtmp://relay.attacker.example/live/key"} {
+		if _, err := b.Start(url); !errors.Is(err, ErrURLNotAllowed) {
+			t.Errorf("Expected %v to be rejected, got %v", url, err)
+		}
+	}
+	for _, address := range []string{"relay:1935", "RELAY:1936", "backup.example:1935"} {
+		if !b.allowed(address) {
+			t.Errorf("Expected %v to be allowed", address)
+		}
+	}
+}
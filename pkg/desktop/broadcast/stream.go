@@ -0,0 +1,308 @@
+package broadcast
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pod-arcade/pod-arcade/api"
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/depacketizer"
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/flv"
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/media_clock"
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/packet_pool"
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/rtmp"
+	"github.com/rs/zerolog"
+)
+
+// minBackoff is the first wait before reconnecting
+const minBackoff = time.Second
+
+// maxAudioDrift is how far the encoder's sample count may drift from the audio's
+// timestamps, like after a gap in the audio, before its frames are placed again
+const maxAudioDrift = 200 * time.Millisecond
+
+// stream publishes the tracks to one URL, reconnecting until it's stopped
+type stream struct {
+	url          string
+	video        api.Track
+	audio        api.Track
+	videoPkts    api.TrackSubscription
+	audioPkts    api.TrackSubscription
+	audioBitrate int
+	maxBackoff   time.Duration
+
+	// What's been sent on the current connection
+	conn        *rtmp.Conn
+	h264        *depacketizer.H264
+	start       time.Time
+	sps         []byte
+	audioConfig []byte
+	buf         []byte
+
+	// The AAC encoder runs for the whole stream, so its timeline doesn't depend on the connection
+	encoder       *aacEncoder
+	audioTimeline *media_clock.Timeline
+	audioFrames   int64
+	lastAudio     time.Time
+
+	status Status
+	mtx    sync.Mutex
+	cancel context.CancelFunc
+	done   chan struct{}
+	l      zerolog.Logger
+}
+
+type dialResult struct {
+	conn *rtmp.Conn
+	err  error
+}
+
+// run streams until the stream is stopped, or the video track goes away
+func (s *stream) run(ctx context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer close(s.done)
+	defer s.closeSubscriptions()
+
+	var audioPkts <-chan *rtp.Packet
+	var aacFrames <-chan aacFrame
+	if s.audioPkts != nil {
+		encoder, err := startAACEncoder(ctx, s.audio.Codec(), s.audioBitrate, s.l)
+		if err != nil {
+			s.l.Warn().Err(err).Msg("Streaming without audio")
+		} else {
+			s.encoder = encoder
+			s.audioTimeline = media_clock.NewTimeline(media_clock.Default, aacSampleRate, maxAudioDrift)
+			audioPkts = s.audioPkts.Packets()
+			aacFrames = encoder.Frames()
+			defer encoder.Close()
+		}
+	}
+
+	dialed := make(chan dialResult, 1)
+	dialing := false
+	retry := time.NewTimer(0)
+	defer retry.Stop()
+	backoff := minBackoff
+	var connected time.Time
+	var connDone <-chan struct{}
+
+	// disconnect hangs up after an error, and waits a little longer each time before reconnecting
+	disconnect := func(err error) {
+		s.l.Warn().Err(err).Msgf("Disconnected, reconnecting in %v", backoff)
+		s.conn.Close()
+		s.conn = nil
+		connDone = nil
+		s.setDisconnected(err)
+		if time.Since(connected) > s.maxBackoff {
+			backoff = minBackoff
+		}
+		retry.Reset(backoff)
+		backoff = min(backoff*2, s.maxBackoff)
+	}
+	defer func() {
+		// Everything started with the context stops with it
+		cancel()
+		if s.conn != nil {
+			s.conn.Close()
+		}
+		if dialing {
+			if r := <-dialed; r.conn != nil {
+				r.conn.Close()
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-retry.C:
+			dialing = true
+			go func() {
+				conn, err := rtmp.Dial(ctx, s.url)
+				dialed <- dialResult{conn: conn, err: err}
+			}()
+		case r := <-dialed:
+			dialing = false
+			if r.err != nil {
+				s.l.Warn().Err(r.err).Msgf("Failed to connect, retrying in %v", backoff)
+				s.setDisconnected(r.err)
+				retry.Reset(backoff)
+				backoff = min(backoff*2, s.maxBackoff)
+				continue
+			}
+			s.l.Info().Msg("Connected")
+			connected = time.Now()
+			s.connect(r.conn)
+			connDone = r.conn.Done()
+		case <-connDone:
+			disconnect(s.conn.Err())
+		case p, ok := <-s.videoPkts.Packets():
+			if !ok {
+				s.l.Warn().Msg("Video track went away, stopping the stream")
+				return
+			}
+			var err error
+			if s.conn != nil {
+				err = s.writeVideo(p)
+			}
+			packet_pool.PutPacket(p)
+			if err != nil {
+				disconnect(err)
+			}
+		case p, ok := <-audioPkts:
+			if !ok {
+				audioPkts = nil
+				continue
+			}
+			// The encoder gets every packet, connected or not, so its sample count stays in step
+			s.lastAudio = media_clock.Default.Time(p.Timestamp, s.audio.Codec().ClockRate, time.Now())
+			err := s.encoder.WriteRTP(p)
+			packet_pool.PutPacket(p)
+			if err != nil {
+				s.l.Warn().Err(err).Msg("AAC encoder stopped, streaming without audio")
+				audioPkts = nil
+			}
+		case f, ok := <-aacFrames:
+			if !ok {
+				aacFrames = nil
+				audioPkts = nil
+				continue
+			}
+			if err := s.writeAudio(f); err != nil {
+				disconnect(err)
+			}
+		}
+	}
+}
+
+// connect starts sending on a new connection, from the next keyframe
+func (s *stream) connect(conn *rtmp.Conn) {
+	s.conn = conn
+	s.h264 = depacketizer.NewH264()
+	s.h264.KeyframeNeeded = s.video.RequestKeyframe
+	s.start = time.Time{}
+	s.sps = nil
+	s.audioConfig = nil
+	s.setConnected()
+	broadcastConnected.Set(1)
+	// Start as soon as possible, rather than at the encoder's next keyframe
+	s.video.RequestKeyframe()
+}
+
+// timestamp returns the RTMP timestamp of an instant, in milliseconds since the connection's first keyframe
+func (s *stream) timestamp(t time.Time) uint32 {
+	return uint32(t.Sub(s.start) / time.Millisecond)
+}
+
+func (s *stream) writeVideo(p *rtp.Packet) error {
+	au := s.h264.Push(p)
+	if au == nil {
+		return nil
+	}
+	t := media_clock.Default.Time(au.Timestamp, s.video.Codec().ClockRate, time.Now())
+	if s.start.IsZero() {
+		// The connection starts at the first keyframe, which the depacketizer waits for
+		s.start = t
+		width, height, err := depacketizer.SPSResolution(au.SPS)
+		if err != nil {
+			return err
+		}
+		metadata := rtmp.ECMAArray{
+			"width":        width,
+			"height":       height,
+			"videocodecid": flv.VideoCodecIDAVC,
+			"encoder":      "pod-arcade",
+		}
+		if s.encoder != nil {
+			metadata["audiocodecid"] = flv.AudioCodecIDAAC
+			metadata["audiosamplerate"] = aacSampleRate
+		}
+		if err := s.conn.WriteMetadata(metadata); err != nil {
+			return err
+		}
+	}
+
+	if !bytes.Equal(au.SPS, s.sps) {
+		// Sent at the start, and whenever the resolution or profile changes
+		s.sps = append(s.sps[:0], au.SPS...)
+		s.buf = flv.AppendAVCHeader(s.buf[:0], true, flv.PacketTypeSequenceHeader)
+		s.buf = append(s.buf, depacketizer.AVCDecoderConfig(au.SPS, au.PPS)...)
+		if err := s.conn.WriteVideo(s.timestamp(t), s.buf); err != nil {
+			return err
+		}
+	}
+
+	s.buf = flv.AppendAVCHeader(s.buf[:0], au.Keyframe, flv.PacketTypeData)
+	s.buf = au.AppendAVCC(s.buf)
+	return s.conn.WriteVideo(s.timestamp(t), s.buf)
+}
+
+func (s *stream) writeAudio(f aacFrame) error {
+	position := s.audioFrames * aacFrameSamples
+	s.audioFrames++
+	timestamp := s.audioTimeline.Timestamp(position, s.lastAudio)
+	t := media_clock.Default.Time(timestamp, aacSampleRate, time.Now())
+	if s.conn == nil || s.start.IsZero() || t.Before(s.start) {
+		// Audio waits for the first video keyframe
+		return nil
+	}
+
+	if !bytes.Equal(f.config, s.audioConfig) {
+		s.audioConfig = f.config
+		s.buf = flv.AppendAACHeader(s.buf[:0], flv.PacketTypeSequenceHeader)
+		s.buf = append(s.buf, f.config...)
+		if err := s.conn.WriteAudio(s.timestamp(t), s.buf); err != nil {
+			return err
+		}
+	}
+	s.buf = flv.AppendAACHeader(s.buf[:0], flv.PacketTypeData)
+	s.buf = append(s.buf, f.data...)
+	return s.conn.WriteAudio(s.timestamp(t), s.buf)
+}
+
+func (s *stream) setConnected() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.status.Connected = true
+	s.status.Since = time.Now()
+}
+
+func (s *stream) setDisconnected(err error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.status.Connected {
+		s.status.Reconnects++
+		broadcastReconnects.Inc()
+	}
+	s.status.Connected = false
+	s.status.Since = time.Now()
+	if err == nil {
+		err = errors.New("the server hung up")
+	}
+	s.status.LastError = err.Error()
+	broadcastConnected.Set(0)
+}
+
+func (s *stream) getStatus() Status {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.status
+}
+
+// closeSubscriptions stops the subscriptions
+func (s *stream) closeSubscriptions() {
+	for _, sub := range []api.TrackSubscription{s.videoPkts, s.audioPkts} {
+		if sub != nil {
+			sub.Close()
+		}
+	}
+}
+
+func (s *stream) stop() {
+	s.cancel()
+	<-s.done
+}
@@ -1,25 +1,57 @@
 package cmd_capture
 
 import (
-	"bytes"
 	"context"
+	"errors"
 	"io"
 	"os"
 	"path"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/pion/rtp"
-	"github.com/pion/rtp/codecs"
 	"github.com/pion/webrtc/v4"
-	"github.com/pion/webrtc/v4/pkg/media/h264reader"
 	"github.com/pod-arcade/pod-arcade/api"
 	"github.com/pod-arcade/pod-arcade/pkg/log"
 	"github.com/pod-arcade/pod-arcade/pkg/util"
 	"github.com/rs/zerolog"
 )
 
+// videoClockRate is the RTP clock rate used by every video codec
+const videoClockRate = 90000
+
+// timelineMaxDrift is how far a source's own timestamps may wander from the shared
+// clock before they are pulled back onto it.
+const timelineMaxDrift = 80 * time.Millisecond
+
+// videoOutput returns the output that a configurator captures, or the default output
+// if it doesn't say.
+func videoOutput(configurator any) api.VideoOutput {
+	if o, ok := configurator.(api.OutputSource); ok {
+		return o.GetVideoOutput()
+	}
+	return api.VideoOutput{ID: api.DefaultVideoOutputID}
+}
+
+// videoSettings returns the settings of a configurator that supports them
+func videoSettings(configurator any) api.VideoSettings {
+	if s, ok := configurator.(api.VideoSettingsSource); ok {
+		return s.GetVideoSettings()
+	}
+	return api.VideoSettings{}
+}
+
+// setVideoSettings changes the settings of a configurator, returning
+// errors.ErrUnsupported if it doesn't support them
+func setVideoSettings(configurator any, settings api.VideoSettings) error {
+	if s, ok := configurator.(api.VideoSettingsSource); ok {
+		return s.SetVideoSettings(settings)
+	}
+	return errors.ErrUnsupported
+}
+
 type CommandConfiguratorH264 interface {
 	GetName() string
 	GetProgramRunnerH264(path *os.File) (*util.ProgramRunner, error)
@@ -28,11 +60,19 @@ type CommandConfiguratorH264 interface {
 }
 
 var _ api.VideoSource = (*CommandCaptureH264)(nil)
+var _ api.OutputSource = (*CommandCaptureH264)(nil)
+var _ api.VideoSettingsSource = (*CommandCaptureH264)(nil)
 var _ api.AudioSource = (*CommandCaptureH264)(nil)
+var _ api.KeyframeRequester = (*CommandCaptureH264)(nil)
 
 type CommandCaptureH264 struct {
 	configurator CommandConfiguratorH264
 
+	keyframes *keyframeForcer
+	// restartRun stops the current run of the program, so that it starts again
+	restartRun context.CancelFunc
+	mtx        sync.Mutex
+
 	l  zerolog.Logger
 	wg sync.WaitGroup
 }
@@ -42,6 +82,7 @@ func NewCommandCaptureH264(c CommandConfiguratorH264) *CommandCaptureH264 {
 		configurator: c,
 		l:            log.NewLogger(c.GetName(), nil),
 	}
+	cap.keyframes = newKeyframeForcer(cap.restart)
 
 	return cap
 }
@@ -71,61 +112,40 @@ func (c *CommandCaptureH264) handleFifoCreate(ctx context.Context) (*os.File, er
 
 // asynchronously runs a handler that reads h264 NALs from the stream, and converts them into RTP packets, publishing it to a channel
 func (c *CommandCaptureH264) handleH264Stream(ctx context.Context, stream io.ReadCloser, pktChan chan<- *rtp.Packet) error {
-	reader, err := h264reader.NewReader(stream)
-	payloader := &codecs.H264Payloader{}
-	pktizer := rtp.NewPacketizer(
-		1200,
-		0, // handled when writing
-		0, // handled when writing
-		payloader,
-		rtp.NewRandomSequencer(),
-		c.GetVideoCodecParameters().ClockRate,
-	)
-
-	if err != nil {
-		c.l.Error().Err(err).Msg("Failed to create h264 reader")
-		return err
+	clockRate := c.GetVideoCodecParameters().ClockRate
+	if clockRate == 0 {
+		clockRate = videoClockRate
 	}
-	go func() {
-		var samples uint32 = 0
-		buffer := bytes.Buffer{}
+	reader := newAnnexBReader(stream)
+	pktizer := newAccessUnitPacketizer(1200, clockRate)
+	pktizer.latencySEI = true
+	pktizer.onKeyframe = c.keyframes.Keyframe
 
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
 		for {
-			startOfFrame := false
 			select {
 			case <-ctx.Done():
 				return
 			default:
 				nal, err := reader.NextNAL()
 				if err != nil {
-					c.l.Error().Err(err).Msg("Failed to read NAL")
-					return
-				}
-				if nal == nil {
-					c.l.Debug().Msg("NAL is nil, no more NALs available for reading")
+					if err == io.EOF {
+						c.l.Debug().Msg("No more NALs available for reading")
+					} else if ctx.Err() == nil {
+						c.l.Error().Err(err).Msg("Failed to read NAL")
+					}
 					return
 				}
-				if ((nal.Data[1] & 0x80) >> 7) == 1 {
-					// start of new batch of frames
-					startOfFrame = true
-				}
 
-				if startOfFrame && buffer.Len() > 0 {
-					// flush previous data
-					pkts := pktizer.Packetize(buffer.Bytes(), samples)
-					for _, p := range pkts {
-						select {
-						case pktChan <- p:
-						default:
-							c.l.Warn().Msgf("Dropping RTP Packet of size %v", len(p.Payload))
-						}
+				for _, p := range pktizer.Push(nal, time.Now()) {
+					select {
+					case pktChan <- p:
+					case <-ctx.Done():
+						return
 					}
-					buffer = bytes.Buffer{}
-					samples = 0
 				}
-				samples++
-				buffer.Write([]byte{0x00, 0x00, 0x00, 0x01})
-				buffer.Write(nal.Data)
 			}
 		}
 	}()
@@ -136,6 +156,10 @@ func (c *CommandCaptureH264) handleH264Stream(ctx context.Context, stream io.Rea
 func (c *CommandCaptureH264) Stream(ctx context.Context, pktChan chan<- *rtp.Packet) error {
 	c.l.Info().Msg("Starting Stream")
 
+	// The reader stops once the file is closed and the context is cancelled, and
+	// is waited for, so that it doesn't send anything after this returns
+	defer c.wg.Wait()
+
 	// Create new context so we can cancel the stream in the event of an error
 	fileCtx, stopFile := context.WithCancel(ctx)
 	defer stopFile()
@@ -154,23 +178,51 @@ func (c *CommandCaptureH264) Stream(ctx context.Context, pktChan chan<- *rtp.Pac
 	// This will run until context cancel
 	c.handleH264Stream(fileCtx, file, pktChan)
 
-	c.l.Debug().Msg("Getting Program Runner")
-	program, err := c.configurator.GetProgramRunnerH264(file)
-	c.l.Info().Msgf("Starting Program — %v", program.String())
-	if err != nil {
-		return err
+	for {
+		// The program runs again on the same FIFO when it's restarted for a keyframe
+		runCtx, restart := context.WithCancel(ctx)
+		c.mtx.Lock()
+		c.restartRun = restart
+		c.mtx.Unlock()
+
+		c.l.Debug().Msg("Getting Program Runner")
+		program, err := c.configurator.GetProgramRunnerH264(file)
+		if err != nil {
+			restart()
+			return err
+		}
+		c.l.Info().Msgf("Starting Program — %v", program.String())
+
+		// Run program until cancelled
+		c.l.Debug().Msg("Running")
+		err = program.Run(c.GetName(), runCtx)
+		restarted := runCtx.Err() != nil && ctx.Err() == nil
+		restart()
+		if restarted {
+			c.l.Info().Msg("Restarting for a keyframe")
+			continue
+		}
+		if err != nil {
+			c.l.Error().Err(err).Msg("Program exited with error")
+			return err
+		}
+		c.l.Error().Msg("Program exited without error")
+		return nil
 	}
+}
 
-	// Run program until cancelled
-	c.l.Debug().Msg("Running")
-	if err := program.Run(c.GetName(), ctx); err != nil {
-		c.l.Error().Err(err).Msg("Program exited with error")
-		return err
-	} else {
-		c.l.Error().Err(err).Msg("Program exited without error")
-	}
+// RequestKeyframe restarts the program if it doesn't make a keyframe soon, since
+// it starts with one
+func (c *CommandCaptureH264) RequestKeyframe() {
+	c.keyframes.Request()
+}
 
-	return nil
+func (c *CommandCaptureH264) restart() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.restartRun != nil {
+		c.restartRun()
+	}
 }
 
 func (c *CommandCaptureH264) StreamVideo(ctx context.Context, pktChan chan<- *rtp.Packet) error {
@@ -180,6 +232,18 @@ func (c *CommandCaptureH264) StreamAudio(ctx context.Context, pktChan chan<- *rt
 	return c.Stream(ctx, pktChan)
 }
 
+func (c *CommandCaptureH264) GetVideoOutput() api.VideoOutput {
+	return videoOutput(c.configurator)
+}
+
+func (c *CommandCaptureH264) GetVideoSettings() api.VideoSettings {
+	return videoSettings(c.configurator)
+}
+
+func (c *CommandCaptureH264) SetVideoSettings(settings api.VideoSettings) error {
+	return setVideoSettings(c.configurator, settings)
+}
+
 func (c *CommandCaptureH264) GetVideoCodecParameters() webrtc.RTPCodecParameters {
 	return *c.configurator.GetVideoCodecParameters()
 }
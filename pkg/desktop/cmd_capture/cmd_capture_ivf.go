@@ -0,0 +1,269 @@
+package cmd_capture
+
+import (
+	"context"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media/ivfreader"
+	"github.com/pod-arcade/pod-arcade/api"
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/media_clock"
+	"github.com/pod-arcade/pod-arcade/pkg/log"
+	"github.com/pod-arcade/pod-arcade/pkg/util"
+	"github.com/rs/zerolog"
+)
+
+// CommandConfiguratorIVF runs a program that writes VP8 or VP9 frames in an IVF container
+type CommandConfiguratorIVF interface {
+	GetName() string
+	GetProgramRunnerIVF(path *os.File) (*util.ProgramRunner, error)
+	GetVideoCodecParameters() *webrtc.RTPCodecParameters
+	GetAudioCodecParameters() *webrtc.RTPCodecParameters
+}
+
+var _ api.VideoSource = (*CommandCaptureIVF)(nil)
+var _ api.OutputSource = (*CommandCaptureIVF)(nil)
+var _ api.VideoSettingsSource = (*CommandCaptureIVF)(nil)
+var _ api.KeyframeRequester = (*CommandCaptureIVF)(nil)
+
+type CommandCaptureIVF struct {
+	configurator CommandConfiguratorIVF
+
+	keyframes *keyframeForcer
+	// restartRun stops the current run of the program, so that it starts again
+	restartRun context.CancelFunc
+	mtx        sync.Mutex
+
+	l  zerolog.Logger
+	wg sync.WaitGroup
+}
+
+func NewCommandCaptureIVF(c CommandConfiguratorIVF) *CommandCaptureIVF {
+	cap := &CommandCaptureIVF{
+		configurator: c,
+		l:            log.NewLogger(c.GetName(), nil),
+	}
+	cap.keyframes = newKeyframeForcer(cap.restart)
+
+	return cap
+}
+
+func (c *CommandCaptureIVF) GetName() string {
+	return c.configurator.GetName()
+}
+
+func (c *CommandCaptureIVF) handleFifoCreate(ctx context.Context) (*os.File, error) {
+	uuid := uuid.NewString()
+	path := path.Join(os.TempDir(), "pipe-"+uuid+"-"+c.GetName()+".ivf")
+	c.l.Debug().Msgf("Creating FIFO at %v", path)
+	err := syscall.Mkfifo(path, 0o777)
+	if err != nil {
+		c.l.Err(err).Msgf("Failed to create FIFO at %v", path)
+		return nil, err
+	}
+	c.l.Debug().Msgf("Opening FIFO at %v", path)
+	file, err := os.OpenFile(path, os.O_RDWR, os.ModeNamedPipe)
+	if err != nil {
+		c.l.Err(err).Msgf("Failed to open FIFO at %v", path)
+		return nil, err
+	}
+
+	return file, nil
+}
+
+func (c *CommandCaptureIVF) getPayloader() rtp.Payloader {
+	if strings.EqualFold(c.GetVideoCodecParameters().MimeType, webrtc.MimeTypeVP8) {
+		return &codecs.VP8Payloader{EnablePictureID: true}
+	}
+	return &codecs.VP9Payloader{}
+}
+
+// asynchronously runs a handler that reads IVF frames from the stream, and converts them into RTP packets, publishing it to a channel
+func (c *CommandCaptureIVF) handleIVFStream(ctx context.Context, stream io.ReadCloser, pktChan chan<- *rtp.Packet) error {
+	clockRate := c.GetVideoCodecParameters().ClockRate
+	if clockRate == 0 {
+		clockRate = videoClockRate
+	}
+	pktizer := rtp.NewPacketizer(
+		1200,
+		0, // handled when writing
+		0, // handled when writing
+		c.getPayloader(),
+		rtp.NewRandomSequencer(),
+		clockRate,
+	)
+
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		reader, header, err := ivfreader.NewWith(stream)
+		if err != nil {
+			c.l.Error().Err(err).Msg("Failed to create ivf reader")
+			return
+		}
+		c.l.Debug().Msgf("Reading %v frames at %vx%v", header.FourCC, header.Width, header.Height)
+
+		// The encoder's timestamps are kept, but moved onto the shared clock
+		timeline := media_clock.NewTimeline(media_clock.Default, clockRate, timelineMaxDrift)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			default:
+			}
+			frame, frameHeader, err := reader.ParseNextFrame()
+			if err != nil {
+				if ctx.Err() == nil {
+					c.l.Error().Err(err).Msg("Failed to parse next frame")
+				}
+				return
+			}
+
+			// IVF timestamps are in units of the file's timebase
+			position := frameHeader.Timestamp * uint64(clockRate) *
+				uint64(header.TimebaseNumerator) / uint64(header.TimebaseDenominator)
+			timestamp := timeline.Timestamp(int64(position), time.Now())
+
+			if vpxKeyframe(header.FourCC, frame) {
+				c.keyframes.Keyframe()
+			}
+			pkts := pktizer.Packetize(frame, 0)
+			for _, p := range pkts {
+				p.Timestamp = timestamp
+				select {
+				case pktChan <- p:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+func (c *CommandCaptureIVF) Stream(ctx context.Context, pktChan chan<- *rtp.Packet) error {
+	for {
+		runCtx, restart := context.WithCancel(ctx)
+		c.mtx.Lock()
+		c.restartRun = restart
+		c.mtx.Unlock()
+
+		err := c.run(runCtx, pktChan)
+		restarted := runCtx.Err() != nil && ctx.Err() == nil
+		restart()
+		if !restarted {
+			return err
+		}
+		c.l.Info().Msg("Restarting for a keyframe")
+	}
+}
+
+// RequestKeyframe restarts the program if it doesn't make a keyframe soon, since
+// it starts with one
+func (c *CommandCaptureIVF) RequestKeyframe() {
+	c.keyframes.Request()
+}
+
+func (c *CommandCaptureIVF) restart() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.restartRun != nil {
+		c.restartRun()
+	}
+}
+
+// run runs the program once, on a FIFO of its own, since each run writes a new IVF header
+func (c *CommandCaptureIVF) run(ctx context.Context, pktChan chan<- *rtp.Packet) error {
+	c.l.Info().Msg("Starting Stream")
+
+	// The reader stops once the file is closed and the context is cancelled, and
+	// is waited for, so that it doesn't send anything after this returns
+	defer c.wg.Wait()
+
+	// Create new context so we can cancel the stream in the event of an error
+	fileCtx, stopFile := context.WithCancel(ctx)
+	defer stopFile()
+
+	// Open the FIFO stream. This will shut down when the context closes
+	c.l.Debug().Msg("Creating FIFO")
+	file, err := c.handleFifoCreate(fileCtx)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	defer os.Remove(file.Name())
+
+	c.l.Debug().Msg("Starting Reader")
+	// spawn goroutine that reads IVF frames and pipes them to a channel
+	// This will run until context cancel
+	c.handleIVFStream(fileCtx, file, pktChan)
+
+	c.l.Debug().Msg("Getting Program Runner")
+	program, err := c.configurator.GetProgramRunnerIVF(file)
+	if err != nil {
+		return err
+	}
+	c.l.Info().Msgf("Starting Program — %v", program.String())
+
+	// Run program until cancelled
+	c.l.Debug().Msg("Running")
+	if err := program.Run(c.GetName(), ctx); err != nil {
+		c.l.Error().Err(err).Msg("Program exited with error")
+		return err
+	} else {
+		c.l.Error().Err(err).Msg("Program exited without error")
+	}
+
+	return nil
+}
+
+func (c *CommandCaptureIVF) StreamVideo(ctx context.Context, pktChan chan<- *rtp.Packet) error {
+	return c.Stream(ctx, pktChan)
+}
+
+func (c *CommandCaptureIVF) GetVideoOutput() api.VideoOutput {
+	return videoOutput(c.configurator)
+}
+
+func (c *CommandCaptureIVF) GetVideoSettings() api.VideoSettings {
+	return videoSettings(c.configurator)
+}
+
+func (c *CommandCaptureIVF) SetVideoSettings(settings api.VideoSettings) error {
+	return setVideoSettings(c.configurator, settings)
+}
+
+func (c *CommandCaptureIVF) GetVideoCodecParameters() webrtc.RTPCodecParameters {
+	return *c.configurator.GetVideoCodecParameters()
+}
+
+// vpxKeyframe returns whether a VP8 or VP9 frame is a keyframe, from the frame type
+// bit of its header
+func vpxKeyframe(fourCC string, frame []byte) bool {
+	if len(frame) == 0 {
+		return false
+	}
+	if fourCC == "VP80" {
+		return frame[0]&0x01 == 0
+	}
+	// frame_marker(2) profile_low_bit(1) profile_high_bit(1), with a reserved bit
+	// for profile 3, then show_existing_frame(1) and frame_type(1)
+	b := frame[0]
+	bit := 4
+	if b&0x30 == 0x30 {
+		bit++
+	}
+	if b&(0x80>>bit) != 0 {
+		return false
+	}
+	return b&(0x80>>(bit+1)) == 0
+}
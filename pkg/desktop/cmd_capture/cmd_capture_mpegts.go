@@ -0,0 +1,485 @@
+package cmd_capture
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"github.com/pod-arcade/pod-arcade/api"
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/media_clock"
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/mpegts"
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/packet_pool"
+	"github.com/pod-arcade/pod-arcade/pkg/log"
+	"github.com/pod-arcade/pod-arcade/pkg/util"
+	"github.com/rs/zerolog"
+)
+
+// CommandConfiguratorMPEGTS runs a program that muxes H.264 video and Opus audio
+// into MPEG-TS, and writes it to the file
+type CommandConfiguratorMPEGTS interface {
+	GetName() string
+	GetProgramRunnerMPEGTS(path *os.File) (*util.ProgramRunner, error)
+	GetVideoCodecParameters() *webrtc.RTPCodecParameters
+	GetAudioCodecParameters() *webrtc.RTPCodecParameters
+}
+
+var _ api.VideoSource = (*mpegtsVideoSource)(nil)
+var _ api.OutputSource = (*mpegtsVideoSource)(nil)
+var _ api.VideoSettingsSource = (*mpegtsVideoSource)(nil)
+var _ api.KeyframeRequester = (*mpegtsVideoSource)(nil)
+var _ api.AudioSource = (*mpegtsAudioSource)(nil)
+
+// CommandCaptureMPEGTS captures video and audio with a single program, so they start
+// together and their timestamps come from the same clock. Its video and audio are
+// separate sources, and the program runs while either of them is streaming.
+type CommandCaptureMPEGTS struct {
+	configurator CommandConfiguratorMPEGTS
+	video        *mpegtsVideoSource
+	audio        *mpegtsAudioSource
+
+	keyframes *keyframeForcer
+	outputs   map[webrtc.RTPCodecType]*mpegtsOutput
+	run       *mpegtsRun
+	// stale is set when the video settings changed, so the program restarts when
+	// the video starts again
+	stale bool
+	mtx   sync.Mutex
+
+	l zerolog.Logger
+}
+
+// mpegtsOutput is where the packets of one of the streams go
+type mpegtsOutput struct {
+	ctx  context.Context
+	pkts chan<- *rtp.Packet
+	// errc receives the error of the program if it exits on its own
+	errc chan error
+	// sending counts the packets being sent to pkts, which the stream waits for
+	sending sync.WaitGroup
+}
+
+// mpegtsRun is a single run of the program
+type mpegtsRun struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func NewCommandCaptureMPEGTS(c CommandConfiguratorMPEGTS) *CommandCaptureMPEGTS {
+	cap := &CommandCaptureMPEGTS{
+		configurator: c,
+		outputs:      map[webrtc.RTPCodecType]*mpegtsOutput{},
+		l:            log.NewLogger(c.GetName(), nil),
+	}
+	cap.video = &mpegtsVideoSource{cap}
+	cap.audio = &mpegtsAudioSource{cap}
+	cap.keyframes = newKeyframeForcer(cap.restart)
+
+	return cap
+}
+
+func (c *CommandCaptureMPEGTS) GetName() string {
+	return c.configurator.GetName()
+}
+
+// Video returns the source of the video
+func (c *CommandCaptureMPEGTS) Video() api.VideoSource {
+	return c.video
+}
+
+// Audio returns the source of the audio
+func (c *CommandCaptureMPEGTS) Audio() api.AudioSource {
+	return c.audio
+}
+
+// stream sends the packets of one of the streams to pktChan until the context is
+// done, starting the program if it isn't running yet
+func (c *CommandCaptureMPEGTS) stream(ctx context.Context, kind webrtc.RTPCodecType, pktChan chan<- *rtp.Packet) error {
+	out := &mpegtsOutput{ctx: ctx, pkts: pktChan, errc: make(chan error, 1)}
+	// Nothing is sent to pktChan once this returns
+	defer out.sending.Wait()
+	c.attach(kind, out)
+	defer c.detach(kind, out)
+
+	select {
+	case <-ctx.Done():
+		return nil
+	case err := <-out.errc:
+		return err
+	}
+}
+
+func (c *CommandCaptureMPEGTS) attach(kind webrtc.RTPCodecType, out *mpegtsOutput) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.outputs[kind] = out
+	if c.run != nil && c.stale && kind == webrtc.RTPCodecTypeVideo {
+		// The audio kept the old program running, but the video needs new settings
+		c.l.Info().Msg("Restarting with new video settings")
+		run := c.run
+		run.cancel()
+		c.run = nil
+		c.mtx.Unlock()
+		<-run.done
+		c.mtx.Lock()
+	}
+	if c.run == nil {
+		c.run = c.start()
+	}
+}
+
+func (c *CommandCaptureMPEGTS) detach(kind webrtc.RTPCodecType, out *mpegtsOutput) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.outputs[kind] == out {
+		delete(c.outputs, kind)
+	}
+	if len(c.outputs) == 0 && c.run != nil {
+		c.run.cancel()
+		c.run = nil
+	}
+}
+
+// restart starts the program again, for a keyframe. The audio restarts with it.
+func (c *CommandCaptureMPEGTS) restart() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.run == nil {
+		return
+	}
+	c.l.Info().Msg("Restarting for a keyframe")
+	run := c.run
+	run.cancel()
+	c.run = nil
+	c.mtx.Unlock()
+	<-run.done
+	c.mtx.Lock()
+	if c.run == nil && len(c.outputs) > 0 {
+		c.run = c.start()
+	}
+}
+
+// start runs the program until it's cancelled. c.mtx must be held.
+func (c *CommandCaptureMPEGTS) start() *mpegtsRun {
+	ctx, cancel := context.WithCancel(context.Background())
+	run := &mpegtsRun{cancel: cancel, done: make(chan struct{})}
+	c.stale = false
+
+	go func() {
+		defer close(run.done)
+		err := c.runProgram(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		// Both streams stop with it, and whichever starts again first starts a new run
+		c.mtx.Lock()
+		defer c.mtx.Unlock()
+		if c.run == run {
+			c.run = nil
+			for _, out := range c.outputs {
+				select {
+				case out.errc <- err:
+				default:
+				}
+			}
+		}
+		cancel()
+	}()
+	return run
+}
+
+func (c *CommandCaptureMPEGTS) handleFifoCreate() (*os.File, error) {
+	uuid := uuid.NewString()
+	path := path.Join(os.TempDir(), "pipe-"+uuid+"-"+c.GetName()+".ts")
+	c.l.Debug().Msgf("Creating FIFO at %v", path)
+	err := syscall.Mkfifo(path, 0o777)
+	if err != nil {
+		c.l.Err(err).Msgf("Failed to create FIFO at %v", path)
+		return nil, err
+	}
+	c.l.Debug().Msgf("Opening FIFO at %v", path)
+	file, err := os.OpenFile(path, os.O_RDWR, os.ModeNamedPipe)
+	if err != nil {
+		c.l.Err(err).Msgf("Failed to open FIFO at %v", path)
+		return nil, err
+	}
+
+	return file, nil
+}
+
+func (c *CommandCaptureMPEGTS) runProgram(ctx context.Context) error {
+	c.l.Info().Msg("Starting Stream")
+
+	// The demuxer stops once the file is closed and the context is cancelled
+	var demuxing sync.WaitGroup
+	defer demuxing.Wait()
+
+	fileCtx, stopFile := context.WithCancel(ctx)
+	defer stopFile()
+
+	file, err := c.handleFifoCreate()
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	defer os.Remove(file.Name())
+
+	demuxing.Add(1)
+	go func() {
+		defer demuxing.Done()
+		c.demux(fileCtx, file)
+	}()
+
+	program, err := c.configurator.GetProgramRunnerMPEGTS(file)
+	if err != nil {
+		return err
+	}
+	c.l.Info().Msgf("Starting Program — %v", program.String())
+
+	if err := program.Run(c.GetName(), ctx); err != nil {
+		c.l.Error().Err(err).Msg("Program exited with error")
+		return err
+	}
+	return nil
+}
+
+// demux reads the MPEG-TS stream, and sends the packets of each stream to its output
+func (c *CommandCaptureMPEGTS) demux(ctx context.Context, stream io.Reader) {
+	clock := newMPEGTSClock()
+	demuxer := mpegts.NewDemuxer(stream)
+	demuxer.OnPCR = func(pcr int64) {
+		clock.pcr(pcr, time.Now())
+	}
+
+	videoRate := c.GetVideoCodecParameters().ClockRate
+	if videoRate == 0 {
+		videoRate = videoClockRate
+	}
+	audioClockRate := c.GetAudioCodecParameters().ClockRate
+	pktizer := newAccessUnitPacketizer(1200, videoRate)
+	pktizer.latencySEI = true
+	pktizer.onKeyframe = c.keyframes.Keyframe
+	audioSequencer := rtp.NewRandomSequencer()
+	var nals, opus [][]byte
+
+	for ctx.Err() == nil {
+		pes, err := demuxer.ReadPES()
+		if err != nil {
+			if ctx.Err() == nil {
+				c.l.Error().Err(err).Msg("Failed to read MPEG-TS")
+			}
+			return
+		}
+		switch pes.Codec {
+		case mpegts.CodecH264:
+			timestamp, ok := clock.timestamp(pes.PTS, videoRate)
+			if !ok {
+				continue
+			}
+			now := time.Now()
+			nals = splitAnnexB(pes.Data, nals[:0])
+			for _, nal := range nals {
+				pktizer.Push(nal, now)
+			}
+			for _, p := range pktizer.flush() {
+				p.Timestamp = timestamp
+				if !c.send(ctx, webrtc.RTPCodecTypeVideo, p) {
+					return
+				}
+			}
+
+		case mpegts.CodecOpus:
+			timestamp, ok := clock.timestamp(pes.PTS, audioClockRate)
+			if !ok {
+				continue
+			}
+			opus, err = mpegts.SplitOpus(pes.Data, opus[:0])
+			if err != nil {
+				c.l.Warn().Err(err).Msg("Failed to split Opus packets")
+			}
+			// Each packet follows straight on from the one before it
+			for _, packet := range opus {
+				p := packet_pool.GetPacket()
+				p.Version = 2
+				p.SequenceNumber = audioSequencer.NextSequenceNumber()
+				p.Timestamp = timestamp
+				packet_pool.SetPayload(p, packet)
+				timestamp += uint32(opusPacketSamples(packet))
+				if !c.send(ctx, webrtc.RTPCodecTypeAudio, p) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// send sends a packet to the output of its stream, dropping it if nothing is
+// streaming it. It returns false once the run is cancelled.
+func (c *CommandCaptureMPEGTS) send(ctx context.Context, kind webrtc.RTPCodecType, p *rtp.Packet) bool {
+	c.mtx.Lock()
+	out := c.outputs[kind]
+	if out != nil {
+		out.sending.Add(1)
+		defer out.sending.Done()
+	}
+	c.mtx.Unlock()
+	if out == nil {
+		packet_pool.PutPacket(p)
+		return true
+	}
+
+	select {
+	case out.pkts <- p:
+		return true
+	case <-out.ctx.Done():
+		packet_pool.PutPacket(p)
+		return true
+	case <-ctx.Done():
+		packet_pool.PutPacket(p)
+		return false
+	}
+}
+
+func (c *CommandCaptureMPEGTS) GetVideoCodecParameters() webrtc.RTPCodecParameters {
+	return *c.configurator.GetVideoCodecParameters()
+}
+
+func (c *CommandCaptureMPEGTS) GetAudioCodecParameters() webrtc.RTPCodecParameters {
+	return *c.configurator.GetAudioCodecParameters()
+}
+
+// splitAnnexB appends the NALs of an Annex-B access unit to nals, without their start codes
+func splitAnnexB(data []byte, nals [][]byte) [][]byte {
+	for {
+		i := bytes.Index(data, annexBStartCode)
+		if i < 0 {
+			return nals
+		}
+		data = data[i+len(annexBStartCode):]
+		nal := data
+		end := bytes.Index(data, annexBStartCode)
+		if end >= 0 {
+			nal = data[:end]
+		}
+		// The zero of a four byte start code is left on the end of the NAL before it
+		if nal = bytes.TrimRight(nal, "\x00"); len(nal) > 0 {
+			nals = append(nals, nal)
+		}
+		if end < 0 {
+			return nals
+		}
+		data = data[end:]
+	}
+}
+
+// mpegtsClock places the PTS of an MPEG-TS stream onto the shared clock. Each PCR
+// anchors the stream's clock to the time it arrived, and every stream's PTS is
+// placed on that one timeline, which keeps them in sync. PTS run ahead of the PCR
+// by the muxer's delay, which is taken off again, so media is stamped with about
+// the time it was captured.
+type mpegtsClock struct {
+	timeline *media_clock.Timeline
+	// last is the last PCR, counting on from the 33 bit wraps
+	last    int64
+	started bool
+	// delay is how far the first PTS was ahead of the PCR
+	delay      int64
+	delayKnown bool
+}
+
+func newMPEGTSClock() *mpegtsClock {
+	return &mpegtsClock{
+		timeline: media_clock.NewTimeline(media_clock.Default, mpegts.ClockRate, timelineMaxDrift),
+	}
+}
+
+func (c *mpegtsClock) pcr(pcr int64, at time.Time) {
+	if c.started {
+		pcr = unwrapTimestamp(pcr, c.last)
+	}
+	c.last = pcr
+	c.started = true
+	c.timeline.Timestamp(pcr, at)
+}
+
+// timestamp returns the RTP timestamp of a PTS at clockRate, or false if it can't be
+// placed yet, because there hasn't been a PCR
+func (c *mpegtsClock) timestamp(pts int64, clockRate uint32) (uint32, bool) {
+	if !c.started || pts == mpegts.NoTimestamp {
+		return 0, false
+	}
+	pts = unwrapTimestamp(pts, c.last)
+	if !c.delayKnown {
+		c.delay = max(pts-c.last, 0)
+		c.delayKnown = true
+	}
+	return c.timeline.TimestampAt(pts-c.delay, clockRate), true
+}
+
+// timestampWrap is where 33 bit MPEG-TS timestamps wrap around
+const timestampWrap = 1 << 33
+
+// unwrapTimestamp returns the 33 bit timestamp ts as the value closest to near
+func unwrapTimestamp(ts int64, near int64) int64 {
+	ts += near &^ (timestampWrap - 1)
+	if ts-near > timestampWrap/2 {
+		ts -= timestampWrap
+	} else if near-ts > timestampWrap/2 {
+		ts += timestampWrap
+	}
+	return ts
+}
+
+// mpegtsVideoSource is the video of an MPEG-TS capture
+type mpegtsVideoSource struct {
+	*CommandCaptureMPEGTS
+}
+
+func (v *mpegtsVideoSource) StreamVideo(ctx context.Context, pktChan chan<- *rtp.Packet) error {
+	return v.stream(ctx, webrtc.RTPCodecTypeVideo, pktChan)
+}
+
+// RequestKeyframe restarts the program if it doesn't make a keyframe soon, since
+// it starts with one
+func (v *mpegtsVideoSource) RequestKeyframe() {
+	v.keyframes.Request()
+}
+
+func (v *mpegtsVideoSource) GetVideoOutput() api.VideoOutput {
+	return videoOutput(v.configurator)
+}
+
+func (v *mpegtsVideoSource) GetVideoSettings() api.VideoSettings {
+	return videoSettings(v.configurator)
+}
+
+func (v *mpegtsVideoSource) SetVideoSettings(settings api.VideoSettings) error {
+	if err := setVideoSettings(v.configurator, settings); err != nil {
+		return err
+	}
+	v.mtx.Lock()
+	v.stale = true
+	v.mtx.Unlock()
+	return nil
+}
+
+// mpegtsAudioSource is the audio of an MPEG-TS capture
+type mpegtsAudioSource struct {
+	*CommandCaptureMPEGTS
+}
+
+func (a *mpegtsAudioSource) GetName() string {
+	return a.CommandCaptureMPEGTS.GetName() + " Audio"
+}
+
+func (a *mpegtsAudioSource) StreamAudio(ctx context.Context, pktChan chan<- *rtp.Packet) error {
+	return a.stream(ctx, webrtc.RTPCodecTypeAudio, pktChan)
+}
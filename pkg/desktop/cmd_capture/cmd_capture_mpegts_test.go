@@ -0,0 +1,47 @@
+package cmd_capture
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/media_clock"
+)
+
+func TestSplitAnnexB(t *testing.T) {
+	data := []byte{0, 0, 0, 1, 0x09, 0xf0, 0, 0, 1, 0x67, 1, 2, 0, 0, 0, 1, 0x65, 3}
+	nals := splitAnnexB(data, nil)
+	want := [][]byte{{0x09, 0xf0}, {0x67, 1, 2}, {0x65, 3}}
+	if len(nals) != len(want) {
+		t.Fatalf("got %v NALs, want %v", len(nals), len(want))
+	}
+	for i := range want {
+		if !bytes.Equal(nals[i], want[i]) {
+			t.Errorf("NAL %v is %x, want %x", i, nals[i], want[i])
+		}
+	}
+}
+
+func TestMPEGTSClock(t *testing.T) {
+	clock := newMPEGTSClock()
+	if _, ok := clock.timestamp(0, videoClockRate); ok {
+		t.Fatal("timestamp before the first PCR")
+	}
+
+	// The PCR is about to wrap, and the muxer runs 100ms ahead of it
+	now := time.Now()
+	pcr := int64(timestampWrap - 4500)
+	clock.pcr(pcr, now)
+	video, _ := clock.timestamp(pcr+9000, videoClockRate)
+	// The timeline keeps whole ticks of the PCR clock, so timestamps may be a tick short
+	if want := media_clock.Default.RTPTimestamp(now, videoClockRate); want-video > 1 {
+		t.Errorf("video timestamp is %v, want %v", video, want)
+	}
+
+	// Audio 100ms later, after the wrap
+	clock.pcr(4500, now.Add(100*time.Millisecond))
+	audio, _ := clock.timestamp(4500+9000, 48000)
+	if want := media_clock.Default.RTPTimestamp(now.Add(100*time.Millisecond), 48000); want-audio > 1 {
+		t.Errorf("audio timestamp is %v, want %v", audio, want)
+	}
+}
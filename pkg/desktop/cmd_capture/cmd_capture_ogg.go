@@ -1,12 +1,14 @@
 package cmd_capture
 
 import (
+	"bytes"
 	"context"
 	"io"
 	"os"
 	"path"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/pion/rtp"
@@ -14,6 +16,7 @@ import (
 	"github.com/pion/webrtc/v4"
 	"github.com/pion/webrtc/v4/pkg/media/oggreader"
 	"github.com/pod-arcade/pod-arcade/api"
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/media_clock"
 	"github.com/pod-arcade/pod-arcade/pkg/log"
 	"github.com/pod-arcade/pod-arcade/pkg/util"
 	"github.com/rs/zerolog"
@@ -70,6 +73,7 @@ func (c *CommandCaptureOgg) handleFifoCreate(ctx context.Context) (*os.File, err
 
 // asynchronously runs a handler that reads Ogg frames from the stream, and converts them into RTP packets, publishing it to a channel
 func (c *CommandCaptureOgg) handleOggStream(ctx context.Context, stream io.ReadCloser, pktChan chan<- *rtp.Packet) error {
+	clockRate := c.GetAudioCodecParameters().ClockRate
 	payloader := &codecs.OpusPayloader{}
 	pktizer := rtp.NewPacketizer(
 		1200,
@@ -77,26 +81,39 @@ func (c *CommandCaptureOgg) handleOggStream(ctx context.Context, stream io.ReadC
 		0, // handled when writing
 		payloader,
 		rtp.NewRandomSequencer(),
-		c.GetAudioCodecParameters().ClockRate,
+		clockRate,
 	)
 
+	c.wg.Add(1)
 	go func() {
+		defer c.wg.Done()
 		reader, _, err := oggreader.NewWith(stream)
 		if err != nil {
 			c.l.Error().Err(err).Msg("Failed to create ogg reader")
 			return
 		}
+		// The granule position counts samples at the end of each page, so a page's
+		// first sample is at the previous page's granule position.
+		timeline := media_clock.NewTimeline(media_clock.Default, clockRate, timelineMaxDrift)
 		var lastGranule uint64
 		for {
 			pageData, pageHeader, err := reader.ParseNextPage()
 			if err != nil {
-				c.l.Error().Err(err).Msg("Failed to parse next page")
+				if ctx.Err() == nil {
+					c.l.Error().Err(err).Msg("Failed to parse next page")
+				}
 				return
 			}
-			sampleCount := float64(pageHeader.GranulePosition - lastGranule)
+			if bytes.HasPrefix(pageData, []byte("OpusTags")) {
+				// The comment header isn't audio
+				continue
+			}
+			sampleCount := pageHeader.GranulePosition - lastGranule
+			timestamp := timeline.Timestamp(int64(lastGranule), time.Now().Add(-samplesToDuration(sampleCount, clockRate)))
 			lastGranule = pageHeader.GranulePosition
-			pkts := pktizer.Packetize(pageData, uint32(sampleCount))
+			pkts := pktizer.Packetize(pageData, 0)
 			for _, p := range pkts {
+				p.Timestamp = timestamp
 				select {
 				case pktChan <- p:
 					// c.l.Debug().
@@ -104,8 +121,8 @@ func (c *CommandCaptureOgg) handleOggStream(ctx context.Context, stream io.ReadC
 					// 	Int("packets", len(pkts)).
 					// 	Uint64("granule", lastGranule).
 					// 	Msgf("Sent RTP Packets — %v", pageHeader)
-				default:
-					c.l.Warn().Msgf("Dropping RTP Packet of size %v", len(p.Payload))
+				case <-ctx.Done():
+					return
 				}
 			}
 		}
@@ -113,9 +130,18 @@ func (c *CommandCaptureOgg) handleOggStream(ctx context.Context, stream io.ReadC
 	return nil
 }
 
+// samplesToDuration returns how long count samples at clockRate last
+func samplesToDuration(count uint64, clockRate uint32) time.Duration {
+	return time.Duration(count) * time.Second / time.Duration(clockRate)
+}
+
 func (c *CommandCaptureOgg) Stream(ctx context.Context, pktChan chan<- *rtp.Packet) error {
 	c.l.Info().Msg("Starting Stream")
 
+	// The reader stops once the file is closed and the context is cancelled, and
+	// is waited for, so that it doesn't send anything after this returns
+	defer c.wg.Wait()
+
 	// Create new context so we can cancel the stream in the event of an error
 	fileCtx, stopFile := context.WithCancel(ctx)
 	defer stopFile()
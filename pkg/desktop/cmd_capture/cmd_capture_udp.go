@@ -4,10 +4,13 @@ import (
 	"context"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/pion/rtp"
 	"github.com/pion/webrtc/v4"
 	"github.com/pod-arcade/pod-arcade/api"
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/media_clock"
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/packet_pool"
 	"github.com/pod-arcade/pod-arcade/pkg/log"
 	"github.com/pod-arcade/pod-arcade/pkg/util"
 	"github.com/rs/zerolog"
@@ -21,6 +24,8 @@ type CommandConfiguratorRTP interface {
 }
 
 var _ api.VideoSource = (*CommandCaptureRTP)(nil)
+var _ api.OutputSource = (*CommandCaptureRTP)(nil)
+var _ api.VideoSettingsSource = (*CommandCaptureRTP)(nil)
 var _ api.AudioSource = (*CommandCaptureRTP)(nil)
 
 type CommandCaptureRTP struct {
@@ -67,10 +72,32 @@ func (c *CommandCaptureRTP) startUDPListener(ctx context.Context) (*net.UDPConn,
 	return conn, nil
 }
 
+// datagram is a UDP read, in a buffer from the packet pool
+type datagram struct {
+	buf *[]byte
+	n   int
+}
+
+// parsePacket unmarshals an RTP datagram into a pooled packet. The payload is copied, so the
+// datagram's buffer can be reused right away. Header extensions are dropped, since they
+// belong to the encoder and weren't negotiated with any session.
+func parsePacket(data []byte) (*rtp.Packet, error) {
+	pkt := packet_pool.GetPacket()
+	payload := pkt.Payload
+	if err := pkt.Unmarshal(data); err != nil {
+		packet_pool.PutPacket(pkt)
+		return nil, err
+	}
+	pkt.Payload = append(payload[:0], pkt.Payload...)
+	pkt.Extension = false
+	pkt.Extensions = nil
+	return pkt, nil
+}
+
 // asynchronously runs a handler that reads UDP packets, and converts them into RTP packets, publishing it to a channel
 func (c *CommandCaptureRTP) handleUDPPackets(ctx context.Context, udpConn *net.UDPConn, pktChan chan<- *rtp.Packet) {
 
-	readChan := make(chan []byte, 1000) // Buffered channel to store incoming data before we can process it
+	readChan := make(chan datagram, 1000) // Buffered channel to store incoming data before we can process it
 
 	// for i := 0; i < 4; i++ {
 	// Goroutine for reading UDP packets
@@ -80,22 +107,25 @@ func (c *CommandCaptureRTP) handleUDPPackets(ctx context.Context, udpConn *net.U
 		c.l.Info().Msg("Starting UDP Reader")
 
 		for {
-			data := make([]byte, 24000)
-			n, _, err := udpConn.ReadFrom(data)
+			buf := packet_pool.GetBuffer()
+			n, err := udpConn.Read(*buf)
 			if err != nil {
 				c.l.Error().Err(err).Msg("Failed to read from video stream")
+				packet_pool.PutBuffer(buf)
 				close(readChan) // Close the channel to signal the other goroutine to stop
 				return
 			}
 
-			if n == len(data) {
+			if n == len(*buf) {
 				c.l.Warn().Msg("Read full buffer, data was likely truncated")
+				packet_pool.PutBuffer(buf)
 				continue
 			}
 			select {
-			case readChan <- data[:n]: // Send the data to the channel
+			case readChan <- datagram{buf: buf, n: n}: // Send the data to the channel
 			default:
 				c.l.Warn().Msgf("Dropping UDP Packet of size %v", n)
+				packet_pool.PutBuffer(buf)
 			}
 		}
 	}()
@@ -107,17 +137,35 @@ func (c *CommandCaptureRTP) handleUDPPackets(ctx context.Context, udpConn *net.U
 		defer c.wg.Done()
 		c.l.Info().Msg("Starting RTP Packet Parser")
 
-		for data := range readChan { // Continuously read from the channel
-			pkt := rtp.Packet{}
-			err := pkt.Unmarshal(data)
+		// The program picks its own random timestamp base, so its timestamps are moved
+		// onto the shared clock. They come from the encoder's PTS, so only the offset changes.
+		clockRate := c.GetVideoCodecParameters().ClockRate
+		if clockRate == 0 {
+			clockRate = videoClockRate
+		}
+		timeline := media_clock.NewTimeline(media_clock.Default, clockRate, timelineMaxDrift)
+		var position int64
+		var lastTimestamp uint32
+		started := false
+
+		for d := range readChan { // Continuously read from the channel
+			pkt, err := parsePacket((*d.buf)[:d.n])
+			packet_pool.PutBuffer(d.buf)
 
 			if err != nil {
 				c.l.Warn().Err(err).Msg("RTP packet failed to unmarshal")
 			} else {
+				if started {
+					position += int64(int32(pkt.Timestamp - lastTimestamp))
+				}
+				started = true
+				lastTimestamp = pkt.Timestamp
+				pkt.Timestamp = timeline.Timestamp(position, time.Now())
+
 				select {
-				case pktChan <- &pkt:
-				default:
-					c.l.Warn().Msgf("Dropping RTP Packet of size %v", len(pkt.Payload))
+				case pktChan <- pkt:
+				case <-ctx.Done():
+					return
 				}
 			}
 		}
@@ -167,6 +215,18 @@ func (c *CommandCaptureRTP) StreamAudio(ctx context.Context, pktChan chan<- *rtp
 	return c.Stream(ctx, pktChan)
 }
 
+func (c *CommandCaptureRTP) GetVideoOutput() api.VideoOutput {
+	return videoOutput(c.configurator)
+}
+
+func (c *CommandCaptureRTP) GetVideoSettings() api.VideoSettings {
+	return videoSettings(c.configurator)
+}
+
+func (c *CommandCaptureRTP) SetVideoSettings(settings api.VideoSettings) error {
+	return setVideoSettings(c.configurator, settings)
+}
+
 func (c *CommandCaptureRTP) GetVideoCodecParameters() webrtc.RTPCodecParameters {
 	return *c.configurator.GetVideoCodecParameters()
 }
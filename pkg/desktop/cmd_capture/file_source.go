@@ -0,0 +1,66 @@
+package cmd_capture
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/media_clock"
+)
+
+// maxPlaybackLag is how far a file may fall behind real time, like when nothing is
+// reading its packets, before it skips ahead instead of catching up in a burst
+const maxPlaybackLag = time.Second
+
+var errEmptyFile = errors.New("file has no media to play")
+
+// playbackClock plays a file's media positions in real time. Positions keep
+// counting up across loops, so timestamps never jump back.
+type playbackClock struct {
+	clockRate uint32
+	start     time.Time
+}
+
+func newPlaybackClock(clockRate uint32) *playbackClock {
+	return &playbackClock{
+		clockRate: clockRate,
+		start:     time.Now(),
+	}
+}
+
+// wait sleeps until position is due, and returns its RTP timestamp
+func (c *playbackClock) wait(ctx context.Context, position int64) (time.Time, uint32, error) {
+	at := c.start.Add(time.Duration(position) * time.Second / time.Duration(c.clockRate))
+	if lag := time.Since(at); lag > maxPlaybackLag {
+		c.start = c.start.Add(lag)
+		at = at.Add(lag)
+	}
+
+	timer := time.NewTimer(time.Until(at))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		return at, 0, ctx.Err()
+	}
+	return at, media_clock.Default.RTPTimestamp(at, c.clockRate), nil
+}
+
+// playLoop calls play until the context is done, starting over whenever it
+// reaches the end of the file. play returns how much media it played.
+func playLoop(ctx context.Context, play func(ctx context.Context) (int, error)) error {
+	for {
+		played, err := play(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return err
+		}
+		if played == 0 {
+			// Looping would spin without ever sleeping
+			return errEmptyFile
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package cmd_capture
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+	"github.com/pod-arcade/pod-arcade/api"
+	"github.com/pod-arcade/pod-arcade/pkg/log"
+	"github.com/rs/zerolog"
+)
+
+// opusClockRate is the RTP clock rate of Opus, whatever the sample rate of the audio
+const opusClockRate = 48000
+
+var errBadOggPage = errors.New("not an ogg page")
+
+var _ api.AudioSource = (*FileAudioSource)(nil)
+
+// FileAudioSource plays an Ogg/Opus file in a loop, in real time
+type FileAudioSource struct {
+	path string
+	l    zerolog.Logger
+}
+
+func NewFileAudioSource(path string) (*FileAudioSource, error) {
+	// Make sure it's there now, rather than when a session first wants it
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	file.Close()
+
+	return &FileAudioSource{
+		path: path,
+		l:    log.NewLogger("FileAudioSource", map[string]string{"path": path}),
+	}, nil
+}
+
+func (s *FileAudioSource) GetName() string {
+	return "File " + filepath.Base(s.path)
+}
+
+func (s *FileAudioSource) GetAudioCodecParameters() webrtc.RTPCodecParameters {
+	return webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: opusClockRate, Channels: 2}, PayloadType: 111}
+}
+
+func (s *FileAudioSource) StreamAudio(ctx context.Context, pktChan chan<- *rtp.Packet) error {
+	s.l.Info().Msg("Starting Stream")
+	clock := newPlaybackClock(opusClockRate)
+	pktizer := rtp.NewPacketizer(
+		1200,
+		0, // handled when writing
+		0, // handled when writing
+		&codecs.OpusPayloader{},
+		rtp.NewRandomSequencer(),
+		opusClockRate,
+	)
+	samples := int64(0)
+
+	return playLoop(ctx, func(ctx context.Context) (int, error) {
+		file, err := os.Open(s.path)
+		if err != nil {
+			return 0, err
+		}
+		defer file.Close()
+
+		reader := newOggPacketReader(file)
+		played := 0
+		for {
+			packet, err := reader.NextPacket()
+			if err != nil {
+				return played, err
+			}
+			if bytes.HasPrefix(packet, []byte("OpusHead")) || bytes.HasPrefix(packet, []byte("OpusTags")) {
+				// The headers aren't audio
+				continue
+			}
+			duration := opusPacketSamples(packet)
+			if duration == 0 {
+				continue
+			}
+
+			_, timestamp, err := clock.wait(ctx, samples)
+			if err != nil {
+				return played, err
+			}
+			samples += duration
+			played++
+			for _, p := range pktizer.Packetize(packet, 0) {
+				p.Timestamp = timestamp
+				select {
+				case pktChan <- p:
+				case <-ctx.Done():
+					return played, ctx.Err()
+				}
+			}
+		}
+	})
+}
+
+// opusPacketSamples returns how many 48kHz samples an Opus packet holds, from its TOC byte (RFC 6716, section 3.1)
+func opusPacketSamples(packet []byte) int64 {
+	if len(packet) == 0 {
+		return 0
+	}
+	config := packet[0] >> 3
+	var frameSamples int64
+	switch {
+	case config < 12:
+		// SILK: 10, 20, 40 or 60ms
+		frameSamples = []int64{480, 960, 1920, 2880}[config%4]
+	case config < 16:
+		// Hybrid: 10 or 20ms
+		frameSamples = []int64{480, 960}[config%2]
+	default:
+		// CELT: 2.5, 5, 10 or 20ms
+		frameSamples = []int64{120, 240, 480, 960}[config%4]
+	}
+
+	switch packet[0] & 0x03 {
+	case 0:
+		return frameSamples
+	case 1, 2:
+		return 2 * frameSamples
+	default:
+		if len(packet) < 2 {
+			return 0
+		}
+		return int64(packet[1]&0x3f) * frameSamples
+	}
+}
+
+// oggPacketReader reads the packets of an Ogg stream, joining the ones that span pages
+type oggPacketReader struct {
+	r       *bufio.Reader
+	header  [27]byte
+	lacing  [255]byte
+	page    []byte
+	packets [][]byte
+	partial []byte
+}
+
+func newOggPacketReader(r io.Reader) *oggPacketReader {
+	return &oggPacketReader{r: bufio.NewReader(r)}
+}
+
+// NextPacket returns the next packet. It's only valid until the next call to NextPacket.
+func (o *oggPacketReader) NextPacket() ([]byte, error) {
+	for len(o.packets) == 0 {
+		if err := o.readPage(); err != nil {
+			return nil, err
+		}
+	}
+	packet := o.packets[0]
+	o.packets = o.packets[1:]
+	return packet, nil
+}
+
+// readPage reads a page, splitting it into packets by its lacing values
+func (o *oggPacketReader) readPage() error {
+	if _, err := io.ReadFull(o.r, o.header[:]); err != nil {
+		return err
+	}
+	if !bytes.Equal(o.header[:4], []byte("OggS")) {
+		return errBadOggPage
+	}
+	segments := int(o.header[26])
+	lacing := o.lacing[:segments]
+	if _, err := io.ReadFull(o.r, lacing); err != nil {
+		return err
+	}
+	size := 0
+	for _, l := range lacing {
+		size += int(l)
+	}
+	if cap(o.page) < size {
+		o.page = make([]byte, size)
+	}
+	o.page = o.page[:size]
+	if _, err := io.ReadFull(o.r, o.page); err != nil {
+		return err
+	}
+
+	// A packet ends at the first lacing value under 255, and carries on into the
+	// next page if the page ends first.
+	o.packets = o.packets[:0]
+	start, end := 0, 0
+	for _, l := range lacing {
+		end += int(l)
+		if l < 255 {
+			packet := o.page[start:end]
+			if len(o.partial) > 0 {
+				packet = append(o.partial, packet...)
+				o.partial = nil
+			}
+			o.packets = append(o.packets, packet)
+			start = end
+		}
+	}
+	if start < end {
+		o.partial = append(o.partial, o.page[start:end]...)
+	}
+	return nil
+}
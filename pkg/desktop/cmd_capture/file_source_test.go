@@ -0,0 +1,127 @@
+package cmd_capture
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media/oggwriter"
+)
+
+// collect streams from a source until it's sent count packets that match keep
+func collect(t *testing.T, stream func(context.Context, chan<- *rtp.Packet) error, count int, keep func(*rtp.Packet) bool) []*rtp.Packet {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	pktChan := make(chan *rtp.Packet)
+	go stream(ctx, pktChan)
+
+	pkts := []*rtp.Packet{}
+	for len(pkts) < count {
+		select {
+		case p := <-pktChan:
+			if keep(p) {
+				pkts = append(pkts, p.Clone())
+			}
+		case <-ctx.Done():
+			t.Fatalf("Only got %v of %v packets", len(pkts), count)
+		}
+	}
+	return pkts
+}
+
+func TestFileVideoSource_LoopsH264(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "video.h264")
+	data := []byte{
+		0, 0, 0, 1, 0x67, 0x42, 0xc0, 0x1f, // SPS
+		0, 0, 0, 1, 0x68, 0xce, 0x3c, 0x80, // PPS
+		0, 0, 0, 1, 0x65, 0x88, 0x84, 0x00, // IDR slice
+		0, 0, 0, 1, 0x41, 0x9a, 0x02, 0x00, // slice
+		0, 0, 0, 1, 0x41, 0x9a, 0x04, 0x00, // slice
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewFileVideoSource(path, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.GetVideoCodecParameters().MimeType != webrtc.MimeTypeH264 {
+		t.Errorf("Expected H.264, got %v", s.GetVideoCodecParameters().MimeType)
+	}
+
+	// Three frames per loop, so this plays the file twice
+	frames := collect(t, s.StreamVideo, 6, func(p *rtp.Packet) bool { return p.Marker })
+	for i := 1; i < len(frames); i++ {
+		if step := frames[i].Timestamp - frames[i-1].Timestamp; step != 900 {
+			t.Errorf("Expected frames 10ms apart at 100fps, but frame %v was %v ticks after the last", i, step)
+		}
+	}
+}
+
+func TestFileVideoSource_RewindsForKeyframe(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "video.h264")
+	data := []byte{
+		0, 0, 0, 1, 0x67, 0x42, 0xc0, 0x1f, // SPS
+		0, 0, 0, 1, 0x68, 0xce, 0x3c, 0x80, // PPS
+		0, 0, 0, 1, 0x65, 0x88, 0x84, 0x00, // IDR slice
+	}
+	for i := 0; i < 50; i++ {
+		data = append(data, 0, 0, 0, 1, 0x41, 0x9a, byte(i), 0x00)
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewFileVideoSource(path, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.keyframes.timeout = 30 * time.Millisecond
+
+	idrs := collect(t, s.StreamVideo, 2, func(p *rtp.Packet) bool {
+		if p.Payload[0]&0x1f != 5 {
+			return false
+		}
+		// The file only gets to its next keyframe by looping, which is too late
+		s.RequestKeyframe()
+		return true
+	})
+	if frames := (idrs[1].Timestamp - idrs[0].Timestamp) / 900; frames >= 51 {
+		t.Errorf("Expected the file to start again for a keyframe, but it took %v frames", frames)
+	}
+}
+
+func TestFileAudioSource_LoopsOggOpus(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audio.ogg")
+	w, err := oggwriter.New(path, opusClockRate, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		// A 20ms CELT frame
+		w.WriteRTP(&rtp.Packet{Header: rtp.Header{Timestamp: uint32(i * 960)}, Payload: []byte{0xfc, byte(i)}})
+	}
+	w.Close()
+
+	s, err := NewFileAudioSource(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pkts := collect(t, s.StreamAudio, 5, func(p *rtp.Packet) bool { return true })
+	for i, p := range pkts {
+		if p.Payload[1] != byte(i%3) {
+			t.Errorf("Expected packet %v to be frame %v of the file, got %v", i, i%3, p.Payload[1])
+		}
+		if i > 0 {
+			if step := p.Timestamp - pkts[i-1].Timestamp; step != 960 {
+				t.Errorf("Expected packets 20ms apart, but packet %v was %v ticks after the last", i, step)
+			}
+		}
+	}
+}
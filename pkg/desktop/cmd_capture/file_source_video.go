@@ -0,0 +1,236 @@
+package cmd_capture
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media/ivfreader"
+	"github.com/pod-arcade/pod-arcade/api"
+	"github.com/pod-arcade/pod-arcade/pkg/log"
+	"github.com/rs/zerolog"
+)
+
+var _ api.VideoSource = (*FileVideoSource)(nil)
+var _ api.KeyframeRequester = (*FileVideoSource)(nil)
+
+// FileVideoSource plays an H.264 Annex-B or IVF file in a loop, in real time. It
+// needs nothing installed, so it's handy for developing clients and for tests.
+type FileVideoSource struct {
+	path string
+	// fps paces Annex-B files, which don't have timestamps
+	fps   int
+	ivf   bool
+	codec webrtc.RTPCodecParameters
+
+	keyframes *keyframeForcer
+	// rewind plays the file from the start again, which is a keyframe
+	rewind atomic.Bool
+
+	l zerolog.Logger
+}
+
+// NewFileVideoSource opens a video file to find out its codec. IVF files are
+// recognised by their signature, and anything else is read as H.264 Annex-B,
+// played at fps frames per second.
+func NewFileVideoSource(path string, fps int) (*FileVideoSource, error) {
+	if fps <= 0 {
+		return nil, fmt.Errorf("fps must be positive, got %v", fps)
+	}
+	s := &FileVideoSource{
+		path: path,
+		fps:  fps,
+		l:    log.NewLogger("FileVideoSource", map[string]string{"path": path}),
+	}
+	s.keyframes = newKeyframeForcer(func() { s.rewind.Store(true) })
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	signature := make([]byte, 4)
+	if _, err := io.ReadFull(file, signature); err != nil {
+		return nil, err
+	}
+	if bytes.Equal(signature, []byte("DKIF")) {
+		file.Seek(0, io.SeekStart)
+		_, header, err := ivfreader.NewWith(file)
+		if err != nil {
+			return nil, err
+		}
+		s.ivf = true
+		switch header.FourCC {
+		case "VP80":
+			s.codec = webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: videoClockRate}, PayloadType: 96}
+		case "VP90":
+			s.codec = webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP9, ClockRate: videoClockRate, SDPFmtpLine: "profile-id=0"}, PayloadType: 98}
+		default:
+			return nil, fmt.Errorf("unsupported IVF codec %q", header.FourCC)
+		}
+	} else {
+		s.codec = webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: videoClockRate}, PayloadType: 102}
+	}
+
+	s.l.Debug().Msgf("Playing %v from %v", s.codec.MimeType, path)
+	return s, nil
+}
+
+func (s *FileVideoSource) GetName() string {
+	return "File " + filepath.Base(s.path)
+}
+
+func (s *FileVideoSource) GetVideoCodecParameters() webrtc.RTPCodecParameters {
+	return s.codec
+}
+
+// RequestKeyframe plays the file from the start again if it doesn't get to a keyframe soon
+func (s *FileVideoSource) RequestKeyframe() {
+	s.keyframes.Request()
+}
+
+func (s *FileVideoSource) StreamVideo(ctx context.Context, pktChan chan<- *rtp.Packet) error {
+	s.l.Info().Msg("Starting Stream")
+	s.rewind.Store(false)
+	clock := newPlaybackClock(videoClockRate)
+	if s.ivf {
+		return s.streamIVF(ctx, clock, pktChan)
+	}
+	return s.streamH264(ctx, clock, pktChan)
+}
+
+func (s *FileVideoSource) streamH264(ctx context.Context, clock *playbackClock, pktChan chan<- *rtp.Packet) error {
+	pktizer := newAccessUnitPacketizer(1200, videoClockRate)
+	pktizer.latencySEI = true
+	pktizer.onKeyframe = s.keyframes.Keyframe
+	frames := int64(0)
+
+	return playLoop(ctx, func(ctx context.Context) (int, error) {
+		file, err := os.Open(s.path)
+		if err != nil {
+			return 0, err
+		}
+		defer file.Close()
+
+		reader := newAnnexBReader(file)
+		played := 0
+		for {
+			nal, err := reader.NextNAL()
+			if err != nil {
+				return played, err
+			}
+
+			// Each access unit is due a frame after the last. The packetizer only
+			// reads the time when an access unit starts.
+			var now time.Time
+			if !pktizer.started || startsAccessUnit(nal, pktizer.seenSlice) {
+				if played > 0 && s.rewind.Swap(false) {
+					return played, io.EOF
+				}
+				now, _, err = clock.wait(ctx, frames*videoClockRate/int64(s.fps))
+				if err != nil {
+					return played, err
+				}
+				frames++
+				played++
+			}
+			for _, p := range pktizer.Push(nal, now) {
+				select {
+				case pktChan <- p:
+				case <-ctx.Done():
+					return played, ctx.Err()
+				}
+			}
+		}
+	})
+}
+
+func (s *FileVideoSource) streamIVF(ctx context.Context, clock *playbackClock, pktChan chan<- *rtp.Packet) error {
+	var payloader rtp.Payloader = &codecs.VP9Payloader{}
+	if strings.EqualFold(s.codec.MimeType, webrtc.MimeTypeVP8) {
+		payloader = &codecs.VP8Payloader{EnablePictureID: true}
+	}
+	pktizer := rtp.NewPacketizer(
+		1200,
+		0, // handled when writing
+		0, // handled when writing
+		payloader,
+		rtp.NewRandomSequencer(),
+		videoClockRate,
+	)
+	// Each loop starts a frame after the last frame of the previous one
+	loopStart := int64(0)
+	nextLoopStart := int64(0)
+
+	return playLoop(ctx, func(ctx context.Context) (int, error) {
+		file, err := os.Open(s.path)
+		if err != nil {
+			return 0, err
+		}
+		defer file.Close()
+
+		reader, header, err := ivfreader.NewWith(file)
+		if err != nil {
+			return 0, err
+		}
+		if header.TimebaseDenominator == 0 {
+			return 0, fmt.Errorf("IVF file has no timebase")
+		}
+
+		loopStart = nextLoopStart
+		played := 0
+		first, last := int64(-1), int64(-1)
+		for {
+			frame, frameHeader, err := reader.ParseNextFrame()
+			if err != nil {
+				return played, err
+			}
+			if played > 0 && s.rewind.Swap(false) {
+				// The next loop starts a frame after the last frame played
+				return played, io.EOF
+			}
+
+			// IVF timestamps are in units of the file's timebase, and may not start at 0
+			position := int64(frameHeader.Timestamp * videoClockRate *
+				uint64(header.TimebaseNumerator) / uint64(header.TimebaseDenominator))
+			if first < 0 {
+				first = position
+			}
+			position -= first
+			frameDuration := int64(videoClockRate / s.fps)
+			if last >= 0 && position > last {
+				frameDuration = position - last
+			}
+			last = position
+			nextLoopStart = loopStart + position + frameDuration
+
+			if vpxKeyframe(header.FourCC, frame) {
+				s.keyframes.Keyframe()
+			}
+
+			_, timestamp, err := clock.wait(ctx, loopStart+position)
+			if err != nil {
+				return played, err
+			}
+			played++
+			for _, p := range pktizer.Packetize(frame, 0) {
+				p.Timestamp = timestamp
+				select {
+				case pktChan <- p:
+				case <-ctx.Done():
+					return played, ctx.Err()
+				}
+			}
+		}
+	})
+}
@@ -0,0 +1,244 @@
+package cmd_capture
+
+import (
+	"bytes"
+	"io"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4/pkg/media/h264reader"
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/media_clock"
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/packet_pool"
+)
+
+const (
+	// annexBBufferSize is where the reader's buffer starts. It grows to fit the largest NAL.
+	annexBBufferSize = 1 << 20
+	// fuaNALType is the NAL type of an RFC 6184 fragmentation unit
+	fuaNALType = 28
+)
+
+var annexBStartCode = []byte{0x00, 0x00, 0x01}
+
+// annexBReader splits an H.264 Annex-B byte stream into NALs, reusing one buffer for all of them
+type annexBReader struct {
+	r   io.Reader
+	buf []byte
+	// unread data is buf[start:end]
+	start int
+	end   int
+}
+
+func newAnnexBReader(r io.Reader) *annexBReader {
+	return &annexBReader{
+		r:   r,
+		buf: make([]byte, annexBBufferSize),
+	}
+}
+
+// fill reads more of the stream, moving the unread data to the front of the buffer first
+func (a *annexBReader) fill() error {
+	if a.start > 0 {
+		a.end = copy(a.buf, a.buf[a.start:a.end])
+		a.start = 0
+	}
+	if a.end == len(a.buf) {
+		a.buf = append(a.buf, make([]byte, len(a.buf))...)
+	}
+	n, err := a.r.Read(a.buf[a.end:])
+	a.end += n
+	if n > 0 {
+		return nil
+	}
+	return err
+}
+
+// NextNAL returns the next NAL without its start code. The returned slice is
+// only valid until the next call to NextNAL.
+func (a *annexBReader) NextNAL() ([]byte, error) {
+	for {
+		nal, err := a.nextNAL()
+		if err != nil || len(nal) > 0 {
+			return nal, err
+		}
+	}
+}
+
+func (a *annexBReader) nextNAL() ([]byte, error) {
+	// Skip past the start code
+	for {
+		if i := bytes.Index(a.buf[a.start:a.end], annexBStartCode); i >= 0 {
+			a.start += i + len(annexBStartCode)
+			break
+		}
+		// Keep enough to find a start code that was split between reads
+		if a.end-a.start >= len(annexBStartCode) {
+			a.start = a.end - len(annexBStartCode) + 1
+		}
+		if err := a.fill(); err != nil {
+			return nil, err
+		}
+	}
+
+	// The NAL runs until the next start code, or the end of the stream
+	searched := 0
+	for {
+		data := a.buf[a.start:a.end]
+		if i := bytes.Index(data[searched:], annexBStartCode); i >= 0 {
+			a.start += searched + i
+			// Zeros before the start code are padding, or part of a 4 byte start code
+			return bytes.TrimRight(data[:searched+i], "\x00"), nil
+		}
+		if len(data) >= len(annexBStartCode) {
+			searched = len(data) - len(annexBStartCode) + 1
+		}
+		if err := a.fill(); err != nil {
+			if err == io.EOF && a.end > a.start {
+				nal := a.buf[a.start:a.end]
+				a.start = a.end
+				return nal, nil
+			}
+			return nil, err
+		}
+	}
+}
+
+// startsAccessUnit reports whether nal is the first NAL of a new access unit.
+// seenSlice is whether the current access unit already contains a slice.
+func startsAccessUnit(nal []byte, seenSlice bool) bool {
+	if !seenSlice {
+		// Everything before the first slice belongs with that slice
+		return false
+	}
+	switch h264reader.NalUnitType(nal[0] & 0x1f) {
+	case h264reader.NalUnitTypeAUD, h264reader.NalUnitTypeSEI, h264reader.NalUnitTypeSPS, h264reader.NalUnitTypePPS:
+		return true
+	case h264reader.NalUnitTypeCodedSliceNonIdr, h264reader.NalUnitTypeCodedSliceIdr:
+		// first_mb_in_slice is the first ue(v) field in the slice header, and is
+		// only 0 (encoded as a single 1 bit) on the first slice of a picture.
+		return len(nal) > 1 && nal[1]&0x80 != 0
+	default:
+		return false
+	}
+}
+
+// accessUnitPacketizer packs NALs into pooled RTP packets, and hands them out
+// one access unit at a time, with the marker bit on the last packet.
+type accessUnitPacketizer struct {
+	mtu       int
+	clockRate uint32
+	sequencer rtp.Sequencer
+
+	// Annex-B streams don't carry timestamps, so each access unit is stamped with the
+	// time its first NAL arrived from the encoder.
+	frameTime time.Time
+	started   bool
+	seenSlice bool
+
+	// latencySEI stamps every access unit with its capture time and frame number
+	latencySEI bool
+	frameCount uint32
+	seiBuf     []byte
+
+	// onKeyframe is called when an access unit with an IDR slice is handed out
+	onKeyframe func()
+	idr        bool
+
+	// pending is the access unit being built, and done is the last one handed out.
+	// They swap on every access unit, so neither is reallocated.
+	pending []*rtp.Packet
+	done    []*rtp.Packet
+}
+
+func newAccessUnitPacketizer(mtu int, clockRate uint32) *accessUnitPacketizer {
+	return &accessUnitPacketizer{
+		mtu:       mtu,
+		clockRate: clockRate,
+		sequencer: rtp.NewRandomSequencer(),
+	}
+}
+
+// Push adds a NAL that arrived at now. When the NAL starts a new access unit,
+// the packets of the previous one are returned. The packets belong to the
+// caller, but the slice holding them is only valid until the next call to Push.
+func (a *accessUnitPacketizer) Push(nal []byte, now time.Time) []*rtp.Packet {
+	var done []*rtp.Packet
+	if a.started && startsAccessUnit(nal, a.seenSlice) {
+		done = a.flush()
+	}
+	if !a.started {
+		a.frameTime = now
+		a.started = true
+	}
+
+	switch h264reader.NalUnitType(nal[0] & 0x1f) {
+	case h264reader.NalUnitTypeCodedSliceNonIdr, h264reader.NalUnitTypeCodedSliceIdr:
+		a.idr = a.idr || h264reader.NalUnitType(nal[0]&0x1f) == h264reader.NalUnitTypeCodedSliceIdr
+		if !a.seenSlice && a.latencySEI {
+			// SEI has to come before the first slice of the access unit
+			a.frameCount++
+			a.seiBuf = appendLatencySEI(a.seiBuf[:0], a.frameTime, a.frameCount)
+			a.appendNAL(a.seiBuf)
+		}
+		a.seenSlice = true
+	case h264reader.NalUnitTypeAUD, h264reader.NalUnitTypeFiller:
+		// These aren't needed over RTP
+		return done
+	}
+	a.appendNAL(nal)
+	return done
+}
+
+// flush finishes the pending access unit and returns its packets
+func (a *accessUnitPacketizer) flush() []*rtp.Packet {
+	timestamp := media_clock.Default.RTPTimestamp(a.frameTime, a.clockRate)
+	for _, p := range a.pending {
+		p.Timestamp = timestamp
+	}
+	if len(a.pending) > 0 {
+		a.pending[len(a.pending)-1].Marker = true
+	}
+	if a.idr && a.onKeyframe != nil {
+		a.onKeyframe()
+	}
+	a.done, a.pending = a.pending, a.done[:0]
+	a.started = false
+	a.seenSlice = false
+	a.idr = false
+	return a.done
+}
+
+func (a *accessUnitPacketizer) newPacket() *rtp.Packet {
+	p := packet_pool.GetPacket()
+	p.Version = 2
+	p.SequenceNumber = a.sequencer.NextSequenceNumber()
+	a.pending = append(a.pending, p)
+	return p
+}
+
+// appendNAL packs a NAL into a single packet if it fits, and splits it into FU-A fragments if it doesn't
+func (a *accessUnitPacketizer) appendNAL(nal []byte) {
+	if len(nal) <= a.mtu {
+		packet_pool.SetPayload(a.newPacket(), nal)
+		return
+	}
+
+	indicator := nal[0]&0xe0 | fuaNALType
+	nalType := nal[0] & 0x1f
+	data := nal[1:]
+	for first := true; len(data) > 0; first = false {
+		size := min(len(data), a.mtu-2)
+		header := nalType
+		if first {
+			header |= 0x80
+		}
+		if size == len(data) {
+			header |= 0x40
+		}
+
+		p := a.newPacket()
+		p.Payload = append(p.Payload[:0], indicator, header)
+		p.Payload = append(p.Payload, data[:size]...)
+		data = data[size:]
+	}
+}
@@ -0,0 +1,207 @@
+package cmd_capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4/pkg/media/h264reader"
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/packet_pool"
+)
+
+// loopReader plays data over and over, like an encoder that never stops
+type loopReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *loopReader) Read(p []byte) (int, error) {
+	n := copy(p, r.data[r.pos:])
+	r.pos = (r.pos + n) % len(r.data)
+	return n, nil
+}
+
+// testFrame returns an Annex-B access unit with one IDR slice of the given size
+func testFrame(size int) []byte {
+	frame := []byte{0x00, 0x00, 0x00, 0x01, 0x65, 0x88}
+	for len(frame) < size+4 {
+		frame = append(frame, byte(len(frame)))
+	}
+	// Make sure the payload doesn't contain anything that looks like a start code
+	for i := 6; i < len(frame); i++ {
+		if frame[i] == 0 {
+			frame[i] = 0xff
+		}
+	}
+	return frame
+}
+
+func TestAccessUnitPacketizer(t *testing.T) {
+	frame := testFrame(5000)
+	reader := newAnnexBReader(&loopReader{data: frame})
+	pktizer := newAccessUnitPacketizer(1200, videoClockRate)
+
+	var pkts []*rtp.Packet
+	for pkts == nil {
+		nal, err := reader.NextNAL()
+		if err != nil {
+			t.Fatal(err)
+		}
+		pkts = pktizer.Push(nal, time.Now())
+	}
+
+	depacketizer := &codecs.H264Packet{IsAVC: false}
+	nal := []byte{}
+	for i, p := range pkts {
+		if p.Marker != (i == len(pkts)-1) {
+			t.Errorf("Packet %v has marker %v", i, p.Marker)
+		}
+		if p.Timestamp != pkts[0].Timestamp || p.SequenceNumber != pkts[0].SequenceNumber+uint16(i) {
+			t.Errorf("Packet %v has timestamp %v and sequence number %v", i, p.Timestamp, p.SequenceNumber)
+		}
+		data, err := depacketizer.Unmarshal(p.Payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nal = append(nal, data...)
+	}
+
+	if !bytes.Equal(nal, frame) {
+		t.Errorf("Expected the frame to survive packetization, got %v bytes instead of %v", len(nal), len(frame))
+	}
+}
+
+func TestAccessUnitPacketizer_LatencySEI(t *testing.T) {
+	pktizer := newAccessUnitPacketizer(1200, videoClockRate)
+	pktizer.latencySEI = true
+	// Frame 1 is stamped with a time whose microseconds contain 00 00 00
+	captured := time.UnixMicro(0x0100_0000_0000)
+
+	pktizer.Push([]byte{0x65, 0x88, 0x01}, captured)
+	pkts := pktizer.Push([]byte{0x65, 0x88, 0x02}, captured)
+	if len(pkts) != 2 {
+		t.Fatalf("Expected the SEI and the slice, got %v packets", len(pkts))
+	}
+
+	sei := pkts[0].Payload
+	if sei[0] != seiNALHeader || sei[1] != seiUserDataUnregistered || sei[2] != latencySEIPayloadSize {
+		t.Fatalf("Expected a user data unregistered SEI, got %x", sei)
+	}
+	if bytes.Contains(sei, []byte{0x00, 0x00, 0x00}) {
+		t.Errorf("Expected the SEI to be escaped, got %x", sei)
+	}
+
+	// Undo emulation prevention
+	rbsp := bytes.ReplaceAll(sei[1:], []byte{0x00, 0x00, 0x03}, []byte{0x00, 0x00})
+	if !bytes.Equal(rbsp[2:18], LatencySEIUUID[:]) {
+		t.Errorf("Expected the latency UUID, got %x", rbsp[2:18])
+	}
+	if got := time.UnixMicro(int64(binary.BigEndian.Uint64(rbsp[18:]))); !got.Equal(captured) {
+		t.Errorf("Expected capture time %v, got %v", captured, got)
+	}
+	if frame := binary.BigEndian.Uint32(rbsp[26:]); frame != 1 {
+		t.Errorf("Expected frame 1, got %v", frame)
+	}
+}
+
+// Each op is one video frame, so allocs/op is allocations per frame.
+func BenchmarkH264Frame(b *testing.B) {
+	frame := testFrame(20000)
+
+	// before is how frames were packetized with h264reader, a bytes.Buffer and pion's packetizer
+	b.Run("before", func(b *testing.B) {
+		reader, err := h264reader.NewReader(&loopReader{data: frame})
+		if err != nil {
+			b.Fatal(err)
+		}
+		pktizer := rtp.NewPacketizer(1200, 0, 0, &codecs.H264Payloader{}, rtp.NewRandomSequencer(), videoClockRate)
+		buffer := bytes.Buffer{}
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; {
+			nal, err := reader.NextNAL()
+			if err != nil {
+				b.Fatal(err)
+			}
+			if startsAccessUnit(nal.Data, true) && buffer.Len() > 0 {
+				pktizer.Packetize(buffer.Bytes(), 0)
+				buffer = bytes.Buffer{}
+				i++
+			}
+			buffer.Write([]byte{0x00, 0x00, 0x00, 0x01})
+			buffer.Write(nal.Data)
+		}
+	})
+
+	b.Run("after", func(b *testing.B) {
+		reader := newAnnexBReader(&loopReader{data: frame})
+		pktizer := newAccessUnitPacketizer(1200, videoClockRate)
+		now := time.Now()
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; {
+			nal, err := reader.NextNAL()
+			if err != nil {
+				b.Fatal(err)
+			}
+			pkts := pktizer.Push(nal, now)
+			if pkts == nil {
+				continue
+			}
+			// The mixer hands packets back once they've been written
+			for _, p := range pkts {
+				packet_pool.PutPacket(p)
+			}
+			i++
+		}
+	})
+}
+
+// packetSink keeps benchmarked packets on the heap, like sending them on a channel would
+var packetSink *rtp.Packet
+
+// Each op is one datagram from an RTP encoder.
+func BenchmarkUDPPacket(b *testing.B) {
+	pkt := rtp.Packet{
+		Header:  rtp.Header{Version: 2, PayloadType: 96, SequenceNumber: 1, Timestamp: 1, SSRC: 1},
+		Payload: bytes.Repeat([]byte{0xab}, 1200),
+	}
+	datagram, err := pkt.Marshal()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	// before is how datagrams were read into a new buffer and a new packet
+	b.Run("before", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			data := make([]byte, 24000)
+			n := copy(data, datagram)
+			p := &rtp.Packet{}
+			if err := p.Unmarshal(data[:n]); err != nil {
+				b.Fatal(err)
+			}
+			packetSink = p
+		}
+	})
+
+	b.Run("after", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			buf := packet_pool.GetBuffer()
+			n := copy(*buf, datagram)
+			p, err := parsePacket((*buf)[:n])
+			packet_pool.PutBuffer(buf)
+			if err != nil {
+				b.Fatal(err)
+			}
+			packetSink = p
+			packet_pool.PutPacket(p)
+		}
+	})
+}
@@ -0,0 +1,56 @@
+package cmd_capture
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+const (
+	// seiNALHeader is the NAL header of an SEI, with nal_ref_idc 0
+	seiNALHeader = 0x06
+	// seiUserDataUnregistered is the SEI payload type for data identified by a UUID
+	seiUserDataUnregistered = 5
+)
+
+// LatencySEIUUID identifies the SEI that stamps every access unit with the wall-clock
+// time it left the encoder, in microseconds since the unix epoch (uint64BE), followed
+// by a frame counter (uint32BE). Clients echo both back to measure end to end latency.
+var LatencySEIUUID = [16]byte{
+	0x70, 0x6f, 0x64, 0x2d, 0x61, 0x72, 0x63, 0x61, // "pod-arca"
+	0x64, 0x65, 0x2d, 0x6c, 0x61, 0x74, 0x65, 0x6e, // "de-laten"
+}
+
+// latencySEIPayloadSize is the UUID, the timestamp and the frame counter
+const latencySEIPayloadSize = 16 + 8 + 4
+
+// appendLatencySEI appends an SEI NAL stamping a frame with its capture time and number
+func appendLatencySEI(dst []byte, captured time.Time, frame uint32) []byte {
+	var rbsp [2 + latencySEIPayloadSize + 1]byte
+	rbsp[0] = seiUserDataUnregistered
+	rbsp[1] = latencySEIPayloadSize
+	copy(rbsp[2:], LatencySEIUUID[:])
+	binary.BigEndian.PutUint64(rbsp[18:], uint64(captured.UnixMicro()))
+	binary.BigEndian.PutUint32(rbsp[26:], frame)
+	rbsp[30] = 0x80 // rbsp_trailing_bits
+
+	dst = append(dst, seiNALHeader)
+	return appendEmulationPrevented(dst, rbsp[:])
+}
+
+// appendEmulationPrevented escapes anything in rbsp that would look like a start code
+func appendEmulationPrevented(dst []byte, rbsp []byte) []byte {
+	zeros := 0
+	for _, b := range rbsp {
+		if zeros == 2 && b <= 0x03 {
+			dst = append(dst, 0x03)
+			zeros = 0
+		}
+		dst = append(dst, b)
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return dst
+}
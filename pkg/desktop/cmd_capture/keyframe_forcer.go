@@ -0,0 +1,75 @@
+package cmd_capture
+
+import (
+	"sync"
+	"time"
+)
+
+// keyframeTimeout is how long a requested keyframe may take before the source is
+// restarted for one. The encoders can't be asked for a keyframe while they run,
+// but they start with one, and their own keyframe interval is usually sooner.
+const keyframeTimeout = 2 * time.Second
+
+// minRestartInterval is the least time between restarts for keyframes. A restart
+// interrupts every session watching the source, so requests in between wait for
+// it, and are usually answered by the encoder's own keyframe first.
+const minRestartInterval = 10 * time.Second
+
+// keyframeForcer restarts a source when a keyframe was requested and none came in
+// time. Requests are combined, and restarts are rate limited.
+type keyframeForcer struct {
+	restart     func()
+	timeout     time.Duration
+	minInterval time.Duration
+
+	// generation identifies the waiting request, so that a timer left over from an
+	// answered one does nothing
+	generation  uint64
+	waiting     bool
+	timer       *time.Timer
+	lastRestart time.Time
+	mtx         sync.Mutex
+}
+
+func newKeyframeForcer(restart func()) *keyframeForcer {
+	return &keyframeForcer{restart: restart, timeout: keyframeTimeout, minInterval: minRestartInterval}
+}
+
+// Request asks for a keyframe. Requests while one is already waiting are combined with it.
+func (k *keyframeForcer) Request() {
+	k.mtx.Lock()
+	defer k.mtx.Unlock()
+	if k.waiting {
+		return
+	}
+	k.waiting = true
+	k.generation++
+	generation := k.generation
+	wait := max(k.timeout, time.Until(k.lastRestart.Add(k.minInterval)))
+	k.timer = time.AfterFunc(wait, func() { k.expire(generation) })
+}
+
+// Keyframe is called whenever the source makes a keyframe, which answers any request
+func (k *keyframeForcer) Keyframe() {
+	k.mtx.Lock()
+	defer k.mtx.Unlock()
+	if k.waiting {
+		k.waiting = false
+		k.generation++
+		k.timer.Stop()
+	}
+}
+
+// expire restarts the source, unless the request was answered in the meantime
+func (k *keyframeForcer) expire(generation uint64) {
+	k.mtx.Lock()
+	waiting := k.waiting && k.generation == generation
+	if waiting {
+		k.waiting = false
+		k.lastRestart = time.Now()
+	}
+	k.mtx.Unlock()
+	if waiting {
+		k.restart()
+	}
+}
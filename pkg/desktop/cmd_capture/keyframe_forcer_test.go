@@ -0,0 +1,32 @@
+package cmd_capture
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestKeyframeForcer_CombinesAndRateLimitsRestarts(t *testing.T) {
+	var restarts atomic.Int32
+	k := newKeyframeForcer(func() { restarts.Add(1) })
+	k.timeout = 10 * time.Millisecond
+	k.minInterval = 200 * time.Millisecond
+
+	// Requests from many sessions at once restart the source once
+	for i := 0; i < 10; i++ {
+		k.Request()
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := restarts.Load(); n != 1 {
+		t.Fatalf("Expected one restart, got %v", n)
+	}
+
+	// The next request waits out the interval, and a keyframe in the meantime answers it
+	k.Request()
+	time.Sleep(50 * time.Millisecond)
+	k.Keyframe()
+	time.Sleep(200 * time.Millisecond)
+	if n := restarts.Load(); n != 1 {
+		t.Errorf("Expected the keyframe to answer the request without a restart, got %v restarts", n)
+	}
+}
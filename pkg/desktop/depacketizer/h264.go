@@ -0,0 +1,211 @@
+// Package depacketizer turns the mixer's RTP packets back into whole frames,
+// for consumers that write them somewhere other than a peer connection.
+package depacketizer
+
+import (
+	"github.com/pion/rtp"
+)
+
+// H.264 NAL unit types, from RFC 6184 and the H.264 specification
+const (
+	nalTypeIDR   = 5
+	nalTypeSPS   = 7
+	nalTypePPS   = 8
+	nalTypeSTAPA = 24
+	nalTypeFUA   = 28
+)
+
+// AccessUnit is a complete H.264 frame
+type AccessUnit struct {
+	Timestamp uint32
+	// NALs are the NAL units of the frame, without start codes
+	NALs [][]byte
+	// Keyframe is whether the frame holds an IDR slice
+	Keyframe bool
+	// SPS and PPS are the latest parameter sets seen, which keyframes depend on
+	SPS []byte
+	PPS []byte
+}
+
+// H264 reassembles access units from RTP packets. After a packet is lost it
+// drops frames until the next keyframe, since the ones in between can't be decoded.
+// It starts out waiting for a keyframe too.
+type H264 struct {
+	// KeyframeNeeded is called when a lost packet means waiting for the next keyframe
+	KeyframeNeeded func()
+
+	started   bool
+	lastSeq   uint16
+	timestamp uint32
+	// broken is set when a packet of the current frame was lost
+	broken       bool
+	waitKeyframe bool
+
+	// buf holds the NALs of the current frame, which start at the offsets in starts
+	buf    []byte
+	starts []int
+	inFUA  bool
+
+	sps []byte
+	pps []byte
+	au  AccessUnit
+}
+
+// NewH264 returns a depacketizer that waits for a keyframe
+func NewH264() *H264 {
+	return &H264{waitKeyframe: true}
+}
+
+// Push adds a packet, and returns the access unit that it completes, if any.
+// The access unit is only valid until the next call to Push.
+func (d *H264) Push(p *rtp.Packet) *AccessUnit {
+	gap := d.started && p.SequenceNumber != d.lastSeq+1
+	d.started = true
+	d.lastSeq = p.SequenceNumber
+
+	if p.Timestamp != d.timestamp {
+		// A new frame, so if the last one wasn't finished, its end was lost
+		gap = gap || len(d.starts) > 0
+		d.reset()
+		d.timestamp = p.Timestamp
+	}
+	if gap {
+		d.lost()
+	}
+
+	if len(p.Payload) > 0 && !d.broken {
+		d.unpack(p.Payload)
+	}
+
+	if !p.Marker {
+		return nil
+	}
+	defer d.reset()
+	if d.broken || len(d.starts) == 0 {
+		return nil
+	}
+	return d.finish()
+}
+
+func (d *H264) lost() {
+	d.broken = true
+	if !d.waitKeyframe {
+		d.waitKeyframe = true
+		if d.KeyframeNeeded != nil {
+			d.KeyframeNeeded()
+		}
+	}
+}
+
+func (d *H264) reset() {
+	d.buf = d.buf[:0]
+	d.starts = d.starts[:0]
+	d.inFUA = false
+	d.broken = false
+}
+
+// unpack adds the NALs in an RTP payload to the current frame
+func (d *H264) unpack(payload []byte) {
+	switch payload[0] & 0x1f {
+	case nalTypeSTAPA:
+		data := payload[1:]
+		for len(data) > 2 {
+			size := int(data[0])<<8 | int(data[1])
+			if size > len(data)-2 {
+				d.broken = true
+				return
+			}
+			d.startNAL(data[2 : 2+size])
+			data = data[2+size:]
+		}
+	case nalTypeFUA:
+		if len(payload) < 2 {
+			d.broken = true
+			return
+		}
+		header := payload[1]
+		if header&0x80 != 0 {
+			d.startNAL([]byte{payload[0]&0xe0 | header&0x1f})
+			d.inFUA = true
+		} else if !d.inFUA {
+			d.broken = true
+			return
+		}
+		d.buf = append(d.buf, payload[2:]...)
+		if header&0x40 != 0 {
+			d.inFUA = false
+		}
+	default:
+		d.startNAL(payload)
+	}
+}
+
+func (d *H264) startNAL(nal []byte) {
+	d.inFUA = false
+	d.starts = append(d.starts, len(d.buf))
+	d.buf = append(d.buf, nal...)
+}
+
+// finish builds the access unit out of the current frame
+func (d *H264) finish() *AccessUnit {
+	d.au.Timestamp = d.timestamp
+	d.au.Keyframe = false
+	d.au.NALs = d.au.NALs[:0]
+	for i, start := range d.starts {
+		end := len(d.buf)
+		if i+1 < len(d.starts) {
+			end = d.starts[i+1]
+		}
+		nal := d.buf[start:end]
+		if len(nal) == 0 {
+			continue
+		}
+		switch nal[0] & 0x1f {
+		case nalTypeIDR:
+			d.au.Keyframe = true
+		case nalTypeSPS:
+			d.sps = append(d.sps[:0], nal...)
+		case nalTypePPS:
+			d.pps = append(d.pps[:0], nal...)
+		}
+		d.au.NALs = append(d.au.NALs, nal)
+	}
+
+	if d.waitKeyframe {
+		if !d.au.Keyframe || d.sps == nil || d.pps == nil {
+			return nil
+		}
+		d.waitKeyframe = false
+	}
+	d.au.SPS = d.sps
+	d.au.PPS = d.pps
+	return &d.au
+}
+
+// AppendAVCC appends the access unit in AVCC format, where every NAL is
+// preceded by its 4 byte length, as MP4, Matroska and FLV store them.
+func (au *AccessUnit) AppendAVCC(dst []byte) []byte {
+	for _, nal := range au.NALs {
+		n := len(nal)
+		dst = append(dst, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+		dst = append(dst, nal...)
+	}
+	return dst
+}
+
+// AVCDecoderConfig returns the AVCDecoderConfigurationRecord for a pair of
+// parameter sets, which containers store in place of in-band SPS and PPS.
+func AVCDecoderConfig(sps []byte, pps []byte) []byte {
+	config := []byte{
+		1,      // configurationVersion
+		sps[1], // AVCProfileIndication
+		sps[2], // profile_compatibility
+		sps[3], // AVCLevelIndication
+		0xff,   // 4 byte NAL lengths
+		0xe1,   // 1 SPS
+		byte(len(sps) >> 8), byte(len(sps)),
+	}
+	config = append(config, sps...)
+	config = append(config, 1, byte(len(pps)>>8), byte(len(pps)))
+	return append(config, pps...)
+}
@@ -0,0 +1,67 @@
+package depacketizer_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/pion/rtp"
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/depacketizer"
+)
+
+var (
+	// A 1920x1080 constrained baseline SPS, which crops 8 lines off the bottom
+	testSPS = []byte{0x67, 0x42, 0xc0, 0x28, 0xd9, 0x00, 0x78, 0x02, 0x27, 0xe5, 0xc0, 0x44, 0x00, 0x00, 0x03, 0x00, 0x04, 0x00, 0x00, 0x03, 0x00, 0xf0, 0x3c, 0x60, 0xc9, 0x20}
+	testPPS = []byte{0x68, 0xcb, 0x83, 0xcb, 0x20}
+)
+
+func packet(seq uint16, timestamp uint32, marker bool, payload ...byte) *rtp.Packet {
+	return &rtp.Packet{Header: rtp.Header{SequenceNumber: seq, Timestamp: timestamp, Marker: marker}, Payload: payload}
+}
+
+func TestSPSResolution(t *testing.T) {
+	width, height, err := depacketizer.SPSResolution(testSPS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if width != 1920 || height != 1080 {
+		t.Errorf("Expected 1920x1080, got %vx%v", width, height)
+	}
+}
+
+func TestH264_ReassemblesFrames(t *testing.T) {
+	d := depacketizer.NewH264()
+
+	// A delta frame can't start the stream
+	if au := d.Push(packet(1, 0, true, 0x41, 0x01)); au != nil {
+		t.Fatalf("Expected to wait for a keyframe, got %v", au)
+	}
+
+	stapA := append([]byte{0x18, 0x00, byte(len(testSPS))}, testSPS...)
+	stapA = append(stapA, 0x00, byte(len(testPPS)))
+	stapA = append(stapA, testPPS...)
+	d.Push(packet(2, 3000, false, stapA...))
+	d.Push(packet(3, 3000, false, 0x7c, 0x85, 0x01, 0x02))
+	au := d.Push(packet(4, 3000, true, 0x7c, 0x45, 0x03))
+	if au == nil || !au.Keyframe {
+		t.Fatalf("Expected a keyframe, got %v", au)
+	}
+	if len(au.NALs) != 3 || !bytes.Equal(au.NALs[2], []byte{0x65, 0x01, 0x02, 0x03}) {
+		t.Errorf("Expected the SPS, PPS and the reassembled IDR slice, got %x", au.NALs)
+	}
+	if !bytes.Equal(au.SPS, testSPS) || !bytes.Equal(au.PPS, testPPS) {
+		t.Errorf("Expected the parameter sets to be kept")
+	}
+
+	// Losing packet 6 breaks every frame until the next keyframe
+	requested := 0
+	d.KeyframeNeeded = func() { requested++ }
+	if au := d.Push(packet(7, 9000, true, 0x41, 0x02)); au != nil {
+		t.Errorf("Expected frames after a loss to be dropped")
+	}
+	if requested != 1 {
+		t.Errorf("Expected a keyframe to be requested once, got %v", requested)
+	}
+	if au := d.Push(packet(8, 12000, true, 0x65, 0x04)); au == nil || !au.Keyframe {
+		t.Errorf("Expected the next keyframe to be returned, got %v", au)
+	}
+}
@@ -0,0 +1,170 @@
+package depacketizer
+
+import (
+	"errors"
+)
+
+var errShortSPS = errors.New("sps is truncated")
+
+// bitReader reads the Exp-Golomb coded fields of a parameter set. Once it runs
+// out of data, every read returns 0 and err is set.
+type bitReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *bitReader) bit() uint {
+	if r.pos >= len(r.data)*8 {
+		r.err = errShortSPS
+		return 0
+	}
+	b := r.data[r.pos/8] >> (7 - r.pos%8) & 1
+	r.pos++
+	return uint(b)
+}
+
+func (r *bitReader) bits(n int) uint {
+	v := uint(0)
+	for i := 0; i < n; i++ {
+		v = v<<1 | r.bit()
+	}
+	return v
+}
+
+// ue reads an unsigned Exp-Golomb code
+func (r *bitReader) ue() uint {
+	zeros := 0
+	for r.bit() == 0 {
+		zeros++
+		if zeros > 31 || r.err != nil {
+			r.err = errShortSPS
+			return 0
+		}
+	}
+	return 1<<zeros - 1 + r.bits(zeros)
+}
+
+// se reads a signed Exp-Golomb code
+func (r *bitReader) se() int {
+	v := r.ue()
+	if v%2 == 1 {
+		return int(v+1) / 2
+	}
+	return -int(v / 2)
+}
+
+// unescape removes the emulation prevention bytes from a NAL
+func unescape(nal []byte) []byte {
+	out := make([]byte, 0, len(nal))
+	zeros := 0
+	for _, b := range nal {
+		if zeros == 2 && b == 0x03 {
+			zeros = 0
+			continue
+		}
+		out = append(out, b)
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return out
+}
+
+// SPSResolution returns the size of the pictures that an SPS describes, after cropping
+func SPSResolution(sps []byte) (width int, height int, err error) {
+	if len(sps) < 4 {
+		return 0, 0, errShortSPS
+	}
+	profile := sps[1]
+	r := &bitReader{data: unescape(sps[4:])}
+
+	r.ue() // seq_parameter_set_id
+	chromaFormat := uint(1)
+	switch profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		chromaFormat = r.ue()
+		if chromaFormat == 3 {
+			r.bit() // separate_colour_plane_flag
+		}
+		r.ue()  // bit_depth_luma_minus8
+		r.ue()  // bit_depth_chroma_minus8
+		r.bit() // qpprime_y_zero_transform_bypass_flag
+		if r.bit() == 1 {
+			// seq_scaling_matrix_present_flag
+			lists := 8
+			if chromaFormat == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				if r.bit() == 1 {
+					size := 16
+					if i >= 6 {
+						size = 64
+					}
+					skipScalingList(r, size)
+				}
+			}
+		}
+	}
+
+	r.ue() // log2_max_frame_num_minus4
+	switch r.ue() {
+	// pic_order_cnt_type
+	case 0:
+		r.ue() // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		r.bit() // delta_pic_order_always_zero_flag
+		r.se()  // offset_for_non_ref_pic
+		r.se()  // offset_for_top_to_bottom_field
+		cycle := r.ue()
+		for i := uint(0); i < cycle && r.err == nil; i++ {
+			r.se() // offset_for_ref_frame
+		}
+	}
+
+	r.ue()  // max_num_ref_frames
+	r.bit() // gaps_in_frame_num_value_allowed_flag
+	widthInMbs := int(r.ue()) + 1
+	heightInMapUnits := int(r.ue()) + 1
+	frameMbsOnly := int(r.bit())
+	if frameMbsOnly == 0 {
+		r.bit() // mb_adaptive_frame_field_flag
+	}
+	r.bit() // direct_8x8_inference_flag
+
+	width = widthInMbs * 16
+	height = (2 - frameMbsOnly) * heightInMapUnits * 16
+
+	if r.bit() == 1 {
+		// frame_cropping_flag
+		left, right, top, bottom := r.ue(), r.ue(), r.ue(), r.ue()
+		cropX, cropY := 2, 2*(2-frameMbsOnly)
+		if chromaFormat == 0 || chromaFormat == 3 {
+			cropX, cropY = 1, 2-frameMbsOnly
+		} else if chromaFormat == 2 {
+			cropY = 2 - frameMbsOnly
+		}
+		width -= cropX * int(left+right)
+		height -= cropY * int(top+bottom)
+	}
+
+	if r.err != nil {
+		return 0, 0, r.err
+	}
+	return width, height, nil
+}
+
+func skipScalingList(r *bitReader, size int) {
+	last, next := 8, 8
+	for i := 0; i < size && r.err == nil; i++ {
+		if next != 0 {
+			next = (last + r.se() + 256) % 256
+		}
+		if next != 0 {
+			last = next
+		}
+	}
+}
@@ -6,6 +6,7 @@ import (
 
 	"github.com/pion/webrtc/v4"
 	"github.com/pod-arcade/pod-arcade/api"
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/microphone"
 	"github.com/pod-arcade/pod-arcade/pkg/log"
 	"github.com/pod-arcade/pod-arcade/pkg/util"
 	"github.com/rs/zerolog"
@@ -19,22 +20,49 @@ type Desktop struct {
 	keyboard  api.Keyboard
 	mouse     api.Mouse
 
+	controllers []api.Controller
+	preview     api.PreviewSource
+	audioSink   api.AudioSink
+
 	mixer         *Mixer
 	webrtcAPI     *webrtc.API
 	webrtcAPIConf *webrtc.Configuration
 
 	inputChannels map[api.SessionID]*webrtc.DataChannel
+	sessions      map[api.SessionID]api.Session
+	// connected holds the sessions that are connected, which acquired their tracks
+	connected map[api.SessionID]bool
+	// videoSenders are each session's video senders, in the order of the offer's video sections
+	videoSenders map[api.SessionID][]*videoSender
+	audioSenders map[api.SessionID]map[api.Track]*audioSender
+	// modes are the media modes of the sessions that aren't in MediaModeFull
+	modes map[api.SessionID]api.MediaMode
+	// outputSettings are the settings that outputs are encoded with for the sessions watching them
+	outputSettings map[string]api.VideoSettings
+	// settingsMtx keeps outputs from being encoded with settings out of order
+	settingsMtx sync.Mutex
+	// microphones are the sessions' microphones, which play once the session sends a track
+	microphones map[api.SessionID]*microphone.Microphone
 
 	rwm sync.RWMutex
 	l   zerolog.Logger
 }
 
 func NewDesktop() api.Desktop {
-	return &Desktop{
-		l:             log.NewLogger("Desktop", nil),
-		mixer:         NewMixer(),
-		inputChannels: map[api.SessionID]*webrtc.DataChannel{},
+	d := &Desktop{
+		l:              log.NewLogger("Desktop", nil),
+		mixer:          NewMixer(),
+		inputChannels:  map[api.SessionID]*webrtc.DataChannel{},
+		sessions:       map[api.SessionID]api.Session{},
+		connected:      map[api.SessionID]bool{},
+		videoSenders:   map[api.SessionID][]*videoSender{},
+		audioSenders:   map[api.SessionID]map[api.Track]*audioSender{},
+		modes:          map[api.SessionID]api.MediaMode{},
+		outputSettings: map[string]api.VideoSettings{},
+		microphones:    map[api.SessionID]*microphone.Microphone{},
 	}
+	d.mixer.OnSourcesChanged(d.updateSessions)
+	return d
 }
 
 func (d *Desktop) WithSignaler(s api.Signaler) api.Desktop {
@@ -68,12 +96,37 @@ func (d *Desktop) WithAudioSource(a api.AudioSource) api.Desktop {
 	d.mixer.AddAudioSource(a)
 	return d
 }
+func (d *Desktop) WithVideoCodecPreference(mimeTypes ...string) api.Desktop {
+	d.l.Info().Msgf("Preferring video codecs %v", mimeTypes)
+	d.mixer.SetVideoCodecPreference(mimeTypes)
+	return d
+}
 func (d *Desktop) WithWebRTCAPI(api *webrtc.API, conf *webrtc.Configuration) api.Desktop {
 	d.webrtcAPI = api
 	d.webrtcAPIConf = conf
 	return d
 }
+func (d *Desktop) WithController(c api.Controller) api.Desktop {
+	d.l.Info().Msgf("Adding controller %s", c.GetName())
+	d.controllers = append(d.controllers, c)
+	return d
+}
+
+func (d *Desktop) WithPreviewSource(p api.PreviewSource) api.Desktop {
+	d.l.Info().Msgf("Adding preview source %s", p.GetName())
+	d.preview = p
+	return d
+}
+
+func (d *Desktop) WithAudioSink(s api.AudioSink) api.Desktop {
+	d.l.Info().Msgf("Adding audio sink %s", s.GetName())
+	d.audioSink = s
+	return d
+}
 
+func (d *Desktop) GetAudioSink() api.AudioSink {
+	return d.audioSink
+}
 func (d *Desktop) GetSignalers() []api.Signaler {
 	return d.signalers
 }
@@ -95,6 +148,17 @@ func (d *Desktop) GetMouse() api.Mouse {
 func (d *Desktop) GetWebRTCAPI() (api *webrtc.API, conf *webrtc.Configuration) {
 	return d.webrtcAPI, d.webrtcAPIConf
 }
+func (d *Desktop) GetPreviewSource() api.PreviewSource {
+	return d.preview
+}
+
+// GetControllers returns the controllers, starting with the mixer, which reports the health of sources
+func (d *Desktop) GetControllers() []api.Controller {
+	return append([]api.Controller{d.mixer}, d.controllers...)
+}
+func (d *Desktop) GetMixer() api.Mixer {
+	return d.mixer
+}
 
 func (d *Desktop) HandleGamepadRumble(rumble api.GamepadRumble) {
 	d.rwm.RLock()
@@ -162,22 +226,20 @@ func (d *Desktop) HandleSession(s api.Session) error {
 	defer d.rwm.Unlock()
 	pc := s.GetPeerConnection()
 
-	// Register Video with peer connection
-	for _, v := range d.mixer.GetVideoTracks() {
-		sender, err := pc.AddTrack(v)
-		if err != nil {
-			return err
-		}
-		d.runPacketDisposer(sender)
+	// Register Video with peer connection, using the codec that best matches the offer.
+	// Each video section of the offer gets the next output, so a session that wants
+	// every monitor can offer a section for each. Without a common codec the session
+	// still gets audio and input.
+	d.sessions[s.GetID()] = s
+	d.videoSenders[s.GetID()] = []*videoSender{}
+	if _, err := d.addVideoSenders(s); err != nil {
+		return err
 	}
 
 	// Register Audio with peer connection
-	for _, v := range d.mixer.GetAudioTracks() {
-		sender, err := pc.AddTrack(v)
-		if err != nil {
-			return err
-		}
-		d.runPacketDisposer(sender)
+	d.audioSenders[s.GetID()] = map[api.Track]*audioSender{}
+	if _, err := d.updateAudioSenders(s); err != nil {
+		return err
 	}
 
 	// Create Input Channel
@@ -192,18 +254,95 @@ func (d *Desktop) HandleSession(s api.Session) error {
 	}
 	d.inputChannels[s.GetID()] = input
 
-	// Handle Input Messages
+	// Play the session's microphone, if it sends one
+	if d.audioSink != nil {
+		d.microphones[s.GetID()] = microphone.NewMicrophone(s.GetID(), d.audioSink, 0)
+		pc.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+			d.playMicrophone(s.GetID(), track)
+		})
+	}
+
+	// Handle Input Messages. Frame echoes are about this session, rather than input.
+	latency := newLatencyTracker(s.GetID(), pc)
 	input.OnMessage(func(msg webrtc.DataChannelMessage) {
-		d.HandleInputMessage(msg.Data)
+		if len(msg.Data) == 0 {
+			return
+		}
+		switch api.InputType(msg.Data[0]) {
+		case api.InputTypeFrameEcho:
+			echo := api.FrameEcho{}
+			if err := echo.FromBytes(msg.Data); err != nil {
+				d.l.Warn().Err(err).Msg("Failed to parse frame echo")
+				return
+			}
+			latency.HandleFrameEcho(echo)
+		case api.InputTypeSelectOutput:
+			sel := api.SelectOutput{}
+			if err := sel.FromBytes(msg.Data); err != nil {
+				d.l.Warn().Err(err).Msg("Failed to parse output selection")
+				return
+			}
+			d.selectOutput(s.GetID(), sel)
+		case api.InputTypeMicrophone:
+			state := api.MicrophoneState{}
+			if err := state.FromBytes(msg.Data); err != nil {
+				d.l.Warn().Err(err).Msg("Failed to parse microphone state")
+				return
+			}
+			d.setMicrophoneMuted(s.GetID(), state.Muted)
+		case api.InputTypePauseTrack:
+			pause := api.PauseTrack{}
+			if err := pause.FromBytes(msg.Data); err != nil {
+				d.l.Warn().Err(err).Msg("Failed to parse track pause")
+				return
+			}
+			d.pauseTrack(s.GetID(), pause)
+		case api.InputTypeMediaMode:
+			mode := api.SetMediaMode{}
+			if err := mode.FromBytes(msg.Data); err != nil {
+				d.l.Warn().Err(err).Msg("Failed to parse media mode")
+				return
+			}
+			d.setMediaMode(s.GetID(), mode.Mode)
+		case api.InputTypeVideoSettings:
+			set := api.SetVideoSettings{}
+			if err := set.FromBytes(msg.Data); err != nil {
+				d.l.Warn().Err(err).Msg("Failed to parse video settings")
+				return
+			}
+			// Restarting the encoder takes a moment, and input shouldn't wait on it
+			go d.setVideoSettings(s.GetID(), set)
+		default:
+			d.HandleInputMessage(msg.Data)
+		}
 	})
 
-	// Handle Peer Connection disconnect
-	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
-		// If we're disconnected
-		if state == webrtc.PeerConnectionStateDisconnected ||
-			state == webrtc.PeerConnectionStateFailed ||
+	// Start the session's sources once it's connected, and release them when it's gone.
+	// Disconnected isn't gone, since ICE often recovers from it.
+	s.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateConnected {
+			d.connectSession(s.GetID())
+			// The outputs it watches are encoded for it too now
+			d.rwm.RLock()
+			outputs := d.sessionOutputs(s.GetID())
+			d.rwm.RUnlock()
+			d.applyVideoSettings(outputs...)
+		}
+		if state == webrtc.PeerConnectionStateFailed ||
 			state == webrtc.PeerConnectionStateClosed {
+			d.rwm.Lock()
+			outputs := d.sessionOutputs(s.GetID())
+			d.releaseSession(s.GetID())
+			d.forgetMediaMode(s.GetID())
+			latency.Close()
 			d.inputChannels[s.GetID()] = nil
+			delete(d.sessions, s.GetID())
+			delete(d.videoSenders, s.GetID())
+			delete(d.audioSenders, s.GetID())
+			delete(d.microphones, s.GetID())
+			d.rwm.Unlock()
+			// The outputs it watched may not need the settings it asked for anymore
+			d.applyVideoSettings(outputs...)
 		}
 	})
 
@@ -259,6 +398,18 @@ func (d *Desktop) Run(ctx context.Context) error {
 		}(s)
 	}
 
+	// Start making previews
+	if d.preview != nil {
+		d.l.Debug().Msgf("Starting preview source — %v...", d.preview.GetName())
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := d.preview.Run(ctx); err != nil {
+				d.l.Error().Err(err).Msg("Preview source stopped")
+			}
+		}()
+	}
+
 	d.l.Debug().Msg("Starting Mixer...")
 	err := d.mixer.Stream(ctx)
 
@@ -0,0 +1,115 @@
+package encoder
+
+import "fmt"
+
+// ffmpegEncoder is the name of the profile's encoder in ffmpeg, which wf-recorder uses too
+func (p EncoderProfile) ffmpegEncoder() string {
+	switch {
+	case p.isH264() && p.Hardware:
+		return "h264_vaapi"
+	case p.isH264():
+		return "libx264"
+	case p.Hardware:
+		return "vp9_vaapi"
+	default:
+		return "libvpx-vp9"
+	}
+}
+
+// ffmpegOptions returns the profile's options for ffmpeg's encoder, by their AVOption names
+func (p EncoderProfile) ffmpegOptions() map[string]string {
+	options := map[string]string{
+		"g": fmt.Sprint(p.GOP),
+	}
+	if p.Hardware {
+		// Don't let frames queue up in the GPU
+		options["async_depth"] = "1"
+		if p.Bitrate > 0 {
+			options["b"] = fmt.Sprintf("%vk", p.Bitrate)
+			options["rc_mode"] = "CBR"
+		} else {
+			options["global_quality"] = fmt.Sprint(p.CRF)
+		}
+	} else if p.Bitrate > 0 {
+		options["b"] = fmt.Sprintf("%vk", p.Bitrate)
+		options["maxrate"] = fmt.Sprintf("%vk", p.Bitrate)
+		options["bufsize"] = fmt.Sprintf("%vk", p.Bitrate)
+	} else {
+		options["crf"] = fmt.Sprint(p.CRF)
+		if !p.isH264() {
+			// libvpx only holds the quality constant without a target bitrate
+			options["b"] = "0"
+		}
+	}
+
+	if p.isH264() {
+		if p.Profile != "" {
+			options["profile"] = p.Profile
+			if !p.Hardware {
+				options["profile"] = p.x264Profile()
+			}
+		}
+		if p.Slices > 0 {
+			options["slices"] = fmt.Sprint(p.Slices)
+		}
+		if !p.Hardware {
+			// Keyframes that are asked for have to be IDR frames, or receivers can't start from them
+			options["forced-idr"] = "1"
+			if p.Preset != "" {
+				options["preset"] = p.Preset
+			}
+			if p.Tune != "" {
+				options["tune"] = p.Tune
+			}
+			if p.SliceMaxSize > 0 {
+				options["x264-params"] = fmt.Sprintf("slice-max-size=%v", p.SliceMaxSize)
+			}
+		} else if p.SliceMaxSize > 0 {
+			options["max_frame_size"] = fmt.Sprint(p.SliceMaxSize * max(p.Slices, 1))
+		}
+	} else if !p.Hardware && p.Preset != "" {
+		options["deadline"] = p.Preset
+		if p.Preset == "realtime" {
+			options["cpu-used"] = "8"
+			options["row-mt"] = "1"
+			options["lag-in-frames"] = "0"
+			options["error-resilient"] = "1"
+			options["tile-columns"] = "2"
+		}
+	}
+	return options
+}
+
+// WFRecorderArgs returns the arguments that make wf-recorder encode with the profile.
+// The caller adds the muxer and the file to write to.
+func (p EncoderProfile) WFRecorderArgs() []string {
+	args := []string{"-c", p.ffmpegEncoder(), "-r", fmt.Sprint(p.FrameRate)}
+	if !p.Hardware && p.PixelFormat != "" {
+		args = append(args, "-x", p.PixelFormat)
+	}
+	options := p.ffmpegOptions()
+	for _, k := range sortedOptions(options) {
+		args = append(args, "-p", k+"="+options[k])
+	}
+	return args
+}
+
+// FFmpegArgs returns the output arguments that make ffmpeg encode video with the
+// profile. The caller adds the input, and the VAAPI device and upload filter for
+// hardware profiles.
+func (p EncoderProfile) FFmpegArgs() []string {
+	args := []string{"-c:v", p.ffmpegEncoder(), "-r", fmt.Sprint(p.FrameRate)}
+	if !p.Hardware && p.PixelFormat != "" {
+		args = append(args, "-pix_fmt", p.PixelFormat)
+	}
+	options := p.ffmpegOptions()
+	for _, k := range sortedOptions(options) {
+		flag := "-" + k
+		// These would apply to every stream without a specifier
+		if k == "b" || k == "profile" {
+			flag += ":v"
+		}
+		args = append(args, flag, options[k])
+	}
+	return args
+}
@@ -0,0 +1,119 @@
+package encoder
+
+import (
+	"fmt"
+	"strings"
+)
+
+// gstreamerFormats are the names of pixel formats in GStreamer's caps
+var gstreamerFormats = map[string]string{
+	"yuv420p": "I420",
+	"nv12":    "NV12",
+	"yuv444p": "Y444",
+}
+
+// gstreamerEncoder returns the profile's GStreamer encoder element and its properties
+func (p EncoderProfile) gstreamerEncoder() (string, map[string]string) {
+	properties := map[string]string{}
+	switch {
+	case p.isH264() && p.Hardware:
+		properties["keyframe-period"] = fmt.Sprint(p.GOP)
+		if p.Bitrate > 0 {
+			properties["rate-control"] = "cbr"
+			properties["bitrate"] = fmt.Sprint(p.Bitrate)
+		} else {
+			properties["rate-control"] = "cqp"
+			properties["init-qp"] = fmt.Sprint(p.CRF)
+		}
+		if p.Slices > 0 {
+			properties["num-slices"] = fmt.Sprint(p.Slices)
+		}
+		return "vaapih264enc", properties
+
+	case p.isH264():
+		properties["key-int-max"] = fmt.Sprint(p.GOP)
+		if p.Bitrate > 0 {
+			properties["pass"] = "cbr"
+			properties["bitrate"] = fmt.Sprint(p.Bitrate)
+		} else {
+			properties["pass"] = "quant"
+			properties["quantizer"] = fmt.Sprint(p.CRF)
+		}
+		if p.Preset != "" {
+			properties["speed-preset"] = p.Preset
+		}
+		switch p.Tune {
+		case "":
+		case "zerolatency", "fastdecode", "stillimage":
+			properties["tune"] = p.Tune
+		default:
+			// x264enc keeps the psychovisual tunings apart from the rest
+			properties["psy-tune"] = p.Tune
+		}
+		x264Options := []string{}
+		if p.Slices > 0 {
+			x264Options = append(x264Options, fmt.Sprintf("slices=%v", p.Slices))
+		}
+		if p.SliceMaxSize > 0 {
+			x264Options = append(x264Options, fmt.Sprintf("slice-max-size=%v", p.SliceMaxSize))
+		}
+		if len(x264Options) > 0 {
+			properties["option-string"] = strings.Join(x264Options, ":")
+		}
+		return "x264enc", properties
+
+	case p.Hardware:
+		properties["keyframe-period"] = fmt.Sprint(p.GOP)
+		if p.Bitrate > 0 {
+			properties["rate-control"] = "cbr"
+			properties["bitrate"] = fmt.Sprint(p.Bitrate)
+		} else {
+			properties["rate-control"] = "cqp"
+			// vaapivp9enc's quantizer goes up to 255 rather than 63
+			properties["yac-qi"] = fmt.Sprint(min(p.CRF*4, 255))
+		}
+		return "vaapivp9enc", properties
+
+	default:
+		properties["keyframe-max-dist"] = fmt.Sprint(p.GOP)
+		if p.Bitrate > 0 {
+			properties["end-usage"] = "cbr"
+			properties["target-bitrate"] = fmt.Sprint(p.Bitrate * 1000)
+		} else {
+			properties["end-usage"] = "q"
+			properties["cq-level"] = fmt.Sprint(p.CRF)
+		}
+		if p.Preset == "realtime" {
+			properties["deadline"] = "1"
+			properties["cpu-used"] = "8"
+			properties["row-mt"] = "true"
+			properties["lag-in-frames"] = "0"
+			properties["error-resilient"] = "default"
+			properties["tile-columns"] = "2"
+		}
+		return "vp9enc", properties
+	}
+}
+
+// GStreamerArgs returns the part of a gst-launch pipeline that encodes raw video with
+// the profile, from the conversion of the raw frames to the encoded caps. The caller
+// links a source before it, and a parser or muxer after it.
+func (p EncoderProfile) GStreamerArgs() []string {
+	raw := fmt.Sprintf("video/x-raw,framerate=%v/1", p.FrameRate)
+	if format, ok := gstreamerFormats[p.PixelFormat]; ok && !p.Hardware {
+		raw = fmt.Sprintf("video/x-raw,format=%v,framerate=%v/1", format, p.FrameRate)
+	}
+	args := []string{"videoconvert", "!", "videorate", "!", raw, "!"}
+
+	element, properties := p.gstreamerEncoder()
+	args = append(args, element)
+	for _, k := range sortedOptions(properties) {
+		args = append(args, k+"="+properties[k])
+	}
+
+	if p.isH264() && p.Profile != "" {
+		// GStreamer spells profiles with dashes
+		args = append(args, "!", "video/x-h264,profile="+strings.ReplaceAll(p.Profile, "_", "-"))
+	}
+	return args
+}
@@ -0,0 +1,205 @@
+// Package encoder describes how video is encoded, independently of the program that
+// encodes it. An EncoderProfile is translated into the arguments of wf-recorder,
+// gst-launch or ffmpeg, so every capture backend encodes the same way.
+package encoder
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// EncoderProfile is a set of encoder settings
+type EncoderProfile struct {
+	Name string `json:"name"`
+	// Codec is the mime type of the codec, either video/H264 or video/VP9
+	Codec string `json:"codec"`
+	// Hardware encodes with VAAPI instead of a software encoder
+	Hardware bool `json:"hardware,omitempty"`
+
+	// Bitrate is the target bitrate in kbit/s. When it's 0, the encoder aims for a
+	// constant quality of CRF instead.
+	Bitrate int `json:"bitrate,omitempty"`
+	// CRF is the constant quality, from 0 (lossless) to 51 for H.264 or 63 for VP9
+	CRF int `json:"crf,omitempty"`
+	// GOP is how many frames there are from one keyframe to the next
+	GOP       int `json:"gop"`
+	FrameRate int `json:"frameRate"`
+
+	// Preset is the speed preset of software encoders, like ultrafast for H.264 or
+	// realtime for VP9
+	Preset string `json:"preset,omitempty"`
+	// Tune is the tuning of software H.264 encoders, like zerolatency
+	Tune string `json:"tune,omitempty"`
+	// Profile is the H.264 profile, like constrained_baseline
+	Profile string `json:"profile,omitempty"`
+
+	// Slices is how many slices H.264 frames are split into, and SliceMaxSize is the
+	// most bytes a slice may take, so each fits in a packet. 0 leaves them to the encoder.
+	Slices       int `json:"slices,omitempty"`
+	SliceMaxSize int `json:"sliceMaxSize,omitempty"`
+	// PixelFormat is what frames are converted to before software encoding, like yuv420p
+	PixelFormat string `json:"pixelFormat,omitempty"`
+}
+
+var (
+	x264Presets  = []string{"ultrafast", "superfast", "veryfast", "faster", "fast", "medium", "slow", "slower", "veryslow", "placebo"}
+	x264Tunes    = []string{"film", "animation", "grain", "stillimage", "psnr", "ssim", "fastdecode", "zerolatency"}
+	vp9Presets   = []string{"realtime", "good", "best"}
+	h264Profiles = []string{"baseline", "constrained_baseline", "main", "high"}
+	pixelFormats = []string{"yuv420p", "nv12", "yuv444p"}
+)
+
+// Validate checks that the profile can be translated for every encoder
+func (p EncoderProfile) Validate() error {
+	if err := p.validate(); err != nil {
+		return fmt.Errorf("encoder profile %q: %w", p.Name, err)
+	}
+	return nil
+}
+
+func (p EncoderProfile) validate() error {
+	if p.Name == "" {
+		return errors.New("missing a name")
+	}
+	h264 := p.isH264()
+	if !h264 && !strings.EqualFold(p.Codec, webrtc.MimeTypeVP9) {
+		return fmt.Errorf("unsupported codec %q, should be %v or %v", p.Codec, webrtc.MimeTypeH264, webrtc.MimeTypeVP9)
+	}
+
+	maxCRF := 51
+	if !h264 {
+		maxCRF = 63
+	}
+	if p.Bitrate < 0 {
+		return fmt.Errorf("bitrate %v is negative", p.Bitrate)
+	}
+	if p.CRF < 0 || p.CRF > maxCRF {
+		return fmt.Errorf("crf %v should be between 0 and %v", p.CRF, maxCRF)
+	}
+	if p.GOP < 1 {
+		return fmt.Errorf("gop %v should be at least 1", p.GOP)
+	}
+	if p.FrameRate < 1 || p.FrameRate > 240 {
+		return fmt.Errorf("frame rate %v should be between 1 and 240", p.FrameRate)
+	}
+	if p.Slices < 0 || p.SliceMaxSize < 0 {
+		return errors.New("slices can't be negative")
+	}
+
+	if p.Hardware {
+		if p.Preset != "" || p.Tune != "" || p.PixelFormat != "" {
+			return errors.New("hardware encoders don't take a preset, tune or pixel format")
+		}
+	} else if p.PixelFormat != "" && !slices.Contains(pixelFormats, p.PixelFormat) {
+		return fmt.Errorf("unsupported pixel format %q, should be one of %v", p.PixelFormat, pixelFormats)
+	}
+
+	if h264 {
+		if !p.Hardware && p.Preset != "" && !slices.Contains(x264Presets, p.Preset) {
+			return fmt.Errorf("unknown preset %q, should be one of %v", p.Preset, x264Presets)
+		}
+		if p.Tune != "" && !slices.Contains(x264Tunes, p.Tune) {
+			return fmt.Errorf("unknown tune %q, should be one of %v", p.Tune, x264Tunes)
+		}
+		if p.Profile != "" && !slices.Contains(h264Profiles, p.Profile) {
+			return fmt.Errorf("unknown H.264 profile %q, should be one of %v", p.Profile, h264Profiles)
+		}
+		return nil
+	}
+
+	if !p.Hardware && p.Preset != "" && !slices.Contains(vp9Presets, p.Preset) {
+		return fmt.Errorf("unknown preset %q, should be one of %v", p.Preset, vp9Presets)
+	}
+	if p.Tune != "" || p.Profile != "" || p.Slices != 0 || p.SliceMaxSize != 0 {
+		return errors.New("VP9 doesn't take a tune, H.264 profile or slices")
+	}
+	return nil
+}
+
+func (p EncoderProfile) isH264() bool {
+	return strings.EqualFold(p.Codec, webrtc.MimeTypeH264)
+}
+
+// x264Profile is the H.264 profile in x264's terms, which doesn't have constrained baseline.
+// Baseline is constrained baseline there anyway.
+func (p EncoderProfile) x264Profile() string {
+	if p.Profile == "constrained_baseline" {
+		return "baseline"
+	}
+	return p.Profile
+}
+
+// sortedOptions returns the keys of options in order, so command lines are stable
+func sortedOptions(options map[string]string) []string {
+	keys := make([]string, 0, len(options))
+	for k := range options {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Profiles are encoder profiles by name
+type Profiles map[string]EncoderProfile
+
+// DefaultProfiles returns the built-in profiles, which encode at 60fps with the given
+// constant quality. The H.264 ones use the given H.264 profile.
+func DefaultProfiles(crf int, h264Profile string) Profiles {
+	return Profiles{
+		"h264": {
+			Name: "h264", Codec: webrtc.MimeTypeH264,
+			CRF: crf, GOP: 30, FrameRate: 60,
+			Preset: "ultrafast", Tune: "zerolatency", Profile: h264Profile,
+			Slices: 1, SliceMaxSize: 1200, PixelFormat: "yuv420p",
+		},
+		"h264-vaapi": {
+			Name: "h264-vaapi", Codec: webrtc.MimeTypeH264, Hardware: true,
+			CRF: crf, GOP: 30, FrameRate: 60,
+			Profile: h264Profile,
+		},
+		"vp9": {
+			Name: "vp9", Codec: webrtc.MimeTypeVP9,
+			CRF: crf, GOP: 30, FrameRate: 60,
+			Preset: "realtime", PixelFormat: "yuv420p",
+		},
+		"vp9-vaapi": {
+			Name: "vp9-vaapi", Codec: webrtc.MimeTypeVP9, Hardware: true,
+			CRF: crf, GOP: 30, FrameRate: 60,
+		},
+	}
+}
+
+// Add validates profiles and adds them, replacing the ones with the same name
+func (p Profiles) Add(profiles ...EncoderProfile) error {
+	for _, profile := range profiles {
+		if err := profile.Validate(); err != nil {
+			return err
+		}
+		p[profile.Name] = profile
+	}
+	return nil
+}
+
+// Get returns the profile with the given name
+func (p Profiles) Get(name string) (EncoderProfile, error) {
+	profile, ok := p[name]
+	if !ok {
+		return EncoderProfile{}, fmt.Errorf("unknown encoder profile %q, should be one of %v", name, p.Names())
+	}
+	return profile, profile.Validate()
+}
+
+// Names returns the names of the profiles, in order
+func (p Profiles) Names() []string {
+	names := make([]string, 0, len(p))
+	for name := range p {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
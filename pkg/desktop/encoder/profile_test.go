@@ -0,0 +1,95 @@
+package encoder
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/pion/webrtc/v4"
+)
+
+func TestEncoderProfile_CommandLines(t *testing.T) {
+	profiles := DefaultProfiles(30, "constrained_baseline")
+	bitrate := profiles["h264"]
+	bitrate.Bitrate = 4000
+	if err := profiles.Add(bitrate); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		wfr       string
+		ffmpeg    string
+		gstreamer string
+	}{
+		{
+			name:      "h264",
+			wfr:       "-c libx264 -r 60 -x yuv420p -p b=4000k -p bufsize=4000k -p forced-idr=1 -p g=30 -p maxrate=4000k -p preset=ultrafast -p profile=baseline -p slices=1 -p tune=zerolatency -p x264-params=slice-max-size=1200",
+			ffmpeg:    "-c:v libx264 -r 60 -pix_fmt yuv420p -b:v 4000k -bufsize 4000k -forced-idr 1 -g 30 -maxrate 4000k -preset ultrafast -profile:v baseline -slices 1 -tune zerolatency -x264-params slice-max-size=1200",
+			gstreamer: "videoconvert ! videorate ! video/x-raw,format=I420,framerate=60/1 ! x264enc bitrate=4000 key-int-max=30 option-string=slices=1:slice-max-size=1200 pass=cbr speed-preset=ultrafast tune=zerolatency ! video/x-h264,profile=constrained-baseline",
+		},
+		{
+			name:      "h264-vaapi",
+			wfr:       "-c h264_vaapi -r 60 -p async_depth=1 -p g=30 -p global_quality=30 -p profile=constrained_baseline",
+			ffmpeg:    "-c:v h264_vaapi -r 60 -async_depth 1 -g 30 -global_quality 30 -profile:v constrained_baseline",
+			gstreamer: "videoconvert ! videorate ! video/x-raw,framerate=60/1 ! vaapih264enc init-qp=30 keyframe-period=30 rate-control=cqp ! video/x-h264,profile=constrained-baseline",
+		},
+		{
+			name:      "vp9",
+			wfr:       "-c libvpx-vp9 -r 60 -x yuv420p -p b=0 -p cpu-used=8 -p crf=30 -p deadline=realtime -p error-resilient=1 -p g=30 -p lag-in-frames=0 -p row-mt=1 -p tile-columns=2",
+			ffmpeg:    "-c:v libvpx-vp9 -r 60 -pix_fmt yuv420p -b:v 0 -cpu-used 8 -crf 30 -deadline realtime -error-resilient 1 -g 30 -lag-in-frames 0 -row-mt 1 -tile-columns 2",
+			gstreamer: "videoconvert ! videorate ! video/x-raw,format=I420,framerate=60/1 ! vp9enc cpu-used=8 cq-level=30 deadline=1 end-usage=q error-resilient=default keyframe-max-dist=30 lag-in-frames=0 row-mt=true tile-columns=2",
+		},
+		{
+			name:      "vp9-vaapi",
+			wfr:       "-c vp9_vaapi -r 60 -p async_depth=1 -p g=30 -p global_quality=30",
+			ffmpeg:    "-c:v vp9_vaapi -r 60 -async_depth 1 -g 30 -global_quality 30",
+			gstreamer: "videoconvert ! videorate ! video/x-raw,framerate=60/1 ! vaapivp9enc keyframe-period=30 rate-control=cqp yac-qi=120",
+		},
+	}
+	for _, test := range tests {
+		profile, err := profiles.Get(test.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if args := strings.Join(profile.WFRecorderArgs(), " "); args != test.wfr {
+			t.Errorf("Expected wf-recorder args for %v:\n%v\ngot:\n%v", test.name, test.wfr, args)
+		}
+		if args := strings.Join(profile.FFmpegArgs(), " "); args != test.ffmpeg {
+			t.Errorf("Expected ffmpeg args for %v:\n%v\ngot:\n%v", test.name, test.ffmpeg, args)
+		}
+		if args := strings.Join(profile.GStreamerArgs(), " "); args != test.gstreamer {
+			t.Errorf("Expected gst-launch args for %v:\n%v\ngot:\n%v", test.name, test.gstreamer, args)
+		}
+	}
+}
+
+func TestEncoderProfile_Validate(t *testing.T) {
+	valid := EncoderProfile{Name: "test", Codec: webrtc.MimeTypeH264, GOP: 30, FrameRate: 60}
+	if err := valid.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	invalid := map[string]func(p *EncoderProfile){
+		"no name":           func(p *EncoderProfile) { p.Name = "" },
+		"unknown codec":     func(p *EncoderProfile) { p.Codec = "video/AV1" },
+		"crf out of range":  func(p *EncoderProfile) { p.CRF = 52 },
+		"no gop":            func(p *EncoderProfile) { p.GOP = 0 },
+		"no frame rate":     func(p *EncoderProfile) { p.FrameRate = 0 },
+		"unknown preset":    func(p *EncoderProfile) { p.Preset = "realtime" },
+		"unknown profile":   func(p *EncoderProfile) { p.Profile = "high10" },
+		"hardware preset":   func(p *EncoderProfile) { p.Hardware, p.Preset = true, "ultrafast" },
+		"vp9 slices":        func(p *EncoderProfile) { p.Codec, p.Slices = webrtc.MimeTypeVP9, 2 },
+		"unknown pixel fmt": func(p *EncoderProfile) { p.PixelFormat = "rgb24" },
+	}
+	for name, change := range invalid {
+		p := valid
+		change(&p)
+		if err := p.Validate(); err == nil {
+			t.Errorf("Expected a profile with %v to be invalid", name)
+		}
+	}
+
+	if _, err := DefaultProfiles(30, "main").Get("av1"); err == nil {
+		t.Error("Expected an unknown profile name to be an error")
+	}
+}
@@ -0,0 +1,390 @@
+// Package fanout_track sends one stream of RTP packets to many sessions. Every
+// session that the track is bound to gets its own queue and writer goroutine,
+// so a session that can't keep up only drops its own frames, and never holds
+// back anyone else.
+package fanout_track
+
+import (
+	"context"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"github.com/pod-arcade/pod-arcade/api"
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/frame_queue"
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/media_clock"
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/packet_pool"
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/webrtc_interceptors/stream_registry"
+	"github.com/pod-arcade/pod-arcade/pkg/log"
+	"github.com/pod-arcade/pod-arcade/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+)
+
+// SessionQueueSize is how many packets a session may fall behind before it drops frames
+const SessionQueueSize = 500
+
+var _ api.Track = (*Track)(nil)
+
+// binding is one session's copy of the track
+type binding struct {
+	session     api.SessionID
+	ssrc        webrtc.SSRC
+	payloadType webrtc.PayloadType
+	writer      webrtc.TrackLocalWriter
+	queue       *frame_queue.FrameQueue
+	cancel      context.CancelFunc
+	done        chan struct{}
+	// renumbering closes the gaps left by frames the session skips, for video
+	renumbering *stream_registry.Renumbering
+
+	lag prometheus.Gauge
+}
+
+// Track is a webrtc.TrackLocal that writes to every session through its own queue.
+type Track struct {
+	name     string
+	codec    webrtc.RTPCodecCapability
+	id       string
+	streamID string
+	kind     webrtc.RTPCodecType
+	// streams is where sessions' streams are registered for the interceptors
+	streams *stream_registry.Registry
+
+	requestKeyframe func()
+
+	bindings      map[string]*binding
+	subscriptions map[*subscription]bool
+	// keyframeIntervals are the sessions that only get keyframes, and how often
+	keyframeIntervals map[api.SessionID]time.Duration
+
+	// seq is the sequence number of the last packet written. Sources start from a
+	// random one every time they run, so the track numbers packets itself, and a
+	// restarted source carries on where the last run left off. Timestamps already
+	// carry on, since every source stamps packets with the shared clock.
+	seq        uint16
+	seqStarted bool
+	seqMtx     sync.Mutex
+
+	mtx sync.RWMutex
+	l   zerolog.Logger
+}
+
+// NewTrack creates a track for the named source, which registers the streams it's
+// bound to in streams. requestKeyframe asks the source for a keyframe.
+func NewTrack(name string, codec webrtc.RTPCodecCapability, id, streamID string, streams *stream_registry.Registry, requestKeyframe func()) *Track {
+	kind := webrtc.RTPCodecTypeAudio
+	if strings.HasPrefix(strings.ToLower(codec.MimeType), "video/") {
+		kind = webrtc.RTPCodecTypeVideo
+	}
+	return &Track{
+		name:              name,
+		codec:             codec,
+		id:                id,
+		streamID:          streamID,
+		kind:              kind,
+		streams:           streams,
+		requestKeyframe:   requestKeyframe,
+		bindings:          map[string]*binding{},
+		subscriptions:     map[*subscription]bool{},
+		keyframeIntervals: map[api.SessionID]time.Duration{},
+		l:                 log.NewLogger("FanoutTrack", map[string]string{"track": name}),
+	}
+}
+
+func (t *Track) ID() string {
+	return t.id
+}
+func (t *Track) RID() string {
+	return ""
+}
+func (t *Track) StreamID() string {
+	return t.streamID
+}
+func (t *Track) Kind() webrtc.RTPCodecType {
+	return t.kind
+}
+func (t *Track) Codec() webrtc.RTPCodecCapability {
+	return t.codec
+}
+
+// ForSession returns the track to add to a session's peer connection, so that
+// its metrics are labeled with the session.
+func (t *Track) ForSession(session api.SessionID) webrtc.TrackLocal {
+	return &sessionTrack{Track: t, session: session}
+}
+
+func (t *Track) Bind(ctx webrtc.TrackLocalContext) (webrtc.RTPCodecParameters, error) {
+	return t.bind(ctx, api.SessionID(ctx.ID()))
+}
+
+func (t *Track) Unbind(ctx webrtc.TrackLocalContext) error {
+	t.mtx.Lock()
+	b, ok := t.bindings[ctx.ID()]
+	delete(t.bindings, ctx.ID())
+	t.mtx.Unlock()
+
+	if !ok {
+		return nil
+	}
+	t.streams.Unregister(ctx.ID())
+	b.cancel()
+	<-b.done
+	// The session's series would otherwise be kept forever
+	metrics.GlobalMetricCache.Remove("session_track_lag_seconds", t.lagLabels(b.session))
+	b.queue.RemoveMetrics()
+	t.l.Debug().Msgf("Unbound session %v", b.session)
+	return nil
+}
+
+func (t *Track) lagLabels(session api.SessionID) prometheus.Labels {
+	return prometheus.Labels{"session": string(session), "track": t.name}
+}
+
+// findCodec picks the negotiated codec that matches ours, preferring an exact fmtp match
+func (t *Track) findCodec(negotiated []webrtc.RTPCodecParameters) (webrtc.RTPCodecParameters, bool) {
+	for _, c := range negotiated {
+		if strings.EqualFold(c.MimeType, t.codec.MimeType) && c.SDPFmtpLine == t.codec.SDPFmtpLine {
+			return c, true
+		}
+	}
+	for _, c := range negotiated {
+		if strings.EqualFold(c.MimeType, t.codec.MimeType) {
+			return c, true
+		}
+	}
+	return webrtc.RTPCodecParameters{}, false
+}
+
+// findRepairCodec returns the payload type of a negotiated repair codec, or 0 if it wasn't negotiated.
+// If fmtp is set, the codec's fmtp line has to contain it.
+func findRepairCodec(negotiated []webrtc.RTPCodecParameters, mimeType string, fmtp string) webrtc.PayloadType {
+	for _, c := range negotiated {
+		if !strings.EqualFold(c.MimeType, mimeType) {
+			continue
+		}
+		if fmtp == "" || slices.Contains(strings.Split(c.SDPFmtpLine, ";"), fmtp) {
+			return c.PayloadType
+		}
+	}
+	return 0
+}
+
+func (t *Track) bind(ctx webrtc.TrackLocalContext, session api.SessionID) (webrtc.RTPCodecParameters, error) {
+	codec, ok := t.findCodec(ctx.CodecParameters())
+	if !ok {
+		return webrtc.RTPCodecParameters{}, webrtc.ErrUnsupportedCodec
+	}
+
+	queueName := t.name + "/" + string(session)
+	writerCtx, cancel := context.WithCancel(context.Background())
+	b := &binding{
+		session:     session,
+		ssrc:        ctx.SSRC(),
+		payloadType: codec.PayloadType,
+		writer:      ctx.WriteStream(),
+		queue:       frame_queue.NewFrameQueue(queueName, t.codec.MimeType, SessionQueueSize, t.keyframeNeeded(session)),
+		cancel:      cancel,
+		done:        make(chan struct{}),
+		lag:         metrics.GlobalMetricCache.GetGauge("session_track_lag_seconds", t.lagLabels(session)),
+	}
+	if t.kind == webrtc.RTPCodecTypeVideo {
+		b.renumbering = &stream_registry.Renumbering{}
+	}
+
+	t.mtx.Lock()
+	t.bindings[ctx.ID()] = b
+	if interval := t.keyframeIntervals[session]; interval > 0 {
+		b.queue.SetKeyframeInterval(interval)
+		b.renumbering.SetEnabled(true)
+	}
+	t.mtx.Unlock()
+
+	// Every session gets the same sequence numbers, so NACKs can be answered from one shared buffer
+	t.streams.Register(ctx.ID(), stream_registry.Stream{
+		Source:         t.name,
+		Session:        string(session),
+		RTXPayloadType: uint8(findRepairCodec(ctx.CodecParameters(), "video/rtx", "apt="+strconv.Itoa(int(codec.PayloadType)))),
+		FECPayloadType: uint8(findRepairCodec(ctx.CodecParameters(), "video/flexfec-03", "")),
+		Renumbering:    b.renumbering,
+	})
+
+	go t.write(writerCtx, b, codec.ClockRate)
+	t.l.Debug().Msgf("Bound session %v with %v", session, codec.MimeType)
+	return codec, nil
+}
+
+// RequestKeyframe asks the track's source for a keyframe
+func (t *Track) RequestKeyframe() {
+	if t.requestKeyframe != nil {
+		t.requestKeyframe()
+	}
+}
+
+// SetKeyframeInterval makes the track send a session only keyframes, at most one per
+// interval, or every frame again if interval is 0. It applies to the session's
+// bindings now, and to the ones it makes later.
+func (t *Track) SetKeyframeInterval(session api.SessionID, interval time.Duration) {
+	if t.kind != webrtc.RTPCodecTypeVideo {
+		return
+	}
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if interval > 0 {
+		t.keyframeIntervals[session] = interval
+	} else {
+		delete(t.keyframeIntervals, session)
+	}
+	for _, b := range t.bindings {
+		if b.session == session {
+			b.queue.SetKeyframeInterval(interval)
+			b.renumbering.SetEnabled(interval > 0)
+		}
+	}
+}
+
+// keyframeNeeded returns a callback for when a session fell behind and dropped
+// frames. Its queue waits for the encoder's next keyframe. The source isn't asked
+// for one, since that can restart the encoder for every session.
+func (t *Track) keyframeNeeded(session api.SessionID) func() {
+	return func() {
+		t.l.Warn().Msgf("Session %v fell behind and dropped frames, waiting for a keyframe", session)
+	}
+}
+
+// write sends a session's queued packets until the session is unbound
+func (t *Track) write(ctx context.Context, b *binding, clockRate uint32) {
+	defer close(b.done)
+	defer b.queue.Close()
+
+	for {
+		pkt, ok := b.queue.Pop(ctx)
+		if !ok {
+			return
+		}
+
+		// Every source stamps packets with the shared clock, so the difference
+		// from now is how far this session is behind the source.
+		if clockRate != 0 {
+			behind := int32(media_clock.Default.RTPTimestamp(time.Now(), clockRate) - pkt.Timestamp)
+			b.lag.Set(float64(behind) / float64(clockRate))
+		}
+
+		if b.renumbering != nil {
+			pkt.SequenceNumber = b.renumbering.Renumber(pkt.SequenceNumber)
+		}
+		_, err := b.writer.WriteRTP(&pkt.Header, pkt.Payload)
+		packet_pool.PutPacket(pkt)
+		if err != nil {
+			// The session is going away, and will be unbound shortly
+			t.l.Trace().Err(err).Msgf("Failed to write RTP packet to session %v", b.session)
+		}
+	}
+}
+
+// nextSequenceNumber returns the track's sequence number for the next packet.
+// The track's first packet keeps its own.
+func (t *Track) nextSequenceNumber(p *rtp.Packet) uint16 {
+	t.seqMtx.Lock()
+	defer t.seqMtx.Unlock()
+	if t.seqStarted {
+		t.seq++
+	} else {
+		t.seq = p.SequenceNumber
+		t.seqStarted = true
+	}
+	return t.seq
+}
+
+// WriteRTP queues a copy of the packet for every session, numbered in the
+// track's own sequence. It never blocks on a session, and the caller keeps
+// ownership of p.
+func (t *Track) WriteRTP(p *rtp.Packet) error {
+	seq := t.nextSequenceNumber(p)
+
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+
+	for _, b := range t.bindings {
+		c := packet_pool.GetPacket()
+		copyPacket(c, p)
+		c.SequenceNumber = seq
+		c.SSRC = uint32(b.ssrc)
+		c.PayloadType = uint8(b.payloadType)
+		b.queue.Push(c)
+	}
+	for s := range t.subscriptions {
+		c := packet_pool.GetPacket()
+		copyPacket(c, p)
+		c.SequenceNumber = seq
+		select {
+		case s.packets <- c:
+		default:
+			packet_pool.PutPacket(c)
+			s.dropped.Inc()
+		}
+	}
+	return nil
+}
+
+// Subscribe returns a subscription to copies of the track's packets. Like
+// sessions, a subscriber that falls behind only drops its own packets.
+func (t *Track) Subscribe(size int) api.TrackSubscription {
+	s := &subscription{
+		track:   t,
+		packets: make(chan *rtp.Packet, size),
+		dropped: metrics.GlobalMetricCache.GetCounter("track_subscription_packets_dropped", prometheus.Labels{"track": t.name}),
+	}
+	t.mtx.Lock()
+	t.subscriptions[s] = true
+	t.mtx.Unlock()
+	return s
+}
+
+// subscription is a consumer of the track's packets other than a session
+type subscription struct {
+	track   *Track
+	packets chan *rtp.Packet
+	dropped prometheus.Counter
+}
+
+func (s *subscription) Packets() <-chan *rtp.Packet {
+	return s.packets
+}
+
+func (s *subscription) Close() {
+	s.track.mtx.Lock()
+	if s.track.subscriptions[s] {
+		delete(s.track.subscriptions, s)
+		close(s.packets)
+	}
+	s.track.mtx.Unlock()
+	for p := range s.packets {
+		packet_pool.PutPacket(p)
+	}
+}
+
+// copyPacket copies p into the pooled packet c, without sharing any memory with p
+func copyPacket(c *rtp.Packet, p *rtp.Packet) {
+	csrc := append(c.CSRC[:0], p.CSRC...)
+	c.Header = p.Header
+	c.CSRC = csrc
+	if len(p.Extensions) > 0 {
+		c.Extensions = p.Header.Clone().Extensions
+	}
+	packet_pool.SetPayload(c, p.Payload)
+}
+
+// sessionTrack is how a Track is bound to a known session
+type sessionTrack struct {
+	*Track
+	session api.SessionID
+}
+
+func (s *sessionTrack) Bind(ctx webrtc.TrackLocalContext) (webrtc.RTPCodecParameters, error) {
+	return s.Track.bind(ctx, s.session)
+}
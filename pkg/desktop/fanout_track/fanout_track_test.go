@@ -0,0 +1,248 @@
+package fanout_track_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"github.com/pod-arcade/pod-arcade/api"
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/fanout_track"
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/webrtc_interceptors/nack"
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/webrtc_interceptors/stream_registry"
+)
+
+var h264 = webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000}
+
+// fakeWriter records the packets written to a session, and can be made to stall
+type fakeWriter struct {
+	stall   chan struct{}
+	written chan rtp.Header
+}
+
+func (w *fakeWriter) WriteRTP(header *rtp.Header, payload []byte) (int, error) {
+	if w.stall != nil {
+		<-w.stall
+	}
+	w.written <- *header
+	return len(payload), nil
+}
+
+func (w *fakeWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+type fakeContext struct {
+	id     string
+	ssrc   webrtc.SSRC
+	writer *fakeWriter
+}
+
+func (c *fakeContext) CodecParameters() []webrtc.RTPCodecParameters {
+	return []webrtc.RTPCodecParameters{{RTPCodecCapability: h264, PayloadType: 102}}
+}
+func (c *fakeContext) HeaderExtensions() []webrtc.RTPHeaderExtensionParameter {
+	return nil
+}
+func (c *fakeContext) SSRC() webrtc.SSRC {
+	return c.ssrc
+}
+func (c *fakeContext) WriteStream() webrtc.TrackLocalWriter {
+	return c.writer
+}
+func (c *fakeContext) ID() string {
+	return c.id
+}
+func (c *fakeContext) RTCPReader() interceptor.RTCPReader {
+	return nil
+}
+
+func TestTrack_SlowSessionDoesntStallOthers(t *testing.T) {
+	streams := stream_registry.New()
+	track := fanout_track.NewTrack("test", h264, "video", "test", streams, nil)
+
+	stalled := &fakeContext{id: "stalled", ssrc: 1, writer: &fakeWriter{stall: make(chan struct{}), written: make(chan rtp.Header, 1000)}}
+	healthy := &fakeContext{id: "healthy", ssrc: 2, writer: &fakeWriter{written: make(chan rtp.Header, 1000)}}
+	for _, ctx := range []*fakeContext{stalled, healthy} {
+		if _, err := track.ForSession(api.SessionID("session-" + ctx.id)).Bind(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 10; i++ {
+		pkt := &rtp.Packet{
+			Header:  rtp.Header{Version: 2, SequenceNumber: uint16(i), Timestamp: uint32(i), Marker: true},
+			Payload: []byte{0x65, 0x88},
+		}
+		if err := track.WriteRTP(pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 10; i++ {
+		select {
+		case header := <-healthy.writer.written:
+			if header.SSRC != 2 || header.PayloadType != 102 || header.SequenceNumber != uint16(i) {
+				t.Errorf("Unexpected header %v", header)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Healthy session only got %v packets", i)
+		}
+	}
+
+	close(stalled.writer.stall)
+	for _, ctx := range []*fakeContext{stalled, healthy} {
+		if err := track.Unbind(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if streams.Len() != 0 {
+		t.Errorf("Expected the streams to be unregistered, %v are left", streams.Len())
+	}
+}
+
+func TestTrack_KeyframeIntervalClosesGaps(t *testing.T) {
+	track := fanout_track.NewTrack("test-interval", h264, "video", "test", stream_registry.New(), nil)
+	ctx := &fakeContext{id: "thumbnail", ssrc: 1, writer: &fakeWriter{written: make(chan rtp.Header, 1000)}}
+	track.SetKeyframeInterval("session-thumbnail", time.Millisecond)
+	if _, err := track.ForSession("session-thumbnail").Bind(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the keyframes are sent, one after another
+	nals := []byte{0x65, 0x61, 0x61, 0x65}
+	for i, nal := range nals {
+		time.Sleep(2 * time.Millisecond)
+		pkt := &rtp.Packet{
+			Header:  rtp.Header{Version: 2, SequenceNumber: uint16(100 + i), Timestamp: uint32(i), Marker: true},
+			Payload: []byte{nal, 0x88},
+		}
+		if err := track.WriteRTP(pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, timestamp := range []uint32{0, 3} {
+		select {
+		case header := <-ctx.writer.written:
+			if header.Timestamp != timestamp || header.SequenceNumber != uint16(100+i) {
+				t.Errorf("Unexpected header %v", header)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Session only got %v packets", i)
+		}
+	}
+
+	if err := track.Unbind(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// interceptorWriter sends a session's packets through an interceptor's writer
+type interceptorWriter struct {
+	writer interceptor.RTPWriter
+}
+
+func (w *interceptorWriter) WriteRTP(header *rtp.Header, payload []byte) (int, error) {
+	return w.writer.Write(header, payload, nil)
+}
+
+func (w *interceptorWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+type interceptorContext struct {
+	fakeContext
+	writer *interceptorWriter
+}
+
+func (c *interceptorContext) WriteStream() webrtc.TrackLocalWriter {
+	return c.writer
+}
+
+// nackReader reads one NACK, and then blocks
+type nackReader struct {
+	nack []byte
+}
+
+func (r *nackReader) Read(b []byte, a interceptor.Attributes) (int, interceptor.Attributes, error) {
+	if r.nack == nil {
+		select {}
+	}
+	n := copy(b, r.nack)
+	r.nack = nil
+	return n, a, nil
+}
+
+func TestTrack_RestartedSourceKeepsSequenceNumbers(t *testing.T) {
+	streams := stream_registry.New()
+	track := fanout_track.NewTrack("test-restart", h264, "video", "test", streams, nil)
+	factory, err := nack.NewResponderInterceptor(streams, nack.ResponderSize(8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	responder, err := factory.NewInterceptor("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := &interceptorContext{fakeContext: fakeContext{id: "restart", ssrc: 1}, writer: &interceptorWriter{}}
+	if _, err := track.ForSession("session-restart").Bind(ctx); err != nil {
+		t.Fatal(err)
+	}
+	written := make(chan rtp.Packet, 100)
+	info := &interceptor.StreamInfo{ID: "restart", SSRC: 1, PayloadType: 102, RTCPFeedback: []interceptor.RTCPFeedback{{Type: "nack"}}}
+	ctx.writer.writer = responder.BindLocalStream(info, interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, _ interceptor.Attributes) (int, error) {
+		written <- rtp.Packet{Header: *header, Payload: append([]byte{}, payload...)}
+		return len(payload), nil
+	}))
+
+	// The source is restarted after two packets, and starts from another sequence number
+	runs := [][]uint16{{1000, 1001}, {7, 8}}
+	for run, seqs := range runs {
+		for _, seq := range seqs {
+			pkt := &rtp.Packet{
+				Header:  rtp.Header{Version: 2, SequenceNumber: seq, Timestamp: uint32(seq), Marker: true},
+				Payload: []byte{0x65, byte(run)},
+			}
+			if err := track.WriteRTP(pkt); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	next := func() rtp.Packet {
+		t.Helper()
+		select {
+		case p := <-written:
+			return p
+		case <-time.After(time.Second):
+			t.Fatal("Expected a packet")
+			return rtp.Packet{}
+		}
+	}
+	for i := 0; i < 4; i++ {
+		if p := next(); p.SequenceNumber != uint16(1000+i) || p.Payload[1] != byte(i/2) {
+			t.Errorf("Expected packet %v of run %v, got %v %v", 1000+i, i/2, p.SequenceNumber, p.Payload)
+		}
+	}
+
+	// A NACK for the restarted run's packet is answered with that packet
+	nackPacket, err := (&rtcp.TransportLayerNack{MediaSSRC: 1, Nacks: []rtcp.NackPair{{PacketID: 1003}}}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := responder.BindRTCPReader(&nackReader{nack: nackPacket})
+	if _, _, err := reader.Read(make([]byte, 1500), nil); err != nil {
+		t.Fatal(err)
+	}
+	if p := next(); p.SequenceNumber != 1003 || !bytes.Equal(p.Payload, []byte{0x65, 1}) {
+		t.Errorf("Expected packet 1003 of the second run to be resent, got %v %v", p.SequenceNumber, p.Payload)
+	}
+
+	if err := track.Unbind(ctx); err != nil {
+		t.Fatal(err)
+	}
+	responder.UnbindLocalStream(info)
+}
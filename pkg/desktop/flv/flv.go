@@ -0,0 +1,46 @@
+// Package flv builds the bodies of FLV audio and video tags, which is what RTMP
+// carries in its audio and video messages. Video is H.264 and audio is AAC,
+// since that's all that RTMP servers reliably pass on.
+package flv
+
+// Video frame types
+const (
+	frameTypeKey   = 1
+	frameTypeInter = 2
+)
+
+// codecIDAVC is the video codec ID of H.264
+const codecIDAVC = 7
+
+// soundFormatAAC is the sound format of AAC. Its tags always claim 44 kHz 16 bit
+// stereo, and players go by the AudioSpecificConfig instead.
+const soundFormatAAC = 10
+
+// Packet types of AVC video and AAC audio
+const (
+	PacketTypeSequenceHeader = 0
+	PacketTypeData           = 1
+)
+
+// Codec IDs for onMetaData
+const (
+	VideoCodecIDAVC = codecIDAVC
+	AudioCodecIDAAC = soundFormatAAC
+)
+
+// AppendAVCHeader appends the header of an H.264 video tag. It's followed by the
+// AVCDecoderConfigurationRecord for a sequence header, or by AVCC NAL units for data.
+func AppendAVCHeader(dst []byte, keyframe bool, packetType byte) []byte {
+	frameType := byte(frameTypeInter)
+	if keyframe || packetType == PacketTypeSequenceHeader {
+		frameType = frameTypeKey
+	}
+	// The composition time is always 0, since WebRTC encoders don't make B-frames
+	return append(dst, frameType<<4|codecIDAVC, packetType, 0, 0, 0)
+}
+
+// AppendAACHeader appends the header of an AAC audio tag. It's followed by the
+// AudioSpecificConfig for a sequence header, or by a raw AAC frame for data.
+func AppendAACHeader(dst []byte, packetType byte) []byte {
+	return append(dst, soundFormatAAC<<4|0x0f, packetType)
+}
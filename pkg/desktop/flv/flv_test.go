@@ -0,0 +1,24 @@
+package flv
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestAppendHeaders(t *testing.T) {
+	tests := []struct {
+		name     string
+		actual   []byte
+		expected []byte
+	}{
+		{"sequence header", AppendAVCHeader(nil, false, PacketTypeSequenceHeader), []byte{0x17, 0, 0, 0, 0}},
+		{"keyframe", AppendAVCHeader(nil, true, PacketTypeData), []byte{0x17, 1, 0, 0, 0}},
+		{"inter frame", AppendAVCHeader(nil, false, PacketTypeData), []byte{0x27, 1, 0, 0, 0}},
+		{"audio", AppendAACHeader(nil, PacketTypeData), []byte{0xaf, 1}},
+	}
+	for _, test := range tests {
+		if !bytes.Equal(test.actual, test.expected) {
+			t.Errorf("Expected %v header %x, got %x", test.name, test.expected, test.actual)
+		}
+	}
+}
@@ -0,0 +1,317 @@
+// Package fmp4 writes fragmented MP4, the way HLS and DASH want it: an
+// initialization segment describing the tracks, and then fragments of samples
+// that can be played as soon as each one is written.
+package fmp4
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Codec is the codec of a track
+type Codec uint8
+
+const (
+	CodecH264 Codec = iota
+	CodecOpus
+)
+
+// Sample flags, from ISO/IEC 14496-12
+const (
+	// sampleFlagsSync marks samples that don't depend on others
+	sampleFlagsSync = 0x02000000
+	// sampleFlagsNonSync marks samples that depend on others, and can't be started from
+	sampleFlagsNonSync = 0x01010000
+)
+
+// OpusPreSkip is the number of samples decoders drop at the start of an Opus track
+const OpusPreSkip = 312
+
+var ErrNoTracks = errors.New("an initialization segment needs at least one track")
+
+// Track describes a track of the initialization segment. Tracks are numbered from 1, in order.
+type Track struct {
+	Codec Codec
+	// Timescale is how many units a second has in the track's timestamps
+	Timescale uint32
+
+	// Width, Height and AVCDecoderConfig describe H.264 tracks
+	Width            int
+	Height           int
+	AVCDecoderConfig []byte
+
+	// Channels describes Opus tracks, which are always at 48kHz
+	Channels int
+}
+
+// Sample is a frame of a fragment
+type Sample struct {
+	// Duration is in the track's timescale
+	Duration uint32
+	// Keyframe is whether the sample can be decoded on its own
+	Keyframe bool
+	Data     []byte
+}
+
+// TrackRun is the samples of one track in a fragment
+type TrackRun struct {
+	// Track is the index of the track in the initialization segment
+	Track int
+	// DecodeTime is when the first sample starts, in the track's timescale
+	DecodeTime uint64
+	Samples    []Sample
+}
+
+// startBox appends the header of a box, and returns where it starts so endBox can fill in its size
+func startBox(dst []byte, boxType string) ([]byte, int) {
+	start := len(dst)
+	dst = append(dst, 0, 0, 0, 0)
+	return append(dst, boxType...), start
+}
+
+func endBox(dst []byte, start int) []byte {
+	binary.BigEndian.PutUint32(dst[start:], uint32(len(dst)-start))
+	return dst
+}
+
+// startFullBox starts a box with a version and flags
+func startFullBox(dst []byte, boxType string, version uint8, flags uint32) ([]byte, int) {
+	dst, start := startBox(dst, boxType)
+	return binary.BigEndian.AppendUint32(dst, uint32(version)<<24|flags&0xffffff), start
+}
+
+// AppendInit appends the initialization segment of the tracks, an ftyp and a moov
+func AppendInit(dst []byte, tracks []Track) ([]byte, error) {
+	if len(tracks) == 0 {
+		return dst, ErrNoTracks
+	}
+
+	dst, ftyp := startBox(dst, "ftyp")
+	dst = append(dst, "iso6"...)
+	dst = binary.BigEndian.AppendUint32(dst, 0)
+	dst = append(dst, "iso6mp41"...)
+	dst = endBox(dst, ftyp)
+
+	dst, moov := startBox(dst, "moov")
+	dst, mvhd := startFullBox(dst, "mvhd", 0, 0)
+	dst = binary.BigEndian.AppendUint32(dst, 0)    // creation time
+	dst = binary.BigEndian.AppendUint32(dst, 0)    // modification time
+	dst = binary.BigEndian.AppendUint32(dst, 1000) // timescale
+	dst = binary.BigEndian.AppendUint32(dst, 0)    // duration, which fragments extend
+	dst = binary.BigEndian.AppendUint32(dst, 0x00010000)
+	dst = binary.BigEndian.AppendUint16(dst, 0x0100)
+	dst = append(dst, make([]byte, 10)...)
+	dst = appendMatrix(dst)
+	dst = append(dst, make([]byte, 24)...)
+	dst = binary.BigEndian.AppendUint32(dst, uint32(len(tracks)+1)) // next track ID
+	dst = endBox(dst, mvhd)
+
+	for i, t := range tracks {
+		dst = appendTrak(dst, uint32(i+1), t)
+	}
+
+	dst, mvex := startBox(dst, "mvex")
+	for i := range tracks {
+		var trex int
+		dst, trex = startFullBox(dst, "trex", 0, 0)
+		dst = binary.BigEndian.AppendUint32(dst, uint32(i+1))
+		dst = binary.BigEndian.AppendUint32(dst, 1) // sample description index
+		dst = binary.BigEndian.AppendUint32(dst, 0) // duration
+		dst = binary.BigEndian.AppendUint32(dst, 0) // size
+		dst = binary.BigEndian.AppendUint32(dst, 0) // flags
+		dst = endBox(dst, trex)
+	}
+	dst = endBox(dst, mvex)
+	return endBox(dst, moov), nil
+}
+
+func appendMatrix(dst []byte) []byte {
+	for _, v := range []uint32{0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000} {
+		dst = binary.BigEndian.AppendUint32(dst, v)
+	}
+	return dst
+}
+
+func appendTrak(dst []byte, id uint32, t Track) []byte {
+	video := t.Codec == CodecH264
+	dst, trak := startBox(dst, "trak")
+
+	dst, tkhd := startFullBox(dst, "tkhd", 0, 3) // enabled, in the movie
+	dst = binary.BigEndian.AppendUint32(dst, 0)
+	dst = binary.BigEndian.AppendUint32(dst, 0)
+	dst = binary.BigEndian.AppendUint32(dst, id)
+	dst = binary.BigEndian.AppendUint32(dst, 0)
+	dst = binary.BigEndian.AppendUint32(dst, 0) // duration
+	dst = append(dst, make([]byte, 8)...)
+	dst = binary.BigEndian.AppendUint16(dst, 0) // layer
+	dst = binary.BigEndian.AppendUint16(dst, 0) // alternate group
+	if video {
+		dst = binary.BigEndian.AppendUint16(dst, 0)
+	} else {
+		dst = binary.BigEndian.AppendUint16(dst, 0x0100) // volume
+	}
+	dst = binary.BigEndian.AppendUint16(dst, 0)
+	dst = appendMatrix(dst)
+	dst = binary.BigEndian.AppendUint32(dst, uint32(t.Width)<<16)
+	dst = binary.BigEndian.AppendUint32(dst, uint32(t.Height)<<16)
+	dst = endBox(dst, tkhd)
+
+	dst, mdia := startBox(dst, "mdia")
+	dst, mdhd := startFullBox(dst, "mdhd", 0, 0)
+	dst = binary.BigEndian.AppendUint32(dst, 0)
+	dst = binary.BigEndian.AppendUint32(dst, 0)
+	dst = binary.BigEndian.AppendUint32(dst, t.Timescale)
+	dst = binary.BigEndian.AppendUint32(dst, 0)
+	dst = binary.BigEndian.AppendUint16(dst, 0x55c4) // "und"
+	dst = binary.BigEndian.AppendUint16(dst, 0)
+	dst = endBox(dst, mdhd)
+
+	dst, hdlr := startFullBox(dst, "hdlr", 0, 0)
+	dst = binary.BigEndian.AppendUint32(dst, 0)
+	if video {
+		dst = append(dst, "vide"...)
+	} else {
+		dst = append(dst, "soun"...)
+	}
+	dst = append(dst, make([]byte, 12)...)
+	if video {
+		dst = append(dst, "VideoHandler\x00"...)
+	} else {
+		dst = append(dst, "SoundHandler\x00"...)
+	}
+	dst = endBox(dst, hdlr)
+
+	dst, minf := startBox(dst, "minf")
+	var header int
+	if video {
+		dst, header = startFullBox(dst, "vmhd", 0, 1)
+		dst = append(dst, make([]byte, 8)...)
+	} else {
+		dst, header = startFullBox(dst, "smhd", 0, 0)
+		dst = append(dst, make([]byte, 4)...)
+	}
+	dst = endBox(dst, header)
+	dst, dinf := startBox(dst, "dinf")
+	dst, dref := startFullBox(dst, "dref", 0, 0)
+	dst = binary.BigEndian.AppendUint32(dst, 1)
+	dst, url := startFullBox(dst, "url ", 0, 1) // the media is in this file
+	dst = endBox(dst, url)
+	dst = endBox(dst, dref)
+	dst = endBox(dst, dinf)
+
+	dst, stbl := startBox(dst, "stbl")
+	dst, stsd := startFullBox(dst, "stsd", 0, 0)
+	dst = binary.BigEndian.AppendUint32(dst, 1)
+	if video {
+		dst = appendAVC1(dst, t)
+	} else {
+		dst = appendOpus(dst, t)
+	}
+	dst = endBox(dst, stsd)
+	// The samples are all in fragments, so the sample tables are empty
+	for _, box := range []string{"stts", "stsc", "stco"} {
+		var table int
+		dst, table = startFullBox(dst, box, 0, 0)
+		dst = binary.BigEndian.AppendUint32(dst, 0)
+		dst = endBox(dst, table)
+	}
+	dst, stsz := startFullBox(dst, "stsz", 0, 0)
+	dst = binary.BigEndian.AppendUint32(dst, 0)
+	dst = binary.BigEndian.AppendUint32(dst, 0)
+	dst = endBox(dst, stsz)
+	dst = endBox(dst, stbl)
+
+	dst = endBox(dst, minf)
+	dst = endBox(dst, mdia)
+	return endBox(dst, trak)
+}
+
+func appendAVC1(dst []byte, t Track) []byte {
+	dst, avc1 := startBox(dst, "avc1")
+	dst = append(dst, make([]byte, 6)...)
+	dst = binary.BigEndian.AppendUint16(dst, 1) // data reference index
+	dst = append(dst, make([]byte, 16)...)
+	dst = binary.BigEndian.AppendUint16(dst, uint16(t.Width))
+	dst = binary.BigEndian.AppendUint16(dst, uint16(t.Height))
+	dst = binary.BigEndian.AppendUint32(dst, 0x00480000) // 72 dpi
+	dst = binary.BigEndian.AppendUint32(dst, 0x00480000)
+	dst = binary.BigEndian.AppendUint32(dst, 0)
+	dst = binary.BigEndian.AppendUint16(dst, 1) // frame count
+	dst = append(dst, make([]byte, 32)...)      // compressor name
+	dst = binary.BigEndian.AppendUint16(dst, 0x0018)
+	dst = binary.BigEndian.AppendUint16(dst, 0xffff)
+	dst, avcC := startBox(dst, "avcC")
+	dst = append(dst, t.AVCDecoderConfig...)
+	dst = endBox(dst, avcC)
+	return endBox(dst, avc1)
+}
+
+func appendOpus(dst []byte, t Track) []byte {
+	channels := max(t.Channels, 1)
+	dst, opus := startBox(dst, "Opus")
+	dst = append(dst, make([]byte, 6)...)
+	dst = binary.BigEndian.AppendUint16(dst, 1) // data reference index
+	dst = append(dst, make([]byte, 8)...)
+	dst = binary.BigEndian.AppendUint16(dst, uint16(channels))
+	dst = binary.BigEndian.AppendUint16(dst, 16) // sample size
+	dst = binary.BigEndian.AppendUint32(dst, 0)
+	dst = binary.BigEndian.AppendUint32(dst, 48000<<16)
+	dst, dOps := startBox(dst, "dOps")
+	dst = append(dst, 0, byte(channels))
+	dst = binary.BigEndian.AppendUint16(dst, OpusPreSkip)
+	dst = binary.BigEndian.AppendUint32(dst, 48000)
+	dst = binary.BigEndian.AppendUint16(dst, 0) // output gain
+	dst = append(dst, 0)                        // channel mapping family
+	dst = endBox(dst, dOps)
+	return endBox(dst, opus)
+}
+
+// AppendFragment appends a moof and an mdat with the runs' samples. sequence
+// numbers the fragments, starting from 1.
+func AppendFragment(dst []byte, sequence uint32, runs []TrackRun) []byte {
+	dst, moof := startBox(dst, "moof")
+	dst, mfhd := startFullBox(dst, "mfhd", 0, 0)
+	dst = binary.BigEndian.AppendUint32(dst, sequence)
+	dst = endBox(dst, mfhd)
+
+	// The data offsets are relative to the moof, so they're filled in once its size is known
+	offsets := make([]int, len(runs))
+	for i, r := range runs {
+		var traf, tfhd, tfdt, trun int
+		dst, traf = startBox(dst, "traf")
+		dst, tfhd = startFullBox(dst, "tfhd", 0, 0x020000) // default base is moof
+		dst = binary.BigEndian.AppendUint32(dst, uint32(r.Track+1))
+		dst = endBox(dst, tfhd)
+
+		dst, tfdt = startFullBox(dst, "tfdt", 1, 0)
+		dst = binary.BigEndian.AppendUint64(dst, r.DecodeTime)
+		dst = endBox(dst, tfdt)
+
+		// Data offset, and each sample's duration, size and flags
+		dst, trun = startFullBox(dst, "trun", 0, 0x000701)
+		dst = binary.BigEndian.AppendUint32(dst, uint32(len(r.Samples)))
+		offsets[i] = len(dst)
+		dst = binary.BigEndian.AppendUint32(dst, 0)
+		for _, s := range r.Samples {
+			dst = binary.BigEndian.AppendUint32(dst, s.Duration)
+			dst = binary.BigEndian.AppendUint32(dst, uint32(len(s.Data)))
+			if s.Keyframe {
+				dst = binary.BigEndian.AppendUint32(dst, sampleFlagsSync)
+			} else {
+				dst = binary.BigEndian.AppendUint32(dst, sampleFlagsNonSync)
+			}
+		}
+		dst = endBox(dst, trun)
+		dst = endBox(dst, traf)
+	}
+	dst = endBox(dst, moof)
+
+	dst, mdat := startBox(dst, "mdat")
+	for i, r := range runs {
+		binary.BigEndian.PutUint32(dst[offsets[i]:], uint32(len(dst)-moof))
+		for _, s := range r.Samples {
+			dst = append(dst, s.Data...)
+		}
+	}
+	return endBox(dst, mdat)
+}
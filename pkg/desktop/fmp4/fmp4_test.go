@@ -0,0 +1,89 @@
+package fmp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// findBox returns the payload of the first box of a type along a path of nested boxes
+func findBox(data []byte, path ...string) []byte {
+	for len(data) >= 8 {
+		size := int(binary.BigEndian.Uint32(data))
+		if size < 8 || size > len(data) {
+			return nil
+		}
+		if string(data[4:8]) == path[0] {
+			if len(path) == 1 {
+				return data[8:size]
+			}
+			return findBox(data[8:size], path[1:]...)
+		}
+		data = data[size:]
+	}
+	return nil
+}
+
+func TestAppendInit(t *testing.T) {
+	init, err := AppendInit(nil, []Track{
+		{Codec: CodecH264, Timescale: 90000, Width: 1920, Height: 1080, AVCDecoderConfig: []byte{1, 2, 3}},
+		{Codec: CodecOpus, Timescale: 48000, Channels: 2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if findBox(init, "ftyp") == nil {
+		t.Error("Expected an ftyp")
+	}
+	if n := bytes.Count(init, []byte("trak")); n != 2 {
+		t.Errorf("Expected 2 tracks, got %v", n)
+	}
+	if n := bytes.Count(init, []byte("trex")); n != 2 {
+		t.Errorf("Expected 2 track extends, got %v", n)
+	}
+	mdhd := findBox(init, "moov", "trak", "mdia", "mdhd")
+	if len(mdhd) < 16 || binary.BigEndian.Uint32(mdhd[12:]) != 90000 {
+		t.Errorf("Expected the first track's timescale to be 90000, got mdhd %x", mdhd)
+	}
+	if !bytes.Contains(init, []byte("avcC\x01\x02\x03")) {
+		t.Error("Expected the avcC to hold the decoder config")
+	}
+	if !bytes.Contains(init, []byte("dOps\x00\x02")) {
+		t.Error("Expected a dOps with 2 channels")
+	}
+
+	if _, err := AppendInit(nil, nil); err != ErrNoTracks {
+		t.Errorf("Expected ErrNoTracks, got %v", err)
+	}
+}
+
+func TestAppendFragment(t *testing.T) {
+	fragment := AppendFragment(nil, 7, []TrackRun{
+		{Track: 0, DecodeTime: 9000, Samples: []Sample{
+			{Duration: 3000, Keyframe: true, Data: []byte("key")},
+			{Duration: 3000, Data: []byte("delta")},
+		}},
+		{Track: 1, DecodeTime: 4800, Samples: []Sample{{Duration: 960, Keyframe: true, Data: []byte("opus")}}},
+	})
+
+	mfhd := findBox(fragment, "moof", "mfhd")
+	if binary.BigEndian.Uint32(mfhd[4:]) != 7 {
+		t.Errorf("Expected sequence 7, got %x", mfhd)
+	}
+	mdat := findBox(fragment, "mdat")
+	if string(mdat) != "keydeltaopus" {
+		t.Errorf("Expected the samples in the mdat, got %q", mdat)
+	}
+
+	// Each run's data offset, from the start of the moof, points at its samples
+	moof := fragment[:binary.BigEndian.Uint32(fragment)]
+	traf := moof[8+len(mfhd)+8:]
+	for i, want := range []string{"keydelta", "opus"} {
+		trun := findBox(traf[8:], "trun")
+		offset := binary.BigEndian.Uint32(trun[8:])
+		if got := string(fragment[offset : int(offset)+len(want)]); got != want {
+			t.Errorf("Expected run %v to point at %q, got %q", i, want, got)
+		}
+		traf = traf[binary.BigEndian.Uint32(traf):]
+	}
+}
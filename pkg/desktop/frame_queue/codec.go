@@ -0,0 +1,116 @@
+package frame_queue
+
+import (
+	"strings"
+
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	h264NalTypeIDR   = 5
+	h264NalTypeSPS   = 7
+	h264NalTypeSTAPA = 24
+	h264NalTypeFUA   = 28
+)
+
+// PayloadInspector answers questions about the payload of a codec's RTP packets.
+type PayloadInspector interface {
+	// IsKeyframe reports whether the payload starts a frame that can be decoded on its own.
+	IsKeyframe(payload []byte) bool
+	// IsDiscardable reports whether no other frame references the frame this payload is part of.
+	IsDiscardable(payload []byte) bool
+}
+
+// NewPayloadInspector returns the inspector for a mime type. Audio codecs have no
+// dependencies between frames, so every frame is both a keyframe and discardable.
+func NewPayloadInspector(mimeType string) PayloadInspector {
+	switch strings.ToLower(mimeType) {
+	case strings.ToLower(webrtc.MimeTypeH264):
+		return h264Inspector{}
+	case strings.ToLower(webrtc.MimeTypeVP8):
+		return vp8Inspector{}
+	case strings.ToLower(webrtc.MimeTypeVP9):
+		return vp9Inspector{}
+	default:
+		if strings.HasPrefix(strings.ToLower(mimeType), "audio/") {
+			return audioInspector{}
+		}
+		// We don't know how to read this codec, so never throw frames away
+		// unless we're dropping everything.
+		return unknownInspector{}
+	}
+}
+
+type h264Inspector struct{}
+
+func (h264Inspector) IsKeyframe(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+	switch payload[0] & 0x1F {
+	case h264NalTypeIDR, h264NalTypeSPS:
+		return true
+	case h264NalTypeSTAPA:
+		// Aggregated NALs, each prefixed with a 16 bit size
+		for offset := 1; offset+2 < len(payload); {
+			size := int(payload[offset])<<8 | int(payload[offset+1])
+			nalType := payload[offset+2] & 0x1F
+			if nalType == h264NalTypeIDR || nalType == h264NalTypeSPS {
+				return true
+			}
+			offset += 2 + size
+		}
+	case h264NalTypeFUA:
+		// Only the first fragment of an IDR starts a keyframe
+		return len(payload) > 1 && payload[1]&0x80 != 0 && payload[1]&0x1F == h264NalTypeIDR
+	}
+	return false
+}
+
+func (h264Inspector) IsDiscardable(payload []byte) bool {
+	// nal_ref_idc is 0 for pictures that nothing references. For STAP-A and FU-A,
+	// the indicator carries the highest nal_ref_idc of the NALs inside it.
+	return len(payload) > 0 && payload[0]&0x60 == 0
+}
+
+type vp8Inspector struct{}
+
+func (vp8Inspector) IsKeyframe(payload []byte) bool {
+	pkt := codecs.VP8Packet{}
+	data, err := pkt.Unmarshal(payload)
+	if err != nil || len(data) < 1 {
+		return false
+	}
+	// The P bit of the VP8 payload header is 0 on keyframes
+	return pkt.S == 1 && pkt.PID == 0 && data[0]&0x01 == 0
+}
+
+func (vp8Inspector) IsDiscardable(payload []byte) bool {
+	return len(payload) > 0 && payload[0]&0x20 != 0
+}
+
+type vp9Inspector struct{}
+
+func (vp9Inspector) IsKeyframe(payload []byte) bool {
+	pkt := codecs.VP9Packet{}
+	if _, err := pkt.Unmarshal(payload); err != nil {
+		return false
+	}
+	return pkt.B && !pkt.P
+}
+
+func (vp9Inspector) IsDiscardable(payload []byte) bool {
+	// Without layer information, we can't tell which frames are referenced
+	return false
+}
+
+type audioInspector struct{}
+
+func (audioInspector) IsKeyframe(payload []byte) bool    { return true }
+func (audioInspector) IsDiscardable(payload []byte) bool { return true }
+
+type unknownInspector struct{}
+
+func (unknownInspector) IsKeyframe(payload []byte) bool    { return true }
+func (unknownInspector) IsDiscardable(payload []byte) bool { return false }
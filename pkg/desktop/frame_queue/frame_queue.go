@@ -0,0 +1,367 @@
+// Package frame_queue holds RTP packets between a media source and the track
+// that sends them. Packets are grouped into frames, so that when the queue is
+// overloaded it throws away whole frames instead of random packets, which would
+// corrupt every picture until the next keyframe.
+package frame_queue
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/packet_pool"
+	"github.com/pod-arcade/pod-arcade/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DropReason describes why frames were thrown away
+type DropReason string
+
+const (
+	// DropReasonDiscardable frames weren't referenced by any other frame
+	DropReasonDiscardable DropReason = "discardable"
+	// DropReasonUntilKeyframe frames were thrown away to catch up, and couldn't be decoded without a keyframe
+	DropReasonUntilKeyframe DropReason = "until_keyframe"
+	// DropReasonSkipped frames weren't sent because the queue only sends keyframes
+	DropReasonSkipped DropReason = "skipped"
+)
+
+var dropReasons = []DropReason{DropReasonDiscardable, DropReasonUntilKeyframe, DropReasonSkipped}
+
+type frame struct {
+	timestamp   uint32
+	packets     []*rtp.Packet
+	next        int // index of the next packet to pop
+	keyframe    bool
+	discardable bool
+	ended       bool // the marker bit has been seen
+	held        bool // waiting to find out if this is a keyframe
+}
+
+// FrameQueue is a bounded queue of RTP packets that drops whole frames when it's full.
+// It has a single consumer, which calls Pop. Pushed packets belong to the queue until
+// they're popped, and the ones it drops are put back in the packet pool.
+type FrameQueue struct {
+	inspector        PayloadInspector
+	maxPackets       int
+	onKeyframeNeeded func()
+
+	frames  []*frame
+	free    []*frame // frames that are done, kept so they can be reused
+	packets int      // packets that haven't been popped yet
+
+	// waitingForKeyframe is set after frames were dropped that later frames depend on
+	waitingForKeyframe bool
+	// discarding is set while the rest of a dropped frame is still arriving
+	discarding       bool
+	discardTimestamp uint32
+	discardReason    DropReason
+
+	// keyframeInterval is set when only keyframes are sent, at most one per interval
+	keyframeInterval time.Duration
+	lastKeyframe     time.Time
+
+	closed bool
+	notify chan struct{}
+	mtx    sync.Mutex
+
+	name             string
+	depth            prometheus.Gauge
+	keyframeRequests prometheus.Counter
+	framesDropped    map[DropReason]prometheus.Counter
+	packetsDropped   map[DropReason]prometheus.Counter
+}
+
+// NewFrameQueue creates a queue holding at most maxPackets for a stream of mimeType packets.
+// onKeyframeNeeded is called whenever the queue dropped frames that later frames depend on.
+func NewFrameQueue(name string, mimeType string, maxPackets int, onKeyframeNeeded func()) *FrameQueue {
+	q := &FrameQueue{
+		inspector:        NewPayloadInspector(mimeType),
+		maxPackets:       maxPackets,
+		onKeyframeNeeded: onKeyframeNeeded,
+		notify:           make(chan struct{}, 1),
+
+		name:             name,
+		depth:            metrics.GlobalMetricCache.GetGauge("frame_queue_depth", prometheus.Labels{"queue": name}),
+		keyframeRequests: metrics.GlobalMetricCache.GetCounter("frame_queue_keyframe_requests", prometheus.Labels{"queue": name}),
+		framesDropped:    map[DropReason]prometheus.Counter{},
+		packetsDropped:   map[DropReason]prometheus.Counter{},
+	}
+	for _, reason := range dropReasons {
+		labels := prometheus.Labels{"queue": name, "reason": string(reason)}
+		q.framesDropped[reason] = metrics.GlobalMetricCache.GetCounter("frame_queue_frames_dropped", labels)
+		q.packetsDropped[reason] = metrics.GlobalMetricCache.GetCounter("frame_queue_packets_dropped", labels)
+	}
+	return q
+}
+
+// Push adds a packet to the queue, dropping frames if the queue is full.
+func (q *FrameQueue) Push(pkt *rtp.Packet) {
+	q.mtx.Lock()
+	needKeyframe := q.push(pkt)
+	q.depth.Set(float64(q.packets))
+	q.mtx.Unlock()
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+
+	if needKeyframe {
+		q.keyframeRequests.Inc()
+		if q.onKeyframeNeeded != nil {
+			q.onKeyframeNeeded()
+		}
+	}
+}
+
+// push adds the packet and returns whether a keyframe is needed. q.mtx must be held.
+func (q *FrameQueue) push(pkt *rtp.Packet) bool {
+	if q.closed {
+		packet_pool.PutPacket(pkt)
+		return false
+	}
+
+	if q.discarding {
+		if pkt.Timestamp == q.discardTimestamp {
+			q.packetsDropped[q.discardReason].Inc()
+			packet_pool.PutPacket(pkt)
+			return false
+		}
+		q.discarding = false
+	}
+
+	var last *frame
+	if len(q.frames) > 0 {
+		last = q.frames[len(q.frames)-1]
+	}
+
+	f := last
+	if last == nil || last.timestamp != pkt.Timestamp || last.ended {
+		if last != nil && last.held {
+			// The last frame finished without turning out to be a keyframe
+			q.dropFrame(len(q.frames)-1, q.heldDropReason())
+		}
+		f = q.newFrame()
+		f.timestamp = pkt.Timestamp
+		f.held = q.waitingForKeyframe || q.keyframeInterval > 0
+		q.frames = append(q.frames, f)
+	}
+
+	f.packets = append(f.packets, pkt)
+	q.packets++
+	if q.inspector.IsKeyframe(pkt.Payload) {
+		f.keyframe = true
+		if f.held && (q.keyframeInterval == 0 || time.Since(q.lastKeyframe) >= q.keyframeInterval) {
+			f.held = false
+			q.waitingForKeyframe = false
+			q.lastKeyframe = time.Now()
+		}
+	}
+	f.discardable = f.discardable && q.inspector.IsDiscardable(pkt.Payload)
+	f.ended = pkt.Marker
+
+	if f.ended && f.held {
+		q.dropFrame(len(q.frames)-1, q.heldDropReason())
+	}
+
+	return q.shed()
+}
+
+// heldDropReason is why a held frame that can't be sent is dropped. q.mtx must be held.
+func (q *FrameQueue) heldDropReason() DropReason {
+	if q.waitingForKeyframe {
+		return DropReasonUntilKeyframe
+	}
+	return DropReasonSkipped
+}
+
+// SetKeyframeInterval makes the queue send only keyframes, at most one per interval,
+// or every frame again if interval is 0. The frames skipped in between are still
+// referenced by the ones after them, so going back to every frame waits for a keyframe.
+func (q *FrameQueue) SetKeyframeInterval(interval time.Duration) {
+	q.mtx.Lock()
+	needKeyframe := q.keyframeInterval > 0 && interval == 0 && !q.closed
+	q.keyframeInterval = interval
+	if needKeyframe {
+		q.waitingForKeyframe = true
+	}
+	q.mtx.Unlock()
+
+	if needKeyframe {
+		q.keyframeRequests.Inc()
+		if q.onKeyframeNeeded != nil {
+			q.onKeyframeNeeded()
+		}
+	}
+}
+
+// shed drops frames until the queue fits, returning whether a keyframe is needed. q.mtx must be held.
+func (q *FrameQueue) shed() bool {
+	if q.packets <= q.maxPackets {
+		return false
+	}
+
+	// A frame that is partially sent has to be finished
+	start := 0
+	if len(q.frames) > 0 && q.frames[0].next > 0 {
+		start = 1
+	}
+
+	// Frames that nothing depends on can go without hurting anything else
+	for i := start; i < len(q.frames) && q.packets > q.maxPackets; {
+		if q.frames[i].discardable {
+			q.dropFrame(i, DropReasonDiscardable)
+		} else {
+			i++
+		}
+	}
+	if q.packets <= q.maxPackets {
+		return false
+	}
+
+	// Skip ahead to the newest keyframe that's already queued
+	for i := len(q.frames) - 1; i > start; i-- {
+		if q.frames[i].keyframe {
+			for j := i - 1; j >= start; j-- {
+				q.dropFrame(j, DropReasonUntilKeyframe)
+			}
+			if q.packets <= q.maxPackets {
+				return false
+			}
+			break
+		}
+	}
+
+	// Nothing left is decodable, so drop all of it and wait for a keyframe
+	for i := len(q.frames) - 1; i >= start; i-- {
+		q.dropFrame(i, DropReasonUntilKeyframe)
+	}
+	q.waitingForKeyframe = true
+	return true
+}
+
+// newFrame returns an empty frame, reusing one if it can. q.mtx must be held.
+func (q *FrameQueue) newFrame() *frame {
+	if len(q.free) == 0 {
+		return &frame{discardable: true}
+	}
+	f := q.free[len(q.free)-1]
+	q.free = q.free[:len(q.free)-1]
+	*f = frame{packets: f.packets[:0], discardable: true}
+	return f
+}
+
+// removeFrame takes the frame at index i out of the queue. q.mtx must be held.
+func (q *FrameQueue) removeFrame(i int) {
+	f := q.frames[i]
+	clear(f.packets)
+	q.free = append(q.free, f)
+	q.frames = append(q.frames[:i], q.frames[i+1:]...)
+}
+
+// dropFrame removes the frame at index i. q.mtx must be held.
+func (q *FrameQueue) dropFrame(i int, reason DropReason) {
+	f := q.frames[i]
+	if !f.ended {
+		// The rest of this frame is still coming
+		q.discarding = true
+		q.discardTimestamp = f.timestamp
+		q.discardReason = reason
+	}
+	unsent := len(f.packets) - f.next
+	for _, pkt := range f.packets[f.next:] {
+		packet_pool.PutPacket(pkt)
+	}
+	q.packets -= unsent
+	q.framesDropped[reason].Inc()
+	q.packetsDropped[reason].Add(float64(unsent))
+	q.removeFrame(i)
+}
+
+// Pop returns the next packet, blocking until there is one.
+// It returns false once the queue is closed or the context is cancelled.
+func (q *FrameQueue) Pop(ctx context.Context) (*rtp.Packet, bool) {
+	for {
+		q.mtx.Lock()
+		pkt := q.pop()
+		closed := q.closed
+		q.depth.Set(float64(q.packets))
+		q.mtx.Unlock()
+
+		if pkt != nil {
+			return pkt, true
+		}
+		if closed {
+			return nil, false
+		}
+
+		select {
+		case <-q.notify:
+		case <-ctx.Done():
+			return nil, false
+		}
+	}
+}
+
+// pop returns the next packet, or nil if there isn't one ready. q.mtx must be held.
+func (q *FrameQueue) pop() *rtp.Packet {
+	for len(q.frames) > 0 {
+		f := q.frames[0]
+		if f.held {
+			return nil
+		}
+		if f.next < len(f.packets) {
+			pkt := f.packets[f.next]
+			f.packets[f.next] = nil
+			f.next++
+			q.packets--
+			return pkt
+		}
+		if !f.ended && len(q.frames) == 1 {
+			// more of this frame is coming
+			return nil
+		}
+		q.removeFrame(0)
+	}
+	return nil
+}
+
+// Len returns the number of packets waiting in the queue
+func (q *FrameQueue) Len() int {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	return q.packets
+}
+
+// Close wakes up the consumer, which will get no more packets.
+func (q *FrameQueue) Close() {
+	q.mtx.Lock()
+	q.closed = true
+	for _, f := range q.frames {
+		for _, pkt := range f.packets[f.next:] {
+			packet_pool.PutPacket(pkt)
+		}
+	}
+	q.frames = nil
+	q.packets = 0
+	q.depth.Set(0)
+	q.mtx.Unlock()
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// RemoveMetrics removes the queue's metrics, for queues that won't be used again
+func (q *FrameQueue) RemoveMetrics() {
+	metrics.GlobalMetricCache.Remove("frame_queue_depth", prometheus.Labels{"queue": q.name})
+	metrics.GlobalMetricCache.Remove("frame_queue_keyframe_requests", prometheus.Labels{"queue": q.name})
+	for _, reason := range dropReasons {
+		labels := prometheus.Labels{"queue": q.name, "reason": string(reason)}
+		metrics.GlobalMetricCache.Remove("frame_queue_frames_dropped", labels)
+		metrics.GlobalMetricCache.Remove("frame_queue_packets_dropped", labels)
+	}
+}
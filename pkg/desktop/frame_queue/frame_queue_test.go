@@ -0,0 +1,132 @@
+package frame_queue_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/frame_queue"
+)
+
+// H.264 NAL headers for single NAL unit packets
+const (
+	idr          = 0x65 // IDR slice
+	reference    = 0x61 // non-IDR slice that other frames refer to
+	nonReference = 0x01 // non-IDR slice with nal_ref_idc of 0
+)
+
+func packet(timestamp uint32, nal byte, marker bool) *rtp.Packet {
+	return &rtp.Packet{
+		Header:  rtp.Header{Timestamp: timestamp, Marker: marker},
+		Payload: []byte{nal, 0x88},
+	}
+}
+
+func popAll(q *frame_queue.FrameQueue) []uint32 {
+	timestamps := []uint32{}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for q.Len() > 0 {
+		pkt, ok := q.Pop(ctx)
+		if !ok {
+			break
+		}
+		timestamps = append(timestamps, pkt.Timestamp)
+	}
+	return timestamps
+}
+
+func expectTimestamps(t *testing.T, actual []uint32, expected ...uint32) {
+	t.Helper()
+	if len(actual) != len(expected) {
+		t.Fatalf("Expected timestamps %v, got %v", expected, actual)
+	}
+	for i := range expected {
+		if actual[i] != expected[i] {
+			t.Fatalf("Expected timestamps %v, got %v", expected, actual)
+		}
+	}
+}
+
+func TestFrameQueue_KeepsOrder(t *testing.T) {
+	q := frame_queue.NewFrameQueue("test-order", webrtc.MimeTypeH264, 10, nil)
+	q.Push(packet(1, idr, false))
+	q.Push(packet(1, idr, true))
+	q.Push(packet(2, reference, true))
+	expectTimestamps(t, popAll(q), 1, 1, 2)
+}
+
+func TestFrameQueue_DropsDiscardableFramesFirst(t *testing.T) {
+	requested := false
+	q := frame_queue.NewFrameQueue("test-discardable", webrtc.MimeTypeH264, 4, func() { requested = true })
+	q.Push(packet(1, idr, false))
+	q.Push(packet(1, idr, true))
+	q.Push(packet(2, reference, true))
+	q.Push(packet(3, nonReference, true))
+	q.Push(packet(4, reference, true))
+
+	expectTimestamps(t, popAll(q), 1, 1, 2, 4)
+	if requested {
+		t.Error("Didn't expect a keyframe request when only discardable frames were dropped")
+	}
+}
+
+func TestFrameQueue_DropsUntilKeyframe(t *testing.T) {
+	requested := 0
+	q := frame_queue.NewFrameQueue("test-keyframe", webrtc.MimeTypeH264, 3, func() { requested++ })
+	q.Push(packet(1, idr, true))
+	q.Push(packet(2, reference, true))
+	q.Push(packet(3, reference, true))
+	q.Push(packet(4, reference, true))
+	if requested != 1 {
+		t.Fatalf("Expected a keyframe request, got %v", requested)
+	}
+
+	// Frames that depend on what was dropped are thrown away, including the rest of them
+	q.Push(packet(5, reference, false))
+	q.Push(packet(5, reference, true))
+	q.Push(packet(6, idr, false))
+	q.Push(packet(6, idr, true))
+	q.Push(packet(7, reference, true))
+
+	expectTimestamps(t, popAll(q), 6, 6, 7)
+}
+
+func TestFrameQueue_FinishesPartiallySentFrame(t *testing.T) {
+	q := frame_queue.NewFrameQueue("test-partial", webrtc.MimeTypeH264, 2, nil)
+	q.Push(packet(1, idr, false))
+	q.Push(packet(1, idr, false))
+	if pkt, ok := q.Pop(context.Background()); !ok || pkt.Timestamp != 1 {
+		t.Fatalf("Expected the first packet, got %v", pkt)
+	}
+	q.Push(packet(1, idr, true))
+	q.Push(packet(2, reference, true))
+	q.Push(packet(3, reference, true))
+
+	expectTimestamps(t, popAll(q), 1, 1)
+}
+
+func TestFrameQueue_KeyframeInterval(t *testing.T) {
+	requested := 0
+	q := frame_queue.NewFrameQueue("test-interval", webrtc.MimeTypeH264, 10, func() { requested++ })
+	q.SetKeyframeInterval(time.Hour)
+	q.Push(packet(1, reference, true))
+	q.Push(packet(2, idr, false))
+	q.Push(packet(2, idr, true))
+	q.Push(packet(3, reference, true))
+	// Too soon after the last one
+	q.Push(packet(4, idr, true))
+	expectTimestamps(t, popAll(q), 2, 2)
+
+	// Later frames depend on the ones that were skipped
+	q.SetKeyframeInterval(0)
+	if requested != 1 {
+		t.Fatalf("Expected a keyframe request, got %v", requested)
+	}
+	q.Push(packet(5, reference, true))
+	q.Push(packet(6, idr, true))
+	q.Push(packet(7, reference, true))
+	expectTimestamps(t, popAll(q), 6, 7)
+}
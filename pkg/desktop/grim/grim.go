@@ -0,0 +1,49 @@
+//go:build linux
+// +build linux
+
+// Package grim takes screenshots of wayland desktops with grim.
+package grim
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/preview"
+	"github.com/pod-arcade/pod-arcade/pkg/util"
+)
+
+var _ preview.SnapshotConfigurator = (*Screenshot)(nil)
+
+type Screenshot struct {
+	// Scale shrinks the screenshot, like 0.25 for a quarter of the screen's width and height
+	Scale float64
+}
+
+func NewScreenshot(scale float64) *Screenshot {
+	return &Screenshot{
+		Scale: scale,
+	}
+}
+
+func (s *Screenshot) GetName() string {
+	return "Grim Screenshot"
+}
+
+func (s *Screenshot) GetProgramRunnerSnapshot(file *os.File, quality int) (*util.ProgramRunner, error) {
+	runner := &util.ProgramRunner{}
+	runner.Program = "grim"
+	runner.Args = []string{
+		"-t", "jpeg",
+		"-q", fmt.Sprint(quality),
+		"-s", fmt.Sprint(s.Scale),
+		file.Name(),
+	}
+
+	// Linux-specific: set Pdeathsig to ensure child termination
+	runner.SysProcAttr = syscall.SysProcAttr{
+		Pdeathsig: syscall.SIGKILL,
+	}
+
+	return runner, nil
+}
@@ -0,0 +1,220 @@
+// Package hls packages what the desktop streams as Low-Latency HLS, for audiences
+// too large for a WebRTC session each. Segments and their parts are fragmented
+// MP4, written to a directory that can be served by the desktop itself, with
+// blocking playlist reloads, or by any web server.
+package hls
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"github.com/pod-arcade/pod-arcade/api"
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/depacketizer"
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/fmp4"
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/media_clock"
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/packet_pool"
+	"github.com/pod-arcade/pod-arcade/pkg/log"
+	"github.com/pod-arcade/pod-arcade/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+)
+
+const (
+	DefaultSegmentDuration = 2 * time.Second
+	DefaultPartDuration    = 250 * time.Millisecond
+	DefaultSegments        = 6
+)
+
+var segmentsWritten = metrics.GlobalMetricCache.GetCounter("hls_segments_written", prometheus.Labels{})
+
+type Config struct {
+	// Dir is where the playlist, segments and parts are written
+	Dir string
+	// SegmentDuration is how long segments are, at least. They start at keyframes.
+	SegmentDuration time.Duration
+	// PartDuration is how long parts are, at most
+	PartDuration time.Duration
+	// Segments is how many segments the playlist lists. Older segments are deleted.
+	Segments int
+}
+
+var _ http.Handler = (*Packager)(nil)
+
+// Packager packages the mixer's H.264 video, with its Opus audio, as HLS. The
+// video source is kept running the whole time, since viewers come and go
+// without the desktop knowing.
+type Packager struct {
+	mixer  api.Mixer
+	config Config
+
+	seg *segmenter
+	mtx sync.Mutex
+	l   zerolog.Logger
+}
+
+func NewPackager(mixer api.Mixer, config Config) *Packager {
+	if config.SegmentDuration <= 0 {
+		config.SegmentDuration = DefaultSegmentDuration
+	}
+	if config.PartDuration <= 0 {
+		config.PartDuration = DefaultPartDuration
+	}
+	if config.Segments <= 0 {
+		config.Segments = DefaultSegments
+	}
+	return &Packager{
+		mixer:  mixer,
+		config: config,
+		l:      log.NewLogger("HLS", map[string]string{"dir": config.Dir}),
+	}
+}
+
+// Run packages the stream until the context is done
+func (p *Packager) Run(ctx context.Context) error {
+	video, err := p.mixer.StartVideoTrack("", webrtc.MimeTypeH264)
+	if err != nil {
+		return err
+	}
+	defer p.mixer.ReleaseTrack(video)
+	videoPkts := video.Subscribe(api.VideoSubscriptionSize)
+	defer videoPkts.Close()
+
+	var audio api.Track
+	var audioTrack *fmp4.Track
+	var audioPkts <-chan *rtp.Packet
+	for _, t := range p.mixer.GetAudioTracks() {
+		codec := t.Codec()
+		if !strings.EqualFold(codec.MimeType, webrtc.MimeTypeOpus) {
+			p.l.Warn().Msgf("Can't package %v audio, only Opus", codec.MimeType)
+			continue
+		}
+		audio = t
+		audioTrack = &fmp4.Track{Codec: fmp4.CodecOpus, Timescale: audioTimescale, Channels: int(codec.Channels)}
+		p.mixer.AcquireTrack(audio)
+		defer p.mixer.ReleaseTrack(audio)
+		sub := t.Subscribe(api.AudioSubscriptionSize)
+		defer sub.Close()
+		audioPkts = sub.Packets()
+		break
+	}
+
+	seg := newSegmenter(p.config.Dir, p.config, audioTrack, p.l)
+	seg.RequestKeyframe = video.RequestKeyframe
+	if err := seg.clean(); err != nil {
+		return err
+	}
+	p.mtx.Lock()
+	p.seg = seg
+	p.mtx.Unlock()
+
+	h264 := depacketizer.NewH264()
+	h264.KeyframeNeeded = video.RequestKeyframe
+	videoClockRate := video.Codec().ClockRate
+	p.l.Info().Msgf("Packaging %v segments with %v parts", p.config.SegmentDuration, p.config.PartDuration)
+
+	for {
+		select {
+		case pkt, ok := <-videoPkts.Packets():
+			if !ok {
+				return nil
+			}
+			var err error
+			if au := h264.Push(pkt); au != nil {
+				t := media_clock.Default.Time(au.Timestamp, videoClockRate, time.Now())
+				err = seg.PushVideo(t, au)
+			}
+			packet_pool.PutPacket(pkt)
+			if err != nil {
+				return err
+			}
+		case pkt, ok := <-audioPkts:
+			if !ok {
+				audioPkts = nil
+				continue
+			}
+			if len(pkt.Payload) > 0 {
+				t := media_clock.Default.Time(pkt.Timestamp, audio.Codec().ClockRate, time.Now())
+				seg.PushAudio(t, slices.Clone(pkt.Payload))
+			}
+			packet_pool.PutPacket(pkt)
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// ServeHTTP serves the playlist, segments and parts. Playlist requests with
+// _HLS_msn and _HLS_part wait for that part, and so do requests for the next part.
+func (p *Packager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	p.mtx.Lock()
+	s := p.seg
+	p.mtx.Unlock()
+	if s == nil {
+		http.Error(w, "not packaging yet", http.StatusServiceUnavailable)
+		return
+	}
+
+	name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+	if strings.Contains(name, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	// Players wait up to three target durations for a blocking reload
+	timeout := 3 * p.config.SegmentDuration
+
+	switch {
+	case name == PlaylistName:
+		query := r.URL.Query()
+		if msn := query.Get("_HLS_msn"); msn != "" {
+			sequence, err := strconv.ParseUint(msn, 10, 64)
+			if err != nil {
+				http.Error(w, "invalid _HLS_msn", http.StatusBadRequest)
+				return
+			}
+			part := -1
+			if query.Has("_HLS_part") {
+				if part, err = strconv.Atoi(query.Get("_HLS_part")); err != nil || part < 0 {
+					http.Error(w, "invalid _HLS_part", http.StatusBadRequest)
+					return
+				}
+			}
+			if s.tooFarAhead(sequence) {
+				http.Error(w, "_HLS_msn is too far ahead", http.StatusBadRequest)
+				return
+			}
+			if !s.wait(r.Context(), timeout, func() bool { return s.has(sequence, part) }) {
+				http.Error(w, "timed out waiting for the playlist", http.StatusServiceUnavailable)
+				return
+			}
+		}
+		s.mtx.Lock()
+		playlist := s.playlist(true)
+		s.mtx.Unlock()
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Write(playlist)
+		return
+	case strings.HasSuffix(name, ".m4s"):
+		var sequence uint64
+		var part int
+		if n, _ := fmt.Sscanf(name, "segment%d.%d.m4s", &sequence, &part); n == 2 && !s.tooFarAhead(sequence) {
+			s.wait(r.Context(), timeout, func() bool { return s.has(sequence, part) })
+		}
+		w.Header().Set("Content-Type", "video/iso.segment")
+	case strings.HasSuffix(name, ".mp4"):
+		w.Header().Set("Content-Type", "video/mp4")
+	}
+	w.Header().Set("Cache-Control", "max-age=60")
+	http.ServeFile(w, r, filepath.Join(p.config.Dir, name))
+}
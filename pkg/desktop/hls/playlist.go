@@ -0,0 +1,121 @@
+package hls
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// partSegments is how many of the last finished segments have their parts listed, besides the current one
+const partSegments = 2
+
+func seconds(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
+
+// playlist returns the media playlist. Blocking playlists, which are served over
+// HTTP, say that reloads can block and hint at the next part.
+func (s *segmenter) playlist(blocking bool) []byte {
+	listed := s.finished[max(len(s.finished)-s.segments, 0):]
+	targetDuration := int(math.Ceil(max(s.segmentDuration, s.maxSegment).Seconds()))
+
+	b := &strings.Builder{}
+	b.WriteString("#EXTM3U\n")
+	b.WriteString("#EXT-X-VERSION:6\n")
+	fmt.Fprintf(b, "#EXT-X-TARGETDURATION:%d\n", targetDuration)
+	// Players start three parts from the end, so they can keep up with the parts as they're written
+	if blocking {
+		fmt.Fprintf(b, "#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=%s\n", seconds(3*s.partDuration))
+	} else {
+		fmt.Fprintf(b, "#EXT-X-SERVER-CONTROL:PART-HOLD-BACK=%s\n", seconds(3*s.partDuration))
+	}
+	fmt.Fprintf(b, "#EXT-X-PART-INF:PART-TARGET=%s\n", seconds(s.partDuration))
+	sequence := uint64(0)
+	if len(listed) > 0 {
+		sequence = listed[0].sequence
+	} else if s.current != nil {
+		sequence = s.current.sequence
+	}
+	fmt.Fprintf(b, "#EXT-X-MEDIA-SEQUENCE:%d\n", sequence)
+
+	init := ""
+	writeSegment := func(seg *segment, withParts bool) {
+		if seg.init != init {
+			init = seg.init
+			fmt.Fprintf(b, "#EXT-X-MAP:URI=%q\n", init)
+			fmt.Fprintf(b, "#EXT-X-PROGRAM-DATE-TIME:%s\n", seg.start.UTC().Format("2006-01-02T15:04:05.000Z07:00"))
+		}
+		if withParts {
+			for i, p := range seg.parts {
+				fmt.Fprintf(b, "#EXT-X-PART:DURATION=%s,URI=%q", seconds(p.duration), partName(seg.sequence, i))
+				if p.independent {
+					b.WriteString(",INDEPENDENT=YES")
+				}
+				b.WriteString("\n")
+			}
+		}
+	}
+
+	for i, seg := range listed {
+		writeSegment(seg, i >= len(listed)-partSegments)
+		fmt.Fprintf(b, "#EXTINF:%s,\n%s\n", seconds(seg.duration), segmentName(seg.sequence))
+	}
+	if s.current != nil {
+		writeSegment(s.current, true)
+		if blocking {
+			fmt.Fprintf(b, "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=%q\n", partName(s.current.sequence, len(s.current.parts)))
+		}
+	}
+	return []byte(b.String())
+}
+
+// has returns whether the playlist has a part of a segment, or the whole segment if part is negative
+func (s *segmenter) has(sequence uint64, part int) bool {
+	if s.current == nil {
+		n := len(s.finished)
+		return n > 0 && s.finished[n-1].sequence >= sequence
+	}
+	if sequence != s.current.sequence {
+		return sequence < s.current.sequence
+	}
+	return part >= 0 && part < len(s.current.parts)
+}
+
+// tooFarAhead returns whether a segment is more than two segments after the current one,
+// which players shouldn't wait for
+func (s *segmenter) tooFarAhead(sequence uint64) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	next := uint64(0)
+	if s.current != nil {
+		next = s.current.sequence
+	} else if n := len(s.finished); n > 0 {
+		next = s.finished[n-1].sequence + 1
+	}
+	return sequence > next+2
+}
+
+// wait waits until ready returns true, which it's called with the lock held, or until the timeout.
+// It returns whether it's ready.
+func (s *segmenter) wait(ctx context.Context, timeout time.Duration, ready func() bool) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		s.mtx.Lock()
+		ok := ready()
+		changed := s.changed
+		s.mtx.Unlock()
+		if ok {
+			return true
+		}
+		select {
+		case <-changed:
+		case <-timer.C:
+			return false
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
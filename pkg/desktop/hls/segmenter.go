@@ -0,0 +1,323 @@
+package hls
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/depacketizer"
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/fmp4"
+	"github.com/rs/zerolog"
+)
+
+const (
+	videoTrackIndex = 0
+	audioTrackIndex = 1
+
+	videoTimescale = 90000
+	audioTimescale = 48000
+)
+
+// keptSegments is how many segments are kept on disk after they leave the playlist,
+// for players that are still downloading them
+const keptSegments = 2
+
+// PlaylistName is the name of the media playlist
+const PlaylistName = "index.m3u8"
+
+func initName(n int) string                  { return fmt.Sprintf("init%d.mp4", n) }
+func segmentName(sequence uint64) string     { return fmt.Sprintf("segment%d.m4s", sequence) }
+func partName(sequence uint64, i int) string { return fmt.Sprintf("segment%d.%d.m4s", sequence, i) }
+
+// part is a partial segment, which players can fetch before its segment is finished
+type part struct {
+	duration    time.Duration
+	independent bool
+}
+
+type segment struct {
+	sequence uint64
+	// init is the initialization segment the segment's fragments need
+	init     string
+	start    time.Time
+	duration time.Duration
+	parts    []part
+	// data is what's been written of the segment so far, until it's finished
+	data []byte
+}
+
+// pendingSample is a sample that's waiting for the next one, which gives its duration
+type pendingSample struct {
+	decodeTime uint64
+	keyframe   bool
+	data       []byte
+}
+
+type trackState struct {
+	timescale uint32
+	pending   *pendingSample
+	// samples are finished samples of the current part, starting at decodeTime
+	samples    []fmp4.Sample
+	decodeTime uint64
+}
+
+// push finishes the pending sample, now that the next one's time is known, and makes the next one pending
+func (t *trackState) push(decodeTime uint64, keyframe bool, data []byte) {
+	if p := t.pending; p != nil {
+		// Timestamps that go backwards are pushed forward, so decode times never overlap
+		decodeTime = max(decodeTime, p.decodeTime+1)
+		if len(t.samples) == 0 {
+			t.decodeTime = p.decodeTime
+		}
+		t.samples = append(t.samples, fmp4.Sample{
+			Duration: uint32(decodeTime - p.decodeTime),
+			Keyframe: p.keyframe,
+			Data:     p.data,
+		})
+	}
+	t.pending = &pendingSample{decodeTime: decodeTime, keyframe: keyframe, data: data}
+}
+
+// decodeTimeOf converts a time since the start of the stream to a track's timescale
+func (t *trackState) decodeTimeOf(d time.Duration) uint64 {
+	return uint64(d) * uint64(t.timescale) / uint64(time.Second)
+}
+
+// segmenter cuts the stream into segments and parts, writes them to a
+// directory, and keeps the playlist that lists them
+type segmenter struct {
+	dir             string
+	segmentDuration time.Duration
+	partDuration    time.Duration
+	segments        int
+
+	// RequestKeyframe is called when a segment is long enough, and waiting for the next keyframe
+	RequestKeyframe func()
+
+	video     trackState
+	audio     *trackState
+	tracks    []fmp4.Track
+	sps, pps  []byte
+	inits     int
+	fragments uint32
+
+	start      time.Time
+	partStart  time.Duration
+	frameTime  time.Duration
+	lastFrame  time.Duration
+	requested  bool
+	maxSegment time.Duration
+
+	// finished are the finished segments still on disk, oldest first
+	finished []*segment
+	current  *segment
+	changed  chan struct{}
+	mtx      sync.Mutex
+	l        zerolog.Logger
+}
+
+func newSegmenter(dir string, config Config, audio *fmp4.Track, l zerolog.Logger) *segmenter {
+	s := &segmenter{
+		dir:             dir,
+		segmentDuration: config.SegmentDuration,
+		partDuration:    config.PartDuration,
+		segments:        config.Segments,
+		RequestKeyframe: func() {},
+		video:           trackState{timescale: videoTimescale},
+		tracks:          []fmp4.Track{{Codec: fmp4.CodecH264, Timescale: videoTimescale}},
+		changed:         make(chan struct{}),
+		l:               l,
+	}
+	if audio != nil {
+		s.audio = &trackState{timescale: audio.Timescale}
+		s.tracks = append(s.tracks, *audio)
+	}
+	return s
+}
+
+// clean removes what an earlier run left in the directory, since its segments are numbered from 0 again
+func (s *segmenter) clean() error {
+	if err := os.MkdirAll(s.dir, 0o755); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if name == PlaylistName || strings.HasSuffix(name, ".m4s") || strings.HasPrefix(name, "init") && strings.HasSuffix(name, ".mp4") {
+			os.Remove(filepath.Join(s.dir, name))
+		}
+	}
+	return nil
+}
+
+// PushVideo adds an access unit at a time, which has to start with a keyframe
+func (s *segmenter) PushVideo(t time.Time, au *depacketizer.AccessUnit) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.current == nil && !au.Keyframe {
+		return nil
+	}
+	if s.start.IsZero() {
+		s.start = t
+	}
+	at := max(t.Sub(s.start), s.lastFrame)
+
+	newInit := au.Keyframe && (!bytes.Equal(au.SPS, s.sps) || !bytes.Equal(au.PPS, s.pps))
+	s.video.push(s.video.decodeTimeOf(at), au.Keyframe, au.AppendAVCC(nil))
+	if s.current != nil {
+		// Keyframes half a frame early still end the segment, since their timestamps are rounded
+		long := at-s.partStart+s.current.duration+s.frameTime/2 >= s.segmentDuration
+		if au.Keyframe && (newInit || long) {
+			if err := s.finishPart(at); err != nil {
+				return err
+			}
+			if err := s.finishSegment(); err != nil {
+				return err
+			}
+		} else if at-s.partStart+s.frameTime > s.partDuration {
+			// Parts end before the next frame would make them longer than the part target
+			if err := s.finishPart(at); err != nil {
+				return err
+			}
+		}
+		if long && !s.requested && !au.Keyframe {
+			s.requested = true
+			s.RequestKeyframe()
+		}
+	}
+	s.frameTime = at - s.lastFrame
+	s.lastFrame = at
+
+	if newInit {
+		if err := s.writeInit(au); err != nil {
+			return err
+		}
+	}
+	if s.current == nil {
+		s.startSegment(at)
+	}
+	return nil
+}
+
+// PushAudio adds an audio frame at a time. Audio before the first video keyframe is dropped.
+func (s *segmenter) PushAudio(t time.Time, data []byte) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.audio == nil || s.current == nil || t.Before(s.start) {
+		return
+	}
+	s.audio.push(s.audio.decodeTimeOf(t.Sub(s.start)), true, data)
+}
+
+func (s *segmenter) writeInit(au *depacketizer.AccessUnit) error {
+	width, height, err := depacketizer.SPSResolution(au.SPS)
+	if err != nil {
+		return err
+	}
+	s.sps = append(s.sps[:0], au.SPS...)
+	s.pps = append(s.pps[:0], au.PPS...)
+	s.tracks[videoTrackIndex].Width = width
+	s.tracks[videoTrackIndex].Height = height
+	s.tracks[videoTrackIndex].AVCDecoderConfig = depacketizer.AVCDecoderConfig(au.SPS, au.PPS)
+
+	data, err := fmp4.AppendInit(nil, s.tracks)
+	if err != nil {
+		return err
+	}
+	s.inits++
+	s.l.Info().Msgf("Packaging %vx%v video", width, height)
+	return writeFile(filepath.Join(s.dir, initName(s.inits)), data)
+}
+
+func (s *segmenter) startSegment(at time.Duration) {
+	sequence := uint64(0)
+	if s.current != nil {
+		sequence = s.current.sequence + 1
+	} else if n := len(s.finished); n > 0 {
+		sequence = s.finished[n-1].sequence + 1
+	}
+	s.current = &segment{sequence: sequence, init: initName(s.inits), start: s.start.Add(at)}
+	s.partStart = at
+	s.requested = false
+}
+
+// finishPart writes the samples since the last part, up to a time
+func (s *segmenter) finishPart(at time.Duration) error {
+	runs := []fmp4.TrackRun{{Track: videoTrackIndex, DecodeTime: s.video.decodeTime, Samples: s.video.samples}}
+	if s.audio != nil && len(s.audio.samples) > 0 {
+		runs = append(runs, fmp4.TrackRun{Track: audioTrackIndex, DecodeTime: s.audio.decodeTime, Samples: s.audio.samples})
+	}
+	s.fragments++
+	start := len(s.current.data)
+	s.current.data = fmp4.AppendFragment(s.current.data, s.fragments, runs)
+	s.video.samples = s.video.samples[:0]
+	if s.audio != nil {
+		s.audio.samples = s.audio.samples[:0]
+	}
+
+	name := partName(s.current.sequence, len(s.current.parts))
+	if err := writeFile(filepath.Join(s.dir, name), s.current.data[start:]); err != nil {
+		return err
+	}
+	s.current.parts = append(s.current.parts, part{
+		duration:    at - s.partStart,
+		independent: runs[0].Samples[0].Keyframe,
+	})
+	s.current.duration += at - s.partStart
+	s.partStart = at
+	return s.publish()
+}
+
+// finishSegment writes the current segment whole, and drops the oldest segments
+func (s *segmenter) finishSegment() error {
+	c := s.current
+	if err := writeFile(filepath.Join(s.dir, segmentName(c.sequence)), c.data); err != nil {
+		return err
+	}
+	c.data = nil
+	s.finished = append(s.finished, c)
+	s.maxSegment = max(s.maxSegment, c.duration)
+	s.current = nil
+	segmentsWritten.Inc()
+
+	for len(s.finished) > s.segments+keptSegments {
+		s.remove(s.finished[0])
+		s.finished = s.finished[1:]
+	}
+	return s.publish()
+}
+
+// remove deletes a segment's files, and its initialization segment once no other segment needs it
+func (s *segmenter) remove(old *segment) {
+	os.Remove(filepath.Join(s.dir, segmentName(old.sequence)))
+	for i := range old.parts {
+		os.Remove(filepath.Join(s.dir, partName(old.sequence, i)))
+	}
+	if next := s.finished[1]; next.init != old.init {
+		os.Remove(filepath.Join(s.dir, old.init))
+	}
+}
+
+// publish writes the playlist, and wakes up requests that are waiting for it to change
+func (s *segmenter) publish() error {
+	close(s.changed)
+	s.changed = make(chan struct{})
+	return writeFile(filepath.Join(s.dir, PlaylistName), s.playlist(false))
+}
+
+// writeFile writes a file under a temporary name first, so that it's never read half written
+func writeFile(path string, data []byte) error {
+	if err := os.WriteFile(path+".tmp", data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
@@ -0,0 +1,93 @@
+package hls
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/depacketizer"
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/fmp4"
+	"github.com/rs/zerolog"
+)
+
+var testSPS = []byte{0x67, 0x42, 0xc0, 0x28, 0xd9, 0x00, 0x78, 0x02, 0x27, 0xe5, 0xc0, 0x44, 0x00, 0x00, 0x03, 0x00, 0x04, 0x00, 0x00, 0x03, 0x00, 0xf0, 0x3c, 0x60, 0xc9, 0x20}
+
+func TestSegmenter(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "segment9.m4s"), []byte("stale"), 0o644)
+
+	s := newSegmenter(dir, Config{SegmentDuration: time.Second, PartDuration: 300 * time.Millisecond, Segments: 2},
+		&fmp4.Track{Codec: fmp4.CodecOpus, Timescale: audioTimescale, Channels: 2}, zerolog.Nop())
+	if err := s.clean(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 30fps with a keyframe every second, and audio every 20ms, for 5.5 seconds
+	start := time.Now()
+	frame := time.Second / 30
+	for i := 0; i < 165; i++ {
+		at := start.Add(time.Duration(i) * frame)
+		au := &depacketizer.AccessUnit{Keyframe: i%30 == 0, NALs: [][]byte{{0x41, byte(i)}}}
+		if au.Keyframe {
+			au.SPS, au.PPS = testSPS, []byte{0x68, 0xce}
+		}
+		if err := s.PushVideo(at, au); err != nil {
+			t.Fatal(err)
+		}
+		for a := at; a.Before(at.Add(frame)); a = a.Add(20 * time.Millisecond) {
+			s.PushAudio(a, []byte{0xfc})
+		}
+	}
+
+	if len(s.finished) != 4 || s.finished[0].sequence != 1 {
+		t.Fatalf("Expected segments 1 to 4 to be kept, got %v segments", len(s.finished))
+	}
+	if _, err := os.Stat(filepath.Join(dir, segmentName(0))); !os.IsNotExist(err) {
+		t.Errorf("Expected the oldest segment to be deleted, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "segment9.m4s")); !os.IsNotExist(err) {
+		t.Errorf("Expected an earlier run's segments to be deleted, got %v", err)
+	}
+	for _, name := range []string{initName(1), segmentName(4), partName(5, 0), PlaylistName} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("Expected %v to be written: %v", name, err)
+		}
+	}
+
+	seg := s.finished[3]
+	if seg.duration.Round(time.Millisecond) != time.Second || len(seg.parts) != 4 || !seg.parts[0].independent || seg.parts[1].independent {
+		t.Errorf("Expected a 1s segment of 4 parts, starting with an independent one, got %v and %+v", seg.duration, seg.parts)
+	}
+	for _, p := range seg.parts {
+		if p.duration > 300*time.Millisecond {
+			t.Errorf("Expected parts no longer than 300ms, got %v", p.duration)
+		}
+	}
+
+	playlist := string(s.playlist(true))
+	for _, line := range []string{
+		"#EXT-X-TARGETDURATION:1\n",
+		"#EXT-X-MEDIA-SEQUENCE:3\n",
+		"#EXT-X-MAP:URI=\"init1.mp4\"\n",
+		"#EXTINF:1.000,\nsegment4.m4s\n",
+		"#EXT-X-PART:DURATION=0.300,URI=\"segment5.0.m4s\",INDEPENDENT=YES\n",
+		"#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"segment5.1.m4s\"\n",
+	} {
+		if !strings.Contains(playlist, line) {
+			t.Errorf("Expected the playlist to contain %q, got\n%v", line, playlist)
+		}
+	}
+	if strings.Contains(playlist, "segment2.m4s") {
+		t.Errorf("Expected only the last 2 segments to be listed, got\n%v", playlist)
+	}
+
+	if !s.has(5, 0) || s.has(5, 1) || !s.has(4, -1) || s.has(5, -1) {
+		t.Error("Expected the playlist to have the first part of segment 5")
+	}
+	if s.wait(context.Background(), 10*time.Millisecond, func() bool { return s.has(6, 0) }) {
+		t.Error("Expected waiting for a later segment to time out")
+	}
+}
@@ -0,0 +1,81 @@
+package desktop
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/pod-arcade/pod-arcade/api"
+	"github.com/pod-arcade/pod-arcade/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// rttRefreshInterval is how often the round trip time is read from the connection's stats
+const rttRefreshInterval = time.Second
+
+// latencyBuckets are the end to end latency histogram buckets, in seconds
+var latencyBuckets = []float64{0.01, 0.02, 0.03, 0.05, 0.075, 0.1, 0.15, 0.2, 0.3, 0.5, 1}
+
+// latencyTracker turns a session's frame echoes into end to end latencies. A frame
+// echo arrives half a round trip after the client sent it, so that's taken off, along
+// with however long the client waited between rendering the frame and echoing it.
+type latencyTracker struct {
+	pc        *webrtc.PeerConnection
+	labels    prometheus.Labels
+	histogram prometheus.Histogram
+	now       func() time.Time
+
+	mtx         sync.Mutex
+	rtt         time.Duration
+	rttOutdated time.Time
+}
+
+func newLatencyTracker(session api.SessionID, pc *webrtc.PeerConnection) *latencyTracker {
+	labels := prometheus.Labels{"session": string(session)}
+	return &latencyTracker{
+		pc:        pc,
+		labels:    labels,
+		histogram: metrics.GlobalMetricCache.GetHistogram("session_e2e_latency_seconds", labels, latencyBuckets),
+		now:       time.Now,
+	}
+}
+
+// Close removes the session's histogram once the session is gone
+func (t *latencyTracker) Close() {
+	metrics.GlobalMetricCache.Remove("session_e2e_latency_seconds", t.labels)
+}
+
+// HandleFrameEcho records the latency of the echoed frame
+func (t *latencyTracker) HandleFrameEcho(echo api.FrameEcho) {
+	now := t.now()
+	captured := time.UnixMicro(int64(echo.CaptureTime))
+	renderDelay := time.Duration(echo.RenderDelay) * time.Microsecond
+
+	latency := now.Sub(captured) - renderDelay - t.roundTripTime(now)/2
+	if latency < 0 {
+		// The echo can't be older than the frame, so the round trip estimate is off,
+		// and recording it would skew the histogram
+		return
+	}
+	t.histogram.Observe(latency.Seconds())
+}
+
+// roundTripTime returns the round trip time of the nominated candidate pair, reading it at most once per interval
+func (t *latencyTracker) roundTripTime(now time.Time) time.Duration {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	if now.Before(t.rttOutdated) {
+		return t.rtt
+	}
+	t.rttOutdated = now.Add(rttRefreshInterval)
+
+	for _, s := range t.pc.GetStats() {
+		pair, ok := s.(webrtc.ICECandidatePairStats)
+		if ok && pair.Nominated && pair.State == webrtc.StatsICECandidatePairStateSucceeded {
+			t.rtt = time.Duration(pair.CurrentRoundTripTime * float64(time.Second))
+			break
+		}
+	}
+	return t.rtt
+}
@@ -0,0 +1,46 @@
+// Package media_clock holds the capture clock that every media source derives
+// its RTP timestamps from. Sharing one clock between audio and video is what
+// lets the sender reports line the tracks up so browsers can lip-sync them.
+package media_clock
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Clock maps wall-clock time onto RTP timestamps for any clock rate.
+type Clock struct {
+	epoch time.Time
+	base  uint32
+}
+
+// Default is the clock shared by all of the desktop's media sources and its sender reports.
+var Default = NewClock()
+
+// NewClock returns a clock starting now, with a random RTP timestamp offset.
+func NewClock() *Clock {
+	return &Clock{
+		epoch: time.Now(),
+		base:  rand.Uint32(),
+	}
+}
+
+// RTPTimestamp returns the RTP timestamp of the instant t for a stream using clockRate.
+func (c *Clock) RTPTimestamp(t time.Time, clockRate uint32) uint32 {
+	return c.base + uint32(durationToTicks(t.Sub(c.epoch), clockRate))
+}
+
+// Time returns the instant that timestamp stands for, for a stream using clockRate.
+// RTP timestamps wrap, so it's the instant closest to near with that timestamp.
+func (c *Clock) Time(timestamp uint32, clockRate uint32, near time.Time) time.Time {
+	ticks := int64(int32(timestamp - c.RTPTimestamp(near, clockRate)))
+	return near.Add(time.Duration(ticks * int64(time.Second) / int64(clockRate)))
+}
+
+// durationToTicks converts a duration into a number of ticks of clockRate, without
+// overflowing for long running streams.
+func durationToTicks(d time.Duration, clockRate uint32) int64 {
+	seconds := int64(d / time.Second)
+	remainder := int64(d % time.Second)
+	return seconds*int64(clockRate) + remainder*int64(clockRate)/int64(time.Second)
+}
@@ -0,0 +1,58 @@
+package media_clock
+
+import (
+	"time"
+)
+
+// driftSmoothing is how much weight each new measurement has in the drift average.
+// Pipes deliver samples in bursts, so single measurements are too noisy to act on.
+const driftSmoothing = 0.05
+
+// Timeline places a source's own sample positions onto the shared Clock.
+//
+// Sources like Ogg or PCM count samples at their own rate, which slowly drifts
+// away from the wall clock. The timeline anchors the first position to the clock,
+// then keeps counting in the source's samples, re-anchoring when the average drift
+// gets larger than MaxDrift.
+type Timeline struct {
+	clock     *Clock
+	clockRate uint32
+	maxDrift  int64
+
+	started bool
+	offset  int64
+	drift   float64
+}
+
+// NewTimeline returns a timeline on clock for a stream using clockRate, tolerating maxDrift before re-anchoring.
+func NewTimeline(clock *Clock, clockRate uint32, maxDrift time.Duration) *Timeline {
+	return &Timeline{
+		clock:     clock,
+		clockRate: clockRate,
+		maxDrift:  durationToTicks(maxDrift, clockRate),
+	}
+}
+
+// Timestamp returns the RTP timestamp for the sample at position, which was captured at the time at.
+func (t *Timeline) Timestamp(position int64, at time.Time) uint32 {
+	expected := durationToTicks(at.Sub(t.clock.epoch), t.clockRate)
+	if !t.started {
+		t.offset = expected - position
+		t.started = true
+	}
+
+	t.drift += (float64(expected-(position+t.offset)) - t.drift) * driftSmoothing
+	if t.drift > float64(t.maxDrift) || t.drift < -float64(t.maxDrift) {
+		t.offset += int64(t.drift)
+		t.drift = 0
+	}
+
+	return t.clock.base + uint32(position+t.offset)
+}
+
+// TimestampAt returns the RTP timestamp for position at another clock rate, placed
+// with the anchor of the last call to Timestamp. It's for streams that share the
+// timeline's reference clock, like the audio and video of an MPEG-TS stream.
+func (t *Timeline) TimestampAt(position int64, clockRate uint32) uint32 {
+	return t.clock.base + uint32((position+t.offset)*int64(clockRate)/int64(t.clockRate))
+}
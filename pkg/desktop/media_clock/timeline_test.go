@@ -0,0 +1,78 @@
+package media_clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClock_RTPTimestamp(t *testing.T) {
+	c := &Clock{epoch: time.Unix(0, 0), base: 1000}
+
+	if ts := c.RTPTimestamp(time.Unix(1, 0), 90000); ts != 91000 {
+		t.Errorf("Expected 91000, got %v", ts)
+	}
+	if ts := c.RTPTimestamp(time.Unix(0, int64(20*time.Millisecond)), 48000); ts != 1960 {
+		t.Errorf("Expected 1960, got %v", ts)
+	}
+	// A month in, we should still be counting without overflowing
+	month := int64(60 * 60 * 24 * 30)
+	if ts := c.RTPTimestamp(time.Unix(month, 0), 90000); ts != uint32(1000+month*90000) {
+		t.Errorf("Expected wrapped timestamp, got %v", ts)
+	}
+}
+
+func TestClock_Time(t *testing.T) {
+	c := &Clock{epoch: time.Unix(0, 0), base: 0xffffff00}
+	at := time.Unix(100, int64(20*time.Millisecond))
+
+	ts := c.RTPTimestamp(at, 48000)
+	if got := c.Time(ts, 48000, at.Add(3*time.Second)); !got.Equal(at) {
+		t.Errorf("Expected %v, got %v", at, got)
+	}
+	if got := c.Time(ts, 48000, at.Add(-3*time.Second)); !got.Equal(at) {
+		t.Errorf("Expected %v, got %v", at, got)
+	}
+}
+
+func TestTimeline_Timestamp(t *testing.T) {
+	epoch := time.Unix(0, 0)
+	c := &Clock{epoch: epoch, base: 0}
+	tl := NewTimeline(c, 8000, 80*time.Millisecond)
+
+	// the first sample is anchored to the clock
+	if ts := tl.Timestamp(0, epoch.Add(time.Second)); ts != 8000 {
+		t.Errorf("Expected 8000, got %v", ts)
+	}
+
+	// small amounts of jitter keep the source's own timing
+	if ts := tl.Timestamp(160, epoch.Add(time.Second+25*time.Millisecond)); ts != 8160 {
+		t.Errorf("Expected 8160, got %v", ts)
+	}
+
+	// a source running slow eventually gets pulled back onto the clock
+	var ts uint32
+	for i := int64(0); i < 500; i++ {
+		ts = tl.Timestamp(320+i*160, epoch.Add(time.Second+time.Duration(i+2)*22*time.Millisecond))
+	}
+	expected := c.RTPTimestamp(epoch.Add(time.Second+501*22*time.Millisecond), 8000)
+	// Uncorrected, it would be a second behind by now. The drift is averaged, so
+	// allow for it lagging behind the threshold a bit.
+	if drift := int32(expected - ts); drift > 1280 || drift < -1280 {
+		t.Errorf("Expected the timeline to stay near the clock, drifted %v samples", drift)
+	}
+}
+
+func TestTimeline_TimestampAt(t *testing.T) {
+	epoch := time.Unix(0, 0)
+	c := &Clock{epoch: epoch, base: 1000}
+	tl := NewTimeline(c, 90000, 80*time.Millisecond)
+	tl.Timestamp(5000, epoch.Add(time.Second))
+
+	// Positions at the reference rate land where the clock puts the same instant
+	if ts := tl.TimestampAt(5000+1800, 48000); ts != c.RTPTimestamp(epoch.Add(time.Second+20*time.Millisecond), 48000) {
+		t.Errorf("Expected the audio timestamp 20ms in, got %v", ts)
+	}
+	if ts := tl.TimestampAt(5000, 90000); ts != 91000 {
+		t.Errorf("Expected 91000, got %v", ts)
+	}
+}
@@ -0,0 +1,207 @@
+// Package microphone plays the microphones that sessions send to the desktop, so
+// players can use voice chat in games. Each session's Opus is put back in order by
+// a jitter buffer, decoded by GStreamer, and written to an api.AudioSink.
+package microphone
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media/oggwriter"
+	"github.com/pion/webrtc/v4/pkg/media/samplebuilder"
+	"github.com/pod-arcade/pod-arcade/api"
+	"github.com/pod-arcade/pod-arcade/pkg/log"
+	"github.com/pod-arcade/pod-arcade/pkg/util"
+	"github.com/rs/zerolog"
+)
+
+// DefaultJitterBuffer is how long packets that arrive late or out of order are waited for
+const DefaultJitterBuffer = 60 * time.Millisecond
+
+// opusClockRate is the RTP clock rate of Opus, whatever rate it was recorded at
+const opusClockRate = 48000
+
+// maxLatePackets is how many packets the jitter buffer holds at most, however short they are
+const maxLatePackets = 50
+
+// rtpReader is where a microphone's packets come from, like a session's remote track
+type rtpReader interface {
+	ReadRTP() (*rtp.Packet, interceptor.Attributes, error)
+	Codec() webrtc.RTPCodecParameters
+}
+
+var _ rtpReader = (*webrtc.TrackRemote)(nil)
+
+// Microphone plays a session's microphone on an api.AudioSink
+type Microphone struct {
+	session      api.SessionID
+	sink         api.AudioSink
+	jitterBuffer time.Duration
+	muted        atomic.Bool
+
+	l zerolog.Logger
+}
+
+func NewMicrophone(session api.SessionID, sink api.AudioSink, jitterBuffer time.Duration) *Microphone {
+	if jitterBuffer <= 0 {
+		jitterBuffer = DefaultJitterBuffer
+	}
+	return &Microphone{
+		session:      session,
+		sink:         sink,
+		jitterBuffer: jitterBuffer,
+		l:            log.NewLogger("microphone", map[string]string{"Session": string(session), "Sink": sink.GetName()}),
+	}
+}
+
+// SetMuted mutes or unmutes the microphone. Nothing is played while it's muted.
+func (m *Microphone) SetMuted(muted bool) {
+	if m.muted.Swap(muted) != muted {
+		m.l.Info().Msgf("Muted: %v", muted)
+	}
+}
+
+// Run plays the track until it ends, or the context is done
+func (m *Microphone) Run(ctx context.Context, track *webrtc.TrackRemote) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		// Unblock ReadRTP once we're done
+		<-ctx.Done()
+		track.SetReadDeadline(time.Now())
+	}()
+	return m.run(ctx, track)
+}
+
+func (m *Microphone) run(ctx context.Context, track rtpReader) error {
+	if !strings.EqualFold(track.Codec().MimeType, webrtc.MimeTypeOpus) {
+		return fmt.Errorf("can't play %v, only Opus", track.Codec().MimeType)
+	}
+
+	out, err := m.sink.OpenAudio(m.session)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	decoder, err := m.startDecoder(ctx, out)
+	if err != nil {
+		return err
+	}
+	defer decoder.Close()
+
+	ogg, err := oggwriter.NewWith(decoder, opusClockRate, 1)
+	if err != nil {
+		return err
+	}
+
+	m.l.Info().Msg("Playing microphone")
+	buffer := samplebuilder.New(maxLatePackets, &codecs.OpusPacket{}, opusClockRate, samplebuilder.WithMaxTimeDelay(m.jitterBuffer))
+	for {
+		p, _, err := track.ReadRTP()
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		if m.muted.Load() {
+			continue
+		}
+
+		buffer.Push(p)
+		for sample, timestamp := buffer.PopWithTimestamp(); sample != nil; sample, timestamp = buffer.PopWithTimestamp() {
+			err := ogg.WriteRTP(&rtp.Packet{Header: rtp.Header{Timestamp: timestamp}, Payload: sample.Data})
+			if err != nil {
+				return fmt.Errorf("decoder stopped: %w", err)
+			}
+		}
+	}
+}
+
+// decoder is a GStreamer pipeline that decodes Ogg Opus to PCM
+type decoder struct {
+	in   *os.File
+	done chan struct{}
+}
+
+func (d *decoder) Write(p []byte) (int, error) {
+	return d.in.Write(p)
+}
+
+// Close stops the decoder once it's played what it was given
+func (d *decoder) Close() error {
+	err := d.in.Close()
+	<-d.done
+	return err
+}
+
+// startDecoder starts decoding Ogg Opus written to the decoder, and writes the PCM to out
+func (m *Microphone) startDecoder(ctx context.Context, out io.Writer) (*decoder, error) {
+	inR, inW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	outR, outW, err := os.Pipe()
+	if err != nil {
+		inR.Close()
+		inW.Close()
+		return nil, err
+	}
+
+	runner := &util.ProgramRunner{
+		Program: "gst-launch-1.0",
+		Args: []string{
+			"-q",
+			"fdsrc", "fd=0",
+			"!", "oggdemux",
+			"!", "opusdec", "plc=true",
+			"!", "audioconvert",
+			"!", "audioresample",
+			"!", fmt.Sprintf("audio/x-raw,format=S16LE,rate=%v,channels=1", api.MicrophoneSampleRate),
+			"!", "fdsink", "fd=1", "sync=false",
+		},
+		Stdin:  inR,
+		Stdout: outW,
+		// Linux-specific: set Pdeathsig to ensure child termination
+		SysProcAttr: syscall.SysProcAttr{
+			Pdeathsig: syscall.SIGKILL,
+		},
+	}
+
+	d := &decoder{in: inW, done: make(chan struct{})}
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		defer outW.Close()
+		defer inR.Close()
+		if err := runner.RunOnce("microphone-decoder", ctx); err != nil && ctx.Err() == nil {
+			m.l.Warn().Err(err).Msg("Decoder exited")
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		defer outR.Close()
+		if _, err := io.Copy(out, outR); err != nil {
+			m.l.Warn().Err(err).Msg("Failed to play microphone")
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(d.done)
+	}()
+	return d, nil
+}
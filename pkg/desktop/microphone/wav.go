@@ -0,0 +1,90 @@
+package microphone
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pod-arcade/pod-arcade/api"
+)
+
+var _ api.AudioSink = (*WAVSink)(nil)
+
+// wavHeaderSize is the size of the RIFF header written before the samples
+const wavHeaderSize = 44
+
+// WAVSink writes each session's audio to a WAV file of its own, which is handy for
+// checking what the desktop hears
+type WAVSink struct {
+	Dir string
+}
+
+func NewWAVSink(dir string) *WAVSink {
+	return &WAVSink{Dir: dir}
+}
+
+func (w *WAVSink) GetName() string {
+	return "WAV"
+}
+
+// OpenAudio creates a file named after the session and the time
+func (w *WAVSink) OpenAudio(session api.SessionID) (io.WriteCloser, error) {
+	if err := os.MkdirAll(w.Dir, 0o755); err != nil {
+		return nil, err
+	}
+	name := fmt.Sprintf("%v-%v.wav", filepath.Base(string(session)), time.Now().Format("20060102-150405"))
+	file, err := os.Create(filepath.Join(w.Dir, name))
+	if err != nil {
+		return nil, err
+	}
+	wav := &wavFile{file: file}
+	// The sizes are filled in once we know them
+	if _, err := file.Write(wavHeader(0)); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return wav, nil
+}
+
+// wavFile counts the samples written to it, so the header can be finished on Close
+type wavFile struct {
+	file *os.File
+	size uint32
+}
+
+func (w *wavFile) Write(p []byte) (int, error) {
+	n, err := w.file.Write(p)
+	w.size += uint32(n)
+	return n, err
+}
+
+func (w *wavFile) Close() error {
+	if _, err := w.file.WriteAt(wavHeader(w.size), 0); err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
+
+// wavHeader returns the header of a mono 16 bit WAV file at MicrophoneSampleRate with size bytes of samples
+func wavHeader(size uint32) []byte {
+	const channels, bitsPerSample = 1, 16
+	header := make([]byte, 0, wavHeaderSize)
+	header = append(header, "RIFF"...)
+	header = binary.LittleEndian.AppendUint32(header, wavHeaderSize-8+size)
+	header = append(header, "WAVEfmt "...)
+	header = binary.LittleEndian.AppendUint32(header, 16)
+	// PCM
+	header = binary.LittleEndian.AppendUint16(header, 1)
+	header = binary.LittleEndian.AppendUint16(header, channels)
+	header = binary.LittleEndian.AppendUint32(header, api.MicrophoneSampleRate)
+	header = binary.LittleEndian.AppendUint32(header, api.MicrophoneSampleRate*channels*bitsPerSample/8)
+	header = binary.LittleEndian.AppendUint16(header, channels*bitsPerSample/8)
+	header = binary.LittleEndian.AppendUint16(header, bitsPerSample)
+	header = append(header, "data"...)
+	header = binary.LittleEndian.AppendUint32(header, size)
+	return header
+}
@@ -0,0 +1,43 @@
+package microphone
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWAVSink(t *testing.T) {
+	dir := t.TempDir()
+	sink := NewWAVSink(dir)
+	out, err := sink.OpenAudio("../session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	samples := []byte{1, 0, 2, 0, 3, 0}
+	if _, err := out.Write(samples); err != nil {
+		t.Fatal(err)
+	}
+	if err := out.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "session-*.wav"))
+	if len(files) != 1 {
+		t.Fatalf("Expected a WAV file in the sink's directory, got %v", files)
+	}
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != wavHeaderSize+len(samples) || string(data[:4]) != "RIFF" || string(data[36:40]) != "data" {
+		t.Fatalf("Unexpected WAV file %v", data)
+	}
+	if size := binary.LittleEndian.Uint32(data[40:44]); size != uint32(len(samples)) {
+		t.Errorf("Expected %v bytes of samples, got %v", len(samples), size)
+	}
+	if !bytes.Equal(data[wavHeaderSize:], samples) {
+		t.Errorf("Expected samples %v, got %v", samples, data[wavHeaderSize:])
+	}
+}
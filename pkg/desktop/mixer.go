@@ -2,149 +2,670 @@ package desktop
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/pion/rtp"
 	"github.com/pion/webrtc/v4"
 	"github.com/pod-arcade/pod-arcade/api"
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/fanout_track"
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/frame_queue"
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/packet_pool"
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/supervisor"
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/webrtc_interceptors/stream_registry"
 	"github.com/pod-arcade/pod-arcade/pkg/log"
 	"github.com/rs/zerolog"
 )
 
 var _ api.Mixer = (*Mixer)(nil)
+var _ api.EventController = (*Mixer)(nil)
+
+// ErrNoCommonVideoCodec is returned when a session doesn't offer any of the
+// codecs that our video sources can encode.
+var ErrNoCommonVideoCodec = errors.New("no video source matches the codecs in the offer")
+
+// ErrNoVideoSettings is returned when none of an output's sources can change their settings
+var ErrNoVideoSettings = errors.New("output's settings can't be changed")
+
+// ErrUnknownSource is returned when removing a source that isn't in the mixer
+var ErrUnknownSource = errors.New("source isn't in the mixer")
 
 type Mixer struct {
-	video map[api.VideoSource]*webrtc.TrackLocalStaticRTP
-	audio map[api.AudioSource]*webrtc.TrackLocalStaticRTP
+	video map[api.VideoSource]*fanout_track.Track
+	audio map[api.AudioSource]*fanout_track.Track
+	// streams is where the tracks register the streams they're bound to
+	streams *stream_registry.Registry
 
-	l zerolog.Logger
+	// videoOrder keeps video sources in the order they were added. It's the
+	// fallback order when none of the preferred codecs can be used.
+	videoOrder      []api.VideoSource
+	codecPreference []string
+	// outputs are the outputs of the video sources, in the order they were first seen
+	outputs      []api.VideoOutput
+	sourceOutput map[api.VideoSource]string
+	// consumers counts what's using each source. Sources only run while they have
+	// consumers, and until idleTimeout after their last one left, since encoding
+	// is expensive.
+	consumers   map[api.MediaSource]int
+	idleTimers  map[api.MediaSource]*time.Timer
+	idleTimeout time.Duration
+	// running holds the runs of the sources that are running, so they can be stopped
+	running map[api.MediaSource]*sourceRun
+
+	// supervisors restart sources that crash, and keep track of their health
+	supervisors      map[api.MediaSource]*supervisor.Supervisor
+	supervisorConfig supervisor.Config
+	eventHandlers    []api.ControllerEventHandler
+	changeHandlers   []func()
+
+	ctx context.Context
+	wg  sync.WaitGroup
+	mtx sync.Mutex
+	l   zerolog.Logger
 }
 
 func NewMixer() *Mixer {
 	return &Mixer{
-		video: map[api.VideoSource]*webrtc.TrackLocalStaticRTP{},
-		audio: map[api.AudioSource]*webrtc.TrackLocalStaticRTP{},
-		l:     log.NewLogger("Mixer", nil),
+		video:        map[api.VideoSource]*fanout_track.Track{},
+		audio:        map[api.AudioSource]*fanout_track.Track{},
+		streams:      stream_registry.New(),
+		sourceOutput: map[api.VideoSource]string{},
+
+		consumers:   map[api.MediaSource]int{},
+		idleTimers:  map[api.MediaSource]*time.Timer{},
+		idleTimeout: DefaultIdleTimeout,
+		running:     map[api.MediaSource]*sourceRun{},
+
+		supervisors:      map[api.MediaSource]*supervisor.Supervisor{},
+		supervisorConfig: supervisor.DefaultConfig,
+		l:                log.NewLogger("Mixer", nil),
 	}
 }
 
-func (m *Mixer) AddVideoSource(v api.VideoSource) error {
-	track, err := webrtc.NewTrackLocalStaticRTP(v.GetVideoCodecParameters().RTPCodecCapability, "video", "pion-video")
-	if err != nil {
+// Streams returns the registry that the tracks register their sessions' streams
+// in. The WebRTC API's interceptors look the streams up there.
+func (m *Mixer) Streams() *stream_registry.Registry {
+	return m.streams
+}
+
+// SetSupervisorConfig sets how sources added after it are restarted when they crash
+func (m *Mixer) SetSupervisorConfig(config supervisor.Config) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.supervisorConfig = config
+}
+
+func (m *Mixer) GetName() string {
+	return "sources"
+}
+
+// videoSettingsCommand is the payload of the video-settings command
+type videoSettingsCommand struct {
+	// Output is the output to change, or the default output if it's empty
+	Output string `json:"output"`
+	api.VideoSettings
+}
+
+// HandleCommand handles the list command, which returns the health of every source,
+// and the video-settings command, which changes how an output is encoded
+func (m *Mixer) HandleCommand(command string, payload []byte) (any, error) {
+	switch command {
+	case "list":
+		return m.GetSourceHealth(), nil
+	case "video-settings":
+		cmd := videoSettingsCommand{}
+		if err := json.Unmarshal(payload, &cmd); err != nil {
+			return nil, err
+		}
+		return nil, m.SetVideoSettings(cmd.Output, cmd.VideoSettings)
+	default:
+		return nil, fmt.Errorf("unknown command %q", command)
+	}
+}
+
+// SetVideoSettings changes the settings of every source of the output that supports
+// it, restarting the ones that are running
+func (m *Mixer) SetVideoSettings(output string, settings api.VideoSettings) error {
+	if err := settings.Validate(); err != nil {
 		return err
 	}
+	m.mtx.Lock()
+	output = m.outputID(output)
+	changed := false
+	restart := []api.MediaSource{}
+	for _, src := range m.videoOrder {
+		s, ok := src.(api.VideoSettingsSource)
+		if !ok || m.sourceOutput[src] != output {
+			continue
+		}
+		// Sources that wrap an encoder may not be able to pass the settings on
+		if err := s.SetVideoSettings(settings); errors.Is(err, errors.ErrUnsupported) {
+			continue
+		} else if err != nil {
+			m.mtx.Unlock()
+			return err
+		}
+		changed = true
+		if m.running[src] != nil {
+			restart = append(restart, src)
+		}
+	}
+	m.mtx.Unlock()
+	if !changed {
+		return fmt.Errorf("%w: %v", ErrNoVideoSettings, output)
+	}
+
+	m.l.Info().Msgf("Encoding output %v with %+v", output, settings)
+	for _, src := range restart {
+		m.restartSource(src)
+	}
+	return nil
+}
+
+// OnEvent adds a handler for health events, which are sent whenever a source changes state
+func (m *Mixer) OnEvent(h api.ControllerEventHandler) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.eventHandlers = append(m.eventHandlers, h)
+}
+
+func (m *Mixer) OnSourcesChanged(h func()) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.changeHandlers = append(m.changeHandlers, h)
+}
+
+// GetSourceHealth returns the health of the video sources, in the order they were
+// added, followed by the audio sources
+func (m *Mixer) GetSourceHealth() []supervisor.Health {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	health := []supervisor.Health{}
+	for _, src := range m.videoOrder {
+		health = append(health, m.supervisors[src].Health())
+	}
+	audio := []supervisor.Health{}
+	for src := range m.audio {
+		audio = append(audio, m.supervisors[src].Health())
+	}
+	sort.Slice(audio, func(i, j int) bool { return audio[i].Source < audio[j].Source })
+	return append(health, audio...)
+}
+
+// supervise creates the supervisor of a source. m.mtx must be held.
+func (m *Mixer) supervise(src api.MediaSource) {
+	sup := supervisor.New(src.GetName(), m.supervisorConfig)
+	sup.OnHealthChange(func(h supervisor.Health) {
+		m.mtx.Lock()
+		handlers := slices.Clone(m.eventHandlers)
+		m.mtx.Unlock()
+		for _, handler := range handlers {
+			handler("health", h)
+		}
+	})
+	m.supervisors[src] = sup
+}
+
+// sourcesChanged lets the change handlers know that sources were added or removed
+func (m *Mixer) sourcesChanged() {
+	m.mtx.Lock()
+	handlers := slices.Clone(m.changeHandlers)
+	m.mtx.Unlock()
+	for _, h := range handlers {
+		h()
+	}
+}
+
+// AddVideoSource adds a video source, which is started when a session using it connects.
+// Sources can be added while sessions are live.
+func (m *Mixer) AddVideoSource(v api.VideoSource) error {
+	output := api.VideoOutput{ID: api.DefaultVideoOutputID}
+	if o, ok := v.(api.OutputSource); ok {
+		output = o.GetVideoOutput()
+	}
+	output.TrackID, output.StreamID = outputTrackIDs(output.ID)
+	track := fanout_track.NewTrack(v.GetName(), v.GetVideoCodecParameters().RTPCodecCapability, output.TrackID, output.StreamID, m.streams, requestKeyframe(v))
+
+	m.mtx.Lock()
+	if _, ok := m.video[v]; ok {
+		m.mtx.Unlock()
+		return fmt.Errorf("video source %v was already added", v.GetName())
+	}
 	m.video[v] = track
+	m.videoOrder = append(m.videoOrder, v)
+	m.sourceOutput[v] = output.ID
+	m.supervise(v)
+	m.addOutputCodec(output, v.GetVideoCodecParameters().MimeType)
+	m.mtx.Unlock()
+
+	m.sourcesChanged()
+	return nil
+}
+
+// RemoveVideoSource stops a video source and removes it. Sessions that were watching
+// it move to another source of the same output, or of the default output.
+func (m *Mixer) RemoveVideoSource(v api.VideoSource) error {
+	m.mtx.Lock()
+	if _, ok := m.video[v]; !ok {
+		m.mtx.Unlock()
+		return ErrUnknownSource
+	}
+	m.forget(v)
+	m.removeOutputCodec(m.sourceOutput[v], v.GetVideoCodecParameters().MimeType)
+	m.videoOrder = slices.DeleteFunc(m.videoOrder, func(src api.VideoSource) bool { return src == v })
+	delete(m.video, v)
+	delete(m.sourceOutput, v)
+	m.mtx.Unlock()
+
+	m.sourcesChanged()
 	return nil
 }
+
+// addOutputCodec adds a codec to an output, adding the output if it's new. m.mtx must be held.
+func (m *Mixer) addOutputCodec(output api.VideoOutput, codec string) {
+	for i := range m.outputs {
+		if m.outputs[i].ID == output.ID {
+			m.outputs[i].Codecs = append(m.outputs[i].Codecs, codec)
+			return
+		}
+	}
+	output.Codecs = []string{codec}
+	m.outputs = append(m.outputs, output)
+}
+
+// removeOutputCodec removes a codec from an output, removing the output once it
+// has none left. m.mtx must be held.
+func (m *Mixer) removeOutputCodec(output string, codec string) {
+	for i := range m.outputs {
+		if m.outputs[i].ID != output {
+			continue
+		}
+		if j := slices.Index(m.outputs[i].Codecs, codec); j >= 0 {
+			m.outputs[i].Codecs = slices.Delete(m.outputs[i].Codecs, j, j+1)
+		}
+		if len(m.outputs[i].Codecs) == 0 {
+			m.outputs = slices.Delete(m.outputs, i, i+1)
+		}
+		return
+	}
+}
+
+// outputTrackIDs returns the track and stream IDs of an output. The default
+// output keeps the IDs from before there were outputs.
+func outputTrackIDs(output string) (string, string) {
+	if output == api.DefaultVideoOutputID {
+		return "video", "pion-video"
+	}
+	return "video-" + output, "pion-video-" + output
+}
+
+// AddAudioSource adds an audio source, which is started when a session connects.
+// Sources can be added while sessions are live.
 func (m *Mixer) AddAudioSource(a api.AudioSource) error {
-	track, err := webrtc.NewTrackLocalStaticRTP(a.GetAudioCodecParameters().RTPCodecCapability, "audio", "pion-audio")
-	if err != nil {
-		return err
+	track := fanout_track.NewTrack(a.GetName(), a.GetAudioCodecParameters().RTPCodecCapability, "audio", "pion-audio", m.streams, requestKeyframe(a))
+	m.mtx.Lock()
+	if _, ok := m.audio[a]; ok {
+		m.mtx.Unlock()
+		return fmt.Errorf("audio source %v was already added", a.GetName())
 	}
 	m.audio[a] = track
+	m.supervise(a)
+	m.mtx.Unlock()
+
+	m.sourcesChanged()
+	return nil
+}
+
+// RemoveAudioSource stops an audio source and removes it
+func (m *Mixer) RemoveAudioSource(a api.AudioSource) error {
+	m.mtx.Lock()
+	if _, ok := m.audio[a]; !ok {
+		m.mtx.Unlock()
+		return ErrUnknownSource
+	}
+	m.forget(a)
+	delete(m.audio, a)
+	m.mtx.Unlock()
+
+	m.sourcesChanged()
 	return nil
 }
 
+func (m *Mixer) SetVideoCodecPreference(mimeTypes []string) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.codecPreference = mimeTypes
+}
+
 func (m *Mixer) GetAudioSources() []api.AudioSource {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
 	srcs := []api.AudioSource{}
-	for src, _ := range m.audio {
+	for src := range m.audio {
 		srcs = append(srcs, src)
 	}
 	return srcs
 }
 
 func (m *Mixer) GetVideoSources() []api.VideoSource {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
 	srcs := []api.VideoSource{}
-	for src, _ := range m.video {
-		srcs = append(srcs, src)
-	}
+	srcs = append(srcs, m.videoOrder...)
 	return srcs
 }
 
-func (m *Mixer) GetAudioTracks() []*webrtc.TrackLocalStaticRTP {
-	tracks := []*webrtc.TrackLocalStaticRTP{}
+func (m *Mixer) GetAudioTracks() []api.Track {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	tracks := []api.Track{}
 	for _, track := range m.audio {
 		tracks = append(tracks, track)
 	}
 	return tracks
 }
-func (m *Mixer) GetVideoTracks() []*webrtc.TrackLocalStaticRTP {
-	tracks := []*webrtc.TrackLocalStaticRTP{}
-	for _, track := range m.video {
-		tracks = append(tracks, track)
+func (m *Mixer) GetVideoTracks() []api.Track {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	tracks := []api.Track{}
+	for _, src := range m.videoOrder {
+		tracks = append(tracks, m.video[src])
 	}
 	return tracks
 }
 
-func (m *Mixer) stream(ctx context.Context, pkts chan *rtp.Packet, track *webrtc.TrackLocalStaticRTP) {
-	for {
-		select {
-		case pkt, open := <-pkts:
-			if !open {
-				return
+func (m *Mixer) GetVideoOutputs() []api.VideoOutput {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	outputs := []api.VideoOutput{}
+	for _, o := range m.outputs {
+		o.Codecs = slices.Clone(o.Codecs)
+		outputs = append(outputs, o)
+	}
+	return outputs
+}
+
+func (m *Mixer) NegotiateVideoTrack(offer *webrtc.SessionDescription, output string) (api.Track, error) {
+	offered, err := offeredCodecs(offer, webrtc.RTPCodecTypeVideo)
+	if err != nil {
+		return nil, err
+	}
+	if len(offered) == 0 {
+		// The session didn't ask for video at all
+		return nil, nil
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	src := m.pickVideoSource(offered, m.outputID(output))
+	if src == nil {
+		return nil, ErrNoCommonVideoCodec
+	}
+	m.l.Debug().Msgf("Negotiated %v from %v", src.GetVideoCodecParameters().MimeType, src.GetName())
+	return m.video[src], nil
+}
+
+func (m *Mixer) StartVideoTrack(output string, mimeType string) (api.Track, error) {
+	track, err := m.GetVideoTrack(output, mimeType)
+	if err != nil {
+		return nil, err
+	}
+	m.AcquireTrack(track)
+	return track, nil
+}
+
+func (m *Mixer) GetVideoTrack(output string, mimeType string) (api.Track, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	offered := map[string]bool{}
+	for _, src := range m.videoOrder {
+		codec := strings.ToLower(src.GetVideoCodecParameters().MimeType)
+		offered[codec] = mimeType == "" || codec == strings.ToLower(mimeType)
+	}
+	src := m.pickVideoSource(offered, m.outputID(output))
+	if src == nil {
+		return nil, ErrNoCommonVideoCodec
+	}
+	return m.video[src], nil
+}
+
+// outputID returns the ID of the output, or of the default output if it's empty. m.mtx must be held.
+func (m *Mixer) outputID(output string) string {
+	if output == "" && len(m.outputs) > 0 {
+		return m.outputs[0].ID
+	}
+	return output
+}
+
+// pickVideoSource returns the output's first source whose codec was offered, walking
+// the codec preference first and then the order the sources were added in.
+func (m *Mixer) pickVideoSource(offered map[string]bool, output string) api.VideoSource {
+	for _, mimeType := range m.codecPreference {
+		for _, src := range m.videoOrder {
+			codec := strings.ToLower(src.GetVideoCodecParameters().MimeType)
+			if m.sourceOutput[src] == output && codec == strings.ToLower(mimeType) && offered[codec] {
+				return src
 			}
-			m.l.Trace().Msgf("Got packet from %s", track.ID())
-			if err := track.WriteRTP(pkt); err != nil {
-				// This shouldn't be TOO big of a deal. It just means that one of the
-				// Clients had an error writing an RTP packet.
-				m.l.Trace().Err(err).Msg("Failed to write RTP packet")
+		}
+	}
+	for _, src := range m.videoOrder {
+		if m.sourceOutput[src] == output && offered[strings.ToLower(src.GetVideoCodecParameters().MimeType)] {
+			return src
+		}
+	}
+	return nil
+}
+
+// countMedia returns how many media sections of the given kind the offer has
+func countMedia(offer *webrtc.SessionDescription, kind webrtc.RTPCodecType) (int, error) {
+	if offer == nil {
+		return 0, nil
+	}
+	parsed, err := offer.Unmarshal()
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, media := range parsed.MediaDescriptions {
+		if media.MediaName.Media == kind.String() {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// offeredCodecs returns the lowercased mime types that the remote side offered for the given kind.
+func offeredCodecs(offer *webrtc.SessionDescription, kind webrtc.RTPCodecType) (map[string]bool, error) {
+	codecs := map[string]bool{}
+	if offer == nil {
+		return codecs, nil
+	}
+	parsed, err := offer.Unmarshal()
+	if err != nil {
+		return nil, err
+	}
+	for _, media := range parsed.MediaDescriptions {
+		if media.MediaName.Media != kind.String() {
+			continue
+		}
+		for _, attr := range media.Attributes {
+			if attr.Key != "rtpmap" {
+				continue
+			}
+			// rtpmap values look like "96 VP8/90000"
+			_, encoding, found := strings.Cut(attr.Value, " ")
+			if !found {
 				continue
 			}
-		case <-ctx.Done():
+			name, _, _ := strings.Cut(encoding, "/")
+			codecs[strings.ToLower(kind.String()+"/"+name)] = true
+		}
+	}
+	return codecs, nil
+}
+
+// The queues between sources and tracks are sized in packets. They hold roughly
+// a second of high bitrate video before whole frames start being dropped.
+const (
+	sourceChannelSize = 64
+	maxQueuedPackets  = 1000
+)
+
+// requestKeyframe returns a callback that asks src for a keyframe, if it can make one
+func requestKeyframe(src api.MediaSource) func() {
+	return func() {
+		if requester, ok := src.(api.KeyframeRequester); ok {
+			requester.RequestKeyframe()
+		}
+	}
+}
+
+// keyframeNeeded returns a callback for when frames from src were dropped. The
+// queue waits for the encoder's next keyframe, rather than asking for one from
+// the data path, which can restart the encoder.
+func (m *Mixer) keyframeNeeded(src api.MediaSource) func() {
+	return func() {
+		m.l.Warn().Msgf("Dropped frames from %s, waiting for a keyframe", src.GetName())
+	}
+}
+
+// newQueue creates the frame queue between a source and its track
+func (m *Mixer) newQueue(src api.MediaSource, mimeType string) *frame_queue.FrameQueue {
+	return frame_queue.NewFrameQueue(src.GetName(), mimeType, maxQueuedPackets, m.keyframeNeeded(src))
+}
+
+func (m *Mixer) stream(ctx context.Context, pkts chan *rtp.Packet, queue *frame_queue.FrameQueue, track *fanout_track.Track, sup *supervisor.Supervisor) {
+	// Packets move into the queue as soon as they arrive, so that when the
+	// track falls behind, it's the queue that decides which frames to drop.
+	go func() {
+		defer queue.Close()
+		for {
+			select {
+			case pkt, open := <-pkts:
+				if !open {
+					return
+				}
+				sup.Alive()
+				queue.Push(pkt)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	for {
+		pkt, ok := queue.Pop(ctx)
+		if !ok {
 			return
 		}
+		m.l.Trace().Msgf("Got packet from %s", track.ID())
+		// The track queues its own copy for each session, so writing never
+		// waits on a slow session.
+		err := track.WriteRTP(pkt)
+		packet_pool.PutPacket(pkt)
+		if err != nil {
+			m.l.Trace().Err(err).Msg("Failed to write RTP packet")
+			continue
+		}
 	}
 }
 
+// startVideoSource launches the capture and streaming goroutines for a video source.
+// m.mtx must be held.
+func (m *Mixer) startVideoSource(src api.VideoSource) {
+	// Each run of the source gets its own context, so the streaming goroutine
+	// stops with it even if the source gives up. pkts is never closed, since
+	// sources may still be sending when they give up.
+	ctx, cancel := context.WithCancel(m.ctx)
+	run := m.startRun(src, cancel)
+	track := m.video[src]
+	sup := m.supervisors[src]
+	pkts := make(chan *rtp.Packet, sourceChannelSize)
+	queue := m.newQueue(src, src.GetVideoCodecParameters().MimeType)
+
+	m.wg.Add(2)
+	run.wg.Add(2)
+	go func() {
+		defer m.wg.Done()
+		defer run.wg.Done()
+		defer cancel()
+		m.l.Trace().Msgf("Starting to Capture RTP Video Packets %s", src.GetName())
+		err := sup.Run(ctx, func(ctx context.Context) error {
+			return src.StreamVideo(ctx, pkts)
+		})
+		if err != nil {
+			m.l.Error().Err(err).Msg("Failed to stream video")
+		}
+
+		// Let the next consumer start it again
+		m.endRun(src, run)
+		m.l.Trace().Msgf("Done streaming %s", src.GetName())
+	}()
+	go func() {
+		defer m.wg.Done()
+		defer run.wg.Done()
+		m.l.Trace().Msgf("Starting to stream RTP Video Packets %s", src.GetName())
+		m.stream(ctx, pkts, queue, track, sup)
+		m.l.Trace().Msgf("Done streaming %s", src.GetName())
+	}()
+}
+
+// startAudioSource launches the capture and streaming goroutines for an audio source.
+// m.mtx must be held.
+func (m *Mixer) startAudioSource(src api.AudioSource) {
+	ctx, cancel := context.WithCancel(m.ctx)
+	run := m.startRun(src, cancel)
+	track := m.audio[src]
+	sup := m.supervisors[src]
+	pkts := make(chan *rtp.Packet, sourceChannelSize)
+	queue := m.newQueue(src, src.GetAudioCodecParameters().MimeType)
+
+	m.wg.Add(2)
+	run.wg.Add(2)
+	go func() {
+		defer m.wg.Done()
+		defer run.wg.Done()
+		defer cancel()
+		m.l.Trace().Msgf("Starting to Capture RTP Audio Packets %s", track.ID())
+		err := sup.Run(ctx, func(ctx context.Context) error {
+			return src.StreamAudio(ctx, pkts)
+		})
+		if err != nil {
+			m.l.Error().Err(err).Msg("Failed to stream audio")
+		}
+
+		m.endRun(src, run)
+		m.l.Trace().Msgf("Done streaming %s", track.ID())
+	}()
+	go func() {
+		defer m.wg.Done()
+		defer run.wg.Done()
+		m.l.Trace().Msgf("Starting to stream RTP Audio Packets %s", track.ID())
+		m.stream(ctx, pkts, queue, track, sup)
+		m.l.Trace().Msgf("Done streaming %s", track.ID())
+	}()
+}
+
 func (m *Mixer) Stream(ctx context.Context) error {
-	wg := sync.WaitGroup{}
-
-	// Start all the video tracks
-	for src, track := range m.video {
-		pkts := make(chan *rtp.Packet, 5000)
-
-		wg.Add(2)
-		go func(pkts chan *rtp.Packet) {
-			defer wg.Done()
-			m.l.Trace().Msgf("Starting to Capture RTP Video Packets %s", track.ID())
-			err := src.StreamVideo(ctx, pkts)
-			if err != nil {
-				m.l.Error().Err(err).Msg("Failed to stream video")
-				close(pkts)
-			}
-			m.l.Trace().Msgf("Done streaming %s", track.ID())
-		}(pkts)
-		go func(pkts chan *rtp.Packet, track *webrtc.TrackLocalStaticRTP) {
-			defer wg.Done()
-			m.l.Trace().Msgf("Starting to stream RTP Video Packets %s", track.ID())
-			m.stream(ctx, pkts, track)
-			m.l.Trace().Msgf("Done streaming %s", track.ID())
-		}(pkts, track)
-	}
-
-	// Start all of the audio tracks
-	for src, track := range m.audio {
-		pkts := make(chan *rtp.Packet, 5000)
-
-		wg.Add(2)
-		go func(pkts chan *rtp.Packet) {
-			defer wg.Done()
-			m.l.Trace().Msgf("Starting to Capture RTP Audio Packets %s", track.ID())
-			err := src.StreamAudio(ctx, pkts)
-			if err != nil {
-				m.l.Error().Err(err).Msg("Failed to stream audio")
-				close(pkts)
-			}
-			m.l.Trace().Msgf("Done streaming %s", track.ID())
-		}(pkts)
-		go func(pkts chan *rtp.Packet, track *webrtc.TrackLocalStaticRTP) {
-			defer wg.Done()
-			m.l.Trace().Msgf("Starting to stream RTP Audio Packets %s", track.ID())
-			m.stream(ctx, pkts, track)
-			m.l.Trace().Msgf("Done streaming %s", track.ID())
-		}(pkts, track)
+	// Start any sources that were acquired before we were streaming
+	m.mtx.Lock()
+	m.ctx = ctx
+	for src, consumers := range m.consumers {
+		if consumers > 0 {
+			m.startSource(src)
+		}
 	}
+	m.mtx.Unlock()
 
-	wg.Wait()
+	<-ctx.Done()
+	m.wg.Wait()
 	return nil
 }
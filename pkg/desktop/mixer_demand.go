@@ -0,0 +1,183 @@
+package desktop
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pod-arcade/pod-arcade/api"
+	"github.com/pod-arcade/pod-arcade/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DefaultIdleTimeout is how long sources keep running after their last consumer
+// leaves, so a client that reconnects doesn't wait for the encoder to start again
+const DefaultIdleTimeout = 30 * time.Second
+
+// sourceRun is a single run of a source
+type sourceRun struct {
+	cancel context.CancelFunc
+	// wg is done once the run's goroutines have finished
+	wg sync.WaitGroup
+}
+
+func (m *Mixer) SetIdleTimeout(timeout time.Duration) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.idleTimeout = timeout
+}
+
+func (m *Mixer) AcquireTrack(track api.Track) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if src := m.trackSource(track); src != nil {
+		m.acquire(src)
+	}
+}
+
+func (m *Mixer) ReleaseTrack(track api.Track) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if src := m.trackSource(track); src != nil {
+		m.release(src)
+	}
+}
+
+// trackSource returns the source of a track, or nil if it's been removed. m.mtx must be held.
+func (m *Mixer) trackSource(track api.Track) api.MediaSource {
+	for src, t := range m.video {
+		if api.Track(t) == track {
+			return src
+		}
+	}
+	for src, t := range m.audio {
+		if api.Track(t) == track {
+			return src
+		}
+	}
+	return nil
+}
+
+// acquire adds a consumer to a source, starting it if it isn't running. m.mtx must be held.
+func (m *Mixer) acquire(src api.MediaSource) {
+	m.consumers[src]++
+	sourceConsumers(src).Set(float64(m.consumers[src]))
+	if timer := m.idleTimers[src]; timer != nil {
+		timer.Stop()
+		delete(m.idleTimers, src)
+	}
+	// If we aren't streaming yet, Stream will start it for us
+	if m.running[src] == nil && m.ctx != nil && m.ctx.Err() == nil {
+		m.startSource(src)
+	}
+}
+
+// release removes a consumer from a source, stopping it once it's been idle for the
+// idle timeout. m.mtx must be held.
+func (m *Mixer) release(src api.MediaSource) {
+	if m.consumers[src] == 0 {
+		m.l.Warn().Msgf("Released %v more often than it was acquired", src.GetName())
+		return
+	}
+	m.consumers[src]--
+	sourceConsumers(src).Set(float64(m.consumers[src]))
+	if m.consumers[src] > 0 || m.running[src] == nil || m.idleTimers[src] != nil {
+		return
+	}
+
+	m.l.Debug().Msgf("%v is idle, stopping it in %v", src.GetName(), m.idleTimeout)
+	var timer *time.Timer
+	timer = time.AfterFunc(m.idleTimeout, func() {
+		m.mtx.Lock()
+		defer m.mtx.Unlock()
+		if m.idleTimers[src] != timer {
+			// It was acquired again
+			return
+		}
+		delete(m.idleTimers, src)
+		m.stopRun(src)
+	})
+	m.idleTimers[src] = timer
+}
+
+// startSource starts a video or audio source. m.mtx must be held.
+func (m *Mixer) startSource(src api.MediaSource) {
+	if v, ok := src.(api.VideoSource); ok && m.video[v] != nil {
+		m.startVideoSource(v)
+	} else if a, ok := src.(api.AudioSource); ok && m.audio[a] != nil {
+		m.startAudioSource(a)
+	}
+}
+
+// startRun records that a source is running. m.mtx must be held.
+func (m *Mixer) startRun(src api.MediaSource, cancel context.CancelFunc) *sourceRun {
+	run := &sourceRun{cancel: cancel}
+	m.running[src] = run
+	sourceActive(src).Set(1)
+	m.l.Info().Msgf("Starting %v", src.GetName())
+	return run
+}
+
+// endRun records that a run of a source has finished, whether it was stopped or it gave up
+func (m *Mixer) endRun(src api.MediaSource, run *sourceRun) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if m.running[src] == run {
+		delete(m.running, src)
+		sourceActive(src).Set(0)
+	}
+}
+
+// stopRun stops a source if it's running. m.mtx must be held.
+func (m *Mixer) stopRun(src api.MediaSource) {
+	if run := m.running[src]; run != nil {
+		m.l.Info().Msgf("Stopping %v", src.GetName())
+		run.cancel()
+		delete(m.running, src)
+		sourceActive(src).Set(0)
+	}
+}
+
+// restartSource stops a running source and starts it again once it's finished, so
+// it picks up new settings. Its track stays, so sessions switch over at the first
+// keyframe of the new run.
+func (m *Mixer) restartSource(src api.MediaSource) {
+	m.mtx.Lock()
+	run := m.running[src]
+	m.stopRun(src)
+	m.mtx.Unlock()
+	if run == nil {
+		return
+	}
+	run.wg.Wait()
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	// It may have been acquired again, removed, or left idle in the meantime
+	if m.running[src] == nil && m.consumers[src] > 0 && m.ctx.Err() == nil {
+		m.startSource(src)
+	}
+}
+
+// forget stops a source that's being removed, and drops everything the mixer knows
+// about it. m.mtx must be held.
+func (m *Mixer) forget(src api.MediaSource) {
+	m.stopRun(src)
+	if timer := m.idleTimers[src]; timer != nil {
+		timer.Stop()
+		delete(m.idleTimers, src)
+	}
+	delete(m.consumers, src)
+	delete(m.supervisors, src)
+	sourceConsumers(src).Set(0)
+}
+
+// sourceActive is 1 while a source is running, and 0 while it's idle
+func sourceActive(src api.MediaSource) prometheus.Gauge {
+	return metrics.GlobalMetricCache.GetGauge("source_active", prometheus.Labels{"source": src.GetName()})
+}
+
+// sourceConsumers is how many sessions and other consumers are using a source
+func sourceConsumers(src api.MediaSource) prometheus.Gauge {
+	return metrics.GlobalMetricCache.GetGauge("source_consumers", prometheus.Labels{"source": src.GetName()})
+}
@@ -0,0 +1,433 @@
+package desktop_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"github.com/pod-arcade/pod-arcade/api"
+	"github.com/pod-arcade/pod-arcade/pkg/desktop"
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/supervisor"
+)
+
+type fakeVideoSource struct {
+	codec webrtc.RTPCodecParameters
+}
+
+func (f *fakeVideoSource) GetName() string {
+	return "fake-" + f.codec.MimeType
+}
+
+func (f *fakeVideoSource) GetVideoCodecParameters() webrtc.RTPCodecParameters {
+	return f.codec
+}
+
+func (f *fakeVideoSource) StreamVideo(ctx context.Context, pktChan chan<- *rtp.Packet) error {
+	<-ctx.Done()
+	return nil
+}
+
+func videoOffer(codecs ...string) *webrtc.SessionDescription {
+	sdp := []string{
+		"v=0",
+		"o=- 0 0 IN IP4 127.0.0.1",
+		"s=-",
+		"t=0 0",
+		"m=video 9 UDP/TLS/RTP/SAVPF 96 98 102",
+	}
+	for _, c := range codecs {
+		sdp = append(sdp, "a=rtpmap:"+c+"/90000")
+	}
+	return &webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: strings.Join(sdp, "\r\n") + "\r\n"}
+}
+
+func newTestMixer(t *testing.T) *desktop.Mixer {
+	m := desktop.NewMixer()
+	for _, codec := range []webrtc.RTPCodecParameters{
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000}, PayloadType: 102},
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP9, ClockRate: 90000}, PayloadType: 98},
+	} {
+		if err := m.AddVideoSource(&fakeVideoSource{codec: codec}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return m
+}
+
+func TestMixer_NegotiateVideoTrack(t *testing.T) {
+	tests := []struct {
+		name       string
+		preference []string
+		offer      *webrtc.SessionDescription
+		expected   string
+	}{
+		{"falls back to the order sources were added", nil, videoOffer("96 VP8", "98 VP9", "102 H264"), webrtc.MimeTypeH264},
+		{"uses the preferred codec", []string{webrtc.MimeTypeVP9, webrtc.MimeTypeH264}, videoOffer("98 VP9", "102 H264"), webrtc.MimeTypeVP9},
+		{"skips preferred codecs that weren't offered", []string{webrtc.MimeTypeVP9}, videoOffer("102 H264"), webrtc.MimeTypeH264},
+		{"matches codec names case insensitively", []string{"VIDEO/vp9"}, videoOffer("98 vp9", "102 h264"), webrtc.MimeTypeVP9},
+	}
+
+	for _, tt := range tests {
+		m := newTestMixer(t)
+		m.SetVideoCodecPreference(tt.preference)
+		track, err := m.NegotiateVideoTrack(tt.offer, "")
+		if err != nil {
+			t.Errorf("%v: unexpected error %v", tt.name, err)
+			continue
+		}
+		if track == nil || track.Codec().MimeType != tt.expected {
+			t.Errorf("%v: expected %v, got %v", tt.name, tt.expected, track)
+		}
+	}
+}
+
+func TestMixer_NegotiateVideoTrackWithoutCommonCodec(t *testing.T) {
+	m := newTestMixer(t)
+	if _, err := m.NegotiateVideoTrack(videoOffer("96 VP8"), ""); err != desktop.ErrNoCommonVideoCodec {
+		t.Errorf("Expected %v, got %v", desktop.ErrNoCommonVideoCodec, err)
+	}
+
+	track, err := m.NegotiateVideoTrack(nil, "")
+	if track != nil || err != nil {
+		t.Errorf("Expected no track for a session without video, got %v, %v", track, err)
+	}
+}
+
+type fakeOutputSource struct {
+	fakeVideoSource
+	output api.VideoOutput
+}
+
+func (f *fakeOutputSource) GetName() string {
+	return f.fakeVideoSource.GetName() + "-" + f.output.ID
+}
+
+func (f *fakeOutputSource) GetVideoOutput() api.VideoOutput {
+	return f.output
+}
+
+func TestMixer_VideoOutputs(t *testing.T) {
+	m := desktop.NewMixer()
+	for _, output := range []string{"left", "right"} {
+		for _, codec := range []webrtc.RTPCodecParameters{
+			{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000}, PayloadType: 102},
+			{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP9, ClockRate: 90000}, PayloadType: 98},
+		} {
+			src := &fakeOutputSource{fakeVideoSource: fakeVideoSource{codec: codec}, output: api.VideoOutput{ID: output}}
+			if err := m.AddVideoSource(src); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	outputs := m.GetVideoOutputs()
+	if len(outputs) != 2 || outputs[0].ID != "left" || outputs[1].ID != "right" {
+		t.Fatalf("Expected the left and right outputs in order, got %+v", outputs)
+	}
+	if len(outputs[1].Codecs) != 2 || outputs[1].TrackID != "video-right" {
+		t.Errorf("Expected the right output to have both codecs on track video-right, got %+v", outputs[1])
+	}
+
+	tests := []struct {
+		output    string
+		wantTrack string
+	}{
+		{"", "video-left"},
+		{"left", "video-left"},
+		{"right", "video-right"},
+	}
+	for _, tt := range tests {
+		track, err := m.NegotiateVideoTrack(videoOffer("98 VP9"), tt.output)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if track.ID() != tt.wantTrack || track.Codec().MimeType != webrtc.MimeTypeVP9 {
+			t.Errorf("Output %q: expected VP9 on %v, got %v on %v", tt.output, tt.wantTrack, track.Codec().MimeType, track.ID())
+		}
+	}
+
+	if _, err := m.StartVideoTrack("missing", webrtc.MimeTypeH264); err != desktop.ErrNoCommonVideoCodec {
+		t.Errorf("Expected ErrNoCommonVideoCodec for an unknown output, got %v", err)
+	}
+}
+
+func TestMixer_RemoveVideoSource(t *testing.T) {
+	m := desktop.NewMixer()
+	changes := 0
+	m.OnSourcesChanged(func() { changes++ })
+
+	left := &fakeOutputSource{fakeVideoSource: fakeVideoSource{codec: webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000}}}, output: api.VideoOutput{ID: "left"}}
+	right := &fakeOutputSource{fakeVideoSource: fakeVideoSource{codec: webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000}}}, output: api.VideoOutput{ID: "right"}}
+	for _, src := range []api.VideoSource{left, right} {
+		if err := m.AddVideoSource(src); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.AddVideoSource(left); err == nil {
+		t.Error("Expected adding a source twice to fail")
+	}
+
+	if err := m.RemoveVideoSource(left); err != nil {
+		t.Fatal(err)
+	}
+	if outputs := m.GetVideoOutputs(); len(outputs) != 1 || outputs[0].ID != "right" {
+		t.Errorf("Expected only the right output to be left, got %+v", outputs)
+	}
+	if track, err := m.StartVideoTrack("", webrtc.MimeTypeH264); err != nil || track.ID() != "video-right" {
+		t.Errorf("Expected the right output to be the default now, got %v", err)
+	}
+	if err := m.RemoveVideoSource(left); err != desktop.ErrUnknownSource {
+		t.Errorf("Expected ErrUnknownSource removing a source twice, got %v", err)
+	}
+	if changes != 3 {
+		t.Errorf("Expected 3 changes, got %v", changes)
+	}
+}
+
+// crashingAudioSource fails the first time it's started, and then sends silence
+type crashingAudioSource struct {
+	runs int
+}
+
+func (c *crashingAudioSource) GetName() string {
+	return "crashing-audio"
+}
+
+func (c *crashingAudioSource) GetAudioCodecParameters() webrtc.RTPCodecParameters {
+	return webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}, PayloadType: 111}
+}
+
+func (c *crashingAudioSource) StreamAudio(ctx context.Context, pktChan chan<- *rtp.Packet) error {
+	c.runs++
+	if c.runs == 1 {
+		return errors.New("encoder crashed")
+	}
+	for i := 0; ; i++ {
+		select {
+		case pktChan <- &rtp.Packet{Header: rtp.Header{SequenceNumber: uint16(i), Timestamp: uint32(i * 960), Marker: true}, Payload: []byte{0xfc}}:
+		case <-ctx.Done():
+			return nil
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestMixer_RestartsCrashedSources(t *testing.T) {
+	m := desktop.NewMixer()
+	m.SetSupervisorConfig(supervisor.Config{MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond, CrashLoopCount: 3, CrashLoopWindow: time.Minute})
+	if err := m.AddAudioSource(&crashingAudioSource{}); err != nil {
+		t.Fatal(err)
+	}
+	m.AcquireTrack(m.GetAudioTracks()[0])
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go m.Stream(ctx)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		health := m.GetSourceHealth()
+		if len(health) == 1 && health[0].State == supervisor.StateRunning {
+			if health[0].Restarts != 1 {
+				t.Errorf("Expected one restart, got %+v", health[0])
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the source to be running again, got %+v", health)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// restartingAudioSource crashes after its first two packets, and every run starts from another sequence number
+type restartingAudioSource struct {
+	crashingAudioSource
+}
+
+func (r *restartingAudioSource) StreamAudio(ctx context.Context, pktChan chan<- *rtp.Packet) error {
+	r.runs++
+	first := uint16(r.runs * 1000)
+	for i := uint16(0); ; i++ {
+		select {
+		case pktChan <- &rtp.Packet{Header: rtp.Header{SequenceNumber: first + i, Timestamp: uint32(i) * 960, Marker: true}, Payload: []byte{0xfc, byte(r.runs)}}:
+		case <-ctx.Done():
+			return nil
+		}
+		if r.runs == 1 && i == 1 {
+			return errors.New("encoder crashed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestMixer_RestartedSourceKeepsSequenceNumbers(t *testing.T) {
+	m := desktop.NewMixer()
+	m.SetSupervisorConfig(supervisor.Config{MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond, CrashLoopCount: 3, CrashLoopWindow: time.Minute})
+	if err := m.AddAudioSource(&restartingAudioSource{}); err != nil {
+		t.Fatal(err)
+	}
+	track := m.GetAudioTracks()[0]
+	sub := track.Subscribe(100)
+	defer sub.Close()
+	m.AcquireTrack(track)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go m.Stream(ctx)
+
+	for i := 0; i < 4; i++ {
+		select {
+		case p := <-sub.Packets():
+			if p.SequenceNumber != uint16(1000+i) || p.Payload[1] != byte(1+i/2) {
+				t.Errorf("Expected packet %v from run %v, got %v from run %v", 1000+i, 1+i/2, p.SequenceNumber, p.Payload[1])
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Only got %v packets", i)
+		}
+	}
+}
+
+func TestMixer_StopsIdleSources(t *testing.T) {
+	m := desktop.NewMixer()
+	m.SetIdleTimeout(20 * time.Millisecond)
+	if err := m.AddVideoSource(&fakeVideoSource{codec: webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000}}}); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go m.Stream(ctx)
+
+	waitForState := func(expected supervisor.State) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for m.GetSourceHealth()[0].State != expected {
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected the source to be %v, got %v", expected, m.GetSourceHealth()[0].State)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// Negotiating doesn't start the source, only acquiring it does
+	track, err := m.NegotiateVideoTrack(videoOffer("102 H264"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if state := m.GetSourceHealth()[0].State; state != supervisor.StateStopped {
+		t.Errorf("Expected the source to wait for a consumer, got %v", state)
+	}
+
+	m.AcquireTrack(track)
+	m.AcquireTrack(track)
+	waitForState(supervisor.StateStarting)
+	m.ReleaseTrack(track)
+	time.Sleep(40 * time.Millisecond)
+	if state := m.GetSourceHealth()[0].State; state != supervisor.StateStarting {
+		t.Errorf("Expected the source to keep running while it has a consumer, got %v", state)
+	}
+	m.ReleaseTrack(track)
+	waitForState(supervisor.StateStopped)
+}
+
+// settingsVideoSource reports the settings of each of its runs, and sends a packet
+// in each, starting from another sequence number every run
+type settingsVideoSource struct {
+	fakeVideoSource
+	settings api.VideoSettings
+	runs     chan api.VideoSettings
+	started  int
+}
+
+func (s *settingsVideoSource) GetVideoSettings() api.VideoSettings {
+	return s.settings
+}
+
+func (s *settingsVideoSource) SetVideoSettings(settings api.VideoSettings) error {
+	s.settings = settings
+	return nil
+}
+
+func (s *settingsVideoSource) StreamVideo(ctx context.Context, pktChan chan<- *rtp.Packet) error {
+	s.runs <- s.settings
+	s.started++
+	select {
+	case pktChan <- &rtp.Packet{Header: rtp.Header{SequenceNumber: uint16(s.started * 1000), Marker: true}, Payload: []byte{0x65}}:
+	case <-ctx.Done():
+	}
+	<-ctx.Done()
+	return nil
+}
+
+func TestMixer_SetVideoSettings(t *testing.T) {
+	m := desktop.NewMixer()
+	src := &settingsVideoSource{
+		fakeVideoSource: fakeVideoSource{codec: webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000}}},
+		runs:            make(chan api.VideoSettings, 2),
+	}
+	if err := m.AddVideoSource(src); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go m.Stream(ctx)
+
+	nextRun := func() api.VideoSettings {
+		t.Helper()
+		select {
+		case settings := <-src.runs:
+			return settings
+		case <-time.After(5 * time.Second):
+			t.Fatal("Expected the source to start")
+			return api.VideoSettings{}
+		}
+	}
+
+	track, err := m.GetVideoTrack("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub := track.Subscribe(10)
+	defer sub.Close()
+	nextPacket := func() *rtp.Packet {
+		t.Helper()
+		select {
+		case p := <-sub.Packets():
+			return p
+		case <-time.After(5 * time.Second):
+			t.Fatal("Expected a packet")
+			return nil
+		}
+	}
+
+	m.AcquireTrack(track)
+	if settings := nextRun(); settings != (api.VideoSettings{}) {
+		t.Errorf("Expected the source to start with its own settings, got %+v", settings)
+	}
+	first := nextPacket().SequenceNumber
+
+	if _, err := m.HandleCommand("video-settings", []byte(`{"width":1280,"height":720,"frameRate":30}`)); err != nil {
+		t.Fatal(err)
+	}
+	expected := api.VideoSettings{Width: 1280, Height: 720, FrameRate: 30}
+	if settings := nextRun(); settings != expected {
+		t.Errorf("Expected the source to restart with %+v, got %+v", expected, settings)
+	}
+
+	// The restarted source's packets carry on from the first run's
+	if seq := nextPacket().SequenceNumber; seq != first+1 {
+		t.Errorf("Expected packet %v after the restart, got %v", first+1, seq)
+	}
+
+	if err := m.SetVideoSettings("", api.VideoSettings{FrameRate: 1000}); err == nil {
+		t.Error("Expected an invalid frame rate to be rejected")
+	}
+	if err := m.SetVideoSettings("missing", api.VideoSettings{FrameRate: 30}); !errors.Is(err, desktop.ErrNoVideoSettings) {
+		t.Errorf("Expected ErrNoVideoSettings for an unknown output, got %v", err)
+	}
+}
@@ -0,0 +1,60 @@
+package mkv
+
+import (
+	"encoding/binary"
+	"strings"
+)
+
+// Codec IDs of the codecs the desktop records
+const (
+	CodecIDH264 = "V_MPEG4/ISO/AVC"
+	CodecIDOpus = "A_OPUS"
+	// CodecIDACM holds codecs described by a WAVEFORMATEX, like G.711
+	CodecIDACM = "A_MS/ACM"
+)
+
+// OpusCodecPrivate returns the OpusHead for an Opus track
+func OpusCodecPrivate(channels int) []byte {
+	head := []byte("OpusHead")
+	head = append(head, 1, byte(channels))
+	head = binary.LittleEndian.AppendUint16(head, 312) // pre-skip
+	head = binary.LittleEndian.AppendUint32(head, 48000)
+	head = binary.LittleEndian.AppendUint16(head, 0) // output gain
+	return append(head, 0)                           // channel mapping family
+}
+
+// PCMUCodecPrivate returns the WAVEFORMATEX for a G.711 µ-law track
+func PCMUCodecPrivate(sampleRate int, channels int) []byte {
+	format := binary.LittleEndian.AppendUint16(nil, 7) // WAVE_FORMAT_MULAW
+	format = binary.LittleEndian.AppendUint16(format, uint16(channels))
+	format = binary.LittleEndian.AppendUint32(format, uint32(sampleRate))
+	format = binary.LittleEndian.AppendUint32(format, uint32(sampleRate*channels))
+	format = binary.LittleEndian.AppendUint16(format, uint16(channels)) // block align
+	format = binary.LittleEndian.AppendUint16(format, 8)                // bits per sample
+	return binary.LittleEndian.AppendUint16(format, 0)                  // no extra data
+}
+
+// AudioTrack describes an audio track for the RTP codec, or returns false if it can't be recorded
+func AudioTrack(mimeType string, clockRate uint32, channels uint16) (Track, bool) {
+	channels = max(channels, 1)
+	switch strings.ToLower(mimeType) {
+	case "audio/opus":
+		return Track{
+			Type:         TrackTypeAudio,
+			CodecID:      CodecIDOpus,
+			CodecPrivate: OpusCodecPrivate(int(channels)),
+			SampleRate:   48000,
+			Channels:     int(channels),
+		}, true
+	case "audio/pcmu":
+		return Track{
+			Type:         TrackTypeAudio,
+			CodecID:      CodecIDACM,
+			CodecPrivate: PCMUCodecPrivate(int(clockRate), int(channels)),
+			SampleRate:   float64(clockRate),
+			Channels:     int(channels),
+		}, true
+	default:
+		return Track{}, false
+	}
+}
@@ -0,0 +1,66 @@
+package mkv
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// unknownSize is the size of an element that's written before its size is known
+var unknownSize = []byte{0x01, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+// appendID appends an element ID, which already carries its own length marker
+func appendID(dst []byte, id uint32) []byte {
+	switch {
+	case id >= 1<<24:
+		return append(dst, byte(id>>24), byte(id>>16), byte(id>>8), byte(id))
+	case id >= 1<<16:
+		return append(dst, byte(id>>16), byte(id>>8), byte(id))
+	case id >= 1<<8:
+		return append(dst, byte(id>>8), byte(id))
+	default:
+		return append(dst, byte(id))
+	}
+}
+
+// appendSize appends a variable length size, in as few bytes as it fits in
+func appendSize(dst []byte, size uint64) []byte {
+	length := 1
+	// All ones is reserved for unknown sizes
+	for size >= 1<<(7*length)-1 {
+		length++
+	}
+	marker := uint64(1) << (7 * length)
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], size|marker)
+	return append(dst, buf[8-length:]...)
+}
+
+// appendElement appends an element holding data
+func appendElement(dst []byte, id uint32, data []byte) []byte {
+	dst = appendID(dst, id)
+	dst = appendSize(dst, uint64(len(data)))
+	return append(dst, data...)
+}
+
+// appendUint appends an unsigned integer element, in as few bytes as it fits in
+func appendUint(dst []byte, id uint32, v uint64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+	i := 0
+	for i < 7 && buf[i] == 0 {
+		i++
+	}
+	return appendElement(dst, id, buf[i:])
+}
+
+// appendFloat appends a 64 bit float element
+func appendFloat(dst []byte, id uint32, v float64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], math.Float64bits(v))
+	return appendElement(dst, id, buf[:])
+}
+
+// appendString appends a string element
+func appendString(dst []byte, id uint32, v string) []byte {
+	return appendElement(dst, id, []byte(v))
+}
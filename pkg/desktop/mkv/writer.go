@@ -0,0 +1,214 @@
+// Package mkv writes Matroska files one cluster at a time. Clusters are written
+// whole, so a file is playable up to its last cluster even if it's never closed,
+// like when the desktop crashes or the disk fills up.
+package mkv
+
+import (
+	"errors"
+	"io"
+	"math"
+	"time"
+)
+
+// Element IDs, from the Matroska specification
+const (
+	idEBML               = 0x1A45DFA3
+	idEBMLVersion        = 0x4286
+	idEBMLReadVersion    = 0x42F7
+	idEBMLMaxIDLength    = 0x42F2
+	idEBMLMaxSizeLength  = 0x42F3
+	idDocType            = 0x4282
+	idDocTypeVersion     = 0x4287
+	idDocTypeReadVersion = 0x4285
+
+	idSegment          = 0x18538067
+	idInfo             = 0x1549A966
+	idTimestampScale   = 0x2AD7B1
+	idMuxingApp        = 0x4D80
+	idWritingApp       = 0x5741
+	idTracks           = 0x1654AE6B
+	idTrackEntry       = 0xAE
+	idTrackNumber      = 0xD7
+	idTrackUID         = 0x73C5
+	idTrackType        = 0x83
+	idCodecID          = 0x86
+	idCodecPrivate     = 0x63A2
+	idVideo            = 0xE0
+	idPixelWidth       = 0xB0
+	idPixelHeight      = 0xBA
+	idAudio            = 0xE1
+	idSamplingFreq     = 0xB5
+	idChannels         = 0x9F
+	idCluster          = 0x1F43B675
+	idClusterTimestamp = 0xE7
+	idSimpleBlock      = 0xA3
+)
+
+// maxClusterDuration is how long a cluster may get when keyframes are far apart
+const maxClusterDuration = 5 * time.Second
+
+var (
+	ErrUnknownTrack = errors.New("unknown track")
+	ErrNoTracks     = errors.New("a file needs at least one track")
+)
+
+// TrackType is the Matroska track type
+type TrackType uint8
+
+const (
+	TrackTypeVideo TrackType = 1
+	TrackTypeAudio TrackType = 2
+)
+
+// Track describes a track of the file
+type Track struct {
+	Type         TrackType
+	CodecID      string
+	CodecPrivate []byte
+
+	// Width and Height are the size of video tracks
+	Width  int
+	Height int
+
+	// SampleRate and Channels describe audio tracks
+	SampleRate float64
+	Channels   int
+}
+
+// Writer writes frames to a Matroska file. Video tracks start a new cluster
+// at every keyframe, so that players can seek to any cluster.
+type Writer struct {
+	w      io.Writer
+	tracks []Track
+
+	cluster        []byte
+	clusterTime    time.Duration
+	clusterStarted bool
+	written        int64
+}
+
+// NewWriter writes the file header for the given tracks. Frames are written to
+// tracks by their index in tracks.
+func NewWriter(w io.Writer, tracks []Track) (*Writer, error) {
+	if len(tracks) == 0 {
+		return nil, ErrNoTracks
+	}
+
+	header := []byte{}
+	ebml := []byte{}
+	ebml = appendUint(ebml, idEBMLVersion, 1)
+	ebml = appendUint(ebml, idEBMLReadVersion, 1)
+	ebml = appendUint(ebml, idEBMLMaxIDLength, 4)
+	ebml = appendUint(ebml, idEBMLMaxSizeLength, 8)
+	ebml = appendString(ebml, idDocType, "matroska")
+	ebml = appendUint(ebml, idDocTypeVersion, 4)
+	ebml = appendUint(ebml, idDocTypeReadVersion, 2)
+	header = appendElement(header, idEBML, ebml)
+
+	// The segment's size isn't known until the file is done, which it may never be
+	header = appendID(header, idSegment)
+	header = append(header, unknownSize...)
+
+	info := []byte{}
+	info = appendUint(info, idTimestampScale, uint64(time.Millisecond))
+	info = appendString(info, idMuxingApp, "pod-arcade")
+	info = appendString(info, idWritingApp, "pod-arcade")
+	header = appendElement(header, idInfo, info)
+
+	entries := []byte{}
+	for i, t := range tracks {
+		entry := []byte{}
+		entry = appendUint(entry, idTrackNumber, uint64(i+1))
+		entry = appendUint(entry, idTrackUID, uint64(i+1))
+		entry = appendUint(entry, idTrackType, uint64(t.Type))
+		entry = appendString(entry, idCodecID, t.CodecID)
+		if len(t.CodecPrivate) > 0 {
+			entry = appendElement(entry, idCodecPrivate, t.CodecPrivate)
+		}
+		switch t.Type {
+		case TrackTypeVideo:
+			video := []byte{}
+			video = appendUint(video, idPixelWidth, uint64(t.Width))
+			video = appendUint(video, idPixelHeight, uint64(t.Height))
+			entry = appendElement(entry, idVideo, video)
+		case TrackTypeAudio:
+			audio := []byte{}
+			audio = appendFloat(audio, idSamplingFreq, t.SampleRate)
+			audio = appendUint(audio, idChannels, uint64(t.Channels))
+			entry = appendElement(entry, idAudio, audio)
+		}
+		entries = appendElement(entries, idTrackEntry, entry)
+	}
+	header = appendElement(header, idTracks, entries)
+
+	n, err := w.Write(header)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Writer{
+		w:       w,
+		tracks:  tracks,
+		written: int64(n),
+	}, nil
+}
+
+// WriteFrame adds a frame to the file, at t since the start of the file.
+// Frames are buffered until their cluster is complete.
+func (w *Writer) WriteFrame(track int, t time.Duration, keyframe bool, data []byte) error {
+	if track < 0 || track >= len(w.tracks) {
+		return ErrUnknownTrack
+	}
+	t = max(t, 0).Truncate(time.Millisecond)
+
+	relative := (t - w.clusterTime) / time.Millisecond
+	newCluster := !w.clusterStarted ||
+		(keyframe && w.tracks[track].Type == TrackTypeVideo) ||
+		t-w.clusterTime >= maxClusterDuration ||
+		relative < math.MinInt16 || relative > math.MaxInt16
+	if newCluster {
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		w.clusterTime = t
+		w.clusterStarted = true
+		w.cluster = appendUint(w.cluster[:0], idClusterTimestamp, uint64(t/time.Millisecond))
+		relative = 0
+	}
+
+	flags := byte(0)
+	if keyframe {
+		flags |= 0x80
+	}
+	w.cluster = appendID(w.cluster, idSimpleBlock)
+	w.cluster = appendSize(w.cluster, uint64(4+len(data)))
+	w.cluster = append(w.cluster, 0x80|byte(track+1), byte(int16(relative)>>8), byte(int16(relative)), flags)
+	w.cluster = append(w.cluster, data...)
+	return nil
+}
+
+// Flush writes out the open cluster
+func (w *Writer) Flush() error {
+	if !w.clusterStarted || len(w.cluster) == 0 {
+		return nil
+	}
+	out := appendID(nil, idCluster)
+	out = appendSize(out, uint64(len(w.cluster)))
+	out = append(out, w.cluster...)
+	w.cluster = w.cluster[:0]
+	w.clusterStarted = false
+
+	n, err := w.w.Write(out)
+	w.written += int64(n)
+	return err
+}
+
+// Size returns the size of the file so far, including the open cluster
+func (w *Writer) Size() int64 {
+	return w.written + int64(len(w.cluster))
+}
+
+// Close writes out the open cluster. It doesn't close the underlying writer.
+func (w *Writer) Close() error {
+	return w.Flush()
+}
@@ -0,0 +1,95 @@
+package mkv
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// element is a parsed EBML element
+type element struct {
+	id   uint32
+	data []byte
+}
+
+// readVint reads a variable length integer, returning it with its marker kept or removed
+func readVint(data []byte, keepMarker bool) (uint64, int) {
+	length := 1
+	for length <= 8 && data[0]&(0x80>>(length-1)) == 0 {
+		length++
+	}
+	v := uint64(data[0])
+	if !keepMarker {
+		v &= uint64(0xff >> length)
+	}
+	for _, b := range data[1:length] {
+		v = v<<8 | uint64(b)
+	}
+	return v, length
+}
+
+// parse splits data into elements, treating unknown sizes as running to the end
+func parse(data []byte) []element {
+	elements := []element{}
+	for len(data) > 0 {
+		id, n := readVint(data, true)
+		data = data[n:]
+		size, n := readVint(data, false)
+		if size == 1<<56-1 {
+			size = uint64(len(data) - n)
+		}
+		data = data[n:]
+		elements = append(elements, element{uint32(id), data[:size]})
+		data = data[size:]
+	}
+	return elements
+}
+
+func TestWriter_WritesClustersAtKeyframes(t *testing.T) {
+	out := &bytes.Buffer{}
+	w, err := NewWriter(out, []Track{
+		{Type: TrackTypeVideo, CodecID: CodecIDH264, Width: 1280, Height: 720},
+		{Type: TrackTypeAudio, CodecID: CodecIDOpus, CodecPrivate: OpusCodecPrivate(2), SampleRate: 48000, Channels: 2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w.WriteFrame(0, 0, true, []byte{1})
+	w.WriteFrame(1, 10*time.Millisecond, false, []byte{2})
+	w.WriteFrame(0, 33*time.Millisecond, false, []byte{3})
+	w.WriteFrame(0, 1000*time.Millisecond, true, []byte{4})
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if w.Size() != int64(out.Len()) {
+		t.Errorf("Expected size %v, got %v", out.Len(), w.Size())
+	}
+
+	top := parse(out.Bytes())
+	if len(top) != 2 || top[0].id != idEBML || top[1].id != idSegment {
+		t.Fatalf("Expected an EBML header and a segment, got %v", top)
+	}
+
+	clusters := [][]element{}
+	for _, e := range parse(top[1].data) {
+		if e.id == idCluster {
+			clusters = append(clusters, parse(e.data))
+		}
+	}
+	if len(clusters) != 2 {
+		t.Fatalf("Expected a cluster per keyframe, got %v", len(clusters))
+	}
+
+	first := clusters[0]
+	if len(first) != 4 || first[0].id != idClusterTimestamp {
+		t.Fatalf("Expected a timestamp and 3 blocks in the first cluster, got %v", first)
+	}
+	// track 2, 10ms into the cluster, not a keyframe
+	if !bytes.Equal(first[2].data, []byte{0x82, 0x00, 0x0a, 0x00, 2}) {
+		t.Errorf("Unexpected audio block %x", first[2].data)
+	}
+	if !bytes.Equal(clusters[1][0].data, []byte{0x03, 0xe8}) {
+		t.Errorf("Expected the second cluster to start at 1000ms, got %x", clusters[1][0].data)
+	}
+}
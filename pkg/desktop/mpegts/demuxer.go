@@ -0,0 +1,307 @@
+// Package mpegts demultiplexes the MPEG-TS streams that encoders write into the PES
+// packets of each elementary stream, along with the program clock references that
+// tie their timestamps to the encoder's clock.
+package mpegts
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+)
+
+// PacketSize is the size of every transport stream packet
+const PacketSize = 188
+
+const syncByte = 0x47
+
+// Stream types from the PMT that the demuxer knows
+const (
+	StreamTypeH264    = 0x1b
+	StreamTypePrivate = 0x06
+)
+
+// ClockRate is the rate of PTS, DTS and PCR base values
+const ClockRate = 90000
+
+// NoTimestamp is the PTS or DTS of a PES packet that doesn't have one
+const NoTimestamp = -1
+
+// Codec is the codec of an elementary stream
+type Codec int
+
+const (
+	CodecUnknown Codec = iota
+	CodecH264
+	CodecOpus
+)
+
+// PES is a complete PES packet, which holds an access unit of H.264, or a run of Opus
+// packets with their control headers
+type PES struct {
+	PID   uint16
+	Codec Codec
+	// PTS and DTS are 33 bit timestamps at ClockRate, or NoTimestamp
+	PTS int64
+	DTS int64
+	// Data is only valid until the next call to ReadPES
+	Data []byte
+}
+
+var ErrNoSync = errors.New("lost transport stream sync")
+
+// stream is an elementary stream that PES packets are being collected for
+type stream struct {
+	codec Codec
+	// length is the PES packet length from the header, or 0 when it's unbounded,
+	// like for video, and the packet ends when the next one starts
+	length int
+	cc     byte
+	// broken is set when packets were lost, until the next PES packet starts
+	broken bool
+	// buf is the PES packet being collected, and spare is the last one handed out
+	buf   []byte
+	spare []byte
+}
+
+// Demuxer reads a transport stream with a single program
+type Demuxer struct {
+	r      *bufio.Reader
+	packet [PacketSize]byte
+
+	pmtPID  uint16
+	pcrPID  uint16
+	streams map[uint16]*stream
+
+	// OnPCR is called with each program clock reference, at ClockRate, as it's read
+	OnPCR func(pcr int64)
+}
+
+func NewDemuxer(r io.Reader) *Demuxer {
+	return &Demuxer{
+		r:       bufio.NewReaderSize(r, 64*PacketSize),
+		pmtPID:  0x1fff,
+		pcrPID:  0x1fff,
+		streams: map[uint16]*stream{},
+	}
+}
+
+// ReadPES returns the next complete PES packet of a stream with a known codec
+func (d *Demuxer) ReadPES() (*PES, error) {
+	for {
+		if err := d.readPacket(); err != nil {
+			return nil, err
+		}
+		if pes := d.handlePacket(); pes != nil {
+			return pes, nil
+		}
+	}
+}
+
+// readPacket reads the next packet, skipping ahead to the next sync byte if it was lost
+func (d *Demuxer) readPacket() error {
+	if _, err := io.ReadFull(d.r, d.packet[:]); err != nil {
+		return err
+	}
+	for skipped := 0; d.packet[0] != syncByte; skipped++ {
+		if skipped > 10*PacketSize {
+			return ErrNoSync
+		}
+		i := bytes.IndexByte(d.packet[1:], syncByte)
+		if i < 0 {
+			i = PacketSize - 1
+		}
+		n := copy(d.packet[:], d.packet[i+1:])
+		if _, err := io.ReadFull(d.r, d.packet[n:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handlePacket handles the packet that was just read, returning a PES packet if it completed one
+func (d *Demuxer) handlePacket() *PES {
+	p := d.packet[:]
+	start := p[1]&0x40 != 0
+	pid := uint16(p[1]&0x1f)<<8 | uint16(p[2])
+	control := (p[3] >> 4) & 0x03
+	cc := p[3] & 0x0f
+
+	payload := p[4:]
+	if control&0x02 != 0 {
+		length := int(payload[0])
+		if length > len(payload)-1 {
+			return nil
+		}
+		if length > 0 && pid == d.pcrPID && payload[1]&0x10 != 0 && length >= 7 && d.OnPCR != nil {
+			d.OnPCR(readPCR(payload[2:8]))
+		}
+		payload = payload[1+length:]
+	}
+	if control&0x01 == 0 || len(payload) == 0 {
+		return nil
+	}
+
+	switch {
+	case pid == 0:
+		d.handlePAT(payload, start)
+		return nil
+	case pid == d.pmtPID:
+		d.handlePMT(payload, start)
+		return nil
+	}
+
+	s := d.streams[pid]
+	if s == nil {
+		return nil
+	}
+	lost := cc != (s.cc+1)&0x0f
+	s.cc = cc
+
+	var done *PES
+	if start {
+		// The previous packet ends where an unbounded one starts
+		if s.length == 0 && !s.broken && len(s.buf) > 0 {
+			done = d.finish(pid, s)
+		}
+		s.buf = s.buf[:0]
+		s.broken = false
+		s.length = 0
+		if len(payload) >= 6 {
+			s.length = int(payload[4])<<8 | int(payload[5])
+		}
+	} else if lost {
+		s.broken = true
+	}
+	if s.broken {
+		return done
+	}
+
+	s.buf = append(s.buf, payload...)
+	if s.length > 0 && len(s.buf) >= s.length+6 {
+		s.buf = s.buf[:s.length+6]
+		done = d.finish(pid, s)
+		// Anything else before the next start belongs to nothing
+		s.broken = true
+	}
+	return done
+}
+
+// finish parses the collected PES packet of a stream, and hands it out
+func (d *Demuxer) finish(pid uint16, s *stream) *PES {
+	pes := parsePES(s.buf)
+	s.buf, s.spare = s.spare[:0], s.buf
+	if pes == nil {
+		return nil
+	}
+	pes.PID = pid
+	pes.Codec = s.codec
+	return pes
+}
+
+// parsePES parses a PES packet's header, returning nil if it's invalid
+func parsePES(b []byte) *PES {
+	if len(b) < 9 || b[0] != 0 || b[1] != 0 || b[2] != 1 {
+		return nil
+	}
+	headerLength := int(b[8])
+	if len(b) < 9+headerLength {
+		return nil
+	}
+	pes := &PES{PTS: NoTimestamp, DTS: NoTimestamp, Data: b[9+headerLength:]}
+	flags := b[7] >> 6
+	if flags&0x02 != 0 && headerLength >= 5 {
+		pes.PTS = readTimestamp(b[9:14])
+	}
+	if flags == 0x03 && headerLength >= 10 {
+		pes.DTS = readTimestamp(b[14:19])
+	}
+	return pes
+}
+
+// readTimestamp reads a 33 bit PTS or DTS, which is split up by marker bits
+func readTimestamp(b []byte) int64 {
+	return int64(b[0]>>1&0x07)<<30 | int64(b[1])<<22 | int64(b[2]>>1)<<15 | int64(b[3])<<7 | int64(b[4]>>1)
+}
+
+// readPCR reads the 33 bit base of a program clock reference, leaving out its 27MHz extension
+func readPCR(b []byte) int64 {
+	return int64(b[0])<<25 | int64(b[1])<<17 | int64(b[2])<<9 | int64(b[3])<<1 | int64(b[4]>>7)
+}
+
+// section returns the PSI section that starts in a packet's payload, without its CRC
+func section(payload []byte, start bool) []byte {
+	if !start || len(payload) < 1 {
+		// Sections that span packets aren't needed for a single program
+		return nil
+	}
+	payload = payload[1+int(payload[0]):]
+	if len(payload) < 3 {
+		return nil
+	}
+	length := int(payload[1]&0x0f)<<8 | int(payload[2])
+	if length < 9 || len(payload) < 3+length {
+		return nil
+	}
+	return payload[:3+length-4]
+}
+
+func (d *Demuxer) handlePAT(payload []byte, start bool) {
+	s := section(payload, start)
+	if s == nil || s[0] != 0x00 {
+		return
+	}
+	for entries := s[8:]; len(entries) >= 4; entries = entries[4:] {
+		program := uint16(entries[0])<<8 | uint16(entries[1])
+		if program != 0 {
+			d.pmtPID = uint16(entries[2]&0x1f)<<8 | uint16(entries[3])
+			return
+		}
+	}
+}
+
+func (d *Demuxer) handlePMT(payload []byte, start bool) {
+	s := section(payload, start)
+	if s == nil || s[0] != 0x02 || len(s) < 12 {
+		return
+	}
+	d.pcrPID = uint16(s[8]&0x1f)<<8 | uint16(s[9])
+	infoLength := int(s[10]&0x0f)<<8 | int(s[11])
+	if len(s) < 12+infoLength {
+		return
+	}
+	for es := s[12+infoLength:]; len(es) >= 5; {
+		streamType := es[0]
+		pid := uint16(es[1]&0x1f)<<8 | uint16(es[2])
+		infoLength := int(es[3]&0x0f)<<8 | int(es[4])
+		if len(es) < 5+infoLength {
+			return
+		}
+		codec := streamCodec(streamType, es[5:5+infoLength])
+		if codec != CodecUnknown && d.streams[pid] == nil {
+			d.streams[pid] = &stream{codec: codec, cc: 0x0f, broken: true}
+		}
+		es = es[5+infoLength:]
+	}
+}
+
+// streamCodec returns the codec of a stream from its type and descriptors
+func streamCodec(streamType byte, descriptors []byte) Codec {
+	switch streamType {
+	case StreamTypeH264:
+		return CodecH264
+	case StreamTypePrivate:
+		// Opus is private data, registered with a format identifier
+		for len(descriptors) >= 2 {
+			tag, length := descriptors[0], int(descriptors[1])
+			if len(descriptors) < 2+length {
+				break
+			}
+			if tag == 0x05 && bytes.Equal(descriptors[2:2+length], []byte("Opus")) {
+				return CodecOpus
+			}
+			descriptors = descriptors[2+length:]
+		}
+	}
+	return CodecUnknown
+}
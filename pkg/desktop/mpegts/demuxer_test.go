@@ -0,0 +1,149 @@
+package mpegts
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// tsWriter writes a minimal transport stream, like ffmpeg's muxer does
+type tsWriter struct {
+	buf bytes.Buffer
+	cc  map[uint16]byte
+}
+
+func (w *tsWriter) packet(pid uint16, start bool, adaptation []byte, payload []byte) []byte {
+	p := make([]byte, PacketSize)
+	p[0] = syncByte
+	p[1] = byte(pid >> 8)
+	if start {
+		p[1] |= 0x40
+	}
+	p[2] = byte(pid)
+	control := byte(0x01)
+	if adaptation != nil {
+		control |= 0x02
+	}
+	p[3] = control<<4 | w.cc[pid]
+	w.cc[pid] = (w.cc[pid] + 1) & 0x0f
+
+	// Stuff the adaptation field so the payload ends the packet
+	n := 4
+	space := PacketSize - 4 - len(payload)
+	if adaptation != nil || space > 0 {
+		p[3] |= 0x20
+		field := append([]byte{}, adaptation...)
+		for len(field) < space-1 {
+			if len(field) == 0 {
+				field = append(field, 0x00)
+			} else {
+				field = append(field, 0xff)
+			}
+		}
+		p[n] = byte(len(field))
+		n += 1 + copy(p[n+1:], field)
+	}
+	copy(p[n:], payload)
+	w.buf.Write(p)
+	return p
+}
+
+func (w *tsWriter) section(pid uint16, s []byte) {
+	// Pointer field, then the section with a dummy CRC
+	w.packet(pid, true, nil, append(append([]byte{0}, s...), 0, 0, 0, 0))
+}
+
+func (w *tsWriter) pes(pid uint16, streamID byte, pts int64, data []byte, bounded bool) {
+	header := []byte{0, 0, 1, streamID, 0, 0, 0x80, 0x80, 5,
+		byte(0x21 | (pts>>29)&0x0e), byte(pts >> 22), byte(pts>>14 | 1), byte(pts >> 7), byte(pts<<1 | 1)}
+	if bounded {
+		length := len(header) - 6 + len(data)
+		header[4], header[5] = byte(length>>8), byte(length)
+	}
+	pes := append(header, data...)
+	for start := true; len(pes) > 0; start = false {
+		size := min(len(pes), PacketSize-4)
+		w.packet(pid, start, nil, pes[:size])
+		pes = pes[size:]
+	}
+}
+
+func (w *tsWriter) pcr(pid uint16, pcr int64) {
+	w.packet(pid, false, []byte{0x10, byte(pcr >> 25), byte(pcr >> 17), byte(pcr >> 9), byte(pcr >> 1), byte(pcr<<7 | 0x7e), 0}, nil)
+}
+
+func TestDemuxer(t *testing.T) {
+	w := &tsWriter{cc: map[uint16]byte{}}
+	w.section(0, []byte{0x00, 0xb0, 13, 0, 1, 0xc1, 0, 0, 0, 1, 0xf0, 0x00})
+	w.section(0x1000, []byte{
+		0x02, 0xb0, 29, 0, 1, 0xc1, 0, 0, 0xe1, 0x00, 0xf0, 0x00,
+		StreamTypeH264, 0xe1, 0x00, 0xf0, 0x00,
+		StreamTypePrivate, 0xe1, 0x01, 0xf0, 0x06, 0x05, 0x04, 'O', 'p', 'u', 's',
+	})
+	w.pcr(0x100, 1<<32+5)
+
+	frame := bytes.Repeat([]byte{0, 0, 0, 1, 0x65, 0xaa}, 100)
+	w.pes(0x100, 0xe0, 1<<32+9000, frame, false)
+	opus := []byte{0x7f, 0xe0, 3, 0xf8, 0xff, 0xfe, 0x7f, 0xe0, 2, 0xf8, 0xff}
+	w.pes(0x101, 0xc0, 1<<32+9100, opus, true)
+	w.pes(0x100, 0xe0, 1<<32+10500, frame[:12], false)
+
+	d := NewDemuxer(&w.buf)
+	pcrs := []int64{}
+	d.OnPCR = func(pcr int64) { pcrs = append(pcrs, pcr) }
+
+	// The audio is complete as soon as it's read, but the video only once the next frame starts
+	pes, err := d.ReadPES()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pes.Codec != CodecOpus || pes.PTS != 1<<32+9100 {
+		t.Fatalf("Expected the Opus PES first, got %v at %v", pes.Codec, pes.PTS)
+	}
+	packets, err := SplitOpus(pes.Data, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packets) != 2 || !bytes.Equal(packets[0], []byte{0xf8, 0xff, 0xfe}) || !bytes.Equal(packets[1], []byte{0xf8, 0xff}) {
+		t.Errorf("Expected two Opus packets, got %v", packets)
+	}
+
+	pes, err = d.ReadPES()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pes.Codec != CodecH264 || pes.PTS != 1<<32+9000 || !bytes.Equal(pes.Data, frame) {
+		t.Errorf("Expected the first H.264 frame, got %v at %v with %v bytes", pes.Codec, pes.PTS, len(pes.Data))
+	}
+	if len(pcrs) != 1 || pcrs[0] != 1<<32+5 {
+		t.Errorf("Expected the PCR, got %v", pcrs)
+	}
+
+	if _, err := d.ReadPES(); err != io.EOF {
+		t.Errorf("Expected EOF with the last frame unfinished, got %v", err)
+	}
+}
+
+func TestDemuxer_DropsBrokenPES(t *testing.T) {
+	w := &tsWriter{cc: map[uint16]byte{}}
+	w.section(0, []byte{0x00, 0xb0, 13, 0, 1, 0xc1, 0, 0, 0, 1, 0xf0, 0x00})
+	w.section(0x1000, []byte{0x02, 0xb0, 18, 0, 1, 0xc1, 0, 0, 0xe1, 0x00, 0xf0, 0x00, StreamTypeH264, 0xe1, 0x00, 0xf0, 0x00})
+
+	w.pes(0x100, 0xe0, 0, bytes.Repeat([]byte{0xaa}, 1000), false)
+	// Lose a packet in the middle of the frame
+	lost := w.buf.Len() - 2*PacketSize
+	stream := append(append([]byte{}, w.buf.Bytes()[:lost]...), w.buf.Bytes()[lost+PacketSize:]...)
+	w.buf.Reset()
+	w.buf.Write(stream)
+	w.pes(0x100, 0xe0, 3000, []byte{0xbb}, false)
+	w.pes(0x100, 0xe0, 6000, []byte{0xcc}, false)
+
+	d := NewDemuxer(&w.buf)
+	pes, err := d.ReadPES()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pes.PTS != 3000 {
+		t.Errorf("Expected the broken frame to be dropped, got the frame at %v", pes.PTS)
+	}
+}
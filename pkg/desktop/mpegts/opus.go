@@ -0,0 +1,57 @@
+package mpegts
+
+import "errors"
+
+var ErrInvalidOpusHeader = errors.New("invalid opus control header")
+
+// SplitOpus splits the data of an Opus PES packet into its Opus packets, stripping the
+// control header in front of each one (ETSI TS 102 366, appendix A)
+func SplitOpus(data []byte, packets [][]byte) ([][]byte, error) {
+	for len(data) > 0 {
+		if len(data) < 2 || data[0] != 0x7f || data[1]&0xe0 != 0xe0 {
+			return packets, ErrInvalidOpusHeader
+		}
+		startTrim := data[1]&0x10 != 0
+		endTrim := data[1]&0x08 != 0
+		extension := data[1]&0x04 != 0
+		data = data[2:]
+
+		size := 0
+		for {
+			if len(data) == 0 {
+				return packets, ErrInvalidOpusHeader
+			}
+			b := data[0]
+			data = data[1:]
+			size += int(b)
+			if b != 0xff {
+				break
+			}
+		}
+		if startTrim {
+			data = skip(data, 2)
+		}
+		if endTrim {
+			data = skip(data, 2)
+		}
+		if extension {
+			if len(data) == 0 {
+				return packets, ErrInvalidOpusHeader
+			}
+			data = skip(data, 1+int(data[0]))
+		}
+		if len(data) < size {
+			return packets, ErrInvalidOpusHeader
+		}
+		packets = append(packets, data[:size])
+		data = data[size:]
+	}
+	return packets, nil
+}
+
+func skip(data []byte, n int) []byte {
+	if len(data) < n {
+		return nil
+	}
+	return data[n:]
+}
@@ -13,6 +13,7 @@ import (
 	"github.com/pion/webrtc/v4"
 	"github.com/pod-arcade/pod-arcade/api"
 	"github.com/pod-arcade/pod-arcade/pkg/desktop"
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/webrtc_interceptors/stream_registry"
 	"github.com/pod-arcade/pod-arcade/pkg/log"
 	"github.com/pod-arcade/pod-arcade/pkg/metrics"
 	"github.com/rs/zerolog"
@@ -118,6 +119,21 @@ func (c *MQTTSignaler) Run(ctx context.Context, desktop api.Desktop) error {
 		opts.AddBroker(cfg.Host)
 	}
 
+	// Publish events from controllers, like saved clips
+	for _, controller := range desktop.GetControllers() {
+		if ec, ok := controller.(api.EventController); ok {
+			name := ec.GetName()
+			ec.OnEvent(func(event string, payload any) {
+				c.onControllerEvent(name, event, payload)
+			})
+		}
+	}
+
+	// Keep the latest preview of the screen retained, for desktop pickers
+	if preview := desktop.GetPreviewSource(); preview != nil {
+		preview.OnPreview(c.publishPreview)
+	}
+
 	opts.WillEnabled = true
 	opts.SetWill(c.getTopicPrefix()+"status", "offline", 0, true)
 
@@ -129,6 +145,7 @@ func (c *MQTTSignaler) Run(ctx context.Context, desktop api.Desktop) error {
 			case <-ticker.C:
 				c.publishOnlineMessage()
 				c.publishICEServers()
+				c.publishOutputs()
 			case <-c.ctx.Done():
 				return
 			}
@@ -147,6 +164,9 @@ func (c *MQTTSignaler) Run(ctx context.Context, desktop api.Desktop) error {
 	// Wait for the done context
 	<-c.ctx.Done()
 	c.publishOfflineMessage() // last will doesn't fire on graceful disconnect
+	if desktop.GetPreviewSource() != nil {
+		c.clearPreview()
+	}
 
 	// If we're shutting down, disconnect the client.
 	c.Client.Disconnect(1000)
@@ -186,6 +206,25 @@ func (c *MQTTSignaler) onConnect(client mqtt.Client) {
 	})
 	c.l.Debug().Msg("Subscribed to offer-ice-candidate")
 
+	// Listen for answers to the offers we make when our tracks change
+	client.Subscribe(c.getTopicPrefix()+"sessions/+/webrtc-renegotiation-answer", 0, func(client mqtt.Client, m mqtt.Message) {
+		components := strings.Split(strings.Replace(m.Topic(), c.getTopicPrefix(), "", 1), "/")
+		sessionId := api.SessionID(components[1])
+		session := c.sessions[sessionId]
+		if session == nil {
+			c.l.Error().Msgf("Received renegotiation answer for unknown session %v", sessionId)
+			return
+		}
+		answer := webrtc.SessionDescription{
+			Type: webrtc.SDPTypeAnswer,
+			SDP:  string(m.Payload()),
+		}
+		if err := session.GetPeerConnection().SetRemoteDescription(answer); err != nil {
+			c.l.Error().Err(err).Msgf("Failed to set renegotiation answer for session %v", sessionId)
+		}
+	})
+	c.l.Debug().Msg("Subscribed to webrtc-renegotiation-answer")
+
 	// Detect bugged status
 	client.Subscribe(c.getTopicPrefix()+"status", 0, func(client mqtt.Client, m mqtt.Message) {
 		if string(m.Payload()) == "offline" {
@@ -208,11 +247,62 @@ func (c *MQTTSignaler) onConnect(client mqtt.Client) {
 	})
 	c.l.Debug().Msg("Subscribed to offer-ice-candidate")
 
+	// Pass commands on to the desktop's controllers
+	for _, controller := range c.desktop.GetControllers() {
+		controller := controller
+		prefix := c.getTopicPrefix() + controller.GetName() + "/"
+		client.Subscribe(prefix+"+", 0, func(client mqtt.Client, m mqtt.Message) {
+			command := strings.TrimPrefix(m.Topic(), prefix)
+			payload := m.Payload()
+			// Commands may take a while, and shouldn't hold up other messages
+			go c.onCommand(controller, command, payload)
+		})
+		c.l.Debug().Msgf("Subscribed to %v commands", controller.GetName())
+	}
+
 	c.publishOnlineMessage()
 	c.publishICEServers()
+	c.publishOutputs()
 	c.l.Debug().Msg("Published online status")
 }
 
+// commandReply is published in reply to every command
+type commandReply struct {
+	Result any    `json:"result,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+func (c *MQTTSignaler) onCommand(controller api.Controller, command string, payload []byte) {
+	c.l.Debug().Msgf("Received %v command %v", controller.GetName(), command)
+	reply := commandReply{}
+	result, err := controller.HandleCommand(command, payload)
+	if err != nil {
+		c.l.Warn().Err(err).Msgf("%v command %v failed", controller.GetName(), command)
+		reply.Error = err.Error()
+	} else {
+		reply.Result = result
+	}
+
+	replyBytes, err := json.Marshal(reply)
+	if err != nil {
+		c.l.Error().Msgf("Failed to encode reply to %v command %v. %v", controller.GetName(), command, err)
+		return
+	}
+	c.Client.Publish(c.getTopicPrefix()+controller.GetName()+"/"+command+"/reply", 0, false, replyBytes)
+}
+
+func (c *MQTTSignaler) onControllerEvent(controller string, event string, payload any) {
+	if c.Client == nil {
+		return
+	}
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		c.l.Error().Msgf("Failed to encode %v event %v. %v", controller, event, err)
+		return
+	}
+	c.Client.Publish(c.getTopicPrefix()+controller+"/events/"+event, 1, false, payloadBytes)
+}
+
 func (c *MQTTSignaler) getTopicPrefix() string {
 	if c.cachedConfig == nil {
 		c.RefreshConfig()
@@ -233,6 +323,28 @@ func (c *MQTTSignaler) publishICEServers() {
 	c.Client.Publish(c.getTopicPrefix()+"ice-servers", 0, true, iceServersString)
 }
 
+// publishOutputs publishes the outputs that clients can pick between
+func (c *MQTTSignaler) publishOutputs() {
+	outputs, err := json.Marshal(c.desktop.GetMixer().GetVideoOutputs())
+	if err != nil {
+		c.l.Error().Msgf("Failed to encode video outputs. %v", err)
+		return
+	}
+	c.Client.Publish(c.getTopicPrefix()+"outputs", 0, true, outputs)
+}
+
+func (c *MQTTSignaler) publishPreview(image []byte) {
+	if c.Client == nil {
+		return
+	}
+	c.Client.Publish(c.getTopicPrefix()+"preview", 0, true, image)
+}
+
+// clearPreview deletes the retained preview, since it's stale once the desktop is gone
+func (c *MQTTSignaler) clearPreview() {
+	c.Client.Publish(c.getTopicPrefix()+"preview", 0, true, []byte{})
+}
+
 func (c *MQTTSignaler) publishOfflineMessage() {
 	c.Client.Publish(c.getTopicPrefix()+"status", 0, true, "offline")
 }
@@ -274,19 +386,30 @@ func (c *MQTTSignaler) onOffer(sessionId api.SessionID, sdp webrtc.SessionDescri
 	if session == nil {
 		c.l.Debug().Msgf("Creating new session %v", sessionId)
 		session = desktop.NewSession(c.ctx, sessionId)
+		session.OnRenegotiate(func(offer webrtc.SessionDescription) error {
+			c.publishRenegotiationOffer(string(sessionId), offer)
+			return nil
+		})
 		c.sessions[sessionId] = session
 		_, err := session.CreatePeerConnection(c.getWebRTCConfig())
 		if err != nil {
 			c.l.Error().Err(err).Msg("Failed to create peer connection")
 			return
 		}
+		pc = session.GetPeerConnection()
+		// The session handler picks its tracks based on the offer, so it
+		// needs the remote description before it runs.
+		if err := pc.SetRemoteDescription(sdp); err != nil {
+			c.l.Error().Err(err).Msg("Failed to set remote description")
+			return
+		}
 		if c.newSessionHandler != nil {
 			c.newSessionHandler(session)
 		}
-		pc = session.GetPeerConnection()
-		pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
-			if state == webrtc.PeerConnectionStateDisconnected || state == webrtc.PeerConnectionStateClosed || state == webrtc.PeerConnectionStateFailed {
-				c.l.Debug().Msgf("Peer Connection for session %v has disconnected", sessionId)
+		session.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+			// Disconnected sessions are kept, since ICE often recovers from it
+			if state == webrtc.PeerConnectionStateClosed || state == webrtc.PeerConnectionStateFailed {
+				c.l.Debug().Msgf("Peer Connection for session %v has closed", sessionId)
 				delete(c.sessions, sessionId)
 			}
 		})
@@ -300,19 +423,26 @@ func (c *MQTTSignaler) onOffer(sessionId api.SessionID, sdp webrtc.SessionDescri
 		})
 	} else {
 		pc = session.GetPeerConnection()
-	}
-	err := pc.SetRemoteDescription(sdp)
-	if err != nil {
-		c.l.Error().Err(err).Msg("Failed to set local description")
-		return
+		err := pc.SetRemoteDescription(sdp)
+		if err != nil {
+			c.l.Error().Err(err).Msg("Failed to set remote description")
+			return
+		}
 	}
 	answer, err := pc.CreateAnswer(nil)
 	if err != nil {
 		c.l.Error().Err(err).Msg("Failed to create answer")
 		return
 	}
-	pc.SetLocalDescription(answer)
-	c.publishAnswer(string(sessionId), answer)
+	if err := pc.SetLocalDescription(answer); err != nil {
+		c.l.Error().Err(err).Msg("Failed to set local description")
+		return
+	}
+	// pion doesn't declare the SSRCs of the RTX and FlexFEC streams it sends. Only the
+	// published answer gets them, since pion rejects a local answer it didn't create.
+	sent := answer
+	sent.SDP = stream_registry.AddRepairSSRCs(answer.SDP)
+	c.publishAnswer(string(sessionId), sent)
 }
 
 func (c *MQTTSignaler) publishAnswer(sessionId string, answerSdp webrtc.SessionDescription) {
@@ -320,6 +450,11 @@ func (c *MQTTSignaler) publishAnswer(sessionId string, answerSdp webrtc.SessionD
 	c.Client.Publish(c.getTopicPrefix()+"sessions/"+sessionId+"/webrtc-answer", 1, false, answerSdp.SDP)
 }
 
+func (c *MQTTSignaler) publishRenegotiationOffer(sessionId string, offerSdp webrtc.SessionDescription) {
+	c.l.Debug().Msgf("Publishing renegotiation offer for session %v", sessionId)
+	c.Client.Publish(c.getTopicPrefix()+"sessions/"+sessionId+"/webrtc-renegotiation-offer", 1, false, offerSdp.SDP)
+}
+
 func (c *MQTTSignaler) publishICECandidate(sessionId string, candidate webrtc.ICECandidateInit) {
 	candidateBytes, err := json.Marshal(candidate)
 	if err != nil {
@@ -0,0 +1,69 @@
+// Package packet_pool recycles RTP packets and read buffers on the path from
+// capture to track, so that a steady stream of frames doesn't keep the garbage
+// collector busy.
+//
+// Ownership works like a hand-off: a packet from GetPacket belongs to whoever
+// holds it. Sending it on a source's packet channel hands it to the mixer,
+// which puts it back once it's been written to the track or dropped. Once a
+// packet has been handed on or put back, the previous owner must not touch it,
+// including its Payload. The same goes for buffers from GetBuffer.
+package packet_pool
+
+import (
+	"sync"
+
+	"github.com/pion/rtp"
+)
+
+// MaxPayloadSize is the payload capacity that pooled packets start with.
+// Larger payloads still work, they just grow the packet.
+const MaxPayloadSize = 1500
+
+// BufferSize is the size of the buffers handed out by GetBuffer. It's big
+// enough for any datagram an encoder sends us over the loopback interface.
+const BufferSize = 24000
+
+var packets = sync.Pool{
+	New: func() any {
+		return &rtp.Packet{Payload: make([]byte, 0, MaxPayloadSize)}
+	},
+}
+
+var buffers = sync.Pool{
+	New: func() any {
+		buf := make([]byte, BufferSize)
+		return &buf
+	},
+}
+
+// GetPacket returns an empty packet, with room for MaxPayloadSize bytes of payload
+func GetPacket() *rtp.Packet {
+	return packets.Get().(*rtp.Packet)
+}
+
+// PutPacket gives a packet back to the pool. Packets that didn't come from
+// GetPacket may be put back too.
+func PutPacket(p *rtp.Packet) {
+	payload := p.Payload[:0]
+	csrc := p.CSRC[:0]
+	*p = rtp.Packet{
+		Header:  rtp.Header{CSRC: csrc},
+		Payload: payload,
+	}
+	packets.Put(p)
+}
+
+// SetPayload copies data into the packet's own payload
+func SetPayload(p *rtp.Packet, data []byte) {
+	p.Payload = append(p.Payload[:0], data...)
+}
+
+// GetBuffer returns a buffer of BufferSize bytes
+func GetBuffer() *[]byte {
+	return buffers.Get().(*[]byte)
+}
+
+// PutBuffer gives a buffer from GetBuffer back to the pool
+func PutBuffer(buf *[]byte) {
+	buffers.Put(buf)
+}
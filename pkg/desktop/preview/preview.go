@@ -0,0 +1,147 @@
+// Package preview makes small JPEG previews of the screen every so often, with
+// a program that saves a screenshot, so that desktop pickers can show what's
+// on each desktop.
+package preview
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pod-arcade/pod-arcade/api"
+	"github.com/pod-arcade/pod-arcade/pkg/log"
+	"github.com/pod-arcade/pod-arcade/pkg/metrics"
+	"github.com/pod-arcade/pod-arcade/pkg/util"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+)
+
+// SnapshotConfigurator makes programs that save a JPEG of the screen to a file, and exit
+type SnapshotConfigurator interface {
+	GetName() string
+	// GetProgramRunnerSnapshot returns a program that saves a JPEG to file, at a quality from 1 to 100
+	GetProgramRunnerSnapshot(file *os.File, quality int) (*util.ProgramRunner, error)
+}
+
+const (
+	minQuality = 10
+	// maxAttempts is how many times a preview is retaken at lower quality to fit the size cap
+	maxAttempts = 4
+)
+
+var previewSize = metrics.GlobalMetricCache.GetGauge("preview_size_bytes", prometheus.Labels{})
+var previewQuality = metrics.GlobalMetricCache.GetGauge("preview_quality", prometheus.Labels{})
+
+type Config struct {
+	// Interval is how often a preview is made
+	Interval time.Duration
+	// MaxSize is the largest preview in bytes. Previews are retaken at lower quality until they fit.
+	MaxSize int
+	// Quality is the JPEG quality previews start at, from 1 to 100
+	Quality int
+}
+
+var _ api.PreviewSource = (*Preview)(nil)
+
+type Preview struct {
+	configurator SnapshotConfigurator
+	config       Config
+
+	// quality is lowered when previews are too big, and raised when they're well under the cap
+	quality int
+
+	handlers []api.PreviewHandler
+	mtx      sync.Mutex
+	l        zerolog.Logger
+}
+
+func NewPreview(configurator SnapshotConfigurator, config Config) *Preview {
+	return &Preview{
+		configurator: configurator,
+		config:       config,
+		quality:      config.Quality,
+		l:            log.NewLogger("Preview", map[string]string{"configurator": configurator.GetName()}),
+	}
+}
+
+func (p *Preview) GetName() string {
+	return "Preview from " + p.configurator.GetName()
+}
+
+func (p *Preview) OnPreview(h api.PreviewHandler) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.handlers = append(p.handlers, h)
+}
+
+func (p *Preview) Run(ctx context.Context) error {
+	ticker := time.NewTicker(p.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		image, err := p.Take(ctx)
+		if err != nil {
+			p.l.Warn().Err(err).Msg("Failed to make a preview")
+		} else {
+			p.mtx.Lock()
+			handlers := p.handlers
+			p.mtx.Unlock()
+			for _, h := range handlers {
+				h(image)
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// Take makes a preview that fits the size cap
+func (p *Preview) Take(ctx context.Context) ([]byte, error) {
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		image, err := p.snapshot(ctx, p.quality)
+		if err != nil {
+			return nil, err
+		}
+
+		if p.config.MaxSize > 0 && len(image) > p.config.MaxSize {
+			if p.quality == minQuality {
+				break
+			}
+			p.quality = max(p.quality*2/3, minQuality)
+			p.l.Debug().Msgf("Preview was %v bytes, retaking it at quality %v", len(image), p.quality)
+			continue
+		}
+		if p.config.MaxSize > 0 && len(image) < p.config.MaxSize/2 {
+			p.quality = min(p.quality+5, p.config.Quality)
+		}
+
+		previewSize.Set(float64(len(image)))
+		previewQuality.Set(float64(p.quality))
+		return image, nil
+	}
+	return nil, fmt.Errorf("preview doesn't fit in %v bytes", p.config.MaxSize)
+}
+
+func (p *Preview) snapshot(ctx context.Context, quality int) ([]byte, error) {
+	file, err := os.CreateTemp("", "preview-*.jpg")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	program, err := p.configurator.GetProgramRunnerSnapshot(file, quality)
+	if err != nil {
+		return nil, err
+	}
+	if err := program.RunOnce("Preview", ctx); err != nil {
+		return nil, err
+	}
+	return os.ReadFile(file.Name())
+}
@@ -0,0 +1,51 @@
+package preview_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/preview"
+	"github.com/pod-arcade/pod-arcade/pkg/util"
+)
+
+// fakeSnapshot writes 100 bytes per point of quality
+type fakeSnapshot struct {
+	qualities []int
+}
+
+func (f *fakeSnapshot) GetName() string {
+	return "fake"
+}
+
+func (f *fakeSnapshot) GetProgramRunnerSnapshot(file *os.File, quality int) (*util.ProgramRunner, error) {
+	f.qualities = append(f.qualities, quality)
+	return &util.ProgramRunner{
+		Program: "sh",
+		Args:    []string{"-c", fmt.Sprintf("head -c %v /dev/zero > %v", quality*100, file.Name())},
+	}, nil
+}
+
+func TestPreview_RetakesUntilItFits(t *testing.T) {
+	snapshot := &fakeSnapshot{}
+	p := preview.NewPreview(snapshot, preview.Config{Interval: time.Minute, MaxSize: 2000, Quality: 50})
+
+	image, err := p.Take(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(image) != 1400 {
+		t.Errorf("Expected a 1400 byte preview, got %v", len(image))
+	}
+	if fmt.Sprint(snapshot.qualities) != "[50 33 22 14]" {
+		t.Errorf("Expected the quality to drop until the preview fit, got %v", snapshot.qualities)
+	}
+
+	// 1400 bytes is more than half the cap, so the quality stays put
+	p.Take(context.Background())
+	if snapshot.qualities[4] != 14 {
+		t.Errorf("Expected the next preview to start at the quality that fit, got %v", snapshot.qualities[4])
+	}
+}
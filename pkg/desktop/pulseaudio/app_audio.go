@@ -0,0 +1,321 @@
+package pulseaudio
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jfreymuth/pulse"
+	"github.com/jfreymuth/pulse/proto"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"github.com/pkg/errors"
+	"github.com/pod-arcade/pod-arcade/api"
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/cmd_capture"
+	"github.com/pod-arcade/pod-arcade/pkg/log"
+	"github.com/rs/zerolog"
+)
+
+var _ api.AudioSource = (*AppAudio)(nil)
+var _ api.Controller = (*AppAudio)(nil)
+
+// volumeNorm is PulseAudio's 100% volume
+const volumeNorm = 0x10000
+
+// MaxAppVolume is the loudest an application can be turned up to, as a fraction of its own volume
+const MaxAppVolume = 1.5
+
+type AppAudioConfig struct {
+	// SinkName is the name of the null sink that streamed applications play into
+	SinkName string
+	// Apps are the applications whose audio is streamed, matched by their application
+	// name, their binary, or their process ID. Every application is streamed when it's empty.
+	Apps []string
+	// PollInterval is how often new streams of the applications are looked for
+	PollInterval time.Duration
+}
+
+// AppStream is a stream that an application is playing
+type AppStream struct {
+	Index  uint32 `json:"index"`
+	App    string `json:"app"`
+	Binary string `json:"binary"`
+	PID    int    `json:"pid"`
+	// Streamed is true when the stream is playing into the streamed sink
+	Streamed bool `json:"streamed"`
+	// Volume is the stream's volume, from 0 to MaxAppVolume
+	Volume float64 `json:"volume"`
+}
+
+type volumeCommand struct {
+	App    string  `json:"app"`
+	Volume float64 `json:"volume"`
+}
+
+// AppAudio streams the audio of selected applications, leaving notification sounds and
+// everything else out. It creates a null sink, moves the applications' streams onto it,
+// and records the sink's monitor. Each application's volume can be changed on its own.
+type AppAudio struct {
+	config AppAudioConfig
+	source api.AudioSource
+
+	// volumes are the volumes that were set for applications, by the name they were set with
+	volumes map[string]float64
+	// wake makes the running stream apply volumes straight away
+	wake chan struct{}
+	mtx  sync.Mutex
+
+	l zerolog.Logger
+}
+
+func NewAppAudio(config AppAudioConfig) *AppAudio {
+	if config.SinkName == "" {
+		config.SinkName = "pod-arcade"
+	}
+	if config.PollInterval <= 0 {
+		config.PollInterval = time.Second
+	}
+	capture := NewGSTPulseAudioCapture()
+	capture.Device = config.SinkName + ".monitor"
+
+	return &AppAudio{
+		config:  config,
+		source:  cmd_capture.NewCommandCaptureOgg(capture),
+		volumes: map[string]float64{},
+		wake:    make(chan struct{}, 1),
+		l:       log.NewLogger("app-audio", map[string]string{"Sink": config.SinkName}),
+	}
+}
+
+func (a *AppAudio) GetName() string {
+	return "audio"
+}
+
+func (a *AppAudio) GetAudioCodecParameters() webrtc.RTPCodecParameters {
+	return a.source.GetAudioCodecParameters()
+}
+
+// HandleCommand handles the list and volume commands
+func (a *AppAudio) HandleCommand(command string, payload []byte) (any, error) {
+	switch command {
+	case "list":
+		return a.List()
+	case "volume":
+		cmd := volumeCommand{}
+		if err := json.Unmarshal(payload, &cmd); err != nil {
+			return nil, err
+		}
+		return nil, a.SetVolume(cmd.App, cmd.Volume)
+	default:
+		return nil, fmt.Errorf("unknown command %q", command)
+	}
+}
+
+// SetVolume sets the volume of every stream of an application, from 0 to MaxAppVolume
+func (a *AppAudio) SetVolume(app string, volume float64) error {
+	if app == "" {
+		return errors.New("no app")
+	}
+	if volume < 0 || volume > MaxAppVolume || math.IsNaN(volume) {
+		return fmt.Errorf("volume must be from 0 to %v", MaxAppVolume)
+	}
+	a.mtx.Lock()
+	a.volumes[app] = volume
+	a.mtx.Unlock()
+
+	select {
+	case a.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// List returns every stream that an application is playing
+func (a *AppAudio) List() ([]AppStream, error) {
+	client, err := pulse.NewClient()
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to create Pulse Client")
+	}
+	defer client.Close()
+
+	sink, err := client.SinkByID(a.config.SinkName)
+	sinkIndex := uint32(proto.Undefined)
+	if err == nil {
+		sinkIndex = sink.SinkIndex()
+	}
+
+	inputs := proto.GetSinkInputInfoListReply{}
+	if err := client.RawRequest(&proto.GetSinkInputInfoList{}, &inputs); err != nil {
+		return nil, err
+	}
+	streams := []AppStream{}
+	for _, input := range inputs {
+		streams = append(streams, appStream(input, sinkIndex))
+	}
+	return streams, nil
+}
+
+// StreamAudio creates the sink, and records it while moving the applications' streams
+// onto it. The sink is removed afterwards, which moves the streams back.
+func (a *AppAudio) StreamAudio(ctx context.Context, pktChan chan<- *rtp.Packet) error {
+	client, err := pulse.NewClient(pulse.ClientApplicationName("Pod Arcade"))
+	if err != nil {
+		return errors.Wrap(err, "Failed to create Pulse Client")
+	}
+	defer client.Close()
+
+	sinkIndex, err := a.createSink(client)
+	if err != nil {
+		return err
+	}
+	defer a.removeSink(client)
+
+	ctx, cancel := context.WithCancel(ctx)
+	wg := sync.WaitGroup{}
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(a.config.PollInterval)
+		defer ticker.Stop()
+		for {
+			if err := a.moveStreams(client, sinkIndex); err != nil {
+				a.l.Warn().Err(err).Msg("Failed to move application streams")
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			case <-a.wake:
+			}
+		}
+	}()
+
+	return a.source.StreamAudio(ctx, pktChan)
+}
+
+// createSink loads a null sink, unless one was left behind, and returns its index
+func (a *AppAudio) createSink(client *pulse.Client) (uint32, error) {
+	if sink, err := client.SinkByID(a.config.SinkName); err == nil {
+		a.l.Info().Msg("Using the sink that's already there")
+		return sink.SinkIndex(), nil
+	}
+
+	reply := proto.LoadModuleReply{}
+	err := client.RawRequest(&proto.LoadModule{
+		Name: "module-null-sink",
+		Args: fmt.Sprintf("sink_name=%v sink_properties=device.description=Pod-Arcade-Stream", a.config.SinkName),
+	}, &reply)
+	if err != nil {
+		return 0, errors.Wrap(err, "Failed to create the null sink")
+	}
+	a.l.Info().Msgf("Created the null sink, module %v", reply.ModuleIndex)
+
+	sink, err := client.SinkByID(a.config.SinkName)
+	if err != nil {
+		return 0, errors.Wrap(err, "Failed to find the null sink")
+	}
+	return sink.SinkIndex(), nil
+}
+
+// removeSink unloads the null sink
+func (a *AppAudio) removeSink(client *pulse.Client) {
+	info := proto.GetSinkInfoReply{}
+	if err := client.RawRequest(&proto.GetSinkInfo{SinkIndex: proto.Undefined, SinkName: a.config.SinkName}, &info); err != nil {
+		a.l.Warn().Err(err).Msg("Failed to find the null sink to remove it")
+		return
+	}
+	if err := client.RawRequest(&proto.UnloadModule{ModuleIndex: info.ModuleIndex}, nil); err != nil {
+		a.l.Warn().Err(err).Msg("Failed to remove the null sink")
+	}
+}
+
+// moveStreams moves the applications' new streams onto the sink, and sets their volumes
+func (a *AppAudio) moveStreams(client *pulse.Client, sinkIndex uint32) error {
+	inputs := proto.GetSinkInputInfoListReply{}
+	if err := client.RawRequest(&proto.GetSinkInputInfoList{}, &inputs); err != nil {
+		return err
+	}
+
+	a.mtx.Lock()
+	volumes := make(map[string]float64, len(a.volumes))
+	for app, volume := range a.volumes {
+		volumes[app] = volume
+	}
+	a.mtx.Unlock()
+
+	for _, input := range inputs {
+		stream := appStream(input, sinkIndex)
+		if !a.streamed(stream) {
+			continue
+		}
+		if !stream.Streamed {
+			err := client.RawRequest(&proto.MoveSinkInput{SinkInputIndex: input.SinkInputIndex, DeviceIndex: sinkIndex}, nil)
+			if err != nil {
+				a.l.Warn().Err(err).Msgf("Failed to move stream %v of %v", stream.Index, stream.App)
+				continue
+			}
+			a.l.Info().Msgf("Moved stream %v of %v onto the sink", stream.Index, stream.App)
+		}
+
+		for app, volume := range volumes {
+			if !stream.matches(app) || !input.VolumeWritable || math.Abs(stream.Volume-volume) < 0.01 {
+				continue
+			}
+			channels := make(proto.ChannelVolumes, len(input.ChannelVolumes))
+			for i := range channels {
+				channels[i] = uint32(volume * volumeNorm)
+			}
+			err := client.RawRequest(&proto.SetSinkInputVolume{SinkInputIndex: input.SinkInputIndex, ChannelVolumes: channels}, nil)
+			if err != nil {
+				a.l.Warn().Err(err).Msgf("Failed to set the volume of %v", stream.App)
+			}
+		}
+	}
+	return nil
+}
+
+// streamed returns whether the stream belongs to one of the streamed applications
+func (a *AppAudio) streamed(stream AppStream) bool {
+	if len(a.config.Apps) == 0 {
+		return true
+	}
+	return slices.ContainsFunc(a.config.Apps, stream.matches)
+}
+
+// matches returns whether app names the stream's application, binary or process ID
+func (s AppStream) matches(app string) bool {
+	return strings.EqualFold(app, s.App) || strings.EqualFold(app, s.Binary) || app == strconv.Itoa(s.PID)
+}
+
+// appStream describes a sink input
+func appStream(input *proto.GetSinkInputInfoReply, sinkIndex uint32) AppStream {
+	stream := AppStream{
+		Index:    input.SinkInputIndex,
+		App:      property(input.Properties, "application.name"),
+		Binary:   property(input.Properties, "application.process.binary"),
+		Streamed: input.SinkIndex == sinkIndex,
+	}
+	stream.PID, _ = strconv.Atoi(property(input.Properties, "application.process.id"))
+	if len(input.ChannelVolumes) > 0 {
+		// The loudest channel, rounded to a percent
+		stream.Volume = math.Round(float64(slices.Max(input.ChannelVolumes))*100/volumeNorm) / 100
+	}
+	return stream
+}
+
+func property(props proto.PropList, key string) string {
+	if entry, ok := props[key]; ok {
+		return entry.String()
+	}
+	return ""
+}
@@ -0,0 +1,41 @@
+package pulseaudio
+
+import (
+	"testing"
+
+	"github.com/jfreymuth/pulse/proto"
+)
+
+func TestAppStream(t *testing.T) {
+	input := &proto.GetSinkInputInfoReply{
+		SinkInputIndex: 7,
+		SinkIndex:      3,
+		ChannelVolumes: proto.ChannelVolumes{volumeNorm / 2, volumeNorm / 4},
+		Properties: proto.PropList{
+			"application.name":           proto.PropListString("RetroArch"),
+			"application.process.binary": proto.PropListString("retroarch"),
+			"application.process.id":     proto.PropListString("1234"),
+		},
+	}
+	stream := appStream(input, 3)
+	if stream.App != "RetroArch" || stream.PID != 1234 || !stream.Streamed || stream.Volume != 0.5 {
+		t.Errorf("Unexpected stream %+v", stream)
+	}
+
+	a := NewAppAudio(AppAudioConfig{Apps: []string{"firefox", "retroarch"}})
+	if !a.streamed(stream) {
+		t.Error("Expected the binary name to match")
+	}
+	a.config.Apps = []string{"1234"}
+	if !a.streamed(stream) {
+		t.Error("Expected the process ID to match")
+	}
+	a.config.Apps = []string{"firefox"}
+	if a.streamed(stream) {
+		t.Error("Expected firefox not to match")
+	}
+
+	if err := a.SetVolume("retroarch", 2); err == nil {
+		t.Error("Expected an error turning the volume up past MaxAppVolume")
+	}
+}
@@ -14,6 +14,10 @@ import (
 var _ cmd_capture.CommandConfiguratorOgg = (*GSTPulseAudioCapture)(nil)
 
 type GSTPulseAudioCapture struct {
+	// Device is the PulseAudio source to record, like a sink's monitor. The default
+	// source is recorded when it's empty.
+	Device string
+
 	l zerolog.Logger
 }
 
@@ -32,8 +36,11 @@ func (c *GSTPulseAudioCapture) GetName() string {
 func (c *GSTPulseAudioCapture) GetProgramRunnerOgg(path *os.File) (*util.ProgramRunner, error) {
 	runner := &util.ProgramRunner{}
 	runner.Program = "gst-launch-1.0"
-	runner.Args = []string{
-		"pulsesrc",
+	runner.Args = []string{"pulsesrc"}
+	if c.Device != "" {
+		runner.Args = append(runner.Args, "device="+c.Device)
+	}
+	runner.Args = append(runner.Args,
 		"!",
 		"audioconvert",
 		"!",
@@ -53,8 +60,8 @@ func (c *GSTPulseAudioCapture) GetProgramRunnerOgg(path *os.File) (*util.Program
 		"!",
 		"filesink",
 		"buffer-mode=unbuffered",
-		"location=" + path.Name(),
-	}
+		"location="+path.Name(),
+	)
 
 	// Linux-specific: set Pdeathsig to ensure child termination
 	runner.SysProcAttr = syscall.SysProcAttr{
@@ -0,0 +1,121 @@
+package pulseaudio
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/jfreymuth/pulse"
+	"github.com/jfreymuth/pulse/proto"
+	"github.com/pkg/errors"
+	"github.com/pod-arcade/pod-arcade/api"
+	"github.com/pod-arcade/pod-arcade/pkg/log"
+	"github.com/rs/zerolog"
+)
+
+var _ api.AudioSink = (*MicrophoneSink)(nil)
+
+// MicrophoneSink gives each session a virtual PulseAudio microphone. Its audio plays
+// into a null sink, whose monitor is remapped into a source that applications can
+// pick like any other microphone.
+type MicrophoneSink struct {
+	l zerolog.Logger
+}
+
+func NewMicrophoneSink() *MicrophoneSink {
+	return &MicrophoneSink{
+		l: log.NewLogger("pulse-microphone", nil),
+	}
+}
+
+func (s *MicrophoneSink) GetName() string {
+	return "PulseAudio Microphone"
+}
+
+// OpenAudio creates the session's microphone, and plays to it until it's closed
+func (s *MicrophoneSink) OpenAudio(session api.SessionID) (io.WriteCloser, error) {
+	client, err := pulse.NewClient(pulse.ClientApplicationName("Pod Arcade"))
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to create Pulse Client")
+	}
+	mic := &pulseMicrophone{client: client, l: s.l.With().Str("Session", string(session)).Logger()}
+
+	// Module arguments are split on spaces, so the name has to do without them
+	name := "pod-arcade-mic-" + strings.Map(func(r rune) rune {
+		if r == ' ' || r == '"' || r == '\'' {
+			return '-'
+		}
+		return r
+	}, string(session))
+	if err := mic.loadModule("module-null-sink", fmt.Sprintf("sink_name=%v sink_properties=device.description=%v-sink", name, name)); err != nil {
+		mic.Close()
+		return nil, err
+	}
+	err = mic.loadModule("module-remap-source", fmt.Sprintf("master=%v.monitor source_name=%v source_properties=device.description=%v", name, name+"-source", name))
+	if err != nil {
+		mic.Close()
+		return nil, err
+	}
+	sink, err := client.SinkByID(name)
+	if err != nil {
+		mic.Close()
+		return nil, errors.Wrap(err, "Failed to find the microphone's sink")
+	}
+
+	mic.r, mic.w = io.Pipe()
+	mic.playback, err = client.NewPlayback(pulse.NewReader(mic.r, proto.FormatInt16LE),
+		pulse.PlaybackSink(sink),
+		pulse.PlaybackMono,
+		pulse.PlaybackSampleRate(api.MicrophoneSampleRate),
+		pulse.PlaybackLatency(0.05),
+		pulse.PlaybackMediaName("Microphone"))
+	if err != nil {
+		mic.Close()
+		return nil, errors.Wrap(err, "Failed to create Pulse Playback")
+	}
+	mic.playback.Start()
+	mic.l.Info().Msgf("Created microphone %v", name+"-source")
+
+	return mic, nil
+}
+
+// pulseMicrophone is a session's microphone, which is removed when it's closed
+type pulseMicrophone struct {
+	client   *pulse.Client
+	modules  []uint32
+	playback *pulse.PlaybackStream
+	r        *io.PipeReader
+	w        *io.PipeWriter
+
+	l zerolog.Logger
+}
+
+func (m *pulseMicrophone) loadModule(name string, args string) error {
+	reply := proto.LoadModuleReply{}
+	if err := m.client.RawRequest(&proto.LoadModule{Name: name, Args: args}, &reply); err != nil {
+		return errors.Wrapf(err, "Failed to load %v", name)
+	}
+	m.modules = append(m.modules, reply.ModuleIndex)
+	return nil
+}
+
+func (m *pulseMicrophone) Write(p []byte) (int, error) {
+	return m.w.Write(p)
+}
+
+func (m *pulseMicrophone) Close() error {
+	if m.w != nil {
+		m.w.Close()
+	}
+	if m.playback != nil {
+		m.playback.Close()
+	}
+	// The remapped source goes first, since it depends on the sink
+	for i := len(m.modules) - 1; i >= 0; i-- {
+		if err := m.client.RawRequest(&proto.UnloadModule{ModuleIndex: m.modules[i]}, nil); err != nil {
+			m.l.Warn().Err(err).Msgf("Failed to unload module %v", m.modules[i])
+		}
+	}
+	m.client.Close()
+	return nil
+}
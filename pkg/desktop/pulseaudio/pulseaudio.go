@@ -2,6 +2,7 @@ package pulseaudio
 
 import (
 	"context"
+	"time"
 
 	"github.com/jfreymuth/pulse"
 	"github.com/pion/rtp"
@@ -9,6 +10,7 @@ import (
 	"github.com/pion/webrtc/v4"
 	"github.com/pkg/errors"
 	"github.com/pod-arcade/pod-arcade/api"
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/media_clock"
 	"github.com/pod-arcade/pod-arcade/pkg/log"
 	"github.com/rs/zerolog"
 	"github.com/zaf/g711"
@@ -19,8 +21,11 @@ var _ api.AudioSource = (*PulseAudioCaptureSource)(nil)
 const AUDIO_BUFFER_SIZE = 200
 const AUDIO_SAMPLE_RATE = 8000
 const RTP_OUTBOUND_MTU = 8000
+const AUDIO_MAX_DRIFT = 80 * time.Millisecond
 
 type PulseAudioCaptureSource struct {
+	// source is the PulseAudio source that's recorded, or the default source if it's empty
+	source           string
 	sampleChan       chan []byte
 	audioFrame       []byte
 	audioFrameOffset int
@@ -30,19 +35,28 @@ type PulseAudioCaptureSource struct {
 }
 
 func NewPulseAudioCapture() *PulseAudioCaptureSource {
+	return NewPulseAudioSourceCapture("")
+}
+
+// NewPulseAudioSourceCapture records a PulseAudio source by name, like the monitor of a sink
+func NewPulseAudioSourceCapture(source string) *PulseAudioCaptureSource {
 	packetizer := rtp.NewPacketizer(RTP_OUTBOUND_MTU, 0, 0, &codecs.G711Payloader{},
 		rtp.NewRandomSequencer(), AUDIO_SAMPLE_RATE)
 
 	return &PulseAudioCaptureSource{
+		source:           source,
 		audioFrame:       make([]byte, AUDIO_BUFFER_SIZE),
 		sampleChan:       make(chan []byte),
 		audioFrameOffset: 0,
 		packetizer:       packetizer,
-		l:                log.NewLogger("pulse-audio-capture", nil),
+		l:                log.NewLogger("pulse-audio-capture", map[string]string{"source": source}),
 	}
 }
 
 func (c *PulseAudioCaptureSource) GetName() string {
+	if c.source != "" {
+		return "Pulse Audio Capture " + c.source
+	}
 	return "Pulse Audio Capture"
 }
 
@@ -73,7 +87,15 @@ func (c *PulseAudioCaptureSource) StreamAudio(ctx context.Context, pktChan chan<
 
 	c.l.Info().Msg("Created Pulse Client")
 
-	stream, err := client.NewRecord(pulse.Int16Writer(c.EncodeSamples), pulse.RecordSampleRate(AUDIO_SAMPLE_RATE))
+	opts := []pulse.RecordOption{pulse.RecordSampleRate(AUDIO_SAMPLE_RATE)}
+	if c.source != "" {
+		source, err := client.SourceByID(c.source)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to find Pulse source %v", c.source)
+		}
+		opts = append(opts, pulse.RecordSource(source))
+	}
+	stream, err := client.NewRecord(pulse.Int16Writer(c.EncodeSamples), opts...)
 	if err != nil {
 		return errors.Wrap(err, "Failed to create Pulse Recorder")
 	}
@@ -82,6 +104,11 @@ func (c *PulseAudioCaptureSource) StreamAudio(ctx context.Context, pktChan chan<
 
 	stream.Start()
 	c.l.Debug().Msg("Started Pulse Recorder")
+
+	// Count samples from the recorder, anchored to the shared clock so that the
+	// sender reports can line us up with the video.
+	timeline := media_clock.NewTimeline(media_clock.Default, AUDIO_SAMPLE_RATE, AUDIO_MAX_DRIFT)
+	var position int64
 	for {
 		select {
 		case <-ctx.Done():
@@ -93,17 +120,22 @@ func (c *PulseAudioCaptureSource) StreamAudio(ctx context.Context, pktChan chan<
 				c.l.Warn().Msgf("Audio Backpressure is getting high — %v recorder frames", len(c.sampleChan))
 			}
 
-			// The TrackLocalStatic does some weird math to calculate the number of samples
-			// that I don't think we need to do since our sample rate matches our clock rate.
-			rtpPackets := c.packetizer.Packetize(frame, uint32(len(frame)))
+			// Each byte is one sample, and the frame was complete when we received it
+			frameDuration := time.Duration(len(frame)) * time.Second / AUDIO_SAMPLE_RATE
+			timestamp := timeline.Timestamp(position, time.Now().Add(-frameDuration))
+			position += int64(len(frame))
+
+			rtpPackets := c.packetizer.Packetize(frame, 0)
 			// c.l.Trace().Msgf("Repacked frame into %v packets", len(rtpPackets))
 
 			for _, pkt := range rtpPackets {
+				pkt.Timestamp = timestamp
 				select {
 				case pktChan <- pkt:
 					// c.l.Trace().Msgf("Sent frame with size %v", len(pkt.Payload))
-				default:
-					c.l.Warn().Msgf("Ignoring frame of size %v", len(pkt.Payload))
+				case <-ctx.Done():
+					stream.Stop()
+					return nil
 				}
 			}
 		}
@@ -111,5 +143,5 @@ func (c *PulseAudioCaptureSource) StreamAudio(ctx context.Context, pktChan chan<
 }
 
 func (c *PulseAudioCaptureSource) GetAudioCodecParameters() webrtc.RTPCodecParameters {
-	return webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMU}, PayloadType: 0}
+	return webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMU, ClockRate: AUDIO_SAMPLE_RATE}, PayloadType: 0}
 }
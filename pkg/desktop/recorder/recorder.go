@@ -0,0 +1,294 @@
+// Package recorder records what the desktop streams to Matroska files, for
+// tournaments and bug reports. It's controlled with commands, which signalers
+// pass on from clients.
+package recorder
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pod-arcade/pod-arcade/api"
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/depacketizer"
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/mkv"
+	"github.com/pod-arcade/pod-arcade/pkg/log"
+	"github.com/pod-arcade/pod-arcade/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+)
+
+// fileExtension is the extension of every recording, which retention looks for
+const fileExtension = ".mkv"
+
+var (
+	ErrAlreadyRecording = errors.New("already recording")
+	ErrNotRecording     = errors.New("not recording")
+	ErrUnknownCommand   = errors.New("unknown command")
+)
+
+// unsafeNameCharacters are replaced in recording names, so they can't escape the output directory
+var unsafeNameCharacters = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+var recordingActive = metrics.GlobalMetricCache.GetGauge("recording_active", prometheus.Labels{})
+var recordingSize = metrics.GlobalMetricCache.GetGauge("recording_size_bytes", prometheus.Labels{})
+
+type Config struct {
+	// Dir is where recordings are written
+	Dir string
+	// MaxSize stops a recording once it's this many bytes. 0 doesn't limit recordings.
+	MaxSize int64
+	// Retention is how long recordings are kept. 0 keeps them forever.
+	Retention time.Duration
+}
+
+// RecordingInfo describes a recording file
+type RecordingInfo struct {
+	File      string    `json:"file"`
+	Size      int64     `json:"size"`
+	Modified  time.Time `json:"modified"`
+	Recording bool      `json:"recording"`
+}
+
+// startCommand is the optional payload of the start command
+type startCommand struct {
+	// Name is put at the start of the file name
+	Name string `json:"name"`
+}
+
+var _ api.Controller = (*Recorder)(nil)
+
+// Recorder records the mixer's H.264 video, with its Opus or PCMU audio, one recording at a time
+type Recorder struct {
+	mixer  api.Mixer
+	config Config
+
+	active *recording
+	mtx    sync.Mutex
+	l      zerolog.Logger
+}
+
+func NewRecorder(mixer api.Mixer, config Config) *Recorder {
+	return &Recorder{
+		mixer:  mixer,
+		config: config,
+		l:      log.NewLogger("Recorder", map[string]string{"dir": config.Dir}),
+	}
+}
+
+func (r *Recorder) GetName() string {
+	return "recorder"
+}
+
+// HandleCommand handles the start, stop and list commands
+func (r *Recorder) HandleCommand(command string, payload []byte) (any, error) {
+	switch command {
+	case "start":
+		cmd := startCommand{}
+		if len(payload) > 0 {
+			if err := json.Unmarshal(payload, &cmd); err != nil {
+				return nil, err
+			}
+		}
+		return r.Start(cmd.Name)
+	case "stop":
+		return r.Stop()
+	case "list":
+		return r.List()
+	default:
+		return nil, fmt.Errorf("%w %q", ErrUnknownCommand, command)
+	}
+}
+
+// Start starts recording to a new file in the output directory
+func (r *Recorder) Start(name string) (RecordingInfo, error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if r.active != nil {
+		return RecordingInfo{}, ErrAlreadyRecording
+	}
+	r.cleanup()
+
+	if err := os.MkdirAll(r.config.Dir, 0o755); err != nil {
+		return RecordingInfo{}, err
+	}
+	name = unsafeNameCharacters.ReplaceAllString(name, "_")
+	if name == "" {
+		name = "recording"
+	}
+	started := time.Now()
+	path := filepath.Join(r.config.Dir, name+"-"+started.Format("20060102-150405")+fileExtension)
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		return RecordingInfo{}, err
+	}
+
+	// The sources keep running for as long as we're recording, even without sessions
+	video, err := r.mixer.StartVideoTrack("", "video/h264")
+	if err != nil {
+		file.Close()
+		os.Remove(path)
+		return RecordingInfo{}, err
+	}
+	var audio api.Track
+	for _, t := range r.mixer.GetAudioTracks() {
+		codec := t.Codec()
+		if _, ok := mkv.AudioTrack(codec.MimeType, codec.ClockRate, codec.Channels); ok {
+			audio = t
+			r.mixer.AcquireTrack(audio)
+			break
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	rec := &recording{
+		path:      path,
+		file:      file,
+		started:   started,
+		maxSize:   r.config.MaxSize,
+		video:     video,
+		audio:     audio,
+		videoPkts: video.Subscribe(api.VideoSubscriptionSize),
+		h264:      depacketizer.NewH264(),
+		cancel:    cancel,
+		done:      make(chan struct{}),
+		l:         r.l.With().Str("file", path).Logger(),
+	}
+	rec.h264.KeyframeNeeded = video.RequestKeyframe
+	if audio != nil {
+		rec.audioPkts = audio.Subscribe(api.AudioSubscriptionSize)
+	}
+	r.active = rec
+	recordingActive.Set(1)
+
+	go func() {
+		rec.run(ctx)
+		r.finished(rec)
+	}()
+	// Start as soon as possible, rather than at the encoder's next keyframe
+	video.RequestKeyframe()
+
+	r.l.Info().Msgf("Started recording to %v", path)
+	return rec.info(), nil
+}
+
+// Stop stops the current recording
+func (r *Recorder) Stop() (RecordingInfo, error) {
+	r.mtx.Lock()
+	rec := r.active
+	r.active = nil
+	r.mtx.Unlock()
+
+	if rec == nil {
+		return RecordingInfo{}, ErrNotRecording
+	}
+	rec.stop()
+	r.l.Info().Msgf("Stopped recording to %v", rec.path)
+
+	info := rec.info()
+	info.Recording = false
+	return info, nil
+}
+
+// finished is called when a recording stops, whether it was asked to or not
+func (r *Recorder) finished(rec *recording) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if r.active == rec {
+		r.active = nil
+	}
+	if r.active == nil {
+		recordingActive.Set(0)
+	}
+	r.mixer.ReleaseTrack(rec.video)
+	if rec.audio != nil {
+		r.mixer.ReleaseTrack(rec.audio)
+	}
+	recordingSize.Set(float64(rec.size.Load()))
+
+	if rec.size.Load() == 0 {
+		// Nothing was written before it stopped, so there's nothing to keep
+		os.Remove(rec.path)
+	}
+}
+
+// List returns the recordings in the output directory, newest first
+func (r *Recorder) List() ([]RecordingInfo, error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.cleanup()
+
+	entries, err := os.ReadDir(r.config.Dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return []RecordingInfo{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	recordings := []RecordingInfo{}
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), fileExtension) {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil {
+			continue
+		}
+		path := filepath.Join(r.config.Dir, e.Name())
+		recordings = append(recordings, RecordingInfo{
+			File:      path,
+			Size:      fi.Size(),
+			Modified:  fi.ModTime(),
+			Recording: r.active != nil && r.active.path == path,
+		})
+	}
+	sort.Slice(recordings, func(i, j int) bool {
+		return recordings[i].Modified.After(recordings[j].Modified)
+	})
+	return recordings, nil
+}
+
+// cleanup deletes recordings older than the retention period. r.mtx must be held.
+func (r *Recorder) cleanup() {
+	if r.config.Retention <= 0 {
+		return
+	}
+	entries, err := os.ReadDir(r.config.Dir)
+	if err != nil {
+		return
+	}
+	cutoff := time.Now().Add(-r.config.Retention)
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), fileExtension) {
+			continue
+		}
+		path := filepath.Join(r.config.Dir, e.Name())
+		fi, err := e.Info()
+		if err != nil || fi.ModTime().After(cutoff) || (r.active != nil && r.active.path == path) {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			r.l.Warn().Err(err).Msgf("Failed to delete old recording %v", path)
+			continue
+		}
+		r.l.Info().Msgf("Deleted recording %v, which is older than %v", path, r.config.Retention)
+	}
+}
+
+func (rec *recording) info() RecordingInfo {
+	return RecordingInfo{
+		File:      rec.path,
+		Size:      rec.size.Load(),
+		Modified:  time.Now(),
+		Recording: true,
+	}
+}
@@ -0,0 +1,186 @@
+package recorder
+
+import (
+	"context"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pod-arcade/pod-arcade/api"
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/depacketizer"
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/media_clock"
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/mkv"
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/packet_pool"
+	"github.com/rs/zerolog"
+)
+
+const (
+	videoTrackIndex = 0
+	audioTrackIndex = 1
+)
+
+// recording writes a video track, and optionally an audio track, to one file
+type recording struct {
+	path    string
+	file    *os.File
+	started time.Time
+	maxSize int64
+
+	video      api.Track
+	audio      api.Track
+	videoPkts  api.TrackSubscription
+	audioPkts  api.TrackSubscription
+	h264       *depacketizer.H264
+	writer     *mkv.Writer
+	firstFrame time.Time
+	buf        []byte
+
+	size   atomic.Int64
+	cancel context.CancelFunc
+	done   chan struct{}
+	l      zerolog.Logger
+}
+
+// run writes packets to the file until the recording is stopped or full
+func (r *recording) run(ctx context.Context) {
+	defer close(r.done)
+	defer r.file.Close()
+	defer r.closeSubscriptions()
+
+	var audioPkts <-chan *rtp.Packet
+	if r.audioPkts != nil {
+		audioPkts = r.audioPkts.Packets()
+	}
+
+	for {
+		select {
+		case p, ok := <-r.videoPkts.Packets():
+			if !ok {
+				r.l.Warn().Msg("Video track went away, stopping the recording")
+				r.finish()
+				return
+			}
+			err := r.writeVideo(p)
+			packet_pool.PutPacket(p)
+			if err != nil {
+				r.l.Error().Err(err).Msg("Failed to write video, stopping the recording")
+				r.finish()
+				return
+			}
+		case p, ok := <-audioPkts:
+			if !ok {
+				audioPkts = nil
+				continue
+			}
+			err := r.writeAudio(p)
+			packet_pool.PutPacket(p)
+			if err != nil {
+				r.l.Error().Err(err).Msg("Failed to write audio, stopping the recording")
+				r.finish()
+				return
+			}
+		case <-ctx.Done():
+			r.finish()
+			return
+		}
+
+		if r.maxSize > 0 && r.size.Load() >= r.maxSize {
+			r.l.Warn().Msgf("Recording reached its maximum size of %v bytes", r.maxSize)
+			r.finish()
+			return
+		}
+	}
+}
+
+// timeOf returns how far into the recording a packet's timestamp is
+func (r *recording) timeOf(timestamp uint32, clockRate uint32) time.Duration {
+	return media_clock.Default.Time(timestamp, clockRate, time.Now()).Sub(r.firstFrame)
+}
+
+func (r *recording) writeVideo(p *rtp.Packet) error {
+	au := r.h264.Push(p)
+	if au == nil {
+		return nil
+	}
+
+	clockRate := r.video.Codec().ClockRate
+	if r.writer == nil {
+		// The file starts at the first keyframe, which the depacketizer waits for
+		if err := r.start(au); err != nil {
+			return err
+		}
+		r.firstFrame = media_clock.Default.Time(au.Timestamp, clockRate, time.Now())
+	}
+
+	r.buf = au.AppendAVCC(r.buf[:0])
+	err := r.writer.WriteFrame(videoTrackIndex, r.timeOf(au.Timestamp, clockRate), au.Keyframe, r.buf)
+	r.size.Store(r.writer.Size())
+	return err
+}
+
+func (r *recording) writeAudio(p *rtp.Packet) error {
+	if r.writer == nil || len(p.Payload) == 0 {
+		// Audio waits for the first video keyframe
+		return nil
+	}
+	t := r.timeOf(p.Timestamp, r.audio.Codec().ClockRate)
+	if t < 0 {
+		return nil
+	}
+	err := r.writer.WriteFrame(audioTrackIndex, t, true, p.Payload)
+	r.size.Store(r.writer.Size())
+	return err
+}
+
+// start writes the file header, which needs the resolution from the first keyframe
+func (r *recording) start(au *depacketizer.AccessUnit) error {
+	width, height, err := depacketizer.SPSResolution(au.SPS)
+	if err != nil {
+		return err
+	}
+	tracks := []mkv.Track{{
+		Type:         mkv.TrackTypeVideo,
+		CodecID:      mkv.CodecIDH264,
+		CodecPrivate: depacketizer.AVCDecoderConfig(au.SPS, au.PPS),
+		Width:        width,
+		Height:       height,
+	}}
+	if r.audio != nil {
+		codec := r.audio.Codec()
+		track, _ := mkv.AudioTrack(codec.MimeType, codec.ClockRate, codec.Channels)
+		tracks = append(tracks, track)
+	}
+
+	r.writer, err = mkv.NewWriter(r.file, tracks)
+	if err != nil {
+		return err
+	}
+	r.l.Info().Msgf("Recording %vx%v video to %v", width, height, r.path)
+	return nil
+}
+
+// finish writes out the last cluster
+func (r *recording) finish() {
+	if r.writer == nil {
+		return
+	}
+	if err := r.writer.Close(); err != nil {
+		r.l.Error().Err(err).Msg("Failed to finish the recording")
+	}
+	r.size.Store(r.writer.Size())
+}
+
+// closeSubscriptions stops the subscriptions
+func (r *recording) closeSubscriptions() {
+	for _, s := range []api.TrackSubscription{r.videoPkts, r.audioPkts} {
+		if s != nil {
+			s.Close()
+		}
+	}
+}
+
+func (r *recording) stop() {
+	r.cancel()
+	<-r.done
+}
@@ -0,0 +1,104 @@
+package replay
+
+import (
+	"sync"
+	"time"
+)
+
+// frame is an encoded video frame or audio packet
+type frame struct {
+	audio    bool
+	time     time.Time
+	keyframe bool
+	data     []byte
+}
+
+// gop is a keyframe and everything that arrived until the next one
+type gop struct {
+	start    time.Time
+	sps, pps []byte
+	frames   []*frame
+	size     int
+}
+
+// Buffer holds the most recent window of video and audio. It's trimmed a whole
+// GOP at a time, so it always starts at a keyframe and covers at least the
+// window once it's been running that long.
+type Buffer struct {
+	window time.Duration
+
+	gops []*gop
+	size int
+	mtx  sync.Mutex
+}
+
+func NewBuffer(window time.Duration) *Buffer {
+	return &Buffer{window: window}
+}
+
+// PushVideo adds a video frame in AVCC format. Keyframes start a new GOP, and
+// must come with their SPS and PPS.
+func (b *Buffer) PushVideo(t time.Time, keyframe bool, data []byte, sps []byte, pps []byte) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	if keyframe {
+		b.gops = append(b.gops, &gop{start: t, sps: sps, pps: pps})
+		b.trim(t)
+	}
+	b.push(&frame{time: t, keyframe: keyframe, data: data})
+}
+
+// PushAudio adds an audio packet. It's dropped if there's no video to go with it yet.
+func (b *Buffer) PushAudio(t time.Time, data []byte) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.push(&frame{audio: true, time: t, data: data})
+}
+
+func (b *Buffer) push(f *frame) {
+	if len(b.gops) == 0 {
+		return
+	}
+	g := b.gops[len(b.gops)-1]
+	g.frames = append(g.frames, f)
+	g.size += len(f.data)
+	b.size += len(f.data)
+}
+
+// trim drops the oldest GOPs for as long as the next one still reaches back to the window
+func (b *Buffer) trim(now time.Time) {
+	cutoff := now.Add(-b.window)
+	for len(b.gops) > 1 && !b.gops[1].start.After(cutoff) {
+		b.size -= b.gops[0].size
+		b.gops[0] = nil
+		b.gops = b.gops[1:]
+	}
+}
+
+// Size returns how many bytes of media are buffered
+func (b *Buffer) Size() int {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.size
+}
+
+// snapshot returns the GOPs that make up the last window up to now. The frames
+// are shared with the buffer, and mustn't be modified.
+func (b *Buffer) snapshot(now time.Time) []gop {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	cutoff := now.Add(-b.window)
+	gops := []gop{}
+	for i, g := range b.gops {
+		if i+1 < len(b.gops) && !b.gops[i+1].start.After(cutoff) {
+			// The next GOP covers the window on its own
+			continue
+		}
+		c := *g
+		c.frames = g.frames[:len(g.frames):len(g.frames)]
+		gops = append(gops, c)
+	}
+	return gops
+}
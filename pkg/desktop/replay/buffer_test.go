@@ -0,0 +1,62 @@
+package replay
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pod-arcade/pod-arcade/api"
+)
+
+func TestBuffer_TrimsWholeGOPs(t *testing.T) {
+	b := NewBuffer(10 * time.Second)
+	start := time.Now()
+
+	// A keyframe every 4 seconds, with a frame and some audio between them
+	for i := 0; i < 6; i++ {
+		t0 := start.Add(time.Duration(i) * 4 * time.Second)
+		b.PushVideo(t0, true, []byte{byte(i)}, []byte{0x67}, []byte{0x68})
+		b.PushAudio(t0.Add(time.Second), []byte{byte(i)})
+		b.PushVideo(t0.Add(2*time.Second), false, []byte{byte(i)}, nil, nil)
+	}
+
+	// At 21s the window reaches back to 11s, and the GOP that starts at 8s is
+	// the latest one that covers it.
+	gops := b.snapshot(start.Add(21 * time.Second))
+	if len(gops) != 4 {
+		t.Fatalf("Expected 4 GOPs, got %v", len(gops))
+	}
+	if !gops[0].start.Equal(start.Add(8 * time.Second)) {
+		t.Errorf("Expected the clip to start at the keyframe at 8s, got %v", gops[0].start.Sub(start))
+	}
+	if len(gops[0].frames) != 3 || !gops[0].frames[0].keyframe || !gops[0].frames[1].audio {
+		t.Errorf("Expected a keyframe, audio and a frame in the GOP, got %v", gops[0].frames)
+	}
+	if b.Size() != 4*3 {
+		t.Errorf("Expected older GOPs to be dropped, but %v bytes are buffered", b.Size())
+	}
+}
+
+func TestBuffer_DropsAudioBeforeVideo(t *testing.T) {
+	b := NewBuffer(time.Second)
+	b.PushAudio(time.Now(), []byte{1})
+	if b.Size() != 0 {
+		t.Errorf("Expected audio to wait for a keyframe")
+	}
+}
+
+func TestChord_PressedOnce(t *testing.T) {
+	chord, err := ParseChord("Select+Home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseChord("select+turbo"); err == nil {
+		t.Errorf("Expected an unknown button to fail")
+	}
+
+	if chord.Pressed(api.GamepadInput{Select: true}) {
+		t.Errorf("Expected the chord to need every button")
+	}
+	if !chord.Pressed(api.GamepadInput{Select: true, Home: true, South: true}) {
+		t.Errorf("Expected the chord to be pressed")
+	}
+}
@@ -0,0 +1,83 @@
+package replay
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/pod-arcade/pod-arcade/api"
+)
+
+// buttons are the gamepad buttons that chords can be made from, by name
+var buttons = map[string]func(api.GamepadInput) bool{
+	"north":     func(i api.GamepadInput) bool { return i.North },
+	"south":     func(i api.GamepadInput) bool { return i.South },
+	"west":      func(i api.GamepadInput) bool { return i.West },
+	"east":      func(i api.GamepadInput) bool { return i.East },
+	"l1":        func(i api.GamepadInput) bool { return i.L1 },
+	"r1":        func(i api.GamepadInput) bool { return i.R1 },
+	"l2":        func(i api.GamepadInput) bool { return i.L2 },
+	"r2":        func(i api.GamepadInput) bool { return i.R2 },
+	"lz":        func(i api.GamepadInput) bool { return i.LZ },
+	"rz":        func(i api.GamepadInput) bool { return i.RZ },
+	"select":    func(i api.GamepadInput) bool { return i.Select },
+	"start":     func(i api.GamepadInput) bool { return i.Start },
+	"dpadup":    func(i api.GamepadInput) bool { return i.DPadUp },
+	"dpaddown":  func(i api.GamepadInput) bool { return i.DPadDown },
+	"dpadleft":  func(i api.GamepadInput) bool { return i.DPadLeft },
+	"dpadright": func(i api.GamepadInput) bool { return i.DPadRight },
+	"home":      func(i api.GamepadInput) bool { return i.Home },
+	"capture":   func(i api.GamepadInput) bool { return i.Capture },
+}
+
+// Chord is a set of gamepad buttons that are pressed together
+type Chord []func(api.GamepadInput) bool
+
+// ParseChord parses button names joined by +, like "select+home"
+func ParseChord(s string) (Chord, error) {
+	chord := Chord{}
+	for _, name := range strings.Split(s, "+") {
+		button, ok := buttons[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			return nil, fmt.Errorf("unknown gamepad button %q", name)
+		}
+		chord = append(chord, button)
+	}
+	return chord, nil
+}
+
+// Pressed returns whether every button of the chord is pressed
+func (c Chord) Pressed(input api.GamepadInput) bool {
+	for _, button := range c {
+		if !button(input) {
+			return false
+		}
+	}
+	return len(c) > 0
+}
+
+// chordGamepad calls a function whenever its chord is pressed
+type chordGamepad struct {
+	api.Gamepad
+	chord   Chord
+	fn      func()
+	pressed atomic.Bool
+}
+
+// WithChord wraps a gamepad, calling fn each time the chord is pressed. The
+// buttons still reach the gamepad, so a chord should be one that games ignore.
+func WithChord(g api.Gamepad, chord Chord, fn func()) api.Gamepad {
+	return &chordGamepad{
+		Gamepad: g,
+		chord:   chord,
+		fn:      fn,
+	}
+}
+
+func (g *chordGamepad) SetGamepadInputState(input api.GamepadInput) error {
+	pressed := g.chord.Pressed(input)
+	if wasPressed := g.pressed.Swap(pressed); pressed && !wasPressed {
+		go g.fn()
+	}
+	return g.Gamepad.SetGamepadInputState(input)
+}
@@ -0,0 +1,109 @@
+package replay
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/depacketizer"
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/mkv"
+)
+
+var ErrNothingBuffered = errors.New("nothing has been buffered yet")
+
+const (
+	videoTrackIndex = 0
+	audioTrackIndex = 1
+)
+
+// ClipInfo describes a saved clip
+type ClipInfo struct {
+	File  string    `json:"file"`
+	Size  int64     `json:"size"`
+	Start time.Time `json:"start"`
+	// Duration is in seconds
+	Duration float64 `json:"duration"`
+	Width    int     `json:"width"`
+	Height   int     `json:"height"`
+	Audio    bool    `json:"audio"`
+	// Trigger is what saved the clip, either command or gamepad
+	Trigger string `json:"trigger"`
+}
+
+// writeClip writes the GOPs to a new file. Only the GOPs since the last change
+// of SPS are kept, since a file can only have one resolution.
+func writeClip(path string, gops []gop, audio *mkv.Track) (info ClipInfo, err error) {
+	for i := len(gops) - 1; i > 0; i-- {
+		if !bytes.Equal(gops[i-1].sps, gops[i].sps) || !bytes.Equal(gops[i-1].pps, gops[i].pps) {
+			gops = gops[i:]
+			break
+		}
+	}
+	if len(gops) == 0 {
+		return ClipInfo{}, ErrNothingBuffered
+	}
+
+	width, height, err := depacketizer.SPSResolution(gops[0].sps)
+	if err != nil {
+		return ClipInfo{}, err
+	}
+	tracks := []mkv.Track{{
+		Type:         mkv.TrackTypeVideo,
+		CodecID:      mkv.CodecIDH264,
+		CodecPrivate: depacketizer.AVCDecoderConfig(gops[0].sps, gops[0].pps),
+		Width:        width,
+		Height:       height,
+	}}
+	if audio != nil {
+		tracks = append(tracks, *audio)
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		return ClipInfo{}, err
+	}
+	defer func() {
+		file.Close()
+		if err != nil {
+			os.Remove(path)
+		}
+	}()
+
+	w, err := mkv.NewWriter(file, tracks)
+	if err != nil {
+		return ClipInfo{}, err
+	}
+	start := gops[0].start
+	end := start
+	for _, g := range gops {
+		for _, f := range g.frames {
+			track := videoTrackIndex
+			if f.audio {
+				if audio == nil || f.time.Before(start) {
+					continue
+				}
+				track = audioTrackIndex
+			}
+			if err := w.WriteFrame(track, f.time.Sub(start), f.keyframe || f.audio, f.data); err != nil {
+				return ClipInfo{}, err
+			}
+			if f.time.After(end) {
+				end = f.time
+			}
+		}
+	}
+	if err := w.Close(); err != nil {
+		return ClipInfo{}, err
+	}
+
+	return ClipInfo{
+		File:     path,
+		Size:     w.Size(),
+		Start:    start,
+		Duration: end.Sub(start).Seconds(),
+		Width:    width,
+		Height:   height,
+		Audio:    audio != nil,
+	}, nil
+}
@@ -0,0 +1,184 @@
+// Package replay keeps the last few seconds of what the desktop streams, so that
+// they can be saved as a clip after something worth keeping happens.
+package replay
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pod-arcade/pod-arcade/api"
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/depacketizer"
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/media_clock"
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/mkv"
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/packet_pool"
+	"github.com/pod-arcade/pod-arcade/pkg/log"
+	"github.com/pod-arcade/pod-arcade/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+)
+
+var bufferSize = metrics.GlobalMetricCache.GetGauge("replay_buffer_bytes", prometheus.Labels{})
+var clipsSaved = metrics.GlobalMetricCache.GetCounter("replay_clips_saved", prometheus.Labels{})
+
+type Config struct {
+	// Dir is where clips are written
+	Dir string
+	// Window is how much of the stream a clip covers
+	Window time.Duration
+}
+
+var _ api.EventController = (*Replay)(nil)
+
+// Replay buffers the mixer's H.264 video, with its Opus or PCMU audio, and
+// saves the buffer to a clip on demand. The video source is kept running the
+// whole time, since there's nothing to save otherwise.
+type Replay struct {
+	mixer  api.Mixer
+	config Config
+	buffer *Buffer
+
+	audio    *mkv.Track
+	handlers []api.ControllerEventHandler
+	mtx      sync.Mutex
+	saveMtx  sync.Mutex
+	l        zerolog.Logger
+}
+
+func NewReplay(mixer api.Mixer, config Config) *Replay {
+	return &Replay{
+		mixer:  mixer,
+		config: config,
+		buffer: NewBuffer(config.Window),
+		l:      log.NewLogger("Replay", map[string]string{"dir": config.Dir}),
+	}
+}
+
+func (r *Replay) GetName() string {
+	return "replay"
+}
+
+// HandleCommand handles the save command
+func (r *Replay) HandleCommand(command string, payload []byte) (any, error) {
+	switch command {
+	case "save":
+		return r.Save("command")
+	default:
+		return nil, fmt.Errorf("unknown command %q", command)
+	}
+}
+
+func (r *Replay) OnEvent(h api.ControllerEventHandler) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.handlers = append(r.handlers, h)
+}
+
+// Run fills the buffer until the context is done
+func (r *Replay) Run(ctx context.Context) error {
+	video, err := r.mixer.StartVideoTrack("", "video/h264")
+	if err != nil {
+		return err
+	}
+	defer r.mixer.ReleaseTrack(video)
+	videoPkts := video.Subscribe(api.VideoSubscriptionSize)
+	defer videoPkts.Close()
+
+	var audio api.Track
+	var audioPkts <-chan *rtp.Packet
+	for _, t := range r.mixer.GetAudioTracks() {
+		codec := t.Codec()
+		if track, ok := mkv.AudioTrack(codec.MimeType, codec.ClockRate, codec.Channels); ok {
+			audio = t
+			r.mixer.AcquireTrack(audio)
+			defer r.mixer.ReleaseTrack(audio)
+			r.mtx.Lock()
+			r.audio = &track
+			r.mtx.Unlock()
+
+			sub := t.Subscribe(api.AudioSubscriptionSize)
+			defer sub.Close()
+			audioPkts = sub.Packets()
+			break
+		}
+	}
+
+	h264 := depacketizer.NewH264()
+	h264.KeyframeNeeded = video.RequestKeyframe
+	videoClockRate := video.Codec().ClockRate
+	r.l.Info().Msgf("Buffering the last %v of video", r.config.Window)
+
+	for {
+		select {
+		case p, ok := <-videoPkts.Packets():
+			if !ok {
+				return nil
+			}
+			if au := h264.Push(p); au != nil {
+				t := media_clock.Default.Time(au.Timestamp, videoClockRate, time.Now())
+				var sps, pps []byte
+				if au.Keyframe {
+					sps, pps = slices.Clone(au.SPS), slices.Clone(au.PPS)
+				}
+				r.buffer.PushVideo(t, au.Keyframe, au.AppendAVCC(nil), sps, pps)
+				if au.Keyframe {
+					bufferSize.Set(float64(r.buffer.Size()))
+				}
+			}
+			packet_pool.PutPacket(p)
+		case p, ok := <-audioPkts:
+			if !ok {
+				audioPkts = nil
+				continue
+			}
+			if len(p.Payload) > 0 {
+				t := media_clock.Default.Time(p.Timestamp, audio.Codec().ClockRate, time.Now())
+				r.buffer.PushAudio(t, slices.Clone(p.Payload))
+			}
+			packet_pool.PutPacket(p)
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// Save writes the buffered window to a new clip, and publishes it as a clip event.
+// trigger describes what asked for the clip.
+func (r *Replay) Save(trigger string) (ClipInfo, error) {
+	r.saveMtx.Lock()
+	defer r.saveMtx.Unlock()
+
+	now := time.Now()
+	gops := r.buffer.snapshot(now)
+
+	if err := os.MkdirAll(r.config.Dir, 0o755); err != nil {
+		return ClipInfo{}, err
+	}
+	path := filepath.Join(r.config.Dir, "replay-"+now.Format("20060102-150405.000")+".mkv")
+
+	r.mtx.Lock()
+	audio := r.audio
+	r.mtx.Unlock()
+
+	info, err := writeClip(path, gops, audio)
+	if err != nil {
+		r.l.Error().Err(err).Msg("Failed to save a clip")
+		return ClipInfo{}, err
+	}
+	info.Trigger = trigger
+	clipsSaved.Inc()
+	r.l.Info().Msgf("Saved a %.1fs clip to %v", info.Duration, path)
+
+	r.mtx.Lock()
+	handlers := slices.Clone(r.handlers)
+	r.mtx.Unlock()
+	for _, h := range handlers {
+		h("clip", info)
+	}
+	return info, nil
+}
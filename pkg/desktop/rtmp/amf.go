@@ -0,0 +1,209 @@
+package rtmp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// AMF0 type markers
+const (
+	amfNumber      = 0x00
+	amfBoolean     = 0x01
+	amfString      = 0x02
+	amfObject      = 0x03
+	amfNull        = 0x05
+	amfUndefined   = 0x06
+	amfECMAArray   = 0x08
+	amfObjectEnd   = 0x09
+	amfStrictArray = 0x0a
+	amfDate        = 0x0b
+	amfLongString  = 0x0c
+)
+
+var errShortAMF = errors.New("amf0 value is cut short")
+
+// ECMAArray is encoded as an AMF0 ECMA array instead of an object, like onMetaData expects
+type ECMAArray map[string]any
+
+// appendAMF appends AMF0 values. Numbers are float64 or int, objects are
+// map[string]any, and nil is null.
+func appendAMF(dst []byte, values ...any) ([]byte, error) {
+	for _, v := range values {
+		switch v := v.(type) {
+		case nil:
+			dst = append(dst, amfNull)
+		case float64:
+			dst = append(dst, amfNumber)
+			dst = binary.BigEndian.AppendUint64(dst, math.Float64bits(v))
+		case int:
+			dst = append(dst, amfNumber)
+			dst = binary.BigEndian.AppendUint64(dst, math.Float64bits(float64(v)))
+		case bool:
+			dst = append(dst, amfBoolean, 0)
+			if v {
+				dst[len(dst)-1] = 1
+			}
+		case string:
+			if len(v) > math.MaxUint16 {
+				dst = append(dst, amfLongString)
+				dst = binary.BigEndian.AppendUint32(dst, uint32(len(v)))
+			} else {
+				dst = append(dst, amfString)
+				dst = binary.BigEndian.AppendUint16(dst, uint16(len(v)))
+			}
+			dst = append(dst, v...)
+		case map[string]any:
+			dst = append(dst, amfObject)
+			var err error
+			if dst, err = appendAMFProperties(dst, v); err != nil {
+				return nil, err
+			}
+		case ECMAArray:
+			dst = append(dst, amfECMAArray)
+			dst = binary.BigEndian.AppendUint32(dst, uint32(len(v)))
+			var err error
+			if dst, err = appendAMFProperties(dst, v); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("can't encode %T as amf0", v)
+		}
+	}
+	return dst, nil
+}
+
+// appendAMFProperties appends an object's properties, in order of their names, and the end marker
+func appendAMFProperties(dst []byte, properties map[string]any) ([]byte, error) {
+	keys := make([]string, 0, len(properties))
+	for k := range properties {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		dst = binary.BigEndian.AppendUint16(dst, uint16(len(k)))
+		dst = append(dst, k...)
+		var err error
+		if dst, err = appendAMF(dst, properties[k]); err != nil {
+			return nil, err
+		}
+	}
+	return append(dst, 0, 0, amfObjectEnd), nil
+}
+
+// readAMF decodes every AMF0 value in data
+func readAMF(data []byte) ([]any, error) {
+	values := []any{}
+	for len(data) > 0 {
+		v, n, err := readAMFValue(data)
+		if err != nil {
+			return values, err
+		}
+		values = append(values, v)
+		data = data[n:]
+	}
+	return values, nil
+}
+
+// readAMFValue decodes one value, and returns how many bytes it took
+func readAMFValue(data []byte) (any, int, error) {
+	if len(data) < 1 {
+		return nil, 0, errShortAMF
+	}
+	switch data[0] {
+	case amfNumber:
+		if len(data) < 9 {
+			return nil, 0, errShortAMF
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(data[1:9])), 9, nil
+	case amfBoolean:
+		if len(data) < 2 {
+			return nil, 0, errShortAMF
+		}
+		return data[1] != 0, 2, nil
+	case amfString:
+		s, n, err := readAMFString(data[1:])
+		return s, 1 + n, err
+	case amfLongString:
+		if len(data) < 5 {
+			return nil, 0, errShortAMF
+		}
+		size := int(binary.BigEndian.Uint32(data[1:5]))
+		if len(data) < 5+size {
+			return nil, 0, errShortAMF
+		}
+		return string(data[5 : 5+size]), 5 + size, nil
+	case amfObject:
+		properties, n, err := readAMFProperties(data[1:])
+		return properties, 1 + n, err
+	case amfECMAArray:
+		if len(data) < 5 {
+			return nil, 0, errShortAMF
+		}
+		properties, n, err := readAMFProperties(data[5:])
+		return properties, 5 + n, err
+	case amfStrictArray:
+		if len(data) < 5 {
+			return nil, 0, errShortAMF
+		}
+		count := int(binary.BigEndian.Uint32(data[1:5]))
+		values := []any{}
+		offset := 5
+		for i := 0; i < count; i++ {
+			v, n, err := readAMFValue(data[offset:])
+			if err != nil {
+				return nil, 0, err
+			}
+			values = append(values, v)
+			offset += n
+		}
+		return values, offset, nil
+	case amfDate:
+		if len(data) < 11 {
+			return nil, 0, errShortAMF
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(data[1:9])), 11, nil
+	case amfNull, amfUndefined:
+		return nil, 1, nil
+	default:
+		return nil, 0, fmt.Errorf("unsupported amf0 type %#x", data[0])
+	}
+}
+
+func readAMFString(data []byte) (string, int, error) {
+	if len(data) < 2 {
+		return "", 0, errShortAMF
+	}
+	size := int(binary.BigEndian.Uint16(data))
+	if len(data) < 2+size {
+		return "", 0, errShortAMF
+	}
+	return string(data[2 : 2+size]), 2 + size, nil
+}
+
+// readAMFProperties decodes an object's properties, up to and including the end marker
+func readAMFProperties(data []byte) (map[string]any, int, error) {
+	properties := map[string]any{}
+	offset := 0
+	for {
+		key, n, err := readAMFString(data[offset:])
+		if err != nil {
+			return nil, 0, err
+		}
+		offset += n
+		if key == "" {
+			if offset >= len(data) || data[offset] != amfObjectEnd {
+				return nil, 0, errShortAMF
+			}
+			return properties, offset + 1, nil
+		}
+		v, n, err := readAMFValue(data[offset:])
+		if err != nil {
+			return nil, 0, err
+		}
+		properties[key] = v
+		offset += n
+	}
+}
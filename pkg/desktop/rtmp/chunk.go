@@ -0,0 +1,217 @@
+package rtmp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// RTMP message types
+const (
+	typeSetChunkSize     = 1
+	typeAbort            = 2
+	typeAcknowledgement  = 3
+	typeUserControl      = 4
+	typeWindowAckSize    = 5
+	typeSetPeerBandwidth = 6
+	typeAudio            = 8
+	typeVideo            = 9
+	typeDataAMF0         = 18
+	typeCommandAMF0      = 20
+)
+
+// Chunk stream IDs that messages are sent on
+const (
+	chunkStreamControl = 2
+	chunkStreamCommand = 3
+	chunkStreamAudio   = 4
+	chunkStreamData    = 5
+	chunkStreamVideo   = 6
+)
+
+// defaultChunkSize is the chunk size both ends start with
+const defaultChunkSize = 128
+
+// maxTimestamp is the largest timestamp that fits in a chunk's message header
+const maxTimestamp = 0xffffff
+
+// message is an RTMP message, which is sent in one or more chunks
+type message struct {
+	Type      uint8
+	StreamID  uint32
+	Timestamp uint32
+	Payload   []byte
+}
+
+// chunkWriter splits messages into chunks. Every message starts with a full
+// header, and its other chunks have none.
+type chunkWriter struct {
+	w         *bufio.Writer
+	chunkSize int
+	header    []byte
+}
+
+func newChunkWriter(w io.Writer) *chunkWriter {
+	return &chunkWriter{w: bufio.NewWriterSize(w, 64*1024), chunkSize: defaultChunkSize}
+}
+
+func (c *chunkWriter) writeMessage(chunkStream uint8, m message) error {
+	extended := m.Timestamp >= maxTimestamp
+	h := c.header[:0]
+	h = append(h, chunkStream&0x3f) // fmt 0
+	if extended {
+		h = append(h, 0xff, 0xff, 0xff)
+	} else {
+		h = append(h, byte(m.Timestamp>>16), byte(m.Timestamp>>8), byte(m.Timestamp))
+	}
+	size := len(m.Payload)
+	h = append(h, byte(size>>16), byte(size>>8), byte(size), m.Type)
+	h = binary.LittleEndian.AppendUint32(h, m.StreamID)
+	if extended {
+		h = binary.BigEndian.AppendUint32(h, m.Timestamp)
+	}
+	c.header = h
+
+	if _, err := c.w.Write(h); err != nil {
+		return err
+	}
+	payload := m.Payload
+	for {
+		n := min(len(payload), c.chunkSize)
+		if _, err := c.w.Write(payload[:n]); err != nil {
+			return err
+		}
+		payload = payload[n:]
+		if len(payload) == 0 {
+			break
+		}
+		// fmt 3, which continues the message
+		if err := c.w.WriteByte(0xc0 | chunkStream&0x3f); err != nil {
+			return err
+		}
+		if extended {
+			if _, err := c.w.Write(h[len(h)-4:]); err != nil {
+				return err
+			}
+		}
+	}
+	return c.w.Flush()
+}
+
+// chunkStreamState is what the reader remembers about a chunk stream, since
+// later chunks leave out whatever didn't change
+type chunkStreamState struct {
+	message
+	size     int
+	delta    uint32
+	extended bool
+	started  bool
+}
+
+// chunkReader puts messages back together from their chunks
+type chunkReader struct {
+	r         *bufio.Reader
+	chunkSize int
+	streams   map[uint32]*chunkStreamState
+	buf       [11]byte
+}
+
+func newChunkReader(r io.Reader) *chunkReader {
+	return &chunkReader{r: bufio.NewReader(r), chunkSize: defaultChunkSize, streams: map[uint32]*chunkStreamState{}}
+}
+
+// readMessage returns the next complete message
+func (c *chunkReader) readMessage() (message, error) {
+	for {
+		m, ok, err := c.readChunk()
+		if err != nil || ok {
+			return m, err
+		}
+	}
+}
+
+// readChunk reads one chunk, and returns its message if the chunk completed it
+func (c *chunkReader) readChunk() (message, bool, error) {
+	first, err := c.r.ReadByte()
+	if err != nil {
+		return message{}, false, err
+	}
+	format := first >> 6
+	id := uint32(first & 0x3f)
+	switch id {
+	case 0:
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return message{}, false, err
+		}
+		id = 64 + uint32(b)
+	case 1:
+		if _, err := io.ReadFull(c.r, c.buf[:2]); err != nil {
+			return message{}, false, err
+		}
+		id = 64 + uint32(c.buf[0]) + uint32(c.buf[1])<<8
+	}
+
+	s := c.streams[id]
+	if s == nil {
+		if format != 0 {
+			return message{}, false, fmt.Errorf("chunk stream %v starts without a full header", id)
+		}
+		s = &chunkStreamState{}
+		c.streams[id] = s
+	}
+
+	headerSize := [4]int{11, 7, 3, 0}[format]
+	if _, err := io.ReadFull(c.r, c.buf[:headerSize]); err != nil {
+		return message{}, false, err
+	}
+	h := c.buf[:headerSize]
+	if format <= 2 {
+		timestamp := uint32(h[0])<<16 | uint32(h[1])<<8 | uint32(h[2])
+		s.extended = timestamp == maxTimestamp
+		if format == 0 {
+			s.Timestamp = timestamp
+			s.delta = 0
+		} else {
+			s.delta = timestamp
+		}
+	}
+	if format <= 1 {
+		s.size = int(h[3])<<16 | int(h[4])<<8 | int(h[5])
+		s.Type = h[6]
+	}
+	if format == 0 {
+		s.StreamID = binary.LittleEndian.Uint32(h[7:11])
+	}
+	if s.extended {
+		if _, err := io.ReadFull(c.r, c.buf[:4]); err != nil {
+			return message{}, false, err
+		}
+		if format == 0 {
+			s.Timestamp = binary.BigEndian.Uint32(c.buf[:4])
+		} else if format <= 2 {
+			s.delta = binary.BigEndian.Uint32(c.buf[:4])
+		}
+	}
+
+	if !s.started {
+		// The first chunk of a message
+		if format != 0 {
+			s.Timestamp += s.delta
+		}
+		s.Payload = make([]byte, 0, s.size)
+		s.started = true
+	}
+	n := min(s.size-len(s.Payload), c.chunkSize)
+	start := len(s.Payload)
+	s.Payload = s.Payload[:start+n]
+	if _, err := io.ReadFull(c.r, s.Payload[start:]); err != nil {
+		return message{}, false, err
+	}
+	if len(s.Payload) < s.size {
+		return message{}, false, nil
+	}
+	s.started = false
+	return s.message, true, nil
+}
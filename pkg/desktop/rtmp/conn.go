@@ -0,0 +1,376 @@
+// Package rtmp publishes a live stream to an RTMP server, like nginx-rtmp or a
+// streaming site's ingest. It only does what a publisher needs: the handshake,
+// connect, createStream and publish, and sending FLV audio, video and metadata.
+package rtmp
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// handshakeSize is the size of C1, C2, S1 and S2
+const handshakeSize = 1536
+
+// chunkSize is the chunk size we send with, so that most audio fits in one chunk
+const chunkSize = 4096
+
+// DefaultTimeout is how long connecting, and each write, may take
+const DefaultTimeout = 10 * time.Second
+
+var ErrPublishRejected = errors.New("the server rejected the stream")
+
+// Conn is a connection that publishes one stream
+type Conn struct {
+	conn     net.Conn
+	w        *chunkWriter
+	r        *chunkReader
+	read     countingReader
+	streamID uint32
+	stream   string
+
+	// acknowledged is how many bytes were read when we last acknowledged them
+	acknowledged uint32
+	windowSize   uint32
+
+	done chan struct{}
+	err  error
+	mtx  sync.Mutex
+}
+
+// countingReader counts the bytes read, which the server wants acknowledged
+type countingReader struct {
+	r io.Reader
+	n atomic.Uint32
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n.Add(uint32(n))
+	return n, err
+}
+
+// ParseURL splits an RTMP URL into the address to dial, the URL of the application,
+// and the stream key. The key is the last part of the path, with its query.
+func ParseURL(rawURL string) (address string, tcURL string, app string, stream string, err error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", "", "", "", err
+	}
+	if u.Scheme != "rtmp" {
+		return "", "", "", "", fmt.Errorf("unsupported scheme %q, only rtmp is", u.Scheme)
+	}
+	path := strings.Trim(u.Path, "/")
+	i := strings.LastIndex(path, "/")
+	if i <= 0 {
+		return "", "", "", "", fmt.Errorf("%q needs an application and a stream key", rawURL)
+	}
+	app, stream = path[:i], path[i+1:]
+	if u.RawQuery != "" {
+		stream += "?" + u.RawQuery
+	}
+	address = u.Host
+	if u.Port() == "" {
+		address = net.JoinHostPort(u.Hostname(), "1935")
+	}
+	return address, "rtmp://" + u.Host + "/" + app, app, stream, nil
+}
+
+// Dial connects to the server and starts publishing the stream in the URL
+func Dial(ctx context.Context, rawURL string) (*Conn, error) {
+	address, tcURL, app, stream, err := ParseURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, DefaultTimeout)
+	defer cancel()
+
+	dialer := net.Dialer{}
+	nc, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	deadline, _ := ctx.Deadline()
+	nc.SetDeadline(deadline)
+	// Closing the connection is the only way to interrupt it, if the context is cancelled
+	stop := context.AfterFunc(ctx, func() { nc.SetDeadline(time.Now()) })
+	defer stop()
+
+	c := newConn(nc)
+	c.stream = stream
+	if err := c.handshake(); err != nil {
+		nc.Close()
+		return nil, fmt.Errorf("handshake failed: %w", err)
+	}
+	if err := c.publish(tcURL, app, stream); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	nc.SetDeadline(time.Time{})
+
+	go c.readLoop()
+	return c, nil
+}
+
+func newConn(nc net.Conn) *Conn {
+	c := &Conn{conn: nc, w: newChunkWriter(nc), done: make(chan struct{})}
+	c.read.r = nc
+	c.r = newChunkReader(&c.read)
+	return c
+}
+
+// handshake does the simple handshake, which every server accepts from publishers
+func (c *Conn) handshake() error {
+	c0c1 := make([]byte, 1+handshakeSize)
+	c0c1[0] = 3 // RTMP version
+	if _, err := rand.Read(c0c1[9:]); err != nil {
+		return err
+	}
+	if _, err := c.conn.Write(c0c1); err != nil {
+		return err
+	}
+
+	s0s1 := make([]byte, 1+handshakeSize)
+	if _, err := io.ReadFull(c.r.r, s0s1); err != nil {
+		return err
+	}
+	if s0s1[0] != 3 {
+		return fmt.Errorf("unsupported rtmp version %v", s0s1[0])
+	}
+	// C2 echoes S1
+	if _, err := c.conn.Write(s0s1[1:]); err != nil {
+		return err
+	}
+	s2 := make([]byte, handshakeSize)
+	_, err := io.ReadFull(c.r.r, s2)
+	return err
+}
+
+// publish connects to the application, creates a stream and publishes it
+func (c *Conn) publish(tcURL string, app string, stream string) error {
+	if err := c.writeControl(typeSetChunkSize, chunkSize); err != nil {
+		return err
+	}
+	c.w.chunkSize = chunkSize
+
+	err := c.command(0, "connect", 1, map[string]any{
+		"app":      app,
+		"type":     "nonprivate",
+		"flashVer": "FMLE/3.0 (compatible; pod-arcade)",
+		"tcUrl":    tcURL,
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := c.awaitResult(1); err != nil {
+		return fmt.Errorf("connect failed: %w", err)
+	}
+
+	// Some servers, like streaming sites, want these before they'll let us publish
+	if err := c.command(0, "releaseStream", 2, nil, stream); err != nil {
+		return err
+	}
+	if err := c.command(0, "FCPublish", 3, nil, stream); err != nil {
+		return err
+	}
+	if err := c.command(0, "createStream", 4, nil); err != nil {
+		return err
+	}
+	result, err := c.awaitResult(4)
+	if err != nil {
+		return fmt.Errorf("createStream failed: %w", err)
+	}
+	var id float64
+	if len(result) > 0 {
+		id, _ = result[len(result)-1].(float64)
+	}
+	if id == 0 {
+		return fmt.Errorf("createStream returned %v instead of a stream ID", result)
+	}
+	c.streamID = uint32(id)
+
+	if err := c.command(c.streamID, "publish", 5, nil, stream, "live"); err != nil {
+		return err
+	}
+	return c.awaitPublish()
+}
+
+// awaitResult reads messages until the reply to a transaction, and returns its values
+func (c *Conn) awaitResult(transaction float64) ([]any, error) {
+	for {
+		values, err := c.readCommand()
+		if err != nil {
+			return nil, err
+		}
+		if len(values) < 2 || values[1] != transaction {
+			continue
+		}
+		switch values[0] {
+		case "_result":
+			return values[2:], nil
+		case "_error":
+			return nil, fmt.Errorf("%w: %v", ErrPublishRejected, values[2:])
+		}
+	}
+}
+
+// awaitPublish reads messages until the server says whether we can publish
+func (c *Conn) awaitPublish() error {
+	for {
+		values, err := c.readCommand()
+		if err != nil {
+			return err
+		}
+		if len(values) < 4 || values[0] != "onStatus" {
+			continue
+		}
+		status, _ := values[3].(map[string]any)
+		if status["code"] == "NetStream.Publish.Start" {
+			return nil
+		}
+		if status["level"] == "error" {
+			return fmt.Errorf("%w: %v", ErrPublishRejected, status["description"])
+		}
+	}
+}
+
+// readCommand reads messages until the next command, handling the protocol's own messages on the way
+func (c *Conn) readCommand() ([]any, error) {
+	for {
+		m, err := c.r.readMessage()
+		if err != nil {
+			return nil, err
+		}
+		if m.Type == typeCommandAMF0 {
+			return readAMF(m.Payload)
+		}
+		if err := c.handleMessage(m); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// handleMessage handles a message that isn't a command
+func (c *Conn) handleMessage(m message) error {
+	switch m.Type {
+	case typeSetChunkSize:
+		if len(m.Payload) < 4 {
+			return errors.New("set chunk size is cut short")
+		}
+		c.r.chunkSize = int(binary.BigEndian.Uint32(m.Payload) & 0x7fffffff)
+		if c.r.chunkSize == 0 {
+			return errors.New("the server set a chunk size of 0")
+		}
+	case typeWindowAckSize:
+		if len(m.Payload) < 4 {
+			return errors.New("window acknowledgement size is cut short")
+		}
+		c.windowSize = binary.BigEndian.Uint32(m.Payload)
+	case typeUserControl:
+		// Ping requests have to be answered, or the server hangs up
+		if len(m.Payload) >= 6 && binary.BigEndian.Uint16(m.Payload) == 6 {
+			pong := append([]byte{0, 7}, m.Payload[2:6]...)
+			return c.write(chunkStreamControl, message{Type: typeUserControl, Payload: pong})
+		}
+	}
+
+	if read := c.read.n.Load(); c.windowSize > 0 && read-c.acknowledged >= c.windowSize {
+		c.acknowledged = read
+		return c.writeControl(typeAcknowledgement, read)
+	}
+	return nil
+}
+
+// readLoop handles what the server sends while we're publishing, until the connection ends
+func (c *Conn) readLoop() {
+	var err error
+	for err == nil {
+		var values []any
+		values, err = c.readCommand()
+		if err != nil {
+			break
+		}
+		if len(values) >= 4 && values[0] == "onStatus" {
+			status, _ := values[3].(map[string]any)
+			if status["level"] == "error" {
+				err = fmt.Errorf("%w: %v", ErrPublishRejected, status["description"])
+			}
+		}
+	}
+	c.mtx.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	c.mtx.Unlock()
+	close(c.done)
+}
+
+// Done is closed once the connection ends
+func (c *Conn) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns why the connection ended
+func (c *Conn) Err() error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.err
+}
+
+func (c *Conn) command(streamID uint32, name string, transaction float64, values ...any) error {
+	payload, err := appendAMF(nil, append([]any{name, transaction}, values...)...)
+	if err != nil {
+		return err
+	}
+	return c.write(chunkStreamCommand, message{Type: typeCommandAMF0, StreamID: streamID, Payload: payload})
+}
+
+func (c *Conn) writeControl(messageType uint8, value uint32) error {
+	return c.write(chunkStreamControl, message{Type: messageType, Payload: binary.BigEndian.AppendUint32(nil, value)})
+}
+
+func (c *Conn) write(chunkStream uint8, m message) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(DefaultTimeout))
+	return c.w.writeMessage(chunkStream, m)
+}
+
+// WriteMetadata sends the stream's onMetaData
+func (c *Conn) WriteMetadata(metadata ECMAArray) error {
+	payload, err := appendAMF(nil, "@setDataFrame", "onMetaData", metadata)
+	if err != nil {
+		return err
+	}
+	return c.write(chunkStreamData, message{Type: typeDataAMF0, StreamID: c.streamID, Payload: payload})
+}
+
+// WriteVideo sends the body of an FLV video tag, at a timestamp in milliseconds
+func (c *Conn) WriteVideo(timestamp uint32, data []byte) error {
+	return c.write(chunkStreamVideo, message{Type: typeVideo, StreamID: c.streamID, Timestamp: timestamp, Payload: data})
+}
+
+// WriteAudio sends the body of an FLV audio tag, at a timestamp in milliseconds
+func (c *Conn) WriteAudio(timestamp uint32, data []byte) error {
+	return c.write(chunkStreamAudio, message{Type: typeAudio, StreamID: c.streamID, Timestamp: timestamp, Payload: data})
+}
+
+// Close stops publishing and hangs up
+func (c *Conn) Close() error {
+	select {
+	case <-c.done:
+	default:
+		c.command(0, "FCUnpublish", 6, nil, c.stream)
+		c.command(0, "deleteStream", 7, nil, float64(c.streamID))
+	}
+	return c.conn.Close()
+}
@@ -0,0 +1,118 @@
+package rtmp
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestAMF(t *testing.T) {
+	values := []any{"connect", 1.0, map[string]any{"app": "live", "fpad": false}, nil, ECMAArray{"width": 1920}}
+	data, err := appendAMF(nil, values...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := readAMF(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []any{"connect", 1.0, map[string]any{"app": "live", "fpad": false}, nil, map[string]any{"width": 1920.0}}
+	if !reflect.DeepEqual(decoded, expected) {
+		t.Errorf("Expected %v, got %v", expected, decoded)
+	}
+}
+
+func TestParseURL(t *testing.T) {
+	address, tcURL, app, stream, err := ParseURL("rtmp://relay.local/live/table-1?key=secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if address != "relay.local:1935" || tcURL != "rtmp://relay.local/live" || app != "live" || stream != "table-1?key=secret" {
+		t.Errorf("Unexpected %v %v %v %v", address, tcURL, app, stream)
+	}
+	if _, _, _, _, err := ParseURL("rtmp://relay.local/table-1"); err == nil {
+		t.Error("Expected a URL without a stream key to fail")
+	}
+}
+
+// fakeServer accepts one publisher, and returns the first video message it sends
+func fakeServer(t *testing.T, l net.Listener, video chan<- message) {
+	nc, err := l.Accept()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer nc.Close()
+
+	c0c1 := make([]byte, 1+handshakeSize)
+	if _, err := io.ReadFull(nc, c0c1); err != nil {
+		t.Error(err)
+		return
+	}
+	s1 := make([]byte, handshakeSize)
+	nc.Write(append(append([]byte{3}, s1...), c0c1[1:]...))
+	if _, err := io.ReadFull(nc, make([]byte, handshakeSize)); err != nil {
+		t.Error(err)
+		return
+	}
+
+	r := newChunkReader(nc)
+	w := newChunkWriter(nc)
+	reply := func(streamID uint32, values ...any) {
+		payload, _ := appendAMF(nil, values...)
+		w.writeMessage(chunkStreamCommand, message{Type: typeCommandAMF0, StreamID: streamID, Payload: payload})
+	}
+	for {
+		m, err := r.readMessage()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		switch m.Type {
+		case typeSetChunkSize:
+			r.chunkSize = chunkSize
+		case typeCommandAMF0:
+			values, _ := readAMF(m.Payload)
+			switch values[0] {
+			case "connect":
+				reply(0, "_result", values[1], nil, map[string]any{"code": "NetConnection.Connect.Success"})
+			case "createStream":
+				reply(0, "_result", values[1], nil, 1.0)
+			case "publish":
+				reply(m.StreamID, "onStatus", 0.0, nil, map[string]any{"level": "status", "code": "NetStream.Publish.Start"})
+			}
+		case typeVideo:
+			video <- m
+			return
+		}
+	}
+}
+
+func TestConn_Publish(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	video := make(chan message, 1)
+	go fakeServer(t, l, video)
+
+	conn, err := Dial(context.Background(), "rtmp://"+l.Addr().String()+"/live/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Big enough to be split into chunks, with an extended timestamp
+	data := bytes.Repeat([]byte{0x17, 1, 2, 3}, 3000)
+	if err := conn.WriteVideo(0x1000000, data); err != nil {
+		t.Fatal(err)
+	}
+	m := <-video
+	if m.StreamID != 1 || m.Timestamp != 0x1000000 || !bytes.Equal(m.Payload, data) {
+		t.Errorf("Unexpected video message on stream %v at %v of %v bytes", m.StreamID, m.Timestamp, len(m.Payload))
+	}
+}
@@ -40,6 +40,5 @@ func (r *SampleRecorder) GetName() string {
 }
 
 func (r *SampleRecorder) GetVideoCodecParameters() *webrtc.RTPCodecParameters {
-	// Clock Rate should probably be set to something
-	return &webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 0}, PayloadType: 102}
+	return &webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000}, PayloadType: 102}
 }
@@ -2,18 +2,33 @@ package desktop
 
 import (
 	"context"
+	"errors"
+	"slices"
+	"sync"
+	"time"
 
 	"github.com/pion/webrtc/v4"
 	"github.com/pod-arcade/pod-arcade/api"
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/webrtc_interceptors/stream_registry"
 )
 
+// renegotiationTimeout is how long the client has to answer an offer from the desktop,
+// before the offer is rolled back so the client can make offers of its own again
+const renegotiationTimeout = 10 * time.Second
+
+// ErrCannotRenegotiate is returned when a session can't take an offer from the desktop
+var ErrCannotRenegotiate = errors.New("session can't renegotiate")
+
 var _ api.Session = (*DesktopSession)(nil)
 
 type DesktopSession struct {
 	id             api.SessionID
 	peerConnection *webrtc.PeerConnection
+	renegotiate    api.RenegotiationHandler
+	stateHandlers  []func(webrtc.PeerConnectionState)
 
 	ctx context.Context
+	mtx sync.Mutex
 }
 
 func NewSession(ctx context.Context, sessionId api.SessionID) *DesktopSession {
@@ -38,9 +53,68 @@ func (s *DesktopSession) CreatePeerConnection(api *webrtc.API, conf *webrtc.Conf
 		return nil, err
 	}
 	s.peerConnection = pc
+	pc.OnConnectionStateChange(s.connectionStateChanged)
 	return pc, nil
 }
 
+func (s *DesktopSession) OnConnectionStateChange(h func(webrtc.PeerConnectionState)) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.stateHandlers = append(s.stateHandlers, h)
+}
+
+func (s *DesktopSession) connectionStateChanged(state webrtc.PeerConnectionState) {
+	s.mtx.Lock()
+	handlers := slices.Clone(s.stateHandlers)
+	s.mtx.Unlock()
+	for _, h := range handlers {
+		h(state)
+	}
+}
+
 func (s *DesktopSession) GetPeerConnection() *webrtc.PeerConnection {
 	return s.peerConnection
 }
+
+func (s *DesktopSession) OnRenegotiate(h api.RenegotiationHandler) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.renegotiate = h
+}
+
+func (s *DesktopSession) Renegotiate() error {
+	s.mtx.Lock()
+	handler := s.renegotiate
+	s.mtx.Unlock()
+	pc := s.peerConnection
+	if handler == nil || pc == nil {
+		return ErrCannotRenegotiate
+	}
+	if pc.SignalingState() != webrtc.SignalingStateStable {
+		return errors.Join(ErrCannotRenegotiate, errors.New("negotiation already in progress"))
+	}
+
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		return err
+	}
+	if err := pc.SetLocalDescription(offer); err != nil {
+		return err
+	}
+	rollback := webrtc.SessionDescription{Type: webrtc.SDPTypeRollback, SDP: offer.SDP}
+	// pion doesn't declare the SSRCs of the RTX and FlexFEC streams it sends
+	sent := offer
+	sent.SDP = stream_registry.AddRepairSSRCs(offer.SDP)
+	if err := handler(sent); err != nil {
+		pc.SetLocalDescription(rollback)
+		return err
+	}
+
+	// Clients that don't answer would otherwise be stuck unable to make offers
+	time.AfterFunc(renegotiationTimeout, func() {
+		if pc.SignalingState() == webrtc.SignalingStateHaveLocalOffer && pc.LocalDescription() != nil && pc.LocalDescription().SDP == offer.SDP {
+			pc.SetLocalDescription(rollback)
+		}
+	})
+	return nil
+}
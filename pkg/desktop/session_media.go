@@ -0,0 +1,346 @@
+package desktop
+
+import (
+	"slices"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/pod-arcade/pod-arcade/api"
+)
+
+// videoSender is one of a session's video tracks
+type videoSender struct {
+	sender *webrtc.RTPSender
+	// output is the output the session asked for. The track may be showing the
+	// default output instead, while that output has no sources.
+	output string
+	track  api.Track
+	// paused is set while the session asked not to get the track
+	paused bool
+	// settings are the settings the session asked for the output to be encoded with
+	settings *api.VideoSettings
+}
+
+// audioSender is one of a session's audio tracks
+type audioSender struct {
+	sender *webrtc.RTPSender
+	paused bool
+}
+
+// addVideoSenders adds a track for each of the session's video sections that doesn't
+// have one yet, if there are outputs left for them. d.rwm must be held.
+func (d *Desktop) addVideoSenders(s api.Session) (bool, error) {
+	pc := s.GetPeerConnection()
+	offer := pc.RemoteDescription()
+	sections, err := countMedia(offer, webrtc.RTPCodecTypeVideo)
+	if err != nil {
+		return false, err
+	}
+
+	added := false
+	outputs := d.mixer.GetVideoOutputs()
+	for i := len(d.videoSenders[s.GetID()]); i < min(sections, len(outputs)); i++ {
+		video, err := d.mixer.NegotiateVideoTrack(offer, outputs[i].ID)
+		if err != nil {
+			d.l.Warn().Err(err).Msgf("Not sending output %v to session %v", outputs[i].ID, s.GetID())
+			continue
+		} else if video == nil {
+			break
+		}
+		v := &videoSender{output: outputs[i].ID, track: video}
+		video.SetKeyframeInterval(s.GetID(), d.keyframeInterval(s.GetID()))
+		var local webrtc.TrackLocal = video.ForSession(s.GetID())
+		if d.videoPaused(s.GetID(), v) {
+			local = mutedTrack{video}
+		}
+		v.sender, err = pc.AddTrack(local)
+		if err != nil {
+			return added, err
+		}
+		d.runPacketDisposer(v.sender)
+		d.videoSenders[s.GetID()] = append(d.videoSenders[s.GetID()], v)
+		if d.connected[s.GetID()] && !d.videoPaused(s.GetID(), v) {
+			d.mixer.AcquireTrack(video)
+		}
+		added = true
+	}
+	return added, nil
+}
+
+// updateAudioSenders adds the mixer's new audio tracks to the session, and removes the
+// ones that are gone. d.rwm must be held.
+func (d *Desktop) updateAudioSenders(s api.Session) (bool, error) {
+	pc := s.GetPeerConnection()
+	senders := d.audioSenders[s.GetID()]
+	tracks := d.mixer.GetAudioTracks()
+
+	changed := false
+	for _, track := range tracks {
+		if senders[track] != nil {
+			continue
+		}
+		sender, err := pc.AddTrack(track.ForSession(s.GetID()))
+		if err != nil {
+			return changed, err
+		}
+		d.runPacketDisposer(sender)
+		senders[track] = &audioSender{sender: sender}
+		if d.connected[s.GetID()] {
+			d.mixer.AcquireTrack(track)
+		}
+		changed = true
+	}
+	for track, a := range senders {
+		if slices.Contains(tracks, track) {
+			continue
+		}
+		if err := pc.RemoveTrack(a.sender); err != nil {
+			return changed, err
+		}
+		delete(senders, track)
+		if d.connected[s.GetID()] && !a.paused {
+			d.mixer.ReleaseTrack(track)
+		}
+		changed = true
+	}
+	return changed, nil
+}
+
+// moveVideoSenders switches the session's video tracks whose source was removed to
+// another source of the same output, or of the default output. d.rwm must be held.
+func (d *Desktop) moveVideoSenders(s api.Session) {
+	for i, v := range d.videoSenders[s.GetID()] {
+		codecs := v.sender.GetParameters().Codecs
+		if len(codecs) == 0 {
+			continue
+		}
+		track, err := d.mixer.GetVideoTrack(v.output, codecs[0].MimeType)
+		if err != nil {
+			track, err = d.mixer.GetVideoTrack("", codecs[0].MimeType)
+		}
+		if err != nil {
+			d.l.Warn().Msgf("Video track %v of session %v has no %v source left", i, s.GetID(), codecs[0].MimeType)
+			continue
+		}
+		if track == v.track {
+			continue
+		}
+		if err := d.switchTrack(s.GetID(), v, track); err != nil {
+			d.l.Warn().Err(err).Msgf("Failed to move video track %v of session %v", i, s.GetID())
+			continue
+		}
+		d.l.Info().Msgf("Moved video track %v of session %v to %v", i, s.GetID(), track.ID())
+	}
+}
+
+// updateSessions brings live sessions up to date after the mixer's sources changed,
+// renegotiating with the ones whose tracks were added or removed
+func (d *Desktop) updateSessions() {
+	d.rwm.Lock()
+	renegotiate := []api.Session{}
+	for _, s := range d.sessions {
+		d.moveVideoSenders(s)
+		videoAdded, err := d.addVideoSenders(s)
+		if err != nil {
+			d.l.Warn().Err(err).Msgf("Failed to add video to session %v", s.GetID())
+		}
+		audioChanged, err := d.updateAudioSenders(s)
+		if err != nil {
+			d.l.Warn().Err(err).Msgf("Failed to update the audio of session %v", s.GetID())
+		}
+		if videoAdded || audioChanged {
+			renegotiate = append(renegotiate, s)
+		}
+	}
+	d.rwm.Unlock()
+
+	for _, s := range renegotiate {
+		d.l.Info().Msgf("Renegotiating session %v", s.GetID())
+		if err := s.Renegotiate(); err != nil {
+			d.l.Warn().Err(err).Msgf("Failed to renegotiate session %v", s.GetID())
+		}
+	}
+}
+
+// selectOutput switches one of a session's video tracks to another output, keeping its codec
+func (d *Desktop) selectOutput(session api.SessionID, sel api.SelectOutput) {
+	d.rwm.Lock()
+	defer d.rwm.Unlock()
+	senders := d.videoSenders[session]
+	if int(sel.Track) >= len(senders) {
+		d.l.Warn().Msgf("Session %v selected an output for video track %v, but it only has %v", session, sel.Track, len(senders))
+		return
+	}
+	v := senders[sel.Track]
+
+	codecs := v.sender.GetParameters().Codecs
+	if len(codecs) == 0 {
+		d.l.Warn().Msgf("Video track %v of session %v hasn't been negotiated yet", sel.Track, session)
+		return
+	}
+	track, err := d.mixer.GetVideoTrack(sel.OutputID, codecs[0].MimeType)
+	if err != nil {
+		d.l.Warn().Err(err).Msgf("Session %v selected output %v, which isn't available in %v", session, sel.OutputID, codecs[0].MimeType)
+		return
+	}
+	if v.output != sel.OutputID {
+		// The session's settings were for the old output, which may not need them anymore
+		old := v.output
+		v.settings = nil
+		defer func() { go d.applyVideoSettings(old, sel.OutputID) }()
+	}
+	v.output = sel.OutputID
+	if track == v.track {
+		return
+	}
+
+	if err := d.switchTrack(session, v, track); err != nil {
+		d.l.Warn().Err(err).Msgf("Failed to switch session %v to output %v", session, sel.OutputID)
+		return
+	}
+	d.l.Info().Msgf("Switched video track %v of session %v to output %v", sel.Track, session, sel.OutputID)
+}
+
+// setVideoSettings asks for the output shown on one of a session's video tracks to be
+// encoded with other settings. The output is shared, so it gets the highest settings
+// any session watching it asked for.
+func (d *Desktop) setVideoSettings(session api.SessionID, set api.SetVideoSettings) {
+	if err := set.Settings.Validate(); err != nil {
+		d.l.Warn().Err(err).Msgf("Session %v asked for invalid video settings", session)
+		return
+	}
+	d.rwm.Lock()
+	senders := d.videoSenders[session]
+	if int(set.Track) >= len(senders) {
+		d.rwm.Unlock()
+		d.l.Warn().Msgf("Session %v changed the settings of video track %v, but it only has %v", session, set.Track, len(senders))
+		return
+	}
+	v := senders[set.Track]
+	v.settings = &set.Settings
+	d.rwm.Unlock()
+
+	d.l.Info().Msgf("Session %v asked for output %v to be encoded with %+v", session, v.output, set.Settings)
+	d.applyVideoSettings(v.output)
+}
+
+// applyVideoSettings encodes outputs with the settings their sessions asked for,
+// if those changed. d.rwm must not be held.
+func (d *Desktop) applyVideoSettings(outputs ...string) {
+	d.settingsMtx.Lock()
+	defer d.settingsMtx.Unlock()
+	changed := map[string]api.VideoSettings{}
+	d.rwm.Lock()
+	for _, output := range outputs {
+		if settings := d.requestedVideoSettings(output); settings != d.outputSettings[output] {
+			d.outputSettings[output] = settings
+			changed[output] = settings
+		}
+	}
+	d.rwm.Unlock()
+
+	for output, settings := range changed {
+		if err := d.mixer.SetVideoSettings(output, settings); err != nil {
+			d.l.Warn().Err(err).Msgf("Failed to change the settings of output %v", output)
+		}
+	}
+}
+
+// sessionOutputs returns the outputs a session watches. d.rwm must be held.
+func (d *Desktop) sessionOutputs(session api.SessionID) []string {
+	outputs := []string{}
+	for _, v := range d.videoSenders[session] {
+		outputs = append(outputs, v.output)
+	}
+	return outputs
+}
+
+// requestedVideoSettings returns the highest settings that the sessions watching an
+// output asked for. Only the sessions that set a field take part in it, and fields
+// that none of them set stay zero, which is the desktop's own. d.rwm must be held.
+func (d *Desktop) requestedVideoSettings(output string) api.VideoSettings {
+	merged := api.VideoSettings{}
+	for _, senders := range d.videoSenders {
+		for _, v := range senders {
+			if v.output != output || v.settings == nil {
+				continue
+			}
+			merged.Width = higherSetting(merged.Width, v.settings.Width)
+			merged.Height = higherSetting(merged.Height, v.settings.Height)
+			merged.FrameRate = higherSetting(merged.FrameRate, v.settings.FrameRate)
+			// Lower qualities are better
+			merged.Quality = -higherSetting(-merged.Quality, -v.settings.Quality)
+		}
+	}
+	return merged
+}
+
+// higherSetting returns the higher of two settings, ignoring a zero one, which wasn't set
+func higherSetting(a, b int) int {
+	if a == 0 {
+		return b
+	}
+	if b == 0 {
+		return a
+	}
+	return max(a, b)
+}
+
+// switchTrack switches a video sender to another track, moving the session's claim on
+// its source over too. A paused sender only remembers the track, until it's resumed.
+// d.rwm must be held.
+func (d *Desktop) switchTrack(session api.SessionID, v *videoSender, track api.Track) error {
+	track.SetKeyframeInterval(session, d.keyframeInterval(session))
+	if !d.videoPaused(session, v) {
+		if err := v.sender.ReplaceTrack(track.ForSession(session)); err != nil {
+			track.SetKeyframeInterval(session, 0)
+			return err
+		}
+		if d.connected[session] {
+			d.mixer.AcquireTrack(track)
+			d.mixer.ReleaseTrack(v.track)
+		}
+		// The session can't decode the new track until it gets a keyframe
+		track.RequestKeyframe()
+	}
+	v.track.SetKeyframeInterval(session, 0)
+	v.track = track
+	return nil
+}
+
+// connectSession starts the sources of a session that just connected
+func (d *Desktop) connectSession(session api.SessionID) {
+	d.rwm.Lock()
+	defer d.rwm.Unlock()
+	if d.connected[session] || d.sessions[session] == nil {
+		return
+	}
+	d.connected[session] = true
+	for _, v := range d.videoSenders[session] {
+		if !d.videoPaused(session, v) {
+			d.mixer.AcquireTrack(v.track)
+		}
+	}
+	for track, a := range d.audioSenders[session] {
+		if !a.paused {
+			d.mixer.AcquireTrack(track)
+		}
+	}
+}
+
+// releaseSession releases the sources of a session that's leaving. d.rwm must be held.
+func (d *Desktop) releaseSession(session api.SessionID) {
+	if !d.connected[session] {
+		return
+	}
+	delete(d.connected, session)
+	for _, v := range d.videoSenders[session] {
+		if !d.videoPaused(session, v) {
+			d.mixer.ReleaseTrack(v.track)
+		}
+	}
+	for track, a := range d.audioSenders[session] {
+		if !a.paused {
+			d.mixer.ReleaseTrack(track)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package desktop
+
+import (
+	"testing"
+
+	"github.com/pod-arcade/pod-arcade/api"
+)
+
+func TestRequestedVideoSettings_TakesTheHighest(t *testing.T) {
+	phone := api.VideoSettings{Width: 1280, Height: 720, FrameRate: 30, Quality: 30}
+	tablet := api.VideoSettings{Width: 1920, Height: 1080, FrameRate: 30, Quality: 25}
+	d := &Desktop{videoSenders: map[api.SessionID][]*videoSender{
+		"phone":  {{output: "left", settings: &phone}},
+		"tablet": {{output: "left", settings: &tablet}, {output: "right"}},
+	}}
+
+	if got := d.requestedVideoSettings("left"); got != tablet {
+		t.Errorf("Expected the tablet's settings %+v, got %+v", tablet, got)
+	}
+
+	// A session that didn't ask doesn't take part
+	d.videoSenders["tv"] = []*videoSender{{output: "left"}}
+	if got := d.requestedVideoSettings("left"); got != tablet {
+		t.Errorf("Expected the tablet's settings %+v, got %+v", tablet, got)
+	}
+
+	// Nor do the fields a session didn't set
+	d.videoSenders["tv"][0].settings = &api.VideoSettings{FrameRate: 60}
+	if got, want := d.requestedVideoSettings("left"), (api.VideoSettings{Width: 1920, Height: 1080, FrameRate: 60, Quality: 25}); got != want {
+		t.Errorf("Expected %+v, got %+v", want, got)
+	}
+
+	delete(d.videoSenders, "tv")
+	delete(d.videoSenders, "tablet")
+	if got := d.requestedVideoSettings("left"); got != phone {
+		t.Errorf("Expected the phone's settings %+v once it's the only one watching, got %+v", phone, got)
+	}
+}
@@ -0,0 +1,47 @@
+package desktop
+
+import (
+	"context"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/pod-arcade/pod-arcade/api"
+)
+
+// microphonePayloadType is the payload type sessions send their microphones with,
+// when none of the desktop's audio sources use Opus
+const microphonePayloadType = 111
+
+// playMicrophone plays a track that a session sent, until the session ends
+func (d *Desktop) playMicrophone(session api.SessionID, track *webrtc.TrackRemote) {
+	if track.Kind() != webrtc.RTPCodecTypeAudio {
+		d.l.Warn().Msgf("Ignoring %v track from session %v", track.Kind(), session)
+		return
+	}
+	d.rwm.RLock()
+	mic := d.microphones[session]
+	d.rwm.RUnlock()
+	if mic == nil {
+		return
+	}
+
+	go func() {
+		d.l.Info().Msgf("Playing the microphone of session %v", session)
+		if err := mic.Run(context.Background(), track); err != nil {
+			d.l.Warn().Err(err).Msgf("Failed to play the microphone of session %v", session)
+			return
+		}
+		d.l.Info().Msgf("The microphone of session %v ended", session)
+	}()
+}
+
+// setMicrophoneMuted mutes or unmutes a session's microphone
+func (d *Desktop) setMicrophoneMuted(session api.SessionID, muted bool) {
+	d.rwm.RLock()
+	mic := d.microphones[session]
+	d.rwm.RUnlock()
+	if mic == nil {
+		d.l.Warn().Msgf("Session %v muted its microphone, but the desktop has no audio sink", session)
+		return
+	}
+	mic.SetMuted(muted)
+}
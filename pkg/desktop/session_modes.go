@@ -0,0 +1,155 @@
+package desktop
+
+import (
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/pod-arcade/pod-arcade/api"
+)
+
+// mutedTrack stands in for a paused track. It has the track's IDs, so renegotiating
+// while it's paused doesn't look like the track was removed, but it never sends anything.
+type mutedTrack struct {
+	api.Track
+}
+
+func (m mutedTrack) Bind(ctx webrtc.TrackLocalContext) (webrtc.RTPCodecParameters, error) {
+	for _, codec := range ctx.CodecParameters() {
+		if strings.EqualFold(codec.MimeType, m.Codec().MimeType) {
+			return codec, nil
+		}
+	}
+	return webrtc.RTPCodecParameters{}, webrtc.ErrUnsupportedCodec
+}
+
+func (m mutedTrack) Unbind(webrtc.TrackLocalContext) error {
+	return nil
+}
+
+// videoPaused returns whether a session isn't getting one of its video tracks. d.rwm must be held.
+func (d *Desktop) videoPaused(session api.SessionID, v *videoSender) bool {
+	return v.paused || d.modes[session] == api.MediaModeAudioOnly
+}
+
+// keyframeInterval returns how often the session gets a keyframe, if it only gets keyframes. d.rwm must be held.
+func (d *Desktop) keyframeInterval(session api.SessionID) time.Duration {
+	if d.modes[session] == api.MediaModeThumbnail {
+		return api.ThumbnailInterval
+	}
+	return 0
+}
+
+// setSenderPaused swaps a sender's track for a muted one, or back, without renegotiating.
+// The session's claim on the track's source goes with it. d.rwm must be held.
+func (d *Desktop) setSenderPaused(session api.SessionID, sender *webrtc.RTPSender, track api.Track, paused bool) error {
+	var local webrtc.TrackLocal = track.ForSession(session)
+	if paused {
+		local = mutedTrack{track}
+	}
+	if err := sender.ReplaceTrack(local); err != nil {
+		return err
+	}
+	if d.connected[session] {
+		if paused {
+			d.mixer.ReleaseTrack(track)
+		} else {
+			d.mixer.AcquireTrack(track)
+		}
+	}
+	if !paused && track.Kind() == webrtc.RTPCodecTypeVideo {
+		// The session can't decode the track until it gets a keyframe
+		track.RequestKeyframe()
+	}
+	return nil
+}
+
+// updateVideoPaused pauses or resumes a video sender, if whether it should be paused
+// changed from wasPaused. d.rwm must be held.
+func (d *Desktop) updateVideoPaused(session api.SessionID, v *videoSender, wasPaused bool) {
+	paused := d.videoPaused(session, v)
+	if paused == wasPaused {
+		return
+	}
+	if err := d.setSenderPaused(session, v.sender, v.track, paused); err != nil {
+		d.l.Warn().Err(err).Msgf("Failed to pause video track %v of session %v", v.track.ID(), session)
+	}
+}
+
+// pauseTrack pauses or resumes the track a session gets on one of its transceivers
+func (d *Desktop) pauseTrack(session api.SessionID, pause api.PauseTrack) {
+	d.rwm.Lock()
+	defer d.rwm.Unlock()
+	s := d.sessions[session]
+	if s == nil {
+		return
+	}
+
+	var sender *webrtc.RTPSender
+	for _, t := range s.GetPeerConnection().GetTransceivers() {
+		if t.Mid() == pause.MID {
+			sender = t.Sender()
+		}
+	}
+	if sender == nil {
+		d.l.Warn().Msgf("Session %v paused track %q, which it isn't sent", session, pause.MID)
+		return
+	}
+
+	for _, v := range d.videoSenders[session] {
+		if v.sender == sender {
+			wasPaused := d.videoPaused(session, v)
+			v.paused = pause.Paused
+			d.updateVideoPaused(session, v, wasPaused)
+			d.l.Info().Msgf("Session %v paused video track %q: %v", session, pause.MID, pause.Paused)
+			return
+		}
+	}
+	for track, a := range d.audioSenders[session] {
+		if a.sender == sender {
+			if a.paused != pause.Paused {
+				if err := d.setSenderPaused(session, a.sender, track, pause.Paused); err != nil {
+					d.l.Warn().Err(err).Msgf("Failed to pause audio track %q of session %v", pause.MID, session)
+					return
+				}
+				a.paused = pause.Paused
+			}
+			d.l.Info().Msgf("Session %v paused audio track %q: %v", session, pause.MID, pause.Paused)
+			return
+		}
+	}
+}
+
+// setMediaMode changes how much of the desktop's media a session gets. Tracks the
+// session paused stay paused, whatever the mode.
+func (d *Desktop) setMediaMode(session api.SessionID, mode api.MediaMode) {
+	d.rwm.Lock()
+	defer d.rwm.Unlock()
+	if d.sessions[session] == nil || d.modes[session] == mode {
+		return
+	}
+
+	senders := d.videoSenders[session]
+	wasPaused := make([]bool, len(senders))
+	for i, v := range senders {
+		wasPaused[i] = d.videoPaused(session, v)
+	}
+	if mode == api.MediaModeFull {
+		delete(d.modes, session)
+	} else {
+		d.modes[session] = mode
+	}
+	for i, v := range senders {
+		v.track.SetKeyframeInterval(session, d.keyframeInterval(session))
+		d.updateVideoPaused(session, v, wasPaused[i])
+	}
+	d.l.Info().Msgf("Session %v switched to media mode %v", session, mode)
+}
+
+// forgetMediaMode puts a session that's leaving back in MediaModeFull. d.rwm must be held.
+func (d *Desktop) forgetMediaMode(session api.SessionID) {
+	for _, v := range d.videoSenders[session] {
+		v.track.SetKeyframeInterval(session, 0)
+	}
+	delete(d.modes, session)
+}
@@ -0,0 +1,208 @@
+// Package supervisor restarts media sources when they crash, backing off between
+// restarts, and gives up on sources that keep crashing so they don't spin forever.
+package supervisor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pod-arcade/pod-arcade/pkg/log"
+	"github.com/pod-arcade/pod-arcade/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+)
+
+// State is the health of a source
+type State string
+
+const (
+	// StateStopped sources aren't running, because nothing has asked for them
+	StateStopped State = "stopped"
+	// StateStarting sources have been started, but haven't produced any media yet
+	StateStarting State = "starting"
+	// StateRunning sources are producing media
+	StateRunning State = "running"
+	// StateDegraded sources crashed, and are being restarted
+	StateDegraded State = "degraded"
+	// StateFailed sources crashed too often, and won't be restarted until they're asked for again
+	StateFailed State = "failed"
+)
+
+// ErrExited is the crash of a source that stopped on its own without an error
+var ErrExited = errors.New("source exited")
+
+type Config struct {
+	// MinBackoff is the delay before restarting a source that crashed. It doubles
+	// with each crash in the crash loop window, up to MaxBackoff.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// A source that crashes CrashLoopCount times within CrashLoopWindow is failed
+	CrashLoopCount  int
+	CrashLoopWindow time.Duration
+}
+
+var DefaultConfig = Config{
+	MinBackoff:      500 * time.Millisecond,
+	MaxBackoff:      30 * time.Second,
+	CrashLoopCount:  5,
+	CrashLoopWindow: time.Minute,
+}
+
+// Health is what the supervisor knows about its source
+type Health struct {
+	Source    string    `json:"source"`
+	State     State     `json:"state"`
+	Restarts  int       `json:"restarts"`
+	LastError string    `json:"lastError,omitempty"`
+	Since     time.Time `json:"since"`
+}
+
+// HealthHandler is called whenever the state of a source changes
+type HealthHandler func(Health)
+
+// Supervisor runs a single source
+type Supervisor struct {
+	config Config
+
+	health  Health
+	crashes []time.Time
+	handler HealthHandler
+	mtx     sync.Mutex
+	// waiting is set until a source that's starting or restarting produces media
+	waiting atomic.Bool
+
+	restarts prometheus.Counter
+	running  prometheus.Gauge
+	l        zerolog.Logger
+}
+
+func New(name string, config Config) *Supervisor {
+	labels := prometheus.Labels{"source": name}
+	return &Supervisor{
+		config:   config,
+		health:   Health{Source: name, State: StateStopped, Since: time.Now()},
+		restarts: metrics.GlobalMetricCache.GetCounter("source_restarts", labels),
+		running:  metrics.GlobalMetricCache.GetGauge("source_running", labels),
+		l:        log.NewLogger("Supervisor", map[string]string{"source": name}),
+	}
+}
+
+// OnHealthChange sets the handler for changes of state. It's called without any locks held.
+func (s *Supervisor) OnHealthChange(h HealthHandler) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.handler = h
+}
+
+func (s *Supervisor) Health() Health {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.health
+}
+
+// Run calls run until the context is done, restarting it whenever it returns
+// early. It returns an error once the source is failed.
+func (s *Supervisor) Run(ctx context.Context, run func(context.Context) error) error {
+	// Asking for a failed source again gives it another chance
+	s.mtx.Lock()
+	s.crashes = nil
+	s.mtx.Unlock()
+	s.setState(StateStarting, nil)
+	defer func() {
+		if s.Health().State != StateFailed {
+			s.setState(StateStopped, nil)
+		}
+	}()
+
+	for {
+		err := run(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err == nil {
+			err = ErrExited
+		}
+
+		backoff, crashLoop := s.crashed(time.Now())
+		if crashLoop {
+			s.setState(StateFailed, err)
+			s.l.Error().Err(err).Msgf("Crashed %v times in %v, giving up", s.config.CrashLoopCount, s.config.CrashLoopWindow)
+			return fmt.Errorf("crash loop: %w", err)
+		}
+		s.setState(StateDegraded, err)
+		s.l.Warn().Err(err).Msgf("Crashed, restarting in %v", backoff)
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		}
+		s.restarts.Inc()
+		s.mtx.Lock()
+		s.health.Restarts++
+		s.mtx.Unlock()
+	}
+}
+
+// crashed records a crash, returning how long to wait before restarting, and
+// whether the source is crash looping
+func (s *Supervisor) crashed(now time.Time) (time.Duration, bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	recent := s.crashes[:0]
+	for _, t := range s.crashes {
+		if now.Sub(t) < s.config.CrashLoopWindow {
+			recent = append(recent, t)
+		}
+	}
+	s.crashes = append(recent, now)
+	if len(s.crashes) >= s.config.CrashLoopCount {
+		return 0, true
+	}
+
+	backoff := s.config.MinBackoff
+	for i := 1; i < len(s.crashes) && backoff < s.config.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, s.config.MaxBackoff), false
+}
+
+// Alive is called whenever the source produces media, which marks it as running
+func (s *Supervisor) Alive() {
+	if s.waiting.CompareAndSwap(true, false) {
+		s.setState(StateRunning, nil)
+	}
+}
+
+func (s *Supervisor) setState(state State, err error) {
+	s.mtx.Lock()
+	if s.health.State == state && err == nil {
+		s.mtx.Unlock()
+		return
+	}
+	s.health.State = state
+	s.health.Since = time.Now()
+	if err != nil {
+		s.health.LastError = err.Error()
+	}
+	health := s.health
+	handler := s.handler
+	s.waiting.Store(state == StateStarting || state == StateDegraded)
+	s.mtx.Unlock()
+
+	if state == StateRunning {
+		s.running.Set(1)
+	} else {
+		s.running.Set(0)
+	}
+	s.l.Debug().Msgf("Source is %v", state)
+	if handler != nil {
+		handler(health)
+	}
+}
@@ -0,0 +1,88 @@
+package supervisor
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+var testConfig = Config{
+	MinBackoff:      time.Millisecond,
+	MaxBackoff:      4 * time.Millisecond,
+	CrashLoopCount:  3,
+	CrashLoopWindow: time.Minute,
+}
+
+func TestSupervisor_GivesUpOnCrashLoops(t *testing.T) {
+	s := New("crashing", testConfig)
+	states := []State{}
+	s.OnHealthChange(func(h Health) { states = append(states, h.State) })
+
+	runs := 0
+	err := s.Run(context.Background(), func(ctx context.Context) error {
+		runs++
+		return errors.New("encoder crashed")
+	})
+	if err == nil {
+		t.Fatal("Expected an error once the source was crash looping")
+	}
+	if runs != 3 {
+		t.Errorf("Expected 3 runs before giving up, got %v", runs)
+	}
+	h := s.Health()
+	if h.State != StateFailed || h.Restarts != 2 || h.LastError != "encoder crashed" {
+		t.Errorf("Expected a failed source with 2 restarts, got %+v", h)
+	}
+	expected := []State{StateStarting, StateDegraded, StateDegraded, StateFailed}
+	if len(states) != len(expected) {
+		t.Fatalf("Expected states %v, got %v", expected, states)
+	}
+	for i := range expected {
+		if states[i] != expected[i] {
+			t.Errorf("Expected states %v, got %v", expected, states)
+			break
+		}
+	}
+}
+
+func TestSupervisor_RestartsUntilDone(t *testing.T) {
+	s := New("recovering", testConfig)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	runs := 0
+	err := s.Run(ctx, func(ctx context.Context) error {
+		runs++
+		if runs == 1 {
+			// Exiting without an error is still a crash
+			return nil
+		}
+		s.Alive()
+		if h := s.Health(); h.State != StateRunning {
+			t.Errorf("Expected the source to be running once it produced media, got %v", h.State)
+		}
+		cancel()
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h := s.Health(); h.State != StateStopped || h.Restarts != 1 || h.LastError != ErrExited.Error() {
+		t.Errorf("Expected a stopped source with 1 restart, got %+v", h)
+	}
+}
+
+func TestSupervisor_BacksOff(t *testing.T) {
+	s := New("backoff", Config{MinBackoff: time.Second, MaxBackoff: 3 * time.Second, CrashLoopCount: 10, CrashLoopWindow: time.Minute})
+	now := time.Now()
+	for i, expected := range []time.Duration{time.Second, 2 * time.Second, 3 * time.Second, 3 * time.Second} {
+		if backoff, _ := s.crashed(now); backoff != expected {
+			t.Errorf("Expected crash %v to back off %v, got %v", i, expected, backoff)
+		}
+	}
+	// Crashes outside the window are forgotten
+	if backoff, _ := s.crashed(now.Add(2 * time.Minute)); backoff != time.Second {
+		t.Errorf("Expected the backoff to reset after the window, got %v", backoff)
+	}
+}
@@ -1,16 +1,32 @@
 package desktop
 
 import (
+	"errors"
+	"fmt"
+	"strings"
+
 	"github.com/pion/ice/v3"
 	"github.com/pion/interceptor"
 	"github.com/pion/webrtc/v4"
 	"github.com/pod-arcade/pod-arcade/api"
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/webrtc_interceptors/flexfec"
 	"github.com/pod-arcade/pod-arcade/pkg/desktop/webrtc_interceptors/nack"
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/webrtc_interceptors/pacer"
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/webrtc_interceptors/sender_report"
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/webrtc_interceptors/stream_registry"
 )
 
 type WebRTCAPIConfig struct {
 	SinglePort  int
 	ExternalIPs []string
+	// FECOverhead is how many FlexFEC packets to send per video packet, from 0 to 1. 0 disables FEC.
+	FECOverhead float64
+	// PacerRate is the rate in bits per second that packets are paced at. 0 disables pacing.
+	PacerRate int
+	// PacerBurst is how many bytes may leave at once after an idle period
+	PacerBurst int
+	// PacerFrameSpread is the fraction of the frame interval that a large frame is spread across
+	PacerFrameSpread float64
 }
 
 // If the GetWebRTCAPI's second parameter is not set to 0, it will use a single port for all of the
@@ -40,22 +56,126 @@ func GetWebRTCAPI(d api.Desktop, c *WebRTCAPIConfig) (*webrtc.API, error) {
 		}
 	}
 
+	usedPayloadTypes := map[webrtc.PayloadType]bool{}
+	receivesOpus := false
+	for _, s := range d.GetAudioSources() {
+		usedPayloadTypes[s.GetAudioCodecParameters().PayloadType] = true
+		receivesOpus = receivesOpus || strings.EqualFold(s.GetAudioCodecParameters().MimeType, webrtc.MimeTypeOpus)
+	}
+
+	// Sessions send their microphones with Opus, even when the desktop's own audio isn't
+	if d.GetAudioSink() != nil && !receivesOpus && !usedPayloadTypes[microphonePayloadType] {
+		if err := mediaEngine.RegisterCodec(webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{
+				MimeType:    webrtc.MimeTypeOpus,
+				ClockRate:   48000,
+				Channels:    2,
+				SDPFmtpLine: "minptime=10;useinbandfec=1",
+			},
+			PayloadType: microphonePayloadType,
+		}, webrtc.RTPCodecTypeAudio); err != nil {
+			return nil, err
+		}
+		usedPayloadTypes[microphonePayloadType] = true
+	}
 	for _, s := range d.GetVideoSources() {
-		if err := mediaEngine.RegisterCodec(s.GetVideoCodecParameters(), webrtc.RTPCodecTypeVideo); err != nil {
+		usedPayloadTypes[s.GetVideoCodecParameters().PayloadType] = true
+	}
+
+	for _, s := range d.GetVideoSources() {
+		params := s.GetVideoCodecParameters()
+		if err := mediaEngine.RegisterCodec(params, webrtc.RTPCodecTypeVideo); err != nil {
+			return nil, err
+		}
+
+		// Retransmissions go on their own stream, so they don't skew the receiver's loss stats
+		rtxPayloadType, err := freePayloadType(usedPayloadTypes)
+		if err != nil {
+			return nil, err
+		}
+		if err := mediaEngine.RegisterCodec(webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{
+				MimeType:    "video/rtx",
+				ClockRate:   90000,
+				SDPFmtpLine: fmt.Sprintf("apt=%d", params.PayloadType),
+			},
+			PayloadType: rtxPayloadType,
+		}, webrtc.RTPCodecTypeVideo); err != nil {
+			return nil, err
+		}
+	}
+
+	fecEnabled := c != nil && c.FECOverhead > 0
+	if fecEnabled {
+		fecPayloadType, err := freePayloadType(usedPayloadTypes)
+		if err != nil {
+			return nil, err
+		}
+		if err := mediaEngine.RegisterCodec(webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{
+				MimeType:    "video/flexfec-03",
+				ClockRate:   90000,
+				SDPFmtpLine: "repair-window=10000000",
+			},
+			PayloadType: fecPayloadType,
+		}, webrtc.RTPCodecTypeVideo); err != nil {
 			return nil, err
 		}
 	}
 
-	// Register NACK Interceptor
 	registry := &interceptor.Registry{}
-	responderFac, err := nack.NewResponderInterceptor(nack.ResponderSize(32768)) //at most, 36MB of data.
+
+	// The interceptors look up which source and session a stream is from in the
+	// registry that the desktop's tracks register their streams in
+	streams := stream_registry.New()
+	if desktop, ok := d.(*Desktop); ok {
+		streams = desktop.mixer.Streams()
+	}
+
+	// Register the pacer first, so that everything sent, including FEC and retransmissions, is paced
+	if c != nil && c.PacerRate > 0 {
+		opts := []pacer.Option{pacer.Rate(c.PacerRate), pacer.FrameSpread(c.PacerFrameSpread)}
+		if c.PacerBurst > 0 {
+			opts = append(opts, pacer.Burst(c.PacerBurst))
+		}
+		pacerFac, err := pacer.NewInterceptor(streams, opts...)
+		if err != nil {
+			return nil, err
+		}
+		registry.Add(pacerFac)
+	}
+
+	// Register FlexFEC before NACK, so it protects packets as they're sent
+	if fecEnabled {
+		fecFac, err := flexfec.NewInterceptor(streams, flexfec.Overhead(c.FECOverhead))
+		if err != nil {
+			return nil, err
+		}
+		registry.Add(fecFac)
+	}
+
+	// Register NACK Interceptor
+	// Sessions share one buffer per source track, so this is at most 36MB per source.
+	responderFac, err := nack.NewResponderInterceptor(streams, nack.ResponderSize(32768))
 	if err != nil {
 		return nil, err
 	}
 
 	registry.Add(responderFac)
 
-	// don't advertise supporting PLI in the parameter, since we can't actually trigger an IDR frame.
+	// Register Sender Reports, so that clients can map audio and video
+	// onto the same clock and keep them in sync.
+	senderReportFac, err := sender_report.NewSenderInterceptor()
+	if err != nil {
+		return nil, err
+	}
+
+	registry.Add(senderReportFac)
+
+	// PLI and FIR aren't advertised. Sources share one encoder between sessions, and the
+	// capture encoders can only make a keyframe by restarting, so one lossy session
+	// would interrupt everyone. NACKs, RTX and FlexFEC repair loss instead, and a
+	// session that still drops frames waits for the encoder's own next keyframe.
 	mediaEngine.RegisterFeedback(webrtc.RTCPFeedback{Type: "nack", Parameter: ""}, webrtc.RTPCodecTypeVideo)
 
 	// Create WebRTC API
@@ -63,3 +183,14 @@ func GetWebRTCAPI(d api.Desktop, c *WebRTCAPIConfig) (*webrtc.API, error) {
 
 	return api, nil
 }
+
+// freePayloadType reserves the first dynamic payload type that isn't in use
+func freePayloadType(used map[webrtc.PayloadType]bool) (webrtc.PayloadType, error) {
+	for pt := webrtc.PayloadType(96); pt <= 127; pt++ {
+		if !used[pt] {
+			used[pt] = true
+			return pt, nil
+		}
+	}
+	return 0, errors.New("no dynamic payload types left")
+}
@@ -0,0 +1,161 @@
+package flexfec
+
+import (
+	"encoding/binary"
+	"math"
+
+	"github.com/pion/rtp"
+)
+
+const (
+	// headerSize is the size of a FlexFEC-03 header protecting one SSRC with a 15 bit mask
+	headerSize = 20
+	// maxGroupSize is the most media packets that fit in a 15 bit mask
+	maxGroupSize = 15
+	// rtpHeaderSize is the fixed part of an RTP header, which FEC recovers field by field
+	rtpHeaderSize = 12
+)
+
+// protectedPacket is what the encoder keeps of a media packet until its group is protected
+type protectedPacket struct {
+	sequenceNumber uint16
+	timestamp      uint32
+	// data is the marshaled packet
+	data []byte
+}
+
+// encoder generates FlexFEC-03 packets, as libwebrtc implements them, for one media stream.
+//
+// Media packets are protected in groups of up to 15, ending early at the end of
+// a frame so that FEC never waits for the next frame. With n FEC packets for a
+// group, FEC packet j protects every n-th packet starting at j, so a burst of
+// up to n lost packets can be recovered.
+type encoder struct {
+	protectedSSRC uint32
+	ssrc          uint32
+	payloadType   uint8
+	sequencer     rtp.Sequencer
+	overhead      float64
+
+	group []protectedPacket
+	// spare holds buffers from earlier groups, to be reused
+	spare   [][]byte
+	lastSeq uint16
+	started bool
+}
+
+func newEncoder(protectedSSRC uint32, ssrc uint32, payloadType uint8, overhead float64) *encoder {
+	return &encoder{
+		protectedSSRC: protectedSSRC,
+		ssrc:          ssrc,
+		payloadType:   payloadType,
+		sequencer:     rtp.NewRandomSequencer(),
+		overhead:      overhead,
+	}
+}
+
+// add protects a media packet, and returns any FEC packets that are ready to send
+func (e *encoder) add(header *rtp.Header, payload []byte) []*rtp.Packet {
+	if e.started {
+		diff := header.SequenceNumber - e.lastSeq
+		if diff == 0 || diff >= 1<<15 {
+			// A retransmission, which was protected the first time
+			return nil
+		}
+	}
+	e.started = true
+	e.lastSeq = header.SequenceNumber
+
+	var fec []*rtp.Packet
+	if len(e.group) > 0 && header.SequenceNumber-e.group[0].sequenceNumber >= maxGroupSize {
+		// Dropped packets left a gap too big for the mask
+		fec = e.protectGroup()
+	}
+
+	var data []byte
+	if len(e.spare) > 0 {
+		data = e.spare[len(e.spare)-1][:0]
+		e.spare = e.spare[:len(e.spare)-1]
+	}
+	data = append(data, make([]byte, header.MarshalSize())...)
+	n, err := header.MarshalTo(data)
+	if err != nil {
+		return fec
+	}
+	data = append(data[:n], payload...)
+
+	e.group = append(e.group, protectedPacket{
+		sequenceNumber: header.SequenceNumber,
+		timestamp:      header.Timestamp,
+		data:           data,
+	})
+
+	if header.Marker || len(e.group) == maxGroupSize {
+		fec = append(fec, e.protectGroup()...)
+	}
+	return fec
+}
+
+// protectGroup returns the FEC packets for the current group, and starts a new one
+func (e *encoder) protectGroup() []*rtp.Packet {
+	count := int(math.Ceil(float64(len(e.group)) * e.overhead))
+	count = min(max(count, 1), len(e.group))
+
+	fec := make([]*rtp.Packet, 0, count)
+	for j := 0; j < count; j++ {
+		covered := []protectedPacket{}
+		for i := j; i < len(e.group); i += count {
+			covered = append(covered, e.group[i])
+		}
+		fec = append(fec, e.fecPacket(covered))
+	}
+
+	for _, p := range e.group {
+		e.spare = append(e.spare, p.data)
+	}
+	e.group = e.group[:0]
+	return fec
+}
+
+// fecPacket XORs the covered packets together behind a FlexFEC-03 header
+func (e *encoder) fecPacket(covered []protectedPacket) *rtp.Packet {
+	size := 0
+	for _, p := range covered {
+		size = max(size, len(p.data)-rtpHeaderSize)
+	}
+
+	base := e.group[0].sequenceNumber
+	payload := make([]byte, headerSize+size)
+	var lengthRecovery uint16
+	var timestampRecovery uint32
+	mask := uint16(0x8000) // the k bit, marking the end of the mask
+	for _, p := range covered {
+		payload[0] ^= p.data[0]
+		payload[1] ^= p.data[1]
+		lengthRecovery ^= uint16(len(p.data) - rtpHeaderSize)
+		timestampRecovery ^= p.timestamp
+		for i, b := range p.data[rtpHeaderSize:] {
+			payload[headerSize+i] ^= b
+		}
+		mask |= 1 << (14 - (p.sequenceNumber - base))
+	}
+
+	payload[0] &= 0x3f // R and F are both 0, for a flexible mask
+	binary.BigEndian.PutUint16(payload[2:], lengthRecovery)
+	binary.BigEndian.PutUint32(payload[4:], timestampRecovery)
+	payload[8] = 1 // SSRCCount
+	binary.BigEndian.PutUint32(payload[12:], e.protectedSSRC)
+	binary.BigEndian.PutUint16(payload[16:], base)
+	binary.BigEndian.PutUint16(payload[18:], mask)
+
+	return &rtp.Packet{
+		Header: rtp.Header{
+			Version:        2,
+			PayloadType:    e.payloadType,
+			SequenceNumber: e.sequencer.NextSequenceNumber(),
+			Timestamp:      covered[len(covered)-1].timestamp,
+			SSRC:           e.ssrc,
+		},
+		Payload: payload,
+	}
+}
@@ -0,0 +1,91 @@
+package flexfec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/pion/rtp"
+)
+
+// recoverPacket rebuilds the one packet covered by fec that isn't in received
+func recoverPacket(fec *rtp.Packet, received []*rtp.Packet) *rtp.Packet {
+	body := append([]byte{}, fec.Payload[headerSize:]...)
+	first, second := fec.Payload[0], fec.Payload[1]
+	length := binary.BigEndian.Uint16(fec.Payload[2:])
+	timestamp := binary.BigEndian.Uint32(fec.Payload[4:])
+	for _, p := range received {
+		data, _ := p.Marshal()
+		first ^= data[0]
+		second ^= data[1]
+		length ^= uint16(len(data) - rtpHeaderSize)
+		timestamp ^= p.Timestamp
+		for i, b := range data[rtpHeaderSize:] {
+			body[i] ^= b
+		}
+	}
+
+	data := make([]byte, rtpHeaderSize, rtpHeaderSize+int(length))
+	data[0] = 0x80 | first&0x3f
+	data[1] = second
+	binary.BigEndian.PutUint32(data[4:], timestamp)
+	binary.BigEndian.PutUint32(data[8:], binary.BigEndian.Uint32(fec.Payload[12:]))
+	data = append(data, body[:length]...)
+
+	p := &rtp.Packet{}
+	if err := p.Unmarshal(data); err != nil {
+		return nil
+	}
+	return p
+}
+
+func TestEncoder_RecoversLostPacket(t *testing.T) {
+	enc := newEncoder(1234, 5678, 118, 0.5)
+
+	packets := []*rtp.Packet{}
+	fec := []*rtp.Packet{}
+	for i := 0; i < 4; i++ {
+		p := &rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				PayloadType:    102,
+				SequenceNumber: uint16(65534 + i),
+				Timestamp:      3000,
+				SSRC:           1234,
+				Marker:         i == 3,
+			},
+			Payload: bytes.Repeat([]byte{byte(i + 1)}, 10+i*7),
+		}
+		packets = append(packets, p)
+		fec = append(fec, enc.add(&p.Header, p.Payload)...)
+	}
+
+	if len(fec) != 2 {
+		t.Fatalf("Expected 2 FEC packets for 4 media packets, got %d", len(fec))
+	}
+	if mask := binary.BigEndian.Uint16(fec[1].Payload[18:]); mask != 0x8000|1<<13|1<<11 {
+		t.Errorf("Expected the second FEC packet to cover packets 1 and 3, got mask %016b", mask)
+	}
+
+	// Lose packet 1, which the second FEC packet covers along with packet 3
+	recovered := recoverPacket(fec[1], []*rtp.Packet{packets[3]})
+	if recovered == nil {
+		t.Fatal("Failed to recover the packet")
+	}
+	recovered.SequenceNumber = packets[1].SequenceNumber
+	if recovered.Marker != packets[1].Marker || recovered.PayloadType != 102 || !bytes.Equal(recovered.Payload, packets[1].Payload) {
+		t.Errorf("Recovered %v, expected %v", recovered, packets[1])
+	}
+}
+
+func TestEncoder_IgnoresRetransmissions(t *testing.T) {
+	enc := newEncoder(1234, 5678, 118, 1)
+
+	header := &rtp.Header{Version: 2, SequenceNumber: 10, SSRC: 1234, Marker: true}
+	if fec := enc.add(header, []byte{1}); len(fec) != 1 {
+		t.Fatalf("Expected 1 FEC packet, got %d", len(fec))
+	}
+	if fec := enc.add(header, []byte{1}); len(fec) != 0 {
+		t.Errorf("Expected a resent packet not to be protected again")
+	}
+}
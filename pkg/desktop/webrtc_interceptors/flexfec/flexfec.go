@@ -0,0 +1,125 @@
+// Package flexfec provides an interceptor that sends FlexFEC-03 packets
+// alongside video streams that negotiated it, so that clients can recover
+// lost packets without waiting a round trip for a retransmission.
+package flexfec
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/webrtc_interceptors/stream_registry"
+	"github.com/pod-arcade/pod-arcade/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var errInvalidOverhead = errors.New("flexfec overhead must be greater than 0 and at most 1")
+
+// InterceptorFactory is a interceptor.Factory for an Interceptor
+type InterceptorFactory struct {
+	streams *stream_registry.Registry
+	opts    []Option
+}
+
+// NewInterceptor returns a new InterceptorFactory, for the streams registered in streams
+func NewInterceptor(streams *stream_registry.Registry, opts ...Option) (*InterceptorFactory, error) {
+	// check the options now, rather than on every peer connection
+	for _, opt := range opts {
+		if err := opt(&Interceptor{}); err != nil {
+			return nil, err
+		}
+	}
+	return &InterceptorFactory{streams: streams, opts: opts}, nil
+}
+
+// NewInterceptor constructs a new Interceptor
+func (f *InterceptorFactory) NewInterceptor(_ string) (interceptor.Interceptor, error) {
+	i := &Interceptor{
+		streams:  f.streams,
+		overhead: 0.1,
+		labels:   map[uint32]prometheus.Labels{},
+	}
+
+	for _, opt := range f.opts {
+		if err := opt(i); err != nil {
+			return nil, err
+		}
+	}
+
+	return i, nil
+}
+
+// Option can be used to configure Interceptor
+type Option func(i *Interceptor) error
+
+// Overhead sets how many FEC packets are sent per media packet, from 0 to 1
+func Overhead(overhead float64) Option {
+	return func(i *Interceptor) error {
+		if overhead <= 0 || overhead > 1 {
+			return errInvalidOverhead
+		}
+		i.overhead = overhead
+		return nil
+	}
+}
+
+// Interceptor sends FlexFEC packets for every local stream with a FlexFEC payload type
+type Interceptor struct {
+	interceptor.NoOp
+	streams  *stream_registry.Registry
+	overhead float64
+
+	// labels are the labels of each stream's metrics, which are removed with the stream
+	labels map[uint32]prometheus.Labels
+	mtx    sync.Mutex
+}
+
+// BindLocalStream lets you modify any outgoing RTP packets. It is called once for per LocalStream. The returned method
+// will be called once per rtp packet.
+func (i *Interceptor) BindLocalStream(info *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	stream := i.streams.Get(info.ID)
+	if stream.FECPayloadType == 0 {
+		return writer
+	}
+
+	labels := prometheus.Labels{"session": stream.Session, "track": stream.Source}
+	fecPackets := metrics.GlobalMetricCache.GetCounter("fec_packets_sent", labels)
+	fecBytes := metrics.GlobalMetricCache.GetCounter("fec_bytes_sent", labels)
+	i.mtx.Lock()
+	i.labels[info.SSRC] = labels
+	i.mtx.Unlock()
+
+	enc := newEncoder(info.SSRC, stream_registry.FECSSRC(info.SSRC), stream.FECPayloadType, i.overhead)
+	// NACK responses are written from another goroutine
+	var mtx sync.Mutex
+
+	return interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, attributes interceptor.Attributes) (int, error) {
+		n, err := writer.Write(header, payload, attributes)
+		if err != nil || header.SSRC != info.SSRC {
+			return n, err
+		}
+
+		mtx.Lock()
+		defer mtx.Unlock()
+		for _, p := range enc.add(header, payload) {
+			if _, err := writer.Write(&p.Header, p.Payload, nil); err == nil {
+				fecPackets.Inc()
+				fecBytes.Add(float64(len(p.Payload)))
+			}
+		}
+		return n, err
+	})
+}
+
+// UnbindLocalStream removes the stream's metrics, since the session's series would otherwise be kept forever
+func (i *Interceptor) UnbindLocalStream(info *interceptor.StreamInfo) {
+	i.mtx.Lock()
+	labels, ok := i.labels[info.SSRC]
+	delete(i.labels, info.SSRC)
+	i.mtx.Unlock()
+	if ok {
+		metrics.GlobalMetricCache.Remove("fec_packets_sent", labels)
+		metrics.GlobalMetricCache.Remove("fec_bytes_sent", labels)
+	}
+}
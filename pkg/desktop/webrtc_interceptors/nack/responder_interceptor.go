@@ -4,12 +4,14 @@
 package nack
 
 import (
+	"encoding/binary"
 	"sync"
 
 	"github.com/pion/interceptor"
 	"github.com/pion/logging"
 	"github.com/pion/rtcp"
 	"github.com/pion/rtp"
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/webrtc_interceptors/stream_registry"
 	"github.com/pod-arcade/pod-arcade/pkg/metrics"
 	"github.com/prometheus/client_golang/prometheus"
 )
@@ -21,7 +23,12 @@ var nacksFailed = metrics.GlobalMetricCache.GetCounter("nacks_sent", prometheus.
 
 // ResponderInterceptorFactory is a interceptor.Factory for a ResponderInterceptor
 type ResponderInterceptorFactory struct {
-	opts []ResponderOption
+	registry *stream_registry.Registry
+	opts     []ResponderOption
+
+	// buffers are shared by the interceptors of every peer connection
+	buffers   *bufferRegistry
+	buffersMu sync.Mutex
 }
 
 type packetFactory interface {
@@ -31,9 +38,10 @@ type packetFactory interface {
 // NewInterceptor constructs a new ResponderInterceptor
 func (r *ResponderInterceptorFactory) NewInterceptor(_ string) (interceptor.Interceptor, error) {
 	i := &ResponderInterceptor{
-		size:    1024,
-		log:     logging.NewDefaultLoggerFactory().NewLogger("nack_responder"),
-		streams: map[uint32]*localStream{},
+		registry: r.registry,
+		size:     1024,
+		log:      logging.NewDefaultLoggerFactory().NewLogger("nack_responder"),
+		streams:  map[uint32]*localStream{},
 	}
 
 	for _, opt := range r.opts {
@@ -46,9 +54,16 @@ func (r *ResponderInterceptorFactory) NewInterceptor(_ string) (interceptor.Inte
 		i.packetFactory = newPacketManager()
 	}
 
-	if _, err := newSendBuffer(i.size); err != nil {
-		return nil, err
+	r.buffersMu.Lock()
+	defer r.buffersMu.Unlock()
+	if r.buffers == nil {
+		buffers, err := newBufferRegistry(i.size)
+		if err != nil {
+			return nil, err
+		}
+		r.buffers = buffers
 	}
+	i.buffers = r.buffers
 
 	return i, nil
 }
@@ -56,22 +71,38 @@ func (r *ResponderInterceptorFactory) NewInterceptor(_ string) (interceptor.Inte
 // ResponderInterceptor responds to nack feedback messages
 type ResponderInterceptor struct {
 	interceptor.NoOp
+	registry      *stream_registry.Registry
 	size          uint16
 	log           logging.LeveledLogger
 	packetFactory packetFactory
+	buffers       *bufferRegistry
 
 	streams   map[uint32]*localStream
 	streamsMu sync.Mutex
 }
 
 type localStream struct {
-	sendBuffer *sendBuffer
-	rtpWriter  interceptor.RTPWriter
+	source      string
+	sendBuffer  *sendBuffer
+	rtpWriter   interceptor.RTPWriter
+	payloadType uint8
+	// renumbering maps the sequence numbers the session was sent to the ones in sendBuffer
+	renumbering *stream_registry.Renumbering
+
+	// Retransmissions go on their own SSRC when RTX was negotiated
+	rtxPayloadType uint8
+	rtxSSRC        uint32
+	rtxSequencer   rtp.Sequencer
+
+	labels      prometheus.Labels
+	hits        prometheus.Counter
+	misses      prometheus.Counter
+	bytesResent prometheus.Counter
 }
 
-// NewResponderInterceptor returns a new ResponderInterceptorFactor
-func NewResponderInterceptor(opts ...ResponderOption) (*ResponderInterceptorFactory, error) {
-	return &ResponderInterceptorFactory{opts}, nil
+// NewResponderInterceptor returns a new ResponderInterceptorFactor, for the streams registered in streams
+func NewResponderInterceptor(streams *stream_registry.Registry, opts ...ResponderOption) (*ResponderInterceptorFactory, error) {
+	return &ResponderInterceptorFactory{registry: streams, opts: opts}, nil
 }
 
 // BindRTCPReader lets you modify any incoming RTCP packets. It is called once per sender/receiver, however this might
@@ -110,18 +141,39 @@ func (n *ResponderInterceptor) BindLocalStream(info *interceptor.StreamInfo, wri
 		return writer
 	}
 
-	// error is already checked in NewGeneratorInterceptor
-	sendBuffer, _ := newSendBuffer(n.size)
+	owner := n.registry.Get(info.ID)
+	labels := prometheus.Labels{"session": owner.Session, "track": owner.Source}
+	sendBuffer := n.buffers.acquire(owner.Source)
 	n.streamsMu.Lock()
-	n.streams[info.SSRC] = &localStream{sendBuffer: sendBuffer, rtpWriter: writer}
+	n.streams[info.SSRC] = &localStream{
+		source:      owner.Source,
+		sendBuffer:  sendBuffer,
+		rtpWriter:   writer,
+		payloadType: info.PayloadType,
+		renumbering: owner.Renumbering,
+
+		rtxPayloadType: owner.RTXPayloadType,
+		rtxSSRC:        stream_registry.RTXSSRC(info.SSRC),
+		rtxSequencer:   rtp.NewRandomSequencer(),
+
+		labels:      labels,
+		hits:        metrics.GlobalMetricCache.GetCounter("nack_hits", labels),
+		misses:      metrics.GlobalMetricCache.GetCounter("nack_misses", labels),
+		bytesResent: metrics.GlobalMetricCache.GetCounter("nack_retransmitted_bytes", labels),
+	}
 	n.streamsMu.Unlock()
 
 	return interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, attributes interceptor.Attributes) (int, error) {
-		pkt, err := n.packetFactory.NewPacket(header, payload)
-		if err != nil {
-			return 0, err
+		// Only the first stream to send a packet needs to store it, under the source's sequence number
+		if seq := owner.Renumbering.Original(header.SequenceNumber); !sendBuffer.has(seq) {
+			original := *header
+			original.SequenceNumber = seq
+			pkt, err := n.packetFactory.NewPacket(&original, payload)
+			if err != nil {
+				return 0, err
+			}
+			sendBuffer.add(pkt)
 		}
-		sendBuffer.add(pkt)
 		return writer.Write(header, payload, attributes)
 	})
 }
@@ -129,8 +181,30 @@ func (n *ResponderInterceptor) BindLocalStream(info *interceptor.StreamInfo, wri
 // UnbindLocalStream is called when the Stream is removed. It can be used to clean up any data related to that track.
 func (n *ResponderInterceptor) UnbindLocalStream(info *interceptor.StreamInfo) {
 	n.streamsMu.Lock()
+	stream, ok := n.streams[info.SSRC]
 	delete(n.streams, info.SSRC)
 	n.streamsMu.Unlock()
+
+	if ok {
+		n.buffers.release(stream.source)
+		// The session's series would otherwise be kept forever
+		metrics.GlobalMetricCache.Remove("nack_hits", stream.labels)
+		metrics.GlobalMetricCache.Remove("nack_misses", stream.labels)
+		metrics.GlobalMetricCache.Remove("nack_retransmitted_bytes", stream.labels)
+	}
+}
+
+// rtxPacket wraps a packet for the RTX stream, as described in RFC 4588. The
+// payload starts with the original sequence number.
+func (s *localStream) rtxPacket(header rtp.Header, payload []byte) (rtp.Header, []byte) {
+	rtxPayload := make([]byte, 2+len(payload))
+	binary.BigEndian.PutUint16(rtxPayload, header.SequenceNumber)
+	copy(rtxPayload[2:], payload)
+
+	header.SSRC = s.rtxSSRC
+	header.PayloadType = s.rtxPayloadType
+	header.SequenceNumber = s.rtxSequencer.NextSequenceNumber()
+	return header, rtxPayload
 }
 
 func (n *ResponderInterceptor) resendPackets(nack *rtcp.TransportLayerNack) {
@@ -144,16 +218,28 @@ func (n *ResponderInterceptor) resendPackets(nack *rtcp.TransportLayerNack) {
 	for i := range nack.Nacks {
 		nackPackets.Add(1)
 		nack.Nacks[i].Range(func(seq uint16) bool {
-			if p := stream.sendBuffer.get(seq); p != nil {
-				if _, err := stream.rtpWriter.Write(p.Header(), p.Payload(), interceptor.Attributes{}); err != nil {
+			if p := stream.sendBuffer.get(stream.renumbering.Original(seq)); p != nil {
+				// The stored packet may have been written by another session's stream
+				header := *p.Header()
+				header.SequenceNumber = seq
+				header.SSRC = nack.MediaSSRC
+				header.PayloadType = stream.payloadType
+				payload := p.Payload()
+				if stream.rtxPayloadType != 0 {
+					header, payload = stream.rtxPacket(header, payload)
+				}
+				if _, err := stream.rtpWriter.Write(&header, payload, interceptor.Attributes{}); err != nil {
 					nacksFailed.Add(1)
 					n.log.Warnf("failed resending nacked packet: %+v", err)
 				} else {
 					nacksSuccessful.Add(1)
+					stream.hits.Inc()
+					stream.bytesResent.Add(float64(len(p.Payload())))
 				}
 				p.Release()
 			} else {
 				nacksMissing.Add(1)
+				stream.misses.Inc()
 			}
 
 			return true
@@ -55,17 +55,20 @@ func (s *sendBuffer) add(packet *retainablePacket) {
 	}
 
 	diff := seq - s.lastAdded
-	if diff == 0 {
+	if diff == 0 || diff >= uint16SizeHalf {
+		// Streams sharing the buffer write the same packets, so an old or
+		// repeated sequence number has already been added by another stream.
+		packet.Release()
 		return
-	} else if diff < uint16SizeHalf {
-		for i := s.lastAdded + 1; i != seq; i++ {
-			idx := i % s.size
-			prevPacket := s.packets[idx]
-			if prevPacket != nil {
-				prevPacket.Release()
-			}
-			s.packets[idx] = nil
+	}
+
+	for i := s.lastAdded + 1; i != seq; i++ {
+		idx := i % s.size
+		prevPacket := s.packets[idx]
+		if prevPacket != nil {
+			prevPacket.Release()
 		}
+		s.packets[idx] = nil
 	}
 
 	idx := seq % s.size
@@ -77,6 +80,32 @@ func (s *sendBuffer) add(packet *retainablePacket) {
 	s.lastAdded = seq
 }
 
+// has returns whether the packet with this sequence number was already added
+func (s *sendBuffer) has(seq uint16) bool {
+	s.m.RLock()
+	defer s.m.RUnlock()
+
+	if !s.started {
+		return false
+	}
+	diff := s.lastAdded - seq
+	return diff < uint16SizeHalf && diff < s.size
+}
+
+// clear releases every packet in the buffer
+func (s *sendBuffer) clear() {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	for i, pkt := range s.packets {
+		if pkt != nil {
+			pkt.Release()
+		}
+		s.packets[i] = nil
+	}
+	s.started = false
+}
+
 func (s *sendBuffer) get(seq uint16) *retainablePacket {
 	s.m.RLock()
 	defer s.m.RUnlock()
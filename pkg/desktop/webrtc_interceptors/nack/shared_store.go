@@ -0,0 +1,66 @@
+package nack
+
+import (
+	"sync"
+)
+
+// Every session gets the same packets from a source track, with the same
+// sequence numbers, so one send buffer per source is enough to answer NACKs
+// from all of them. The stream registry says which source each stream is from.
+// Tracks number packets themselves, so the numbers keep going up even when the
+// source restarts.
+
+type sharedBuffer struct {
+	buffer *sendBuffer
+	refs   int
+}
+
+// bufferRegistry hands out one reference counted send buffer per source
+type bufferRegistry struct {
+	size    uint16
+	buffers map[string]*sharedBuffer
+	mtx     sync.Mutex
+}
+
+func newBufferRegistry(size uint16) (*bufferRegistry, error) {
+	// check the size now, rather than on every acquire
+	if _, err := newSendBuffer(size); err != nil {
+		return nil, err
+	}
+	return &bufferRegistry{
+		size:    size,
+		buffers: map[string]*sharedBuffer{},
+	}, nil
+}
+
+// acquire returns the send buffer for source, creating it for the first stream
+func (r *bufferRegistry) acquire(source string) *sendBuffer {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	shared, ok := r.buffers[source]
+	if !ok {
+		// the size was checked in newBufferRegistry
+		buffer, _ := newSendBuffer(r.size)
+		shared = &sharedBuffer{buffer: buffer}
+		r.buffers[source] = shared
+	}
+	shared.refs++
+	return shared.buffer
+}
+
+// release drops a stream's reference, freeing the buffer after the last one
+func (r *bufferRegistry) release(source string) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	shared, ok := r.buffers[source]
+	if !ok {
+		return
+	}
+	shared.refs--
+	if shared.refs == 0 {
+		shared.buffer.clear()
+		delete(r.buffers, source)
+	}
+}
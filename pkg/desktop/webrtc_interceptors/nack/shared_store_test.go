@@ -0,0 +1,61 @@
+package nack
+
+import (
+	"testing"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/webrtc_interceptors/stream_registry"
+)
+
+func TestResponderInterceptor_SharesBufferBetweenSessions(t *testing.T) {
+	streams := stream_registry.New()
+	factory, err := NewResponderInterceptor(streams, ResponderSize(8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	newResponder := func() *ResponderInterceptor {
+		i, err := factory.NewInterceptor("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return i.(*ResponderInterceptor)
+	}
+	first, second := newResponder(), newResponder()
+
+	streams.Register("first", stream_registry.Stream{Source: "video", Session: "session-1"})
+	streams.Register("second", stream_registry.Stream{Source: "video", Session: "session-2"})
+
+	feedback := []interceptor.RTCPFeedback{{Type: "nack"}}
+	firstInfo := &interceptor.StreamInfo{ID: "first", SSRC: 1, PayloadType: 102, RTCPFeedback: feedback}
+	secondInfo := &interceptor.StreamInfo{ID: "second", SSRC: 2, PayloadType: 103, RTCPFeedback: feedback}
+
+	resent := []rtp.Header{}
+	writer := first.BindLocalStream(firstInfo, interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, _ interceptor.Attributes) (int, error) {
+		return len(payload), nil
+	}))
+	second.BindLocalStream(secondInfo, interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, _ interceptor.Attributes) (int, error) {
+		resent = append(resent, *header)
+		return len(payload), nil
+	}))
+
+	if _, err := writer.Write(&rtp.Header{SequenceNumber: 10, SSRC: 1, PayloadType: 102}, []byte{1, 2, 3}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// The second session never stored packet 10 itself, but can still resend it
+	second.resendPackets(&rtcp.TransportLayerNack{MediaSSRC: 2, Nacks: []rtcp.NackPair{{PacketID: 10}}})
+	if len(resent) != 1 || resent[0].SSRC != 2 || resent[0].PayloadType != 103 || resent[0].SequenceNumber != 10 {
+		t.Fatalf("Expected packet 10 to be resent on the second stream, got %v", resent)
+	}
+
+	first.UnbindLocalStream(firstInfo)
+	if len(factory.buffers.buffers) != 1 {
+		t.Errorf("Expected the buffer to stay while a session uses it")
+	}
+	second.UnbindLocalStream(secondInfo)
+	if len(factory.buffers.buffers) != 0 {
+		t.Errorf("Expected the buffer to be freed after the last session")
+	}
+}
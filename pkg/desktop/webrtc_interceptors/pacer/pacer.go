@@ -0,0 +1,368 @@
+// Package pacer provides an interceptor that paces outgoing RTP packets
+// through a leaky bucket, so that a keyframe leaves as a steady stream of
+// packets instead of a burst that overflows shallow router buffers.
+package pacer
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/logging"
+	"github.com/pion/rtp"
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/packet_pool"
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/webrtc_interceptors/stream_registry"
+	"github.com/pod-arcade/pod-arcade/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// delayBuckets are the pacing delay histogram buckets, in seconds
+var delayBuckets = []float64{0.0005, 0.001, 0.002, 0.005, 0.01, 0.02, 0.05, 0.1, 0.2}
+
+var (
+	errInvalidRate   = errors.New("pacer rate must be greater than 0")
+	errInvalidBurst  = errors.New("pacer burst must be greater than 0")
+	errInvalidSpread = errors.New("pacer frame spread must be between 0 and 1")
+	errClosed        = errors.New("pacer closed")
+)
+
+// InterceptorFactory is a interceptor.Factory for an Interceptor
+type InterceptorFactory struct {
+	streams *stream_registry.Registry
+	opts    []Option
+}
+
+// NewInterceptor returns a new InterceptorFactory, for the streams registered in streams
+func NewInterceptor(streams *stream_registry.Registry, opts ...Option) (*InterceptorFactory, error) {
+	// check the options now, rather than on every peer connection
+	for _, opt := range opts {
+		if err := opt(&Interceptor{}); err != nil {
+			return nil, err
+		}
+	}
+	return &InterceptorFactory{streams: streams, opts: opts}, nil
+}
+
+// NewInterceptor constructs a new Interceptor
+func (f *InterceptorFactory) NewInterceptor(_ string) (interceptor.Interceptor, error) {
+	i := &Interceptor{
+		streams:       f.streams,
+		rate:          20_000_000 / 8,
+		burst:         10 * 1200,
+		spread:        0.5,
+		maxQueue:      1 << 20,
+		frameInterval: time.Second / 60,
+		now:           time.Now,
+		log:           logging.NewDefaultLoggerFactory().NewLogger("pacer"),
+		frames:        map[uint32]*frameState{},
+		delayLabels:   map[uint32]prometheus.Labels{},
+		close:         make(chan struct{}),
+	}
+
+	for _, opt := range f.opts {
+		if err := opt(i); err != nil {
+			return nil, err
+		}
+	}
+
+	i.cond = sync.NewCond(&i.mtx)
+	i.tokens = float64(i.burst)
+	i.lastRefill = i.now()
+
+	return i, nil
+}
+
+// Option can be used to configure Interceptor
+type Option func(i *Interceptor) error
+
+// Rate sets the target rate in bits per second. Frames that wouldn't leave
+// within their share of the frame interval at this rate are sent faster.
+func Rate(bitsPerSecond int) Option {
+	return func(i *Interceptor) error {
+		if bitsPerSecond <= 0 {
+			return errInvalidRate
+		}
+		i.rate = float64(bitsPerSecond) / 8
+		return nil
+	}
+}
+
+// Burst sets how many bytes may be sent at once after the pacer has been idle
+func Burst(bytes int) Option {
+	return func(i *Interceptor) error {
+		if bytes <= 0 {
+			return errInvalidBurst
+		}
+		i.burst = bytes
+		return nil
+	}
+}
+
+// FrameSpread sets the fraction of the frame interval that a frame may be
+// spread across. 0 paces at the target rate no matter how far behind it falls.
+func FrameSpread(fraction float64) Option {
+	return func(i *Interceptor) error {
+		if fraction < 0 || fraction > 1 {
+			return errInvalidSpread
+		}
+		i.spread = fraction
+		return nil
+	}
+}
+
+// Interceptor paces every RTP packet of a peer connection through one leaky bucket
+type Interceptor struct {
+	interceptor.NoOp
+	streams *stream_registry.Registry
+	// rate is the target rate in bytes per second
+	rate   float64
+	burst  int
+	spread float64
+	// maxQueue is how many bytes may be queued before writers block
+	maxQueue int
+	now      func() time.Time
+	log      logging.LeveledLogger
+
+	mtx         sync.Mutex
+	cond        *sync.Cond
+	queue       []queuedPacket
+	queuedBytes int
+	tokens      float64
+	lastRefill  time.Time
+	// frameInterval is a moving average of the time between video frames
+	frameInterval time.Duration
+	// deadline is when the newest queued video frame should have been sent by
+	deadline time.Time
+	frames   map[uint32]*frameState
+	started  bool
+	// delayLabels are the labels of each stream's delay histogram, which is removed with the stream
+	delayLabels map[uint32]prometheus.Labels
+
+	wg    sync.WaitGroup
+	close chan struct{}
+}
+
+// frameState tracks the frames of one video stream
+type frameState struct {
+	// timestamp is the timestamp of the last queued packet
+	timestamp uint32
+	// lastFrame is the timestamp of the last complete frame
+	lastFrame    uint32
+	hasLastFrame bool
+}
+
+type queuedPacket struct {
+	packet     *rtp.Packet
+	attributes interceptor.Attributes
+	writer     interceptor.RTPWriter
+	delay      prometheus.Histogram
+	queuedAt   time.Time
+}
+
+func (i *Interceptor) isClosed() bool {
+	select {
+	case <-i.close:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close stops pacing, dropping any packets that are still queued
+func (i *Interceptor) Close() error {
+	defer i.wg.Wait()
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+
+	if !i.isClosed() {
+		close(i.close)
+		i.cond.Broadcast()
+	}
+
+	return nil
+}
+
+// BindLocalStream lets you modify any outgoing RTP packets. It is called once for per LocalStream. The returned method
+// will be called once per rtp packet.
+func (i *Interceptor) BindLocalStream(info *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+
+	if i.isClosed() {
+		return writer
+	}
+	if !i.started {
+		i.started = true
+		i.wg.Add(1)
+		go i.loop()
+	}
+
+	stream := i.streams.Get(info.ID)
+	labels := prometheus.Labels{"session": stream.Session, "track": stream.Source}
+	delay := metrics.GlobalMetricCache.GetHistogram("pacer_delay_seconds", labels, delayBuckets)
+	i.delayLabels[info.SSRC] = labels
+	video := strings.HasPrefix(strings.ToLower(info.MimeType), "video/")
+
+	return interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, attributes interceptor.Attributes) (int, error) {
+		p := packet_pool.GetPacket()
+		csrc := append(p.CSRC[:0], header.CSRC...)
+		p.Header = *header
+		p.CSRC = csrc
+		if len(header.Extensions) > 0 {
+			p.Extensions = header.Clone().Extensions
+		}
+		packet_pool.SetPayload(p, payload)
+
+		i.mtx.Lock()
+		defer i.mtx.Unlock()
+
+		// Blocking here pushes back on the track's queue, which drops whole frames
+		for i.queuedBytes >= i.maxQueue && !i.isClosed() {
+			i.cond.Wait()
+		}
+		if i.isClosed() {
+			packet_pool.PutPacket(p)
+			return 0, errClosed
+		}
+
+		if video && header.SSRC == info.SSRC && info.ClockRate != 0 {
+			i.trackFrame(header, info.ClockRate)
+		}
+
+		i.queue = append(i.queue, queuedPacket{
+			packet:     p,
+			attributes: attributes,
+			writer:     writer,
+			delay:      delay,
+			queuedAt:   i.now(),
+		})
+		i.queuedBytes += len(payload)
+		i.cond.Broadcast()
+
+		return len(payload), nil
+	})
+}
+
+// UnbindLocalStream is called when the Stream is removed. It can be used to clean up any data related to that track.
+func (i *Interceptor) UnbindLocalStream(info *interceptor.StreamInfo) {
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+	delete(i.frames, info.SSRC)
+	if labels, ok := i.delayLabels[info.SSRC]; ok {
+		// The session's series would otherwise be kept forever
+		metrics.GlobalMetricCache.Remove("pacer_delay_seconds", labels)
+		delete(i.delayLabels, info.SSRC)
+	}
+}
+
+// trackFrame gives a new video frame its deadline, and folds the time
+// between complete frames into the moving average of the frame interval
+func (i *Interceptor) trackFrame(header *rtp.Header, clockRate uint32) {
+	f, ok := i.frames[header.SSRC]
+	if !ok {
+		f = &frameState{timestamp: header.Timestamp - 1}
+		i.frames[header.SSRC] = f
+	}
+
+	if header.Timestamp != f.timestamp {
+		f.timestamp = header.Timestamp
+		i.deadline = i.now().Add(time.Duration(i.spread * float64(i.frameInterval)))
+	}
+
+	if !header.Marker {
+		return
+	}
+	last, hadLast := f.lastFrame, f.hasLastFrame
+	f.lastFrame, f.hasLastFrame = header.Timestamp, true
+	if !hadLast {
+		return
+	}
+
+	interval := time.Duration(float64(header.Timestamp-last) / float64(clockRate) * float64(time.Second))
+	// Ignore gaps from dropped frames and paused streams
+	if interval <= 0 || interval > 200*time.Millisecond {
+		return
+	}
+	i.frameInterval = (i.frameInterval*7 + interval) / 8
+}
+
+// drainRate is the rate the queue is sent at, in bytes per second. It's
+// raised above the target rate when the queue wouldn't otherwise empty
+// before the newest frame's deadline.
+func (i *Interceptor) drainRate(now time.Time) float64 {
+	if i.spread == 0 {
+		return i.rate
+	}
+	remaining := max(i.deadline.Sub(now), time.Millisecond)
+	return max(i.rate, float64(i.queuedBytes)/remaining.Seconds())
+}
+
+// next waits until the head of the queue may be sent, and takes it off the queue.
+// It returns false once the interceptor is closed.
+func (i *Interceptor) next(timer *time.Timer) (queuedPacket, bool) {
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+
+	for {
+		for len(i.queue) == 0 && !i.isClosed() {
+			i.cond.Wait()
+		}
+		if i.isClosed() {
+			for _, p := range i.queue {
+				packet_pool.PutPacket(p.packet)
+			}
+			i.queue = nil
+			return queuedPacket{}, false
+		}
+
+		now := i.now()
+		rate := i.drainRate(now)
+		i.tokens = min(float64(i.burst), i.tokens+now.Sub(i.lastRefill).Seconds()*rate)
+		i.lastRefill = now
+
+		if i.tokens > 0 {
+			p := i.queue[0]
+			i.queue[0] = queuedPacket{}
+			i.queue = i.queue[1:]
+			size := len(p.packet.Payload)
+			i.queuedBytes -= size
+			i.tokens -= float64(size)
+			i.cond.Broadcast()
+			return p, true
+		}
+
+		// Wait for the bucket to leak enough to send again
+		timer.Reset(time.Duration(-i.tokens / rate * float64(time.Second)))
+		i.mtx.Unlock()
+		select {
+		case <-timer.C:
+		case <-i.close:
+			if !timer.Stop() {
+				<-timer.C
+			}
+		}
+		i.mtx.Lock()
+	}
+}
+
+func (i *Interceptor) loop() {
+	defer i.wg.Done()
+
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+
+	for {
+		p, ok := i.next(timer)
+		if !ok {
+			return
+		}
+
+		p.delay.Observe(i.now().Sub(p.queuedAt).Seconds())
+		if _, err := p.writer.Write(&p.packet.Header, p.packet.Payload, p.attributes); err != nil {
+			i.log.Debugf("failed to write paced packet: %v", err)
+		}
+		packet_pool.PutPacket(p.packet)
+	}
+}
@@ -0,0 +1,63 @@
+package pacer_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/webrtc_interceptors/pacer"
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/webrtc_interceptors/stream_registry"
+)
+
+// sendFrame writes a frame of packets through a new pacer, and returns how long it took to leave
+func sendFrame(t *testing.T, packets int, opts ...pacer.Option) time.Duration {
+	factory, err := pacer.NewInterceptor(stream_registry.New(), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i, err := factory.NewInterceptor("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer i.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(packets)
+	info := &interceptor.StreamInfo{ID: "stream", SSRC: 1, ClockRate: 90000, MimeType: "video/H264"}
+	writer := i.BindLocalStream(info, interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, _ interceptor.Attributes) (int, error) {
+		wg.Done()
+		return len(payload), nil
+	}))
+
+	start := time.Now()
+	payload := make([]byte, 1000)
+	for seq := 0; seq < packets; seq++ {
+		header := &rtp.Header{SequenceNumber: uint16(seq), SSRC: 1, Timestamp: 3000, Marker: seq == packets-1}
+		if _, err := writer.Write(header, payload, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+	return time.Since(start)
+}
+
+func TestInterceptor_PacesAtTargetRate(t *testing.T) {
+	// The bucket lets the second packet out on credit, then 100KB/s lets one out every 10ms
+	took := sendFrame(t, 6, pacer.Rate(800_000), pacer.Burst(1000), pacer.FrameSpread(0))
+	if took < 35*time.Millisecond {
+		t.Errorf("Expected 6 packets to take about 40ms, took %v", took)
+	}
+}
+
+func TestInterceptor_SpreadsLargeFrames(t *testing.T) {
+	// At the target rate this frame would take a second, but it may only take half a frame
+	took := sendFrame(t, 100, pacer.Rate(800_000), pacer.Burst(1000), pacer.FrameSpread(0.5))
+	if took > 100*time.Millisecond {
+		t.Errorf("Expected the frame to be spread over about 8ms, took %v", took)
+	}
+	if took < 2*time.Millisecond {
+		t.Errorf("Expected the frame to be paced, but it left at once in %v", took)
+	}
+}
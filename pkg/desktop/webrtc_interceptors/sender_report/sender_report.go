@@ -0,0 +1,205 @@
+// Package sender_report provides an interceptor that sends RTCP Sender Reports
+// whose NTP to RTP mappings come from the shared media clock, rather than being
+// extrapolated from whenever the last packet happened to be written.
+package sender_report
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/logging"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/media_clock"
+)
+
+// ntpEpochOffset is the number of seconds between the NTP epoch (1900) and the unix epoch (1970)
+const ntpEpochOffset = 2208988800
+
+// SenderInterceptorFactory is a interceptor.Factory for a SenderInterceptor
+type SenderInterceptorFactory struct {
+	opts []SenderOption
+}
+
+// NewSenderInterceptor returns a new SenderInterceptorFactory
+func NewSenderInterceptor(opts ...SenderOption) (*SenderInterceptorFactory, error) {
+	return &SenderInterceptorFactory{opts}, nil
+}
+
+// NewInterceptor constructs a new SenderInterceptor
+func (f *SenderInterceptorFactory) NewInterceptor(_ string) (interceptor.Interceptor, error) {
+	i := &SenderInterceptor{
+		interval: time.Second,
+		clock:    media_clock.Default,
+		now:      time.Now,
+		log:      logging.NewDefaultLoggerFactory().NewLogger("sender_report"),
+		close:    make(chan struct{}),
+	}
+
+	for _, opt := range f.opts {
+		if err := opt(i); err != nil {
+			return nil, err
+		}
+	}
+
+	return i, nil
+}
+
+// SenderInterceptor sends a Sender Report for every local stream once per interval
+type SenderInterceptor struct {
+	interceptor.NoOp
+	interval time.Duration
+	clock    *media_clock.Clock
+	now      func() time.Time
+	log      logging.LeveledLogger
+
+	streams sync.Map
+	m       sync.Mutex
+	wg      sync.WaitGroup
+	close   chan struct{}
+}
+
+type senderStream struct {
+	ssrc      uint32
+	clockRate uint32
+
+	m           sync.Mutex
+	packetCount uint32
+	octetCount  uint32
+}
+
+// SenderOption can be used to configure SenderInterceptor
+type SenderOption func(s *SenderInterceptor) error
+
+// SenderInterval sets how often reports are sent
+func SenderInterval(interval time.Duration) SenderOption {
+	return func(s *SenderInterceptor) error {
+		s.interval = interval
+		return nil
+	}
+}
+
+// SenderClock sets the clock that the media sources take their timestamps from
+func SenderClock(clock *media_clock.Clock) SenderOption {
+	return func(s *SenderInterceptor) error {
+		s.clock = clock
+		return nil
+	}
+}
+
+func (s *SenderInterceptor) isClosed() bool {
+	select {
+	case <-s.close:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close stops sending reports
+func (s *SenderInterceptor) Close() error {
+	defer s.wg.Wait()
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if !s.isClosed() {
+		close(s.close)
+	}
+
+	return nil
+}
+
+// BindRTCPWriter lets you modify any outgoing RTCP packets. It is called once per PeerConnection. The returned method
+// will be called once per packet batch.
+func (s *SenderInterceptor) BindRTCPWriter(writer interceptor.RTCPWriter) interceptor.RTCPWriter {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.isClosed() {
+		return writer
+	}
+
+	s.wg.Add(1)
+	go s.loop(writer)
+
+	return writer
+}
+
+// BindLocalStream lets you modify any outgoing RTP packets. It is called once for per LocalStream. The returned method
+// will be called once per rtp packet.
+func (s *SenderInterceptor) BindLocalStream(info *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	if info.ClockRate == 0 {
+		s.log.Warnf("not sending reports for ssrc %d, it has no clock rate", info.SSRC)
+		return writer
+	}
+
+	stream := &senderStream{ssrc: info.SSRC, clockRate: info.ClockRate}
+	s.streams.Store(info.SSRC, stream)
+
+	return interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, a interceptor.Attributes) (int, error) {
+		stream.m.Lock()
+		stream.packetCount++
+		stream.octetCount += uint32(len(payload))
+		stream.m.Unlock()
+
+		return writer.Write(header, payload, a)
+	})
+}
+
+// UnbindLocalStream is called when the Stream is removed. It can be used to clean up any data related to that track.
+func (s *SenderInterceptor) UnbindLocalStream(info *interceptor.StreamInfo) {
+	s.streams.Delete(info.SSRC)
+}
+
+func (s *SenderInterceptor) loop(writer interceptor.RTCPWriter) {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			now := s.now()
+			s.streams.Range(func(_, value any) bool {
+				stream := value.(*senderStream)
+				report := stream.generateReport(now, s.clock)
+				if report == nil {
+					return true
+				}
+				if _, err := writer.Write([]rtcp.Packet{report}, interceptor.Attributes{}); err != nil {
+					s.log.Warnf("failed sending sender report: %+v", err)
+				}
+				return true
+			})
+		case <-s.close:
+			return
+		}
+	}
+}
+
+// generateReport returns the report for the stream at now, or nil if nothing was sent yet
+func (stream *senderStream) generateReport(now time.Time, clock *media_clock.Clock) *rtcp.SenderReport {
+	stream.m.Lock()
+	defer stream.m.Unlock()
+
+	if stream.packetCount == 0 {
+		return nil
+	}
+
+	return &rtcp.SenderReport{
+		SSRC:        stream.ssrc,
+		NTPTime:     toNTP(now),
+		RTPTime:     clock.RTPTimestamp(now, stream.clockRate),
+		PacketCount: stream.packetCount,
+		OctetCount:  stream.octetCount,
+	}
+}
+
+// toNTP converts a time into the 64 bit NTP format used by sender reports
+func toNTP(t time.Time) uint64 {
+	seconds := uint64(t.Unix()) + ntpEpochOffset
+	fraction := (uint64(t.Nanosecond()) << 32) / uint64(time.Second)
+	return seconds<<32 | fraction
+}
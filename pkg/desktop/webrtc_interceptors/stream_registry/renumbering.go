@@ -0,0 +1,68 @@
+package stream_registry
+
+import "sync"
+
+// maxRenumberings is how many changes of offset are remembered for translating NACKs.
+// Older sequence numbers have long left the send buffer anyway.
+const maxRenumberings = 128
+
+// renumbering is where the offset between the source's and the sent sequence numbers changed
+type renumbering struct {
+	// from is the first sent sequence number with this offset
+	from   uint16
+	offset uint16
+}
+
+// Renumbering gives the packets of a stream that skips some of its source's packets
+// sequence numbers without gaps, so the receiver doesn't NACK what was skipped on
+// purpose. It remembers how they were changed, so NACKs can be answered from the
+// source's packets.
+type Renumbering struct {
+	enabled bool
+	started bool
+	last    uint16 // the last sent sequence number
+	offset  uint16 // the source's sequence number minus the sent one
+	changes []renumbering
+	mtx     sync.Mutex
+}
+
+// SetEnabled starts or stops closing the gaps. Once stopped, the offset stays as it
+// was, so the sequence numbers keep going up.
+func (r *Renumbering) SetEnabled(enabled bool) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.enabled = enabled
+}
+
+// Renumber returns the sequence number to send the source's packet seq with.
+// Packets have to be renumbered in the order they're sent.
+func (r *Renumbering) Renumber(seq uint16) uint16 {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if r.enabled && r.started && seq-r.offset != r.last+1 {
+		r.offset = seq - (r.last + 1)
+		r.changes = append(r.changes, renumbering{from: r.last + 1, offset: r.offset})
+		if len(r.changes) > maxRenumberings {
+			r.changes = r.changes[1:]
+		}
+	}
+	r.started = true
+	r.last = seq - r.offset
+	return r.last
+}
+
+// Original returns the source's sequence number of a sent packet. A nil Renumbering
+// never changes sequence numbers.
+func (r *Renumbering) Original(seq uint16) uint16 {
+	if r == nil {
+		return seq
+	}
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	for i := len(r.changes) - 1; i >= 0; i-- {
+		if int16(seq-r.changes[i].from) >= 0 {
+			return seq + r.changes[i].offset
+		}
+	}
+	return seq
+}
@@ -0,0 +1,30 @@
+package stream_registry
+
+import "testing"
+
+func TestRenumbering(t *testing.T) {
+	r := &Renumbering{}
+	sent := []uint16{}
+	for _, seq := range []uint16{65534, 65535} {
+		sent = append(sent, r.Renumber(seq))
+	}
+	r.SetEnabled(true)
+	for _, seq := range []uint16{3, 4, 10} {
+		sent = append(sent, r.Renumber(seq))
+	}
+	// The offset stays once the gaps aren't closed anymore
+	r.SetEnabled(false)
+	sent = append(sent, r.Renumber(20))
+
+	expected := []uint16{65534, 65535, 0, 1, 2, 12}
+	for i := range expected {
+		if sent[i] != expected[i] {
+			t.Fatalf("Expected sequence numbers %v, got %v", expected, sent)
+		}
+	}
+	for i, original := range []uint16{65534, 65535, 3, 4, 10, 20} {
+		if seq := r.Original(sent[i]); seq != original {
+			t.Errorf("Expected %v to have been %v, got %v", sent[i], original, seq)
+		}
+	}
+}
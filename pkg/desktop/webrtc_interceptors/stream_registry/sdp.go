@@ -0,0 +1,79 @@
+package stream_registry
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// AddRepairSSRCs declares the RTX and FlexFEC SSRCs of every video stream in
+// an answer. The receiver needs them to tell repair packets apart from media,
+// and pion doesn't add them for senders. Media sections that didn't negotiate
+// RTX or FlexFEC are left alone.
+func AddRepairSSRCs(sdp string) string {
+	lines := strings.Split(strings.TrimRight(sdp, "\r\n"), "\r\n")
+	out := make([]string, 0, len(lines))
+
+	section := []string{}
+	for _, line := range lines {
+		if strings.HasPrefix(line, "m=") {
+			out = append(out, addRepairSSRCsToSection(section)...)
+			section = section[:0]
+		}
+		section = append(section, line)
+	}
+	out = append(out, addRepairSSRCsToSection(section)...)
+
+	return strings.Join(out, "\r\n") + "\r\n"
+}
+
+func addRepairSSRCsToSection(section []string) []string {
+	if len(section) == 0 || !strings.HasPrefix(section[0], "m=video") {
+		return section
+	}
+
+	hasRTX, hasFEC := false, false
+	ssrcs := []uint32{}
+	ssrcAttributes := map[uint32][]string{}
+	for _, line := range section {
+		switch {
+		case strings.HasPrefix(line, "a=ssrc-group:"):
+			// Someone already declared the groups
+			return section
+		case strings.HasPrefix(line, "a=rtpmap:"):
+			_, encoding, _ := strings.Cut(line, " ")
+			name, _, _ := strings.Cut(encoding, "/")
+			hasRTX = hasRTX || strings.EqualFold(name, "rtx")
+			hasFEC = hasFEC || strings.EqualFold(name, "flexfec-03")
+		case strings.HasPrefix(line, "a=ssrc:"):
+			value, attribute, _ := strings.Cut(strings.TrimPrefix(line, "a=ssrc:"), " ")
+			ssrc, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				continue
+			}
+			if _, ok := ssrcAttributes[uint32(ssrc)]; !ok {
+				ssrcs = append(ssrcs, uint32(ssrc))
+			}
+			ssrcAttributes[uint32(ssrc)] = append(ssrcAttributes[uint32(ssrc)], attribute)
+		}
+	}
+
+	for _, ssrc := range ssrcs {
+		if hasRTX {
+			section = append(section, repairSSRCLines("FID", ssrc, RTXSSRC(ssrc), ssrcAttributes[ssrc])...)
+		}
+		if hasFEC {
+			section = append(section, repairSSRCLines("FEC-FR", ssrc, FECSSRC(ssrc), ssrcAttributes[ssrc])...)
+		}
+	}
+	return section
+}
+
+// repairSSRCLines groups a repair SSRC with its media SSRC, giving it the same attributes
+func repairSSRCLines(semantics string, media uint32, repair uint32, attributes []string) []string {
+	lines := []string{fmt.Sprintf("a=ssrc-group:%s %d %d", semantics, media, repair)}
+	for _, attribute := range attributes {
+		lines = append(lines, fmt.Sprintf("a=ssrc:%d %s", repair, attribute))
+	}
+	return lines
+}
@@ -0,0 +1,82 @@
+// Package stream_registry tells interceptors what they can't learn from
+// interceptor.StreamInfo: which source and session a stream belongs to, and
+// which repair streams were negotiated alongside it. Tracks register their
+// streams from Bind, which runs before the stream reaches the interceptors.
+package stream_registry
+
+import (
+	"sync"
+)
+
+// UnknownSession labels streams that no track registered
+const UnknownSession = "unknown"
+
+// Stream describes the stream of one RTP sender
+type Stream struct {
+	// Source is the name of the source track. Streams from the same source carry the same packets.
+	Source string
+	// Session is the session the stream is sent to
+	Session string
+	// RTXPayloadType is the payload type for RFC 4588 retransmissions, or 0 if they weren't negotiated
+	RTXPayloadType uint8
+	// FECPayloadType is the payload type for FlexFEC, or 0 if it wasn't negotiated
+	FECPayloadType uint8
+	// Renumbering is how the stream's sequence numbers were changed from the source's, if they can be
+	Renumbering *Renumbering
+}
+
+// Registry holds the streams of one WebRTC API's RTP senders. The API's
+// interceptors are given it when they're created, and so are the tracks that
+// their peer connections send.
+type Registry struct {
+	streams map[string]Stream
+	mtx     sync.Mutex
+}
+
+func New() *Registry {
+	return &Registry{streams: map[string]Stream{}}
+}
+
+// Register records the stream of the RTP sender with the given ID
+func (r *Registry) Register(streamID string, s Stream) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.streams[streamID] = s
+}
+
+// Unregister forgets a stream, once it's unbound
+func (r *Registry) Unregister(streamID string) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	delete(r.streams, streamID)
+}
+
+// Get returns the stream with the given ID. Streams that weren't registered
+// are their own source, in an unknown session, without repair streams.
+func (r *Registry) Get(streamID string) Stream {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if s, ok := r.streams[streamID]; ok {
+		return s
+	}
+	return Stream{Source: streamID, Session: UnknownSession}
+}
+
+// Len returns how many streams are registered
+func (r *Registry) Len() int {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return len(r.streams)
+}
+
+// RTXSSRC returns the SSRC that retransmissions of a stream are sent on.
+// It's derived from the media SSRC, so that the SDP and the interceptors
+// agree on it without having to share any state.
+func RTXSSRC(ssrc uint32) uint32 {
+	return ssrc ^ 0x52545800 // "RTX"
+}
+
+// FECSSRC returns the SSRC that FlexFEC packets protecting a stream are sent on
+func FECSSRC(ssrc uint32) uint32 {
+	return ssrc ^ 0x46454300 // "FEC"
+}
@@ -0,0 +1,41 @@
+//go:build linux
+// +build linux
+
+package wf_recorder
+
+import (
+	"os"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/cmd_capture"
+	"github.com/pod-arcade/pod-arcade/pkg/util"
+)
+
+var _ cmd_capture.CommandConfiguratorMPEGTS = (*MuxedCapture)(nil)
+
+// MuxedCapture records the desktop's audio along with the screen, muxing both into
+// MPEG-TS, so they share wf-recorder's clock
+type MuxedCapture struct {
+	*WaylandScreenCapture
+	// AudioDevice is the PulseAudio source to record. The default source is recorded
+	// when it's empty.
+	AudioDevice string
+}
+
+func NewMuxedCapture(capture *WaylandScreenCapture) *MuxedCapture {
+	return &MuxedCapture{WaylandScreenCapture: capture}
+}
+
+func (c *MuxedCapture) GetProgramRunnerMPEGTS(file *os.File) (*util.ProgramRunner, error) {
+	runner := c.programRunner("mpegts", file.Name())
+	audio := "-a"
+	if c.AudioDevice != "" {
+		audio += "=" + c.AudioDevice
+	}
+	runner.Args = append(runner.Args, audio, "-C", "libopus", "-R", "48000")
+	return runner, nil
+}
+
+func (c *MuxedCapture) GetAudioCodecParameters() *webrtc.RTPCodecParameters {
+	return &webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}, PayloadType: 111}
+}
@@ -0,0 +1,100 @@
+//go:build linux
+// +build linux
+
+package wf_recorder
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pod-arcade/pod-arcade/api"
+)
+
+// geometryPattern matches a region of the desktop the way slurp prints it, like "0,0 1920x1080"
+var geometryPattern = regexp.MustCompile(`^(-?\d+),(-?\d+) (\d+)x(\d+)$`)
+
+// Output is a part of the desktop for wf-recorder to capture, either a whole
+// monitor or a region of the screen
+type Output struct {
+	ID string
+	// Name is the name of the monitor, like HDMI-A-1
+	Name string
+	// X, Y, Width and Height are the region to capture, when it isn't a whole monitor
+	X, Y, Width, Height int
+}
+
+// ParseOutputs parses a list of outputs separated by semicolons. Each one is
+// either a monitor name, or an ID and a monitor name or region separated by
+// an equals sign, like "HDMI-A-1;right=DP-1;left=0,0 960x1080".
+func ParseOutputs(spec string) ([]Output, error) {
+	outputs := []Output{}
+	seen := map[string]bool{}
+	for _, entry := range strings.Split(spec, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		id, target, named := strings.Cut(entry, "=")
+		if !named {
+			target = id
+		}
+		id, target = strings.TrimSpace(id), strings.TrimSpace(target)
+
+		output := Output{ID: id}
+		if m := geometryPattern.FindStringSubmatch(target); m != nil {
+			if !named {
+				return nil, fmt.Errorf("region %q needs an ID, like left=%v", target, target)
+			}
+			output.X, _ = strconv.Atoi(m[1])
+			output.Y, _ = strconv.Atoi(m[2])
+			output.Width, _ = strconv.Atoi(m[3])
+			output.Height, _ = strconv.Atoi(m[4])
+			if output.Width == 0 || output.Height == 0 {
+				return nil, fmt.Errorf("region %q of output %v is empty", target, id)
+			}
+		} else {
+			output.Name = target
+		}
+
+		if id == "" || target == "" {
+			return nil, fmt.Errorf("invalid output %q", entry)
+		}
+		if id == api.DefaultVideoOutputID {
+			return nil, fmt.Errorf("output ID %q is reserved", id)
+		}
+		if seen[id] {
+			return nil, fmt.Errorf("output %v is listed twice", id)
+		}
+		seen[id] = true
+		outputs = append(outputs, output)
+	}
+	return outputs, nil
+}
+
+// VideoOutput describes the output to the mixer
+func (o Output) VideoOutput() api.VideoOutput {
+	if o.ID == "" {
+		return api.VideoOutput{ID: api.DefaultVideoOutputID}
+	}
+	return api.VideoOutput{
+		ID:     o.ID,
+		Name:   o.Name,
+		X:      o.X,
+		Y:      o.Y,
+		Width:  o.Width,
+		Height: o.Height,
+	}
+}
+
+// args returns the wf-recorder arguments that select the output
+func (o Output) args() []string {
+	if o.Name != "" {
+		return []string{"-o", o.Name}
+	}
+	if o.Width > 0 && o.Height > 0 {
+		return []string{"-g", fmt.Sprintf("%v,%v %vx%v", o.X, o.Y, o.Width, o.Height)}
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+//go:build linux
+// +build linux
+
+package wf_recorder
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseOutputs(t *testing.T) {
+	outputs, err := ParseOutputs("HDMI-A-1; right=DP-1;left=0,0 960x1080;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Output{
+		{ID: "HDMI-A-1", Name: "HDMI-A-1"},
+		{ID: "right", Name: "DP-1"},
+		{ID: "left", Width: 960, Height: 1080},
+	}
+	if !reflect.DeepEqual(outputs, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, outputs)
+	}
+	if args := outputs[2].args(); !reflect.DeepEqual(args, []string{"-g", "0,0 960x1080"}) {
+		t.Errorf("Expected a geometry argument for the region, got %v", args)
+	}
+
+	for _, spec := range []string{"0,0 960x1080", "a=DP-1;a=DP-2", "default=DP-1", "left=0,0 0x1080", "=DP-1"} {
+		if _, err := ParseOutputs(spec); err == nil {
+			t.Errorf("Expected %q to be invalid", spec)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+//go:build linux
+// +build linux
+
+package wf_recorder
+
+import (
+	"fmt"
+
+	"github.com/pod-arcade/pod-arcade/api"
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/encoder"
+)
+
+var _ api.VideoSettingsSource = (*WaylandScreenCapture)(nil)
+
+func (c *WaylandScreenCapture) GetVideoSettings() api.VideoSettings {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.settings
+}
+
+// SetVideoSettings sets the settings that wf-recorder is started with next
+func (c *WaylandScreenCapture) SetVideoSettings(settings api.VideoSettings) error {
+	if err := settings.Validate(); err != nil {
+		return err
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.settings = settings
+	return nil
+}
+
+// encoderProfile returns the encoder profile with the frame rate and quality that
+// clients asked for
+func (c *WaylandScreenCapture) encoderProfile() encoder.EncoderProfile {
+	settings := c.GetVideoSettings()
+	profile := c.Encoder
+	if settings.FrameRate != 0 {
+		profile.FrameRate = settings.FrameRate
+	}
+	if settings.Quality != 0 {
+		// Asking for a quality switches to constant quality
+		profile.CRF = settings.Quality
+		profile.Bitrate = 0
+	}
+	return profile
+}
+
+// scaleArgs returns the filter that scales the capture to the settings' resolution.
+// The encoder keeps the aspect ratio when only one side is set.
+func scaleArgs(settings api.VideoSettings, hwAccel bool) []string {
+	if settings.Width == 0 && settings.Height == 0 {
+		return nil
+	}
+	width, height := settings.Width, settings.Height
+	if width == 0 {
+		width = -2
+	}
+	if height == 0 {
+		height = -2
+	}
+	if hwAccel {
+		return []string{"-F", fmt.Sprintf("scale_vaapi=w=%v:h=%v", width, height)}
+	}
+	return []string{"-F", fmt.Sprintf("scale=%v:%v", width, height)}
+}
@@ -0,0 +1,48 @@
+//go:build linux
+// +build linux
+
+package wf_recorder
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/pod-arcade/pod-arcade/api"
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/encoder"
+)
+
+func TestScaleArgs(t *testing.T) {
+	tests := []struct {
+		settings api.VideoSettings
+		hwAccel  bool
+		expected []string
+	}{
+		{api.VideoSettings{FrameRate: 30}, false, nil},
+		{api.VideoSettings{Width: 1280, Height: 720}, false, []string{"-F", "scale=1280:720"}},
+		{api.VideoSettings{Height: 720}, false, []string{"-F", "scale=-2:720"}},
+		{api.VideoSettings{Width: 1280}, true, []string{"-F", "scale_vaapi=w=1280:h=-2"}},
+	}
+	for _, test := range tests {
+		if args := scaleArgs(test.settings, test.hwAccel); !reflect.DeepEqual(args, test.expected) {
+			t.Errorf("Expected %v for %+v, got %v", test.expected, test.settings, args)
+		}
+	}
+}
+
+func TestEncoderProfile(t *testing.T) {
+	profile := encoder.DefaultProfiles(30, "main")["h264"]
+	profile.Bitrate = 4000
+	c := NewScreenCapture(profile)
+	if p := c.encoderProfile(); p != profile {
+		t.Errorf("Expected the configured profile, got %+v", p)
+	}
+	if err := c.SetVideoSettings(api.VideoSettings{Width: 1279}); err == nil {
+		t.Error("Expected an odd width to be invalid")
+	}
+	if err := c.SetVideoSettings(api.VideoSettings{FrameRate: 30, Quality: 28}); err != nil {
+		t.Fatal(err)
+	}
+	if p := c.encoderProfile(); p.FrameRate != 30 || p.CRF != 28 || p.Bitrate != 0 {
+		t.Errorf("Expected the settings that were set, got %+v", p)
+	}
+}
@@ -7,170 +7,97 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"strings"
+	"sync"
 	"syscall"
 
 	"github.com/pion/webrtc/v4"
+	"github.com/pod-arcade/pod-arcade/api"
 	"github.com/pod-arcade/pod-arcade/pkg/desktop/cmd_capture"
+	"github.com/pod-arcade/pod-arcade/pkg/desktop/encoder"
 	"github.com/pod-arcade/pod-arcade/pkg/log"
 	"github.com/pod-arcade/pod-arcade/pkg/util"
 	"github.com/rs/zerolog"
 )
 
 var _ cmd_capture.CommandConfiguratorRTP = (*WaylandScreenCapture)(nil)
+var _ cmd_capture.CommandConfiguratorH264 = (*WaylandScreenCapture)(nil)
+var _ cmd_capture.CommandConfiguratorIVF = (*WaylandScreenCapture)(nil)
+var _ api.OutputSource = (*WaylandScreenCapture)(nil)
 
 const PACKET_SIZE = 1200
 const MAX_WF_RECORDER_RESTARTS = 10
 
 type WaylandScreenCapture struct {
-	// The quality of the stream. This can be anything between 0 and 51
-	// 0 is lossless, 51 is barely a single pixel
-	// Default is 23 in FFMPEG
-	// Sane Range is 17-28
-	// 17-18 is visually lossless
-	Quality              int
-	HardwareAcceleration bool
-	Profile              string
-	l                    zerolog.Logger
+	// Encoder is how the capture is encoded
+	Encoder encoder.EncoderProfile
+	// Output is the part of the desktop to capture. The whole desktop is captured
+	// when it's empty.
+	Output Output
+
+	// settings are what clients asked for, which override the encoder profile
+	settings api.VideoSettings
+	mtx      sync.Mutex
+	l        zerolog.Logger
 }
 
-func NewScreenCapture(quality int, hwAccel bool, profile string) *WaylandScreenCapture {
+func NewScreenCapture(profile encoder.EncoderProfile) *WaylandScreenCapture {
 	cap := &WaylandScreenCapture{
-		Quality:              quality,
-		Profile:              profile,
-		HardwareAcceleration: hwAccel,
+		Encoder: profile,
 		l: log.NewLogger("WFRecorder", map[string]string{
-			"Quality": fmt.Sprint(quality),
+			"Profile": profile.Name,
+			"Codec":   profile.Codec,
 		}),
 	}
 
 	return cap
 }
 
-func (c *WaylandScreenCapture) GetName() string {
-	return "Wayland Screen Capture"
+// NewOutputCapture captures one output of the desktop, like a single monitor
+func NewOutputCapture(output Output, profile encoder.EncoderProfile) *WaylandScreenCapture {
+	cap := NewScreenCapture(profile)
+	cap.Output = output
+	cap.l = cap.l.With().Str("Output", output.ID).Logger()
+	return cap
 }
 
-func (c *WaylandScreenCapture) GetProgramRunnerUDP(addr net.UDPAddr) (*util.ProgramRunner, error) {
-	udpAddr := fmt.Sprintf("rtp://127.0.0.1:%v?pkt_size=%vbuffer_size=%v", addr.Port, PACKET_SIZE, 4194304)
-
-	var properties map[string]string
-	var args []string
-
-	if c.HardwareAcceleration {
-		// Hardware Acceleration
-		args = []string{
-			"-c", "h264_vaapi", // also look into h264_nvenc
-			"-D",
-			"-r", "60",
-			"-m", "rtp",
-			"-f", udpAddr,
-		}
-
-		properties = map[string]string{
-			"preset":         "ultrafast",
-			"tune":           "zerolatency",
-			"profile":        c.Profile,
-			"async_depth":    "1",
-			"global_quality": fmt.Sprint(c.Quality),
-			"gop_size":       "5",
-			"open_gop":       "0",
-			"slices":         "2",
-		}
-	} else {
-		if c.Profile == "constrained_baseline" {
-			c.Profile = "baseline"
-		}
-		// No hardware acceleration
-		args = []string{
-			"-c", "libx264",
-			"-D",
-			"-r", "60",
-			"-m", "rtp",
-			"-f", udpAddr,
-			"-x", "yuv420p",
-		}
-
-		properties = map[string]string{
-			"preset":         "ultrafast",
-			"tune":           "zerolatency",
-			"profile":        c.Profile,
-			"async_depth":    "1",
-			"global_quality": fmt.Sprint(c.Quality),
-			"gop_size":       "5",
-			"open_gop":       "0",
-		}
+func (c *WaylandScreenCapture) GetName() string {
+	name := "Wayland Screen Capture"
+	if c.Output.ID != "" {
+		name += " " + c.Output.ID
 	}
-
-	for k, v := range properties {
-		args = append(args, "-p", fmt.Sprintf("%v=%v", k, v))
+	if strings.EqualFold(c.Encoder.Codec, webrtc.MimeTypeH264) {
+		return name
 	}
+	return name + " " + strings.TrimPrefix(c.Encoder.Codec, "video/")
+}
 
-	runner := &util.ProgramRunner{}
-	runner.Program = "wf-recorder"
-	runner.Args = args
-
-	// Linux-specific: set Pdeathsig to ensure child termination
-	runner.SysProcAttr = syscall.SysProcAttr{
-		Pdeathsig: syscall.SIGKILL,
-	}
+func (c *WaylandScreenCapture) GetVideoOutput() api.VideoOutput {
+	return c.Output.VideoOutput()
+}
 
-	return runner, nil
+func (c *WaylandScreenCapture) GetProgramRunnerUDP(addr net.UDPAddr) (*util.ProgramRunner, error) {
+	udpAddr := fmt.Sprintf("rtp://127.0.0.1:%v?pkt_size=%vbuffer_size=%v", addr.Port, PACKET_SIZE, 4194304)
+	return c.programRunner("rtp", udpAddr), nil
 }
 
 func (c *WaylandScreenCapture) GetProgramRunnerH264(file *os.File) (*util.ProgramRunner, error) {
-	var properties map[string]string
-	var args []string
-
-	if c.HardwareAcceleration {
-		// Hardware Acceleration
-		args = []string{
-			"-c", "h264_vaapi", // also look into h264_nvenc
-			"-D",
-			"-r", "60",
-			"-m", "h264",
-			"-f", file.Name(),
-		}
-
-		properties = map[string]string{
-			"preset":         "ultrafast",
-			"tune":           "zerolatency",
-			"profile":        c.Profile,
-			"async_depth":    "1",
-			"global_quality": fmt.Sprint(c.Quality),
-			"gop_size":       "30",
-			"open_gop":       "0",
-		}
-	} else {
-		if c.Profile == "constrained_baseline" {
-			c.Profile = "baseline"
-		}
-		// No hardware acceleration
-		args = []string{
-			"-c", "libx264",
-			"-D",
-			"-r", "60",
-			"-m", "h264",
-			"-f", file.Name(),
-			"-x", "yuv420p",
-		}
-
-		properties = map[string]string{
-			"preset":         "ultrafast",
-			"tune":           "zerolatency",
-			"profile":        c.Profile,
-			"async_depth":    "1",
-			"global_quality": fmt.Sprint(c.Quality),
-			"gop_size":       "30",
-			"open_gop":       "0",
-			"slice-max-size": "1200",
-			"slices":         "1",
-			"forced-idr":     "1",
-		}
-	}
+	return c.programRunner("h264", file.Name()), nil
+}
 
-	for k, v := range properties {
-		args = append(args, "-p", fmt.Sprintf("%v=%v", k, v))
-	}
+func (c *WaylandScreenCapture) GetProgramRunnerIVF(file *os.File) (*util.ProgramRunner, error) {
+	return c.programRunner("ivf", file.Name()), nil
+}
+
+// programRunner runs wf-recorder, writing the capture to the file with the given muxer
+func (c *WaylandScreenCapture) programRunner(muxer string, file string) *util.ProgramRunner {
+	settings := c.GetVideoSettings()
+	profile := c.encoderProfile()
+
+	args := []string{"-D", "-m", muxer, "-f", file}
+	args = append(args, profile.WFRecorderArgs()...)
+	args = append(args, c.Output.args()...)
+	args = append(args, scaleArgs(settings, profile.Hardware)...)
 
 	runner := &util.ProgramRunner{}
 	runner.Program = "wf-recorder"
@@ -181,11 +108,14 @@ func (c *WaylandScreenCapture) GetProgramRunnerH264(file *os.File) (*util.Progra
 		Pdeathsig: syscall.SIGKILL,
 	}
 
-	return runner, nil
+	return runner
 }
 
 func (c *WaylandScreenCapture) GetVideoCodecParameters() *webrtc.RTPCodecParameters {
-	return &webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264}, PayloadType: 102}
+	if strings.EqualFold(c.Encoder.Codec, webrtc.MimeTypeVP9) {
+		return &webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP9, ClockRate: 90000, SDPFmtpLine: "profile-id=0"}, PayloadType: 98}
+	}
+	return &webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000}, PayloadType: 102}
 }
 
 func (c *WaylandScreenCapture) GetAudioCodecParameters() *webrtc.RTPCodecParameters {
@@ -93,5 +93,26 @@ func (mc *MetricCache) GetHistogram(name string, labels prometheus.Labels, bucke
 	return histogram
 }
 
+// Remove unregisters a metric and drops it from the cache, like when what it
+// measured is gone. Getting it again creates a new one.
+func (mc *MetricCache) Remove(name string, labels prometheus.Labels) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	key := getKey(name, labels)
+	if counter, ok := mc.counters[key]; ok {
+		prometheus.DefaultRegisterer.Unregister(counter)
+		delete(mc.counters, key)
+	}
+	if gauge, ok := mc.gauges[key]; ok {
+		prometheus.DefaultRegisterer.Unregister(gauge)
+		delete(mc.gauges, key)
+	}
+	if histogram, ok := mc.histograms[key]; ok {
+		prometheus.DefaultRegisterer.Unregister(histogram)
+		delete(mc.histograms, key)
+	}
+}
+
 // Global metric cache instance.
 var GlobalMetricCache = NewMetricCache()
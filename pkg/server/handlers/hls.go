@@ -0,0 +1,36 @@
+package handlers
+
+import (
+	"net/http"
+	"path"
+)
+
+// HLSHandler serves the HLS that desktops write to a shared directory, each in a
+// directory of its own. Playlist reloads don't block, so players poll for parts.
+type HLSHandler struct {
+	FileServer http.Handler
+}
+
+func NewHLSHandler(dir string) *HLSHandler {
+	return &HLSHandler{FileServer: http.FileServer(http.Dir(dir))}
+}
+
+func (h *HLSHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	switch path.Ext(r.URL.Path) {
+	case ".m3u8":
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		w.Header().Set("Cache-Control", "no-cache")
+	case ".m4s":
+		w.Header().Set("Content-Type", "video/iso.segment")
+		w.Header().Set("Cache-Control", "max-age=60")
+	case ".mp4":
+		w.Header().Set("Content-Type", "video/mp4")
+		w.Header().Set("Cache-Control", "max-age=60")
+	default:
+		// Only playlists and what they list are served, not directory listings or stray files
+		http.NotFound(w, r)
+		return
+	}
+	h.FileServer.ServeHTTP(w, r)
+}
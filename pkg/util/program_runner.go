@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"os/exec"
 	"strings"
 	"syscall"
@@ -20,6 +21,9 @@ type ProgramRunner struct {
 	Program     string
 	Args        []string
 	SysProcAttr syscall.SysProcAttr
+	// Stdin is read by the program, and Stdout gets its output instead of the log
+	Stdin  io.Reader
+	Stdout io.Writer
 
 	l zerolog.Logger
 }
@@ -29,6 +33,10 @@ func (p *ProgramRunner) launchProgram(ctx context.Context) error {
 
 	cmd.Stderr = NewProcessLogWrapper(p.l, zerolog.ErrorLevel)
 	cmd.Stdout = NewProcessLogWrapper(p.l, zerolog.InfoLevel)
+	if p.Stdout != nil {
+		cmd.Stdout = p.Stdout
+	}
+	cmd.Stdin = p.Stdin
 	cmd.SysProcAttr = &p.SysProcAttr
 	cmd.WaitDelay = time.Second * 5
 
@@ -64,6 +72,13 @@ func (p *ProgramRunner) Run(component string, ctx context.Context) error {
 	}
 }
 
+// RunOnce runs the program a single time, like for a program that makes one file and exits
+func (p *ProgramRunner) RunOnce(component string, ctx context.Context) error {
+	p.l = log.NewLogger(component, nil)
+	p.l.Debug().Msgf("Running %v", p.String())
+	return p.launchProgram(ctx)
+}
+
 func (p *ProgramRunner) String() string {
 	return fmt.Sprintf("%v %v", p.Program, strings.Join(p.Args, " "))
 }